@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/adapter"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/julienschmidt/httprouter"
+)
+
+// adaptEvent receives a webhook from a third party, translates it into an event
+// with the adapter named in the URL, and then stores it just like createEvent
+// would. It's bound to POST /v1/adapters/:name.
+//
+// Adapters that verify the third party's signature, like Stripe's, need
+// nothing else. Webhooks for any other adapter must come with an API key (or
+// other credentials) with the "ingest" scope, even if the server doesn't
+// otherwise require authentication: a mapping adapter builds whatever event
+// it's configured to, out of whatever it's sent.
+func (s *server) adaptEvent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	a, ok := s.Adapters[p.ByName("name")]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown_adapter", fmt.Sprintf("no such adapter: %s", p.ByName("name")))
+		return
+	}
+
+	// The third party's signature is as good as a signed request, so events
+	// from these adapters may be of types in -signed-types. Adapt rejects any
+	// webhook whose signature doesn't check out before there's an event.
+	if _, ok := a.(adapter.Verifier); ok {
+		principal := &auth.Principal{Provider: "webhook", Subject: p.ByName("name"), Signed: true}
+		s.adaptWith(w, r.WithContext(auth.NewContext(r.Context(), principal)), a)
+		return
+	}
+
+	s.withAuth(s.withScope("ingest", s.withRateLimit(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if auth.FromContext(r.Context()) == nil {
+			writeAPIError(w, http.StatusUnauthorized, "auth_required", fmt.Sprintf("the %s adapter requires authentication", p.ByName("name")))
+			return
+		}
+
+		s.adaptWith(w, r, a)
+	})))(w, r, p)
+}
+
+// trackEvent takes a Segment track call, so that clients instrumented with
+// Segment's libraries can point them at this server. See adapter.SegmentTrack.
+// It's bound to POST /v1/track.
+func (s *server) trackEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	s.adaptWith(w, r, adapter.SegmentTrack{Clock: s.Clock})
+}
+
+// withSegmentWriteKey lets Segment's libraries authenticate the way they know
+// how: with their write key as the username of HTTP basic auth. It's taken as
+// an API key.
+func (s *server) withSegmentWriteKey(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if writeKey, _, ok := r.BasicAuth(); ok && writeKey != "" && r.Header.Get("X-API-Key") == "" {
+			r.Header.Set("X-API-Key", writeKey)
+		}
+
+		h(w, r, p)
+	}
+}
+
+// adaptWith translates the request into an event with a, and then stores it
+// just like createEvent would. Webhooks may be no bigger than events.
+func (s *server) adaptWith(w http.ResponseWriter, r *http.Request, a adapter.Adapter) {
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEventBody+1))
+	if len(buf) > maxEventBody {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("a webhook's body may be at most %d bytes", maxEventBody))
+		return
+	}
+
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	eventRaw, err := a.Adapt(r, buf)
+
+	// Third parties usually retry webhooks that don't get a 2xx response, so
+	// webhooks we're not interested in still need to be acknowledged.
+	if err == adapter.ErrNotAnEvent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// A webhook with a bad signature may not be from the third party at all,
+	// so it's rejected the way a bad signed request is.
+	if err == adapter.ErrBadSignature {
+		writeAPIError(w, http.StatusUnauthorized, "invalid_signature", err.Error())
+		return
+	}
+
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_webhook", err.Error())
+		return
+	}
+
+	// Re-encode the adapted event, since that's what will be stored.
+	buf, err = json.Marshal(eventRaw)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	s.storeEvent(w, r, buf, eventRaw)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/oidc"
+	"github.com/julienschmidt/httprouter"
+)
+
+// adminSessionLifetime is how long an admin stays logged in.
+const adminSessionLifetime = 8 * time.Hour
+
+// adminLoginLifetime is how long someone has to complete logging in with the
+// identity provider.
+const adminLoginLifetime = 10 * time.Minute
+
+// adminAuth is how the admin endpoints are protected: people log in with an
+// OIDC identity provider, and must be in Group, if it's set.
+type adminAuth struct {
+	Provider *oidc.Provider
+	Group    string
+
+	// Secret signs the login and session cookies.
+	Secret []byte
+
+	// Secure is whether cookies should only be sent over HTTPS.
+	Secure bool
+}
+
+// adminLogin is what's remembered, in a cookie, while someone is off logging
+// in with the identity provider.
+type adminLogin struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Return   string    `json:"return"`
+	Expires  time.Time `json:"expires"`
+}
+
+// adminSession is who's logged in, stored in a cookie.
+type adminSession struct {
+	Subject string    `json:"sub"`
+	Email   string    `json:"email"`
+	Expires time.Time `json:"expires"`
+}
+
+// newAdminAuth sets up OIDC logins for the admin endpoints. The client secret
+// and cookie-signing secret come from the OIDC_CLIENT_SECRET and
+// ADMIN_SESSION_SECRET environment variables.
+func newAdminAuth(config oidc.Config, group string) (*adminAuth, error) {
+	secret := os.Getenv("ADMIN_SESSION_SECRET")
+	if secret == "" {
+		return nil, errors.New("ADMIN_SESSION_SECRET must be set to use -oidc-issuer")
+	}
+
+	config.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	provider, err := oidc.Discover(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &adminAuth{
+		Provider: provider,
+		Group:    group,
+		Secret:   []byte(secret),
+		Secure:   strings.HasPrefix(config.RedirectURL, "https://"),
+	}, nil
+}
+
+// withAdmin wraps an admin endpoint, requiring a logged-in admin. If the
+// server doesn't have OIDC configured, it requires credentials with the
+// "admin" scope instead; see withAdminScope.
+//
+// People browsing to an admin page are redirected to log in. Other clients get
+// a 401.
+func (s *server) withAdmin(h httprouter.Handle) httprouter.Handle {
+	scoped := s.withAdminScope(h)
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if s.Admin == nil {
+			scoped(w, r, p)
+			return
+		}
+
+		// A session without a subject can't have come from adminLoginCallback.
+		var session adminSession
+		if err := s.openAdminCookie(r, "admin_session", &session); err == nil && session.Subject != "" && s.Clock.Now().Before(session.Expires) {
+			h(w, r, p)
+			return
+		}
+
+		if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/admin/login?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+
+		writeAPIError(w, http.StatusUnauthorized, "login_required", "log in at /admin/login to use this endpoint")
+	}
+}
+
+// withAdminScope wraps an admin endpoint, for servers without admin logins,
+// so that only clients whose credentials have the "admin" scope may use it.
+// Unlike withScope, it turns away requests without credentials even if the
+// server doesn't require authentication.
+func (s *server) withAdminScope(h httprouter.Handle) httprouter.Handle {
+	return s.withAuth(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		principal := auth.FromContext(r.Context())
+		if principal == nil {
+			writeAPIError(w, http.StatusUnauthorized, "auth_required", "admin endpoints require credentials with the \"admin\" scope")
+			return
+		}
+
+		if !principal.HasScope("admin") {
+			writeAPIError(w, http.StatusForbidden, "scope_required", "this endpoint requires the \"admin\" scope")
+			return
+		}
+
+		h(w, r, p)
+	})
+}
+
+// adminLoginStart sends someone off to the identity provider to log in.
+//
+// This lives at GET /admin/login?return=XXX, where return is the admin page to
+// go back to afterwards.
+func (s *server) adminLoginStart(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.Admin == nil {
+		writeAPIError(w, http.StatusNotFound, "login_disabled", "admin login is not configured")
+		return
+	}
+
+	// Only return to pages on this server, so the login flow can't be used to
+	// bounce people to somewhere malicious.
+	login := adminLogin{Return: r.URL.Query().Get("return"), Expires: s.Clock.Now().Add(adminLoginLifetime)}
+	if !isLocalPath(login.Return) {
+		login.Return = "/admin/v1/storage"
+	}
+
+	var err error
+	for _, v := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *v, err = oidc.RandomString(); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+	}
+
+	if err := s.setAdminCookie(w, "admin_login", login, login.Expires); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	http.Redirect(w, r, s.Admin.Provider.AuthCodeURL(login.State, login.Nonce, login.Verifier), http.StatusFound)
+}
+
+// isLocalPath returns whether redirecting to path keeps the browser on this
+// server. Browsers treat "/\evil.com" like "//evil.com", and drop tabs and
+// newlines from URLs, so those are ruled out along with anything that has a
+// scheme or host.
+func isLocalPath(path string) bool {
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "\\\t\r\n") {
+		return false
+	}
+
+	u, err := url.Parse(path)
+	return err == nil && u.Scheme == "" && u.Host == "" && !strings.HasPrefix(u.Path, "//")
+}
+
+// adminLoginCallback is where the identity provider sends people back to after
+// logging in. If they're an admin, it starts their session.
+//
+// This lives at GET /admin/callback, which must be the redirect URL registered
+// with the identity provider.
+func (s *server) adminLoginCallback(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.Admin == nil {
+		writeAPIError(w, http.StatusNotFound, "login_disabled", "admin login is not configured")
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		writeAPIError(w, http.StatusUnauthorized, "login_failed", e+": "+query.Get("error_description"))
+		return
+	}
+
+	var login adminLogin
+	if err := s.openAdminCookie(r, "admin_login", &login); err != nil || s.Clock.Now().After(login.Expires) || query.Get("state") != login.State {
+		writeAPIError(w, http.StatusBadRequest, "login_expired", "this login has expired or was not started here; try again")
+		return
+	}
+
+	identity, err := s.Admin.Provider.Exchange(r.Context(), query.Get("code"), login.Verifier)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, "login_failed", err.Error())
+		return
+	}
+
+	if identity.Nonce != login.Nonce {
+		writeAPIError(w, http.StatusUnauthorized, "login_failed", "the ID token's nonce does not match this login")
+		return
+	}
+
+	if s.Admin.Group != "" && !identity.InGroup(s.Admin.Group) {
+		writeAPIError(w, http.StatusForbidden, "not_an_admin", "you must be in the "+s.Admin.Group+" group to use the admin endpoints")
+		return
+	}
+
+	session := adminSession{Subject: identity.Subject, Email: identity.Email, Expires: s.Clock.Now().Add(adminSessionLifetime)}
+	if err := s.setAdminCookie(w, "admin_session", session, session.Expires); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "admin_login", Path: "/admin", MaxAge: -1})
+	http.Redirect(w, r, login.Return, http.StatusFound)
+}
+
+// adminLogout ends an admin's session.
+//
+// This lives at POST /admin/logout.
+func (s *server) adminLogout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	http.SetCookie(w, &http.Cookie{Name: "admin_session", Path: "/admin", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setAdminCookie sets a signed cookie, scoped to the admin endpoints. The
+// signature covers the cookie's name, so one can't be passed off as another.
+func (s *server) setAdminCookie(w http.ResponseWriter, name string, v interface{}, expires time.Time) error {
+	value, err := oidc.SealCookie(s.Admin.Secret, name, v)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/admin",
+		Expires:  expires,
+		Secure:   s.Admin.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// openAdminCookie decodes the signed cookie called name, set by setAdminCookie,
+// into v.
+func (s *server) openAdminCookie(r *http.Request, name string, v interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+
+	return oidc.OpenCookie(s.Admin.Secret, name, cookie.Value, v)
+}
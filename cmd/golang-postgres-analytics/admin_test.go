@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestIsLocalPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		local bool
+	}{
+		{"/admin/v1/storage", true},
+		{"/admin/v1/events?type=Page%20Viewed", true},
+		{"/", true},
+		{"", false},
+		{"admin/v1/storage", false},
+		{"//evil.com", false},
+		{"/\\evil.com", false},
+		{"/\\/evil.com", false},
+		{"/\t/evil.com", false},
+		{"/\n/evil.com", false},
+		{"https://evil.com", false},
+		{"javascript:alert(1)", false},
+	}
+
+	for _, tt := range tests {
+		if local := isLocalPath(tt.path); local != tt.local {
+			t.Errorf("isLocalPath(%q) = %v, want %v", tt.path, local, tt.local)
+		}
+	}
+}
+
+func TestWithAdminSessionCookie(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := &server{
+		Admin: &adminAuth{Secret: []byte("secret")},
+		Clock: clock.NewFake(now),
+	}
+
+	h := s.withAdmin(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// seal returns the value setAdminCookie gives the cookie called name.
+	seal := func(name string, v interface{}) string {
+		w := httptest.NewRecorder()
+		if err := s.setAdminCookie(w, name, v, now.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		return w.Result().Cookies()[0].Value
+	}
+
+	tests := []struct {
+		name   string
+		value  string
+		status int
+	}{
+		{
+			name:   "session",
+			value:  seal("admin_session", adminSession{Subject: "alice", Expires: now.Add(time.Hour)}),
+			status: http.StatusNoContent,
+		},
+		{
+			name:   "expired session",
+			value:  seal("admin_session", adminSession{Subject: "alice", Expires: now.Add(-time.Second)}),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "session without a subject",
+			value:  seal("admin_session", adminSession{Expires: now.Add(time.Hour)}),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "login replayed as a session",
+			value:  seal("admin_login", adminLogin{State: "state", Return: "/", Expires: now.Add(adminLoginLifetime)}),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "login with a subject replayed as a session",
+			value:  seal("admin_login", adminSession{Subject: "alice", Expires: now.Add(time.Hour)}),
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/admin/v1/storage", nil)
+			r.AddCookie(&http.Cookie{Name: "admin_session", Value: tt.value})
+
+			w := httptest.NewRecorder()
+			h(w, r, nil)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/anomaly"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+)
+
+// anomalies is the "anomalies" subcommand. It compares the last complete hour
+// of ingestion, for each event type, against the same hour on previous days,
+// and reports event counts or revenue that are abnormally low or high.
+//
+// A sudden drop in some type of event is the fastest way to notice a broken SDK
+// release. Run this every hour, from cron or similar. It exits non-zero if it
+// finds anything, and can also post alerts to a Slack-compatible webhook.
+func anomalies(args []string) error {
+	flags := flag.NewFlagSet("anomalies", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	days := flags.Int("days", 7, "number of previous days to compare against")
+	threshold := flags.Float64("threshold", 3, "number of standard deviations that counts as anomalous")
+	webhook := flags.String("webhook", "", "URL to post alerts to, as Slack-compatible JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	// Only look at complete hours. The current hour is still filling up, and
+	// would always look like a drop.
+	//
+	// We need the last hour, plus that same hour on each of the previous days.
+	end := time.Now().Truncate(time.Hour)
+	hours := (*days + 1) * 24
+	start := end.Add(-time.Duration(hours) * time.Hour)
+
+	var rows []struct {
+		Type    string    `db:"type"`
+		Hour    time.Time `db:"hour"`
+		Events  float64   `db:"events"`
+		Revenue float64   `db:"revenue"`
+	}
+
+	var q querybuilder.Query
+	err = db.SelectContext(context.Background(), &rows, fmt.Sprintf(`
+		select
+			%s as type,
+			date_trunc('hour', received_at) as hour,
+			count(*) as events,
+			coalesce(sum((payload->>'revenue')::numeric), 0)::float8 as revenue
+		from
+			events_expanded
+		where
+			%s
+		group by
+			1, 2
+	`, querybuilder.Type, q.Where(querybuilder.Filter{ReceivedFrom: start, ReceivedTo: end})), q.Args()...)
+
+	if err != nil {
+		return err
+	}
+
+	// Build an hourly series for each type in the schema. Types that had no
+	// events at all in some hour need a zero there -- a type that's stopped
+	// entirely is exactly what we're looking for.
+	events := map[string][]float64{}
+	revenue := map[string][]float64{}
+	for eventType := range schema.Discriminator.Mapping {
+		events[eventType] = make([]float64, hours)
+		revenue[eventType] = make([]float64, hours)
+	}
+
+	for _, row := range rows {
+		i := int(row.Hour.Sub(start) / time.Hour)
+		if _, ok := events[row.Type]; ok && i >= 0 && i < hours {
+			events[row.Type][i] = row.Events
+			revenue[row.Type][i] = row.Revenue
+		}
+	}
+
+	var alerts []string
+	check := func(eventType, metric string, series []float64) {
+		result := anomaly.Seasonal(series, 24, *days, *threshold)
+		if result.Anomalous {
+			alerts = append(alerts, fmt.Sprintf(
+				"%s %s in the hour before %s was %.2f, compared to a usual %.2f (z=%.1f)",
+				eventType, metric, end.Format(time.RFC3339), result.Current, result.Mean, result.Z,
+			))
+		}
+	}
+
+	types := make([]string, 0, len(events))
+	for eventType := range events {
+		types = append(types, eventType)
+	}
+
+	sort.Strings(types)
+	for _, eventType := range types {
+		check(eventType, "event count", events[eventType])
+
+		// Only check revenue for types that have any.
+		for _, v := range revenue[eventType] {
+			if v != 0 {
+				check(eventType, "revenue", revenue[eventType])
+				break
+			}
+		}
+	}
+
+	if len(alerts) == 0 {
+		fmt.Println("no anomalies")
+		return nil
+	}
+
+	for _, alert := range alerts {
+		fmt.Println(alert)
+	}
+
+	if *webhook != "" {
+		body, err := json.Marshal(map[string]string{"text": strings.Join(alerts, "\n")})
+		if err != nil {
+			return err
+		}
+
+		res, err := http.Post(*webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			return fmt.Errorf("posting alerts to webhook: %s", res.Status)
+		}
+	}
+
+	return fmt.Errorf("found %d anomalies", len(alerts))
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/event"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+)
+
+// archivedEvent is an event read from an archive.
+type archivedEvent struct {
+	ReceivedAt time.Time
+	Event      event.Event
+}
+
+// archiveLine is a line of an export from GET /v1/events/export. Archives of
+// bare events, one per line, are read too: those have no payload.
+type archiveLine struct {
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// archiveLTV is a user's LTV, as reported by "query-archive -report ltv".
+type archiveLTV struct {
+	UserID string     `json:"userId"`
+	LTV    *money.Sum `json:"ltv"`
+	Orders int64      `json:"orders"`
+}
+
+// archiveRevenue is the revenue in one interval, as reported by
+// "query-archive -report revenue".
+type archiveRevenue struct {
+	Start   time.Time  `json:"start"`
+	Orders  int64      `json:"orders"`
+	Revenue *money.Sum `json:"revenue"`
+}
+
+// archiveFunnelStep is how many users got to a step of a funnel, as reported
+// by "query-archive -report funnel".
+type archiveFunnelStep struct {
+	Type  string `json:"type"`
+	Users int64  `json:"users"`
+}
+
+// queryArchive is the "query-archive" subcommand. It computes the server's
+// analytics -- LTVs, revenue over time, and funnels -- from archived exports,
+// so that events that have been deleted from Postgres can still be analyzed,
+// without loading them back in:
+//
+//	golang-postgres-analytics query-archive -report revenue -interval month 2019-*.ndjson.gz
+//
+// Archives are NDJSON, optionally gzipped, as written by GET /v1/events/export,
+// or with one bare event per line. Every archive is read in one pass, keeping
+// only the aggregates in memory. Events are dated by when they were received,
+// or, for bare events, by their timestamp.
+func queryArchive(args []string) error {
+	flags := flag.NewFlagSet("query-archive", flag.ContinueOnError)
+	report := flags.String("report", "ltv", "what to compute: ltv, revenue, or funnel")
+	userID := flags.String("user-id", "", "with -report ltv, the user to report on, rather than the top users")
+	limit := flags.Int("limit", 20, "with -report ltv, how many of the top users to report on")
+	interval := flags.String("interval", "day", "with -report revenue, the interval to sum over: hour, day, week, or month")
+	steps := flags.String("steps", "Page Viewed,Order Completed", "with -report funnel, the comma-separated types of event users go through, in order")
+	within := flags.Duration("within", 24*time.Hour, "with -report funnel, how long users have from the first step to the last")
+	fromFlag := flags.String("from", "", "only count events received at or after this RFC3339 time")
+	toFlag := flags.String("to", "", "only count events received before this RFC3339 time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New("query-archive needs at least one archive to read")
+	}
+
+	var from, to time.Time
+	for _, t := range []struct {
+		value string
+		dst   *time.Time
+	}{{*fromFlag, &from}, {*toFlag, &to}} {
+		if t.value == "" {
+			continue
+		}
+
+		var err error
+		if *t.dst, err = time.Parse(time.RFC3339, t.value); err != nil {
+			return err
+		}
+	}
+
+	var each func(archivedEvent)
+	var result func() interface{}
+	switch *report {
+	case "ltv":
+		each, result = archiveLTVReport(*userID, *limit)
+	case "revenue":
+		truncate, ok := archiveIntervals[*interval]
+		if !ok {
+			return fmt.Errorf("unknown -interval %q", *interval)
+		}
+
+		each, result = archiveRevenueReport(truncate)
+	case "funnel":
+		each, result = archiveFunnelReport(strings.Split(*steps, ","), *within)
+	default:
+		return fmt.Errorf("unknown -report %q", *report)
+	}
+
+	for _, path := range flags.Args() {
+		err := readArchive(path, func(e archivedEvent) {
+			if (from.IsZero() || !e.ReceivedAt.Before(from)) && (to.IsZero() || e.ReceivedAt.Before(to)) {
+				each(e)
+			}
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	buf, err := json.MarshalIndent(result(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(buf))
+	return nil
+}
+
+// readArchive calls f with each event in the archive at path.
+func readArchive(path string, f func(archivedEvent)) error {
+	if strings.HasSuffix(path, ".parquet") {
+		return fmt.Errorf("%s: Parquet archives aren't supported; export them as NDJSON", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	lines, err := ndjsonLines(file)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	for n := 1; ; n++ {
+		buf, err := lines.ReadBytes('\n')
+		if len(strings.TrimSpace(string(buf))) != 0 {
+			var line archiveLine
+			if err := json.Unmarshal(buf, &line); err != nil {
+				return fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+
+			if line.Payload == nil {
+				line.Payload = buf
+			}
+
+			var e archivedEvent
+			if err := json.Unmarshal(line.Payload, &e.Event); err != nil {
+				return fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+
+			e.ReceivedAt = line.ReceivedAt
+			if e.ReceivedAt.IsZero() {
+				e.ReceivedAt = eventTimestamp(e.Event)
+			}
+
+			f(e)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+}
+
+func eventTimestamp(e event.Event) time.Time {
+	switch e.Type {
+	case event.EventTypePageViewed:
+		return e.EventPageViewed.Timestamp
+	case event.EventTypeOrderCompleted:
+		return e.EventOrderCompleted.Timestamp
+	case event.EventTypeHeartbeat:
+		return e.EventHeartbeat.Timestamp
+	}
+
+	return time.Time{}
+}
+
+func eventUserID(e event.Event) string {
+	switch e.Type {
+	case event.EventTypePageViewed:
+		return e.EventPageViewed.UserId
+	case event.EventTypeOrderCompleted:
+		return e.EventOrderCompleted.UserId
+	case event.EventTypeHeartbeat:
+		return e.EventHeartbeat.UserId
+	}
+
+	return ""
+}
+
+// archiveLTVReport sums the revenue from each user, like GET /v1/ltv, and
+// reports on userID, or, if it's empty, the limit users with the highest LTVs.
+func archiveLTVReport(userID string, limit int) (func(archivedEvent), func() interface{}) {
+	ltvs := map[string]*archiveLTV{}
+	each := func(e archivedEvent) {
+		if e.Event.Type != event.EventTypeOrderCompleted {
+			return
+		}
+
+		order := e.Event.EventOrderCompleted
+		if userID != "" && order.UserId != userID {
+			return
+		}
+
+		ltv, ok := ltvs[order.UserId]
+		if !ok {
+			ltv = &archiveLTV{UserID: order.UserId, LTV: &money.Sum{}}
+			ltvs[order.UserId] = ltv
+		}
+
+		ltv.LTV.Add(order.Revenue)
+		ltv.Orders++
+	}
+
+	result := func() interface{} {
+		if userID != "" {
+			if ltv, ok := ltvs[userID]; ok {
+				return ltv
+			}
+
+			return archiveLTV{UserID: userID, LTV: &money.Sum{}}
+		}
+
+		top := []*archiveLTV{}
+		for _, ltv := range ltvs {
+			top = append(top, ltv)
+		}
+
+		sort.Slice(top, func(i, j int) bool {
+			if c := top[i].LTV.CmpSum(top[j].LTV); c != 0 {
+				return c > 0
+			}
+
+			return top[i].UserID < top[j].UserID
+		})
+
+		if len(top) > limit {
+			top = top[:limit]
+		}
+
+		return top
+	}
+
+	return each, result
+}
+
+// archiveIntervals truncate a time to the start of the interval it's in, in
+// UTC. Weeks start on Mondays.
+var archiveIntervals = map[string]func(time.Time) time.Time{
+	"hour": func(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) },
+	"day": func(t time.Time) time.Time {
+		y, m, d := t.UTC().Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	},
+	"week": func(t time.Time) time.Time {
+		y, m, d := t.UTC().Date()
+		weekday := (int(t.UTC().Weekday()) + 6) % 7
+		return time.Date(y, m, d-weekday, 0, 0, 0, 0, time.UTC)
+	},
+	"month": func(t time.Time) time.Time {
+		y, m, _ := t.UTC().Date()
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	},
+}
+
+// archiveRevenueReport sums the revenue from orders in each interval, as
+// truncate divides time up. Only intervals with orders are reported.
+func archiveRevenueReport(truncate func(time.Time) time.Time) (func(archivedEvent), func() interface{}) {
+	intervals := map[time.Time]*archiveRevenue{}
+	each := func(e archivedEvent) {
+		if e.Event.Type != event.EventTypeOrderCompleted {
+			return
+		}
+
+		start := truncate(e.ReceivedAt)
+		interval, ok := intervals[start]
+		if !ok {
+			interval = &archiveRevenue{Start: start, Revenue: &money.Sum{}}
+			intervals[start] = interval
+		}
+
+		interval.Revenue.Add(e.Event.EventOrderCompleted.Revenue)
+		interval.Orders++
+	}
+
+	result := func() interface{} {
+		series := []*archiveRevenue{}
+		for _, interval := range intervals {
+			series = append(series, interval)
+		}
+
+		sort.Slice(series, func(i, j int) bool { return series[i].Start.Before(series[j].Start) })
+		return series
+	}
+
+	return each, result
+}
+
+// archiveFunnelReport counts how many users went through each of steps, in
+// order, within a time of starting. A user counts towards a step if they did
+// it, and every step before it, in that order, within the time; what they did
+// in between doesn't matter.
+func archiveFunnelReport(steps []string, within time.Duration) (func(archivedEvent), func() interface{}) {
+	type step struct {
+		at    time.Time
+		index int
+	}
+
+	index := map[string][]int{}
+	for i, t := range steps {
+		index[t] = append(index[t], i)
+	}
+
+	// Only the events that are steps are kept, and only their times.
+	users := map[string][]step{}
+	each := func(e archivedEvent) {
+		for _, i := range index[e.Event.Type] {
+			user := eventUserID(e.Event)
+			users[user] = append(users[user], step{e.ReceivedAt, i})
+		}
+	}
+
+	result := func() interface{} {
+		reached := make([]int64, len(steps))
+		for _, events := range users {
+			sort.SliceStable(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+
+			// Try each time the user started the funnel, and keep the furthest
+			// they got from any of them.
+			furthest := 0
+			for i, start := range events {
+				if start.index != 0 {
+					continue
+				}
+
+				next := 1
+				for _, e := range events[i+1:] {
+					if next == len(steps) || e.at.Sub(start.at) > within {
+						break
+					}
+
+					if e.index == next {
+						next++
+					}
+				}
+
+				if next > furthest {
+					furthest = next
+				}
+			}
+
+			for i := 0; i < furthest; i++ {
+				reached[i]++
+			}
+		}
+
+		funnel := make([]archiveFunnelStep, len(steps))
+		for i, t := range steps {
+			funnel[i] = archiveFunnelStep{Type: t, Users: reached[i]}
+		}
+
+		return funnel
+	}
+
+	return each, result
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/julienschmidt/httprouter"
+)
+
+// signatureTolerance is how far a signed request's timestamp may be from the
+// server's clock.
+const signatureTolerance = 5 * time.Minute
+
+// jwtConfig is how the "jwt" auth provider is configured, from flags to serve.
+type jwtConfig struct {
+	Issuer        string
+	Audience      string
+	PublicKeyPath string
+	JWKSURL       string
+	TenantClaim   string
+}
+
+// authProviders builds the chain of auth providers named in a comma-separated
+// list, like "api-key,jwt". Providers are tried in the order they're listed.
+func (s *server) authProviders(names string, jwt jwtConfig) (auth.Chain, error) {
+	var chain auth.Chain
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+			continue
+		case "api-key":
+			chain = append(chain, &auth.APIKeys{
+				DB:         s.DB,
+				Signatures: s.Signatures,
+				Tolerance:  signatureTolerance,
+				Clock:      s.Clock,
+			})
+		case "jwt":
+			provider := &auth.JWT{
+				Secret:      []byte(os.Getenv("JWT_SECRET")),
+				Issuer:      jwt.Issuer,
+				Audience:    jwt.Audience,
+				TenantClaim: jwt.TenantClaim,
+				Clock:       s.Clock,
+			}
+
+			if jwt.PublicKeyPath != "" {
+				buf, err := ioutil.ReadFile(jwt.PublicKeyPath)
+				if err != nil {
+					return nil, err
+				}
+
+				key, err := auth.ParseRSAPublicKey(buf)
+				if err != nil {
+					return nil, err
+				}
+
+				provider.PublicKeys = append(provider.PublicKeys, key)
+			}
+
+			// The keys are fetched up front, so that a wrong URL is found at
+			// startup rather than on the first request.
+			if jwt.JWKSURL != "" {
+				provider.KeySet = &auth.KeySet{URL: jwt.JWKSURL, Clock: s.Clock}
+				if _, err := provider.KeySet.Keys(); err != nil {
+					return nil, fmt.Errorf("fetching -jwt-jwks-url: %s", err)
+				}
+			}
+
+			chain = append(chain, provider)
+		case "client-cert":
+			chain = append(chain, &auth.ClientCert{DB: s.DB})
+		default:
+			return nil, fmt.Errorf("unknown auth provider: %q", name)
+		}
+	}
+
+	return chain, nil
+}
+
+// withAuth wraps an endpoint, authenticating the request with the server's
+// auth providers and making the result available via auth.FromContext.
+//
+// Bad credentials are always rejected. Requests without any credentials are
+// rejected only if the server requires authentication.
+func (s *server) withAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		principal, err := s.Auth.Authenticate(r)
+		if err == auth.ErrNoCredentials {
+			if s.RequireAuth {
+				writeAPIError(w, http.StatusUnauthorized, "auth_required", "this endpoint requires authentication")
+				return
+			}
+
+			h(w, r, p)
+			return
+		}
+
+		if err, ok := err.(*auth.Error); ok {
+			writeAPIError(w, err.Status, err.Code, err.Message)
+			return
+		}
+
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+
+		h(w, r.WithContext(auth.NewContext(r.Context(), principal)), p)
+	}
+}
+
+// maxSignedBulkBody is the most the body of a signed request to a bulk
+// endpoint, like a stream of NDJSON or a CSV import, may be. It's read whole to
+// verify its signature before any of it's stored.
+const maxSignedBulkBody = 64 << 20
+
+// withMaxSignedBody wraps an endpoint, so that requests to it signed with an
+// API key's secret may have bodies of up to n bytes, rather than
+// auth.DefaultMaxSignedBody. It goes outside withAuth.
+func (s *server) withMaxSignedBody(n int64, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		h(w, r.WithContext(auth.WithMaxSignedBody(r.Context(), n)), p)
+	}
+}
+
+// checkSigned rejects an event of a type that must be sent in signed requests
+// (see -signed-types), if ctx's request wasn't. Revenue, say, can then only
+// come from backends holding an API key's secret, and not be forged by anyone
+// who's seen a key in a web page.
+func (s *server) checkSigned(ctx context.Context, eventType string) *ingestError {
+	if !s.SignedTypes[eventType] {
+		return nil
+	}
+
+	if principal := auth.FromContext(ctx); principal != nil && principal.Signed {
+		return nil
+	}
+
+	return &ingestError{Status: http.StatusForbidden, Code: "signature_required", Message: fmt.Sprintf("%q events must be sent in requests signed with an API key's secret", eventType)}
+}
+
+// withScope wraps an endpoint, inside withAuth, so that clients may only use it
+// if their credentials have scope. Clients without credentials may still send
+// events, unless the server requires authentication, but everything else is
+// turned away with a 401, like withAdminScope does.
+func (s *server) withScope(scope string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		principal := auth.FromContext(r.Context())
+		if principal == nil && scope != "ingest" {
+			writeAPIError(w, http.StatusUnauthorized, "auth_required", fmt.Sprintf("this endpoint requires credentials with the %q scope", scope))
+			return
+		}
+
+		if principal != nil && !hasScope(principal, scope) {
+			writeAPIError(w, http.StatusForbidden, "scope_required", fmt.Sprintf("this endpoint requires the %q scope", scope))
+			return
+		}
+
+		h(w, r, p)
+	}
+}
+
+// dedicatedScopes are the scopes that give a principal some job other than
+// sending events, like reading analytics or relaying for edge collectors.
+var dedicatedScopes = []string{"read", "export", "collector", "forward", "admin"}
+
+// hasScope returns whether principal has scope. Principals with none of
+// dedicatedScopes may ingest without the "ingest" scope, since that's all that
+// keys could do before there were scopes for anything else. A key for
+// collecting, forwarding or reading may only send events directly if it's
+// given the "ingest" scope too.
+func hasScope(principal *auth.Principal, scope string) bool {
+	if scope != "ingest" || principal.HasScope("ingest") {
+		return principal.HasScope(scope)
+	}
+
+	for _, dedicated := range dedicatedScopes {
+		if principal.HasScope(dedicated) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+)
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		ok     bool
+	}{
+		{scopes: nil, scope: "ingest", ok: true},
+		{scopes: []string{"openid"}, scope: "ingest", ok: true},
+		{scopes: nil, scope: "read"},
+		{scopes: []string{"read"}, scope: "read", ok: true},
+		{scopes: []string{"read"}, scope: "ingest"},
+		{scopes: []string{"read", "ingest"}, scope: "ingest", ok: true},
+		{scopes: []string{"collector"}, scope: "ingest"},
+		{scopes: []string{"collector"}, scope: "collector", ok: true},
+		{scopes: []string{"forward"}, scope: "ingest"},
+		{scopes: []string{"export"}, scope: "ingest"},
+		{scopes: []string{"admin"}, scope: "ingest"},
+		{scopes: []string{"forward", "ingest"}, scope: "ingest", ok: true},
+	}
+
+	for _, tt := range tests {
+		principal := &auth.Principal{Provider: "api-key", Subject: "test", Scopes: tt.scopes}
+		if ok := hasScope(principal, tt.scope); ok != tt.ok {
+			t.Errorf("hasScope(%v, %q) = %v, want %v", tt.scopes, tt.scope, ok, tt.ok)
+		}
+	}
+}
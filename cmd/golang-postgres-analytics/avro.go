@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/avro"
+)
+
+// avroFingerprintHeader says which schema an Avro event was written with: the
+// CRC-64-AVRO fingerprint of its Parsing Canonical Form, as 16 hex digits.
+const avroFingerprintHeader = "X-Avro-Fingerprint"
+
+// createAvroEvent stores an event sent as Avro binary to POST /v1/events. It's
+// decoded with the schema in avro-schemas.json that the request names, and
+// from then on it's treated just like the JSON it decodes to: validated
+// against the event schema, and stored as JSON.
+//
+// The schema is named by the X-Avro-Fingerprint header or, failing that, by
+// the body being in Avro's single object encoding, which starts with the
+// fingerprint.
+func (s *server) createAvroEvent(w http.ResponseWriter, r *http.Request, body []byte) {
+	var fingerprint uint64
+	if header := r.Header.Get(avroFingerprintHeader); header != "" {
+		var err error
+		if fingerprint, err = strconv.ParseUint(header, 16, 64); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "avro_fingerprint_invalid", fmt.Sprintf("%s must be 16 hex digits", avroFingerprintHeader))
+			return
+		}
+	} else if fp, datum, ok := avro.SplitSingleObject(body); ok {
+		fingerprint, body = fp, datum
+	} else {
+		writeAPIError(w, http.StatusBadRequest, "avro_fingerprint_missing", fmt.Sprintf("Avro events need a %s header, or to be in the single object encoding", avroFingerprintHeader))
+		return
+	}
+
+	schema := s.AvroSchemas.Lookup(fingerprint)
+	if schema == nil {
+		writeAPIError(w, http.StatusBadRequest, "avro_schema_unknown", fmt.Sprintf("no Avro schema has fingerprint %016x", fingerprint))
+		return
+	}
+
+	eventRaw, err := avro.Decode(schema, body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "avro_invalid", err.Error())
+		return
+	}
+
+	// What's stored, and validated against limits, is the event's JSON.
+	buf, err := json.Marshal(eventRaw)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	s.storeEvent(w, r, buf, eventRaw)
+}
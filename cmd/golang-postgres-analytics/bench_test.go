@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+)
+
+// The benchmarks here run against the database in TEST_DATABASE_URL, inside
+// transactions that are rolled back. The ones that don't need a database are
+// next to the code they measure, in internal/fixtures and internal/querybuilder.
+
+func BenchmarkCopyEvents(b *testing.B) {
+	db := openTestDatabase(b)
+	defer db.Close()
+
+	for _, size := range []int{10, 100, 1000} {
+		// Random events reach the edges of the schema, which Postgres doesn't
+		// always share. These are more like real traffic anyway.
+		batch := make([][]byte, size)
+		for i := range batch {
+			batch[i] = []byte(fmt.Sprintf(`{"type":"Order Completed","userId":"user-%d","timestamp":"2020-01-01T12:00:00Z","revenue":"%d.99"}`, i%10, i))
+		}
+
+		b.Run(fmt.Sprintf("batch-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tx, err := db.Beginx()
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := (eventCopier{}).copyEventsTx(context.Background(), tx, batch, time.Now()); err != nil {
+					tx.Rollback()
+					b.Fatal(err)
+				}
+
+				tx.Rollback()
+			}
+		})
+	}
+}
+
+func BenchmarkLTVQuery(b *testing.B) {
+	db := openTestDatabase(b)
+	defer db.Close()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var q querybuilder.Query
+		var payloads []dbEvent
+		err := db.Select(&payloads, `select payload from events where `+q.Where(querybuilder.Filter{
+			Type:   "Order Completed",
+			UserID: fmt.Sprintf("user-%d", i%10),
+		}), q.Args()...)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
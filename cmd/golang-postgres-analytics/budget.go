@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// budgetKey is the context key for a request's latency budget.
+type budgetKey struct{}
+
+// withLatencyBudget wraps a composite endpoint -- one whose response is made
+// of several independent queries -- so that it answers within a latency budget,
+// even if some of its queries don't.
+//
+// The budget is the server's -latency-budget, unless the client asks for less
+// with an X-Latency-Budget header, like "500ms". Each part of the response may
+// use its share of the budget; see runParts.
+func (s *server) withLatencyBudget(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		budget := s.LatencyBudget
+		if header := r.Header.Get("X-Latency-Budget"); header != "" {
+			requested, err := time.ParseDuration(header)
+			if err != nil || requested <= 0 {
+				writeAPIError(w, http.StatusBadRequest, "invalid_latency_budget", "X-Latency-Budget must be a positive duration, like \"500ms\"")
+				return
+			}
+
+			if requested < budget {
+				budget = requested
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), budgetKey{}, budget)
+		h(w, r.WithContext(ctx), p)
+	}
+}
+
+// part is one independent piece of a composite response.
+type part struct {
+	// Name identifies the part in the response's "missing" list, if it
+	// doesn't finish in time. It's the part's key in the response, by
+	// convention.
+	Name string
+
+	// Share is the fraction of the latency budget the part may use, from 0 to
+	// 1. Parts run at the same time, so shares needn't add up to 1: an
+	// expensive, less important part can be given less time than the rest.
+	Share float64
+
+	// Run fills in the part of the response. It must stop when ctx is done.
+	Run func(ctx context.Context) error
+}
+
+// partialResult is embedded in composite responses, to say which parts, if
+// any, are missing from them.
+type partialResult struct {
+	Incomplete bool     `json:"incomplete"`
+	Missing    []string `json:"missing,omitempty"`
+}
+
+// runParts runs parts at the same time, each with a deadline of its share of
+// the request's latency budget. A part that doesn't finish by its deadline is
+// abandoned, and reported as missing, rather than failing the whole response.
+//
+// Any other error a part returns is returned, as is ctx's error if the request
+// itself is cancelled. Without a budget (see withLatencyBudget), parts run
+// until they're done.
+func runParts(ctx context.Context, parts ...part) (partialResult, error) {
+	budget, _ := ctx.Value(budgetKey{}).(time.Duration)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(parts))
+	timedOut := make([]bool, len(parts))
+	for i, p := range parts {
+		wg.Add(1)
+		go func(i int, p part) {
+			defer wg.Done()
+
+			partCtx := ctx
+			if budget > 0 {
+				var cancel context.CancelFunc
+				partCtx, cancel = context.WithDeadline(ctx, start.Add(time.Duration(p.Share*float64(budget))))
+				defer cancel()
+			}
+
+			errs[i] = p.Run(partCtx)
+
+			// However the driver reports a cancelled query, it's the part's
+			// deadline that did it if the request is still going.
+			if errs[i] != nil && partCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				errs[i] = nil
+				timedOut[i] = true
+			}
+		}(i, p)
+	}
+
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return partialResult{}, err
+	}
+
+	var result partialResult
+	for i, p := range parts {
+		if errs[i] != nil {
+			return partialResult{}, errs[i]
+		}
+
+		if timedOut[i] {
+			result.Incomplete = true
+			result.Missing = append(result.Missing, p.Name)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf/jddf-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// candidateTimeout is how long recording a candidate failure may take.
+const candidateTimeout = 10 * time.Second
+
+// candidateConcurrency is how many candidate failures may be being recorded at
+// once. Beyond that, they're counted, but not recorded.
+const candidateConcurrency = 16
+
+// candidate is a schema being rolled out, which every event the current
+// schema accepts is also validated against. Events it would reject are
+// recorded in candidate_failures, and still stored: the candidate decides
+// nothing until it's made the current schema.
+//
+// Unlike the shadow's schema, which a fraction of events are tried against,
+// the candidate sees every event, and keeps the ones it rejects, so that a
+// schema change can be assessed against everything clients really send.
+type candidate struct {
+	// The counters come first, so that they're 64-bit aligned for sync/atomic.
+	validated    int64
+	failed       int64
+	unrecorded   int64
+	recordErrors int64
+
+	// Version names the candidate in candidate_failures: the start of the
+	// SHA-256 of its file. Editing the candidate starts a fresh report.
+	Version string
+	Schema  jddf.Schema
+
+	slots chan struct{}
+}
+
+// candidateReport is the response of GET /admin/v1/candidate.
+type candidateReport struct {
+	Version string `json:"version"`
+
+	// Validated is how many events were validated against the candidate since
+	// this instance started, and Failed how many of them it rejected.
+	// Unrecorded is how many of those weren't recorded, because too many were
+	// being recorded already, or recording them failed.
+	Validated  int64 `json:"validated"`
+	Failed     int64 `json:"failed"`
+	Unrecorded int64 `json:"unrecorded"`
+
+	// Failures are how many events the candidate has rejected, across every
+	// instance, grouped by type and where they failed.
+	Failures []candidateFailures `json:"failures"`
+}
+
+// candidateFailures is how many events of a type failed the candidate at a
+// place in it.
+type candidateFailures struct {
+	Type       string    `json:"type" db:"event_type"`
+	SchemaPath string    `json:"schemaPath" db:"schema_path"`
+	Events     int64     `json:"events" db:"events"`
+	LastSeen   time.Time `json:"lastSeen" db:"last_seen"`
+}
+
+// loadCandidate loads the candidate schema at path.
+func loadCandidate(path string) (*candidate, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var schema jddf.Schema
+	if err := json.Unmarshal(buf, &schema); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	sum := sha256.Sum256(buf)
+	return &candidate{
+		Version: hex.EncodeToString(sum[:6]),
+		Schema:  schema,
+		slots:   make(chan struct{}, candidateConcurrency),
+	}, nil
+}
+
+// checkCandidate validates an event the current schema accepted against the
+// candidate, and records it if it fails. It doesn't wait for it to be
+// recorded.
+func (s *server) checkCandidate(buf []byte, eventRaw interface{}, eventType string) {
+	c := s.Candidate
+	atomic.AddInt64(&c.validated, 1)
+
+	validator := jddf.Validator{}
+	result, _ := validator.Validate(c.Schema, eventRaw)
+	if len(result.Errors) == 0 {
+		return
+	}
+
+	atomic.AddInt64(&c.failed, 1)
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&c.unrecorded, 1)
+		return
+	}
+
+	go func() {
+		defer func() { <-c.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), candidateTimeout)
+		defer cancel()
+
+		errs, _ := json.Marshal(result.Errors)
+		_, err := s.DB.ExecContext(ctx, `
+			insert into candidate_failures (candidate, event_type, payload, errors, received_at)
+			values ($1, $2, $3, $4, $5)
+		`, c.Version, eventType, string(buf), string(errs), s.Clock.Now())
+
+		if err != nil {
+			atomic.AddInt64(&c.unrecorded, 1)
+			if atomic.AddInt64(&c.recordErrors, 1) == 1 {
+				fmt.Fprintf(os.Stderr, "recording candidate failure: %s\n", err)
+			}
+		}
+	}()
+}
+
+// getCandidate reports how the candidate schema would have fared: how many
+// events it would have rejected, of which types, and where in the schema.
+// The events themselves are in candidate_failures, for a closer look.
+//
+// This lives at GET /admin/v1/candidate.
+func (s *server) getCandidate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	c := s.Candidate
+	if c == nil {
+		writeAPIError(w, http.StatusNotFound, "candidate_disabled", "there's no candidate schema; see -candidate-schema")
+		return
+	}
+
+	report := candidateReport{
+		Version:    c.Version,
+		Validated:  atomic.LoadInt64(&c.validated),
+		Failed:     atomic.LoadInt64(&c.failed),
+		Unrecorded: atomic.LoadInt64(&c.unrecorded),
+		Failures:   []candidateFailures{},
+	}
+
+	// Each error's schemaPath is a list, like ["discriminator", "mapping",
+	// "Order Completed", "properties", "revenue"], reported as a JSON Pointer.
+	err := s.DB.SelectContext(r.Context(), &report.Failures, `
+		select
+			event_type,
+			'/' || array_to_string(array(select jsonb_array_elements_text(e->'schemaPath')), '/') as schema_path,
+			count(distinct id) as events,
+			max(received_at) as last_seen
+		from candidate_failures, jsonb_array_elements(errors) e
+		where candidate = $1
+		group by 1, 2
+		order by 3 desc, 1, 2
+	`, c.Version)
+
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/codec"
+	"github.com/jmoiron/sqlx"
+)
+
+// codecs keeps track of the codecs events are stored with, and their ids in
+// the event_codecs table.
+//
+// Each codec's state is saved in event_codecs the first time it's used, and
+// events stored with it point to that row. So when the schema changes, and
+// with it the codec for a type, events stored with the old codec can still be
+// read.
+type codecs struct {
+	db *sqlx.DB
+
+	// tag is the discriminator tag of the event schema, which says which codec
+	// to encode an event with.
+	tag string
+
+	// fromSchema are the codecs the schema asks for, keyed by event type.
+	fromSchema map[string]codec.Codec
+
+	mu     sync.RWMutex
+	byType map[string]int64
+	byID   map[int64]codec.Codec
+}
+
+func newCodecs(db *sqlx.DB, tag string, fromSchema map[string]codec.Codec) *codecs {
+	return &codecs{
+		db:         db,
+		tag:        tag,
+		fromSchema: fromSchema,
+		byType:     map[string]int64{},
+		byID:       map[int64]codec.Codec{},
+	}
+}
+
+// register saves the codecs the schema asks for in event_codecs, if they're
+// not there already. Until it's done so, events are stored as plain jsonb.
+func (c *codecs) register(ctx context.Context) error {
+	for eventType, cdc := range c.fromSchema {
+		state, err := codec.State(cdc)
+		if err != nil {
+			return err
+		}
+
+		var id int64
+		err = c.db.GetContext(ctx, &id, `
+			with inserted as (
+				insert into event_codecs (event_type, codec, state) values ($1, $2, $3)
+				on conflict (event_type, codec, state) do nothing
+				returning id
+			)
+			select id from inserted
+			union all
+			select id from event_codecs where event_type = $1 and codec = $2 and state = $3
+			limit 1
+		`, eventType, cdc.Name(), state)
+
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		c.byType[eventType] = id
+		c.byID[id] = cdc
+		c.mu.Unlock()
+	}
+
+	return nil
+}
+
+// encode returns the compact form of an event, and the id of the codec that
+// made it. ok is false if the event should be stored as jsonb.
+func (c *codecs) encode(buf []byte) (compact []byte, id int64, ok bool) {
+	if c == nil || len(c.fromSchema) == 0 {
+		return nil, 0, false
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(buf, &event); err != nil {
+		return nil, 0, false
+	}
+
+	eventType, _ := event[c.tag].(string)
+
+	c.mu.RLock()
+	id, ok = c.byType[eventType]
+	cdc := c.byID[id]
+	c.mu.RUnlock()
+
+	if !ok {
+		return nil, 0, false
+	}
+
+	// An event the codec can't encode is still valid, so it's stored as
+	// jsonb rather than rejected.
+	compact, err := cdc.Encode(event)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	return compact, id, true
+}
+
+// expand returns an event's JSON, whether it was stored as jsonb or compacted
+// by the codec with the given id.
+func (c *codecs) expand(ctx context.Context, payload []byte, id sql.NullInt64, compact []byte) ([]byte, error) {
+	if !id.Valid {
+		return payload, nil
+	}
+
+	c.mu.RLock()
+	cdc, ok := c.byID[id.Int64]
+	c.mu.RUnlock()
+
+	if !ok {
+		var row struct {
+			Codec string `db:"codec"`
+			State []byte `db:"state"`
+		}
+
+		if err := c.db.GetContext(ctx, &row, `select codec, state from event_codecs where id = $1`, id.Int64); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if cdc, err = codec.Load(row.Codec, row.State); err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.byID[id.Int64] = cdc
+		c.mu.Unlock()
+	}
+
+	event, err := cdc.Decode(compact)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(event)
+}
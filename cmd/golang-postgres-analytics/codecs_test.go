@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"testing/quick"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/codec"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/event"
+)
+
+// TestExpandEventMatchesCodec compacts random events with the dictionary codec,
+// expands them again with expand_event in SQL, and checks each unmarshals into
+// the event it was, as it does when the codec expands it in Go. Like
+// TestRandomEventsRoundTripThroughPostgres, it needs TEST_DATABASE_URL, and
+// rolls back everything it inserts.
+func TestExpandEventMatchesCodec(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	schema, err := loadSchema("../../event.jddf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	expands := func(seed int64) bool {
+		payloads, ok := randomPayloads(t, seed, 50)
+		if !ok {
+			return false
+		}
+
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer tx.Rollback()
+
+		codecIDs := map[string]int64{}
+		for _, payload := range payloads {
+			var eventRaw map[string]interface{}
+			if err := json.Unmarshal(payload, &eventRaw); err != nil {
+				t.Fatal(err)
+			}
+
+			eventType := eventRaw["type"].(string)
+			cdc, err := codec.NewDictionary(schema, eventType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Events the codec can't represent are stored as jsonb, so
+			// there's nothing to expand.
+			compact, err := cdc.Encode(eventRaw)
+			if err != nil {
+				continue
+			}
+
+			id, ok := codecIDs[eventType]
+			if !ok {
+				state, err := codec.State(cdc)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = tx.GetContext(ctx, &id, `
+					insert into event_codecs (event_type, codec, state) values ($1, $2, $3)
+					on conflict (event_type, codec, state) do update set codec = excluded.codec
+					returning id
+				`, eventType, cdc.Name(), state)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				codecIDs[eventType] = id
+			}
+
+			var expanded string
+			if err := tx.GetContext(ctx, &expanded, `select expand_event($1, $2)`, id, compact); err != nil {
+				t.Logf("seed %d: %s: %s", seed, payload, err)
+				return false
+			}
+
+			var e event.Event
+			if err := json.Unmarshal([]byte(expanded), &e); err != nil {
+				t.Logf("seed %d: %s: %s", seed, expanded, err)
+				return false
+			}
+
+			buf, err := json.Marshal(e)
+			if err != nil {
+				t.Logf("seed %d: %s", seed, err)
+				return false
+			}
+
+			if !bytes.Equal(buf, payload) {
+				t.Logf("seed %d: %s expanded to %s", seed, payload, expanded)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(expands, &quick.Config{MaxCount: 20}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/event"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/eventid"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/fixtures"
+	"github.com/jddf/jddf-go"
+	"github.com/jmoiron/sqlx"
+)
+
+// randomPayloads returns n random events from seed, marshaled, after checking
+// each gets past validation and limits the way an ingested one would. Limits
+// are checked as if each event were received when it happened, as the seed
+// subcommand does, since most random timestamps are far from now.
+func randomPayloads(t *testing.T, seed int64, n int) ([][]byte, bool) {
+	t.Helper()
+
+	schema, err := loadSchema("../../event.jddf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventLimits, err := loadLimits("../../event.jddf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	validator := jddf.Validator{}
+
+	payloads := make([][]byte, n)
+	for i := range payloads {
+		buf, err := json.Marshal(fixtures.RandomEvent(r))
+		if err != nil {
+			t.Logf("seed %d: %s", seed, err)
+			return nil, false
+		}
+
+		var eventRaw map[string]interface{}
+		if err := json.Unmarshal(buf, &eventRaw); err != nil {
+			t.Logf("seed %d: %s: %s", seed, buf, err)
+			return nil, false
+		}
+
+		if result, err := validator.Validate(schema, eventRaw); err != nil || len(result.Errors) != 0 {
+			t.Logf("seed %d: %s is invalid: %v %v", seed, buf, err, result.Errors)
+			return nil, false
+		}
+
+		timestamp, err := time.Parse(time.RFC3339Nano, eventRaw["timestamp"].(string))
+		if err != nil {
+			t.Logf("seed %d: %s: %s", seed, buf, err)
+			return nil, false
+		}
+
+		if err := eventLimits.Check(eventRaw["type"].(string), buf, eventRaw, timestamp); err != nil {
+			t.Logf("seed %d: %s is over limits: %s", seed, buf, err)
+			return nil, false
+		}
+
+		payloads[i] = buf
+	}
+
+	return payloads, true
+}
+
+func TestRandomEventsPassChecks(t *testing.T) {
+	passes := func(seed int64) bool {
+		_, ok := randomPayloads(t, seed, 10)
+		return ok
+	}
+
+	if err := quick.Check(passes, &quick.Config{MaxCount: 200}); err != nil {
+		t.Error(err)
+	}
+}
+
+// openTestDatabase connects to the database in TEST_DATABASE_URL, or skips the
+// test or benchmark if there isn't one.
+func openTestDatabase(tb testing.TB) *sqlx.DB {
+	tb.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	db, err := sqlx.Open("postgres", url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		tb.Fatal(err)
+	}
+
+	return db
+}
+
+// TestRandomEventsRoundTripThroughPostgres inserts random events with
+// copyEventsTx, reads them back, and checks each unmarshals into the event it
+// was, with the ID it was given. It needs a database to run against, such as
+// one made from schema.sql, in TEST_DATABASE_URL; everything it inserts is
+// rolled back.
+func TestRandomEventsRoundTripThroughPostgres(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	copier := eventCopier{ids: &eventid.ULID{}}
+	roundTrips := func(seed int64) bool {
+		payloads, ok := randomPayloads(t, seed, 50)
+		if !ok {
+			return false
+		}
+
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer tx.Rollback()
+
+		// Events are told apart from any already in the database by a
+		// received_at no real event will have.
+		receivedAt := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(seed))
+		if err := copier.copyEventsTx(ctx, tx, payloads, receivedAt); err != nil {
+			t.Logf("seed %d: %s", seed, err)
+			return false
+		}
+
+		var stored []struct {
+			Payload string         `db:"payload"`
+			EventID sql.NullString `db:"event_id"`
+		}
+
+		if err := tx.SelectContext(ctx, &stored, "select payload, event_id from events where received_at = $1 order by id", receivedAt); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(stored) != len(payloads) {
+			t.Logf("seed %d: stored %d events, want %d", seed, len(stored), len(payloads))
+			return false
+		}
+
+		// jsonb reorders keys and changes whitespace and escapes, so payloads
+		// are compared by what they unmarshal into.
+		for i, row := range stored {
+			payload := row.Payload
+			if !row.EventID.Valid {
+				t.Logf("seed %d: %s wasn't given an ID", seed, payload)
+				return false
+			}
+
+			var e event.Event
+			if err := json.Unmarshal([]byte(payload), &e); err != nil {
+				t.Logf("seed %d: %s: %s", seed, payload, err)
+				return false
+			}
+
+			buf, err := json.Marshal(e)
+			if err != nil {
+				t.Logf("seed %d: %s", seed, err)
+				return false
+			}
+
+			if !bytes.Equal(buf, payloads[i]) {
+				t.Logf("seed %d: %s came back as %s", seed, payloads[i], buf)
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(roundTrips, &quick.Config{MaxCount: 20}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/julienschmidt/httprouter"
+)
+
+// dashboardRequest is the parameters of GET /v1/dashboard.
+type dashboardRequest struct {
+	From   time.Time
+	To     time.Time
+	Traits map[string]string
+}
+
+// dashboardTotals is the headline numbers of a dashboard.
+type dashboardTotals struct {
+	Events      int64     `db:"events" json:"events"`
+	ActiveUsers int64     `db:"active_users" json:"activeUsers"`
+	Revenue     money.Sum `db:"revenue" json:"revenue"`
+}
+
+// dashboardEventType is how many events of one type there were.
+type dashboardEventType struct {
+	Type   string `db:"type" json:"type"`
+	Events int64  `db:"events" json:"events"`
+	Users  int64  `db:"users" json:"users"`
+}
+
+// dashboardPlatform is how many users were active on one platform.
+type dashboardPlatform struct {
+	Platform    string `db:"platform" json:"platform"`
+	ActiveUsers int64  `db:"active_users" json:"activeUsers"`
+}
+
+// dashboard is the response of GET /v1/dashboard. Parts that didn't finish
+// within the latency budget are left null, and listed in "missing".
+type dashboard struct {
+	partialResult
+
+	Totals     *dashboardTotals     `json:"totals"`
+	EventTypes []dashboardEventType `json:"eventTypes"`
+	Platforms  []dashboardPlatform  `json:"platforms"`
+}
+
+// getDashboard reports everything an overview dashboard shows, in one request:
+// headline totals, a breakdown by event type, and active users by platform.
+//
+// Each of those is a separate query, and on a big events table some are much
+// slower than others. So that a slow breakdown doesn't hold up the rest of the
+// dashboard, the endpoint has a latency budget (see withLatencyBudget). Parts
+// that don't finish in time are left out, and the response is marked
+// incomplete.
+//
+// This lives at GET /v1/dashboard?from=XXX&to=XXX. from and to are RFC3339
+// timestamps, defaulting to the last 7 days. Parameters like trait.plan=pro
+// narrow the dashboard to users with those traits.
+func (s *server) getDashboard(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := s.Clock.Now()
+	p := params{values: r.URL.Query()}
+	req := dashboardRequest{
+		From:   p.time("from", now.AddDate(0, 0, -7)),
+		To:     p.time("to", now),
+		Traits: p.traits(),
+	}
+
+	p.timeRange("from", req.From, "to", req.To)
+	if p.failed(w) {
+		return
+	}
+
+	filter := querybuilder.Filter{From: req.From, To: req.To, Traits: req.Traits}
+
+	var d dashboard
+	var err error
+	d.partialResult, err = runParts(r.Context(),
+		part{Name: "totals", Share: 1, Run: func(ctx context.Context) error {
+			var q querybuilder.Query
+			var totals dashboardTotals
+			err := s.DB.GetContext(ctx, &totals, fmt.Sprintf(`
+				select
+					count(*) as events,
+					count(distinct %s) as active_users,
+					coalesce(sum((payload->>'revenue')::numeric) filter (where %s = 'Order Completed'), 0) as revenue
+				from
+					events_expanded
+				where
+					%s
+			`, querybuilder.UserID, querybuilder.Type, q.Where(filter)), q.Args()...)
+
+			if err != nil {
+				return err
+			}
+
+			d.Totals = &totals
+			return nil
+		}},
+		part{Name: "eventTypes", Share: 1, Run: func(ctx context.Context) error {
+			var q querybuilder.Query
+			eventTypes := []dashboardEventType{}
+			err := s.DB.SelectContext(ctx, &eventTypes, fmt.Sprintf(`
+				select
+					%s as type,
+					count(*) as events,
+					count(distinct %s) as users
+				from
+					events_expanded
+				where
+					%s
+				group by
+					1
+				order by
+					2 desc
+			`, querybuilder.Type, querybuilder.UserID, q.Where(filter)), q.Args()...)
+
+			if err != nil {
+				return err
+			}
+
+			d.EventTypes = eventTypes
+			return nil
+		}},
+
+		// Platforms are the least important part, so they get less time.
+		part{Name: "platforms", Share: 0.5, Run: func(ctx context.Context) error {
+			heartbeats := filter
+			heartbeats.Type = "Heartbeat"
+
+			var q querybuilder.Query
+			platforms := []dashboardPlatform{}
+			err := s.DB.SelectContext(ctx, &platforms, fmt.Sprintf(`
+				select
+					coalesce(payload->>'platform', '') as platform,
+					count(distinct %s) as active_users
+				from
+					events_expanded
+				where
+					%s
+				group by
+					1
+				order by
+					2 desc
+			`, querybuilder.UserID, q.Where(heartbeats)), q.Args()...)
+
+			if err != nil {
+				return err
+			}
+
+			d.Platforms = platforms
+			return nil
+		}},
+	)
+
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, d)
+}
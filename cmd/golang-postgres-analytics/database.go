@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// databaseFlags are the flags shared by every subcommand that connects to
+// postgresql.
+type databaseFlags struct {
+	url    *string
+	schema *string
+}
+
+// addDatabaseFlags adds -database-url and -db-schema to a subcommand's flags.
+func addDatabaseFlags(flags *flag.FlagSet) databaseFlags {
+	return databaseFlags{
+		url:    flags.String("database-url", defaultDatabaseURL, "postgres connection string"),
+		schema: flags.String("db-schema", "", "postgres schema the analytics tables live in (default: the database's search_path)"),
+	}
+}
+
+// URL returns the connection string to use, with -db-schema applied.
+//
+// The schema is applied by setting search_path for every connection. That
+// way, none of the SQL in this program needs to qualify table names itself.
+func (f databaseFlags) URL() string {
+	if *f.schema == "" {
+		return *f.url
+	}
+
+	// Connection strings are either URLs or space-separated key=value pairs.
+	// lib/pq passes parameters it doesn't recognize, like search_path, on to
+	// the server either way.
+	if strings.HasPrefix(*f.url, "postgres://") || strings.HasPrefix(*f.url, "postgresql://") {
+		u, err := url.Parse(*f.url)
+		if err == nil {
+			query := u.Query()
+			query.Set("search_path", *f.schema)
+			u.RawQuery = query.Encode()
+			return u.String()
+		}
+	}
+
+	quoted := strings.Replace(strings.Replace(*f.schema, `\`, `\\`, -1), `'`, `\'`, -1)
+	return *f.url + " search_path='" + quoted + "'"
+}
+
+// open connects to postgresql.
+func (f databaseFlags) open() (*sqlx.DB, error) {
+	return sqlx.Open("postgres", f.URL())
+}
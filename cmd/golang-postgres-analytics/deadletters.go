@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf/jddf-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// deadLetterTimeout is how long recording a dead letter may take.
+const deadLetterTimeout = 10 * time.Second
+
+// deadLetterConcurrency is how many dead letters may be being recorded at once.
+// Beyond that, events are still rejected, but not recorded.
+const deadLetterConcurrency = 16
+
+// maxDeadLetterLimit is the most dead letters GET /v1/dead-letters returns at
+// once.
+const maxDeadLetterLimit = 500
+
+// deadLetters keeps the events the schema rejected in events_dead_letter,
+// with the errors they were rejected for, so that what misbehaving clients
+// send can be looked at after the fact.
+type deadLetters struct {
+	// recorded is how many dead letters were recorded since the server started,
+	// and unrecorded how many weren't, because too many were being recorded at
+	// once, or recording them failed. The counters come first, so that they're
+	// 64-bit aligned for sync/atomic.
+	recorded     int64
+	unrecorded   int64
+	recordErrors int64
+
+	slots chan struct{}
+}
+
+// deadLetter is a rejected event as GET /v1/dead-letters returns it.
+type deadLetter struct {
+	ID         int64           `json:"id" db:"id"`
+	Type       *string         `json:"type" db:"event_type"`
+	ReceivedAt time.Time       `json:"receivedAt" db:"received_at"`
+	Payload    json.RawMessage `json:"payload" db:"payload"`
+	Errors     json.RawMessage `json:"validationErrors" db:"errors"`
+}
+
+func newDeadLetters() *deadLetters {
+	return &deadLetters{slots: make(chan struct{}, deadLetterConcurrency)}
+}
+
+// deadLetterSender is who dead letters sent with ctx are recorded as having
+// been sent by, and so who may see them: "<provider>:<subject>", or "" without
+// credentials.
+func deadLetterSender(ctx context.Context) string {
+	if principal := auth.FromContext(ctx); principal != nil {
+		return principal.Provider + ":" + principal.Subject
+	}
+
+	return ""
+}
+
+// recordDeadLetter records an event the schema rejected, with the errors it
+// was rejected for. It doesn't wait for it to be recorded, so that rejecting
+// events is no slower for it.
+func (s *server) recordDeadLetter(ctx context.Context, buf []byte, eventRaw interface{}, errs []jddf.ValidationError, received time.Time) {
+	d := s.DeadLetters
+	select {
+	case d.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&d.unrecorded, 1)
+		return
+	}
+
+	// Invalid events may not have a type, or not one that's a string.
+	var eventType *string
+	if event, ok := eventRaw.(map[string]interface{}); ok {
+		if t, ok := event[s.EventSchema.Discriminator.Tag].(string); ok {
+			eventType = &t
+		}
+	}
+
+	sender := deadLetterSender(ctx)
+	errsJSON, _ := json.Marshal(errs)
+
+	go func() {
+		defer func() { <-d.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+		defer cancel()
+
+		_, err := s.DB.ExecContext(ctx, `
+			insert into events_dead_letter (sender, event_type, payload, errors, received_at)
+			values ($1, $2, $3, $4, $5)
+		`, sender, eventType, string(buf), string(errsJSON), received)
+
+		if err != nil {
+			atomic.AddInt64(&d.unrecorded, 1)
+			if atomic.AddInt64(&d.recordErrors, 1) == 1 {
+				fmt.Fprintf(os.Stderr, "recording dead letter: %s\n", err)
+			}
+
+			return
+		}
+
+		atomic.AddInt64(&d.recorded, 1)
+	}()
+}
+
+// getDeadLetters pages through the events rejected for not matching the
+// schema, newest first, with the errors they were rejected for. Clients only
+// see the events they sent themselves; those sent without credentials are
+// seen by anyone who doesn't send any either.
+//
+// Each page's "next" cursor fetches the page after it, of older events.
+//
+// This lives at GET /v1/dead-letters?before=XXX&limit=YYY&type=ZZZ&from=AAA&to=BBB.
+func (s *server) getDeadLetters(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.DeadLetters == nil {
+		writeAPIError(w, http.StatusNotFound, "dead_letters_disabled", "this server doesn't keep rejected events; see -dead-letters")
+		return
+	}
+
+	p := params{values: r.URL.Query()}
+	limit := p.int("limit", 100, 1, maxDeadLetterLimit)
+	eventType := p.string("type", "")
+
+	var before int64
+	if cursor := p.string("before", ""); cursor != "" {
+		var err error
+		if before, err = strconv.ParseInt(cursor, 10, 64); err != nil || before <= 0 {
+			p.fail("before", "must be a cursor from a previous page")
+		}
+	}
+
+	now := s.Clock.Now()
+	from := p.time("from", now.Add(-7*24*time.Hour))
+	to := p.time("to", now)
+	p.timeRange("from", from, "to", to)
+
+	if p.failed(w) {
+		return
+	}
+
+	letters := []deadLetter{}
+	err := s.DB.SelectContext(r.Context(), &letters, `
+		select id, event_type, received_at, payload, errors from events_dead_letter
+		where sender = $1
+			and ($2 = 0 or id < $2)
+			and ($3 = '' or event_type = $3)
+			and received_at >= $4 and received_at < $5
+		order by id desc
+		limit $6
+	`, deadLetterSender(r.Context()), before, eventType, from, to, limit)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	page := struct {
+		DeadLetters []deadLetter `json:"deadLetters"`
+		Next        string       `json:"next,omitempty"`
+	}{DeadLetters: letters}
+
+	if len(letters) == limit {
+		page.Next = strconv.FormatInt(letters[len(letters)-1].ID, 10)
+	}
+
+	respondJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+)
+
+// deleteEvents is the "delete-events" subcommand. It removes events matching a
+// filter, which is handy for cleaning up after tests or a bad backfill.
+//
+// By default it only reports how many events would be deleted. Pass -execute
+// to actually delete them. Deletes happen in batches, each in its own
+// statement, so that a large cleanup doesn't hold locks on the whole table or
+// produce one enormous transaction.
+func deleteEvents(args []string) error {
+	flags := flag.NewFlagSet("delete-events", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	eventType := flags.String("type", "", "only delete events of this type")
+	userPrefix := flags.String("user-prefix", "", "only delete events whose userId starts with this")
+	from := flags.String("from", "", "only delete events with a timestamp at or after this (RFC3339)")
+	to := flags.String("to", "", "only delete events with a timestamp before this (RFC3339)")
+	batchSize := flags.Int("batch-size", 1000, "number of events to delete per statement")
+	batchDelay := flags.Duration("batch-delay", 0, "time to wait between batches")
+	execute := flags.Bool("execute", false, "actually delete events, instead of only counting them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter := querybuilder.Filter{Type: *eventType, UserPrefix: *userPrefix}
+
+	var err error
+	if *from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return err
+		}
+	}
+
+	if *to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return err
+		}
+	}
+
+	// Refuse to wipe the entire table. If that's really what you want, "truncate
+	// events" is much faster anyway.
+	if filter.Empty() {
+		return errors.New("refusing to delete without a filter; pass at least one of -type, -user-prefix, -from, or -to")
+	}
+
+	if *batchSize <= 0 {
+		return errors.New("-batch-size must be positive")
+	}
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	ctx := context.Background()
+
+	// Always do a dry-run count first, so the operator knows what they're about
+	// to do (or what they would have done).
+	var countQuery querybuilder.Query
+	countSQL := "select count(*) from events_expanded where " + countQuery.Where(filter)
+
+	var count int64
+	if err := db.GetContext(ctx, &count, countSQL, countQuery.Args()...); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d events match\n", count)
+	if !*execute {
+		fmt.Println("dry run; pass -execute to delete them")
+		return nil
+	}
+
+	var deleteQuery querybuilder.Query
+	deleteSQL := fmt.Sprintf(`
+		delete from events where id in (
+			select id from events_expanded where %s order by id limit %s
+		)
+	`, deleteQuery.Where(filter), deleteQuery.Arg(*batchSize))
+
+	var deleted int64
+	for {
+		result, err := db.ExecContext(ctx, deleteSQL, deleteQuery.Args()...)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		deleted += n
+		fmt.Printf("deleted %d/%d events\n", deleted, count)
+
+		if n < int64(*batchSize) {
+			return nil
+		}
+
+		time.Sleep(*batchDelay)
+	}
+}
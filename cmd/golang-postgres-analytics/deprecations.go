@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/deprecation"
+	"github.com/julienschmidt/httprouter"
+)
+
+// deprecationUse is how often one sender has sent one deprecated type or
+// field, as reported by GET /admin/v1/deprecations. Senders are named as in
+// the ingest profile, like "api-key:ios-app".
+type deprecationUse struct {
+	Sender   string    `json:"sender"`
+	Type     string    `json:"type"`
+	Field    string    `json:"field,omitempty"`
+	Events   int64     `json:"events"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// deprecationUses counts which senders still send deprecated types and
+// fields, since the server started.
+type deprecationUses struct {
+	mu   sync.Mutex
+	uses map[deprecationUse]*deprecationUse
+}
+
+func newDeprecationUses() *deprecationUses {
+	return &deprecationUses{uses: map[deprecationUse]*deprecationUse{}}
+}
+
+// add counts warnings about an event from principal, which may be nil.
+func (du *deprecationUses) add(principal *auth.Principal, warnings []deprecation.Warning, now time.Time) {
+	sender := "anonymous"
+	if principal != nil {
+		sender = principal.Provider + ":" + principal.Subject
+	}
+
+	du.mu.Lock()
+	defer du.mu.Unlock()
+
+	for _, warning := range warnings {
+		key := deprecationUse{Sender: sender, Type: warning.Type, Field: warning.Field}
+		use, ok := du.uses[key]
+		if !ok {
+			use = &deprecationUse{Sender: sender, Type: warning.Type, Field: warning.Field}
+			du.uses[key] = use
+		}
+
+		use.Events++
+		use.LastSeen = now
+	}
+}
+
+// list returns copies of every count, most events first.
+func (du *deprecationUses) list() []deprecationUse {
+	du.mu.Lock()
+	defer du.mu.Unlock()
+
+	out := make([]deprecationUse, 0, len(du.uses))
+	for _, use := range du.uses {
+		out = append(out, *use)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Events != out[j].Events {
+			return out[i].Events > out[j].Events
+		}
+
+		if out[i].Sender != out[j].Sender {
+			return out[i].Sender < out[j].Sender
+		}
+
+		return out[i].Type+"."+out[i].Field < out[j].Type+"."+out[j].Field
+	})
+
+	return out
+}
+
+// countDeprecations counts what's deprecated in an event being ingested
+// against whoever sent it, and returns it.
+func (s *server) countDeprecations(ctx context.Context, eventType string, event map[string]interface{}) []deprecation.Warning {
+	warnings := s.Deprecations.Check(eventType, event)
+	if len(warnings) != 0 {
+		s.DeprecationUses.add(auth.FromContext(ctx), warnings, s.Clock.Now())
+	}
+
+	return warnings
+}
+
+// warnDeprecations adds a Warning header to a response for each deprecated
+// thing in the event it's about, with the 299 code for persistent warnings.
+func warnDeprecations(w http.ResponseWriter, warnings []deprecation.Warning) {
+	for _, warning := range warnings {
+		w.Header().Add("Warning", "299 - "+strconv.Quote(warning.String()))
+	}
+}
+
+// getDeprecations reports which senders still send deprecated types and
+// fields, and how many events they've sent with them since the server
+// started, so that the teams behind them can be told before they're removed.
+//
+// This lives at GET /admin/v1/deprecations.
+func (s *server) getDeprecations(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondJSON(w, http.StatusOK, s.DeprecationUses.list())
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemacheck"
+	"github.com/jmoiron/sqlx"
+)
+
+// requiredTables are the tables schema.sql creates, in the same order, and the
+// columns the server uses from each. Databases created before a column was
+// added need migrating.
+var requiredTables = []struct {
+	Name    string
+	Columns []string
+}{
+	{"event_codecs", []string{"id", "event_type", "codec", "state"}},
+	{"events", []string{"id", "payload", "received_at", "codec_id", "payload_compact"}},
+	{"import_checkpoints", []string{"source", "object_key", "lines", "done"}},
+	{"api_keys", []string{"key", "name", "allowed_types", "denied_types", "secret", "scopes"}},
+	{"feature_flags", []string{"name", "enabled"}},
+	{"forward_checkpoints", []string{"target", "last_id"}},
+	{"ltv_webhooks", []string{"url", "first_purchase", "thresholds", "secret"}},
+	{"users", []string{"user_id", "traits"}},
+}
+
+// minFreeDisk is how much free disk space the doctor wants to see.
+const minFreeDisk = 1 << 30
+
+// maxClockSkew is how far the local clock may be from the database's before
+// the doctor complains. Signed requests are only accepted within
+// signatureTolerance, so skew eats into that.
+const maxClockSkew = 5 * time.Second
+
+// checkResult is the outcome of one of the doctor's checks.
+type checkResult struct {
+	Check  string `json:"check"`
+	Status string `json:"status"` // "ok", "warn", or "fail"
+	Detail string `json:"detail"`
+}
+
+// doctor is the "doctor" subcommand. It checks that everything the server
+// needs is in place -- the database, its tables and permissions, the schema,
+// the clock, disk space, and any webhooks -- and prints a report.
+//
+// It exits non-zero if any check fails, so it can gate a deploy.
+func doctor(args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	checkWebhooks := flags.Bool("check-webhooks", false, "also check that LTV webhooks are reachable")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var report []checkResult
+	add := func(check, status, format string, args ...interface{}) {
+		report = append(report, checkResult{Check: check, Status: status, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	doctorSchema(*schemaPath, add)
+	doctorDisk(add)
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		add("database", "fail", "%s", err)
+	} else {
+		add("database", "ok", "connected")
+		doctorTables(ctx, db, add)
+		doctorClock(ctx, db, add)
+		if *checkWebhooks {
+			doctorWebhooks(ctx, db, add)
+		}
+	}
+
+	failed := 0
+	for _, result := range report {
+		if result.Status == "fail" {
+			failed++
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		for _, result := range report {
+			fmt.Printf("%-4s  %-28s  %s\n", result.Status, result.Check, result.Detail)
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+
+	return nil
+}
+
+// doctorSchema checks that the event schema is valid, and that its limits make
+// sense.
+func doctorSchema(path string, add func(check, status, format string, args ...interface{})) {
+	raw, err := readJSONFile(path)
+	if err != nil {
+		add("schema", "fail", "%s", err)
+		return
+	}
+
+	findings := schemacheck.Lint(raw)
+	for _, finding := range findings {
+		add("schema", "fail", "%s", finding)
+	}
+
+	_, err = loadSchema(path)
+	if err == nil {
+		_, err = loadLimits(path)
+	}
+
+	if err != nil {
+		add("schema", "fail", "%s", err)
+	} else if len(findings) == 0 {
+		add("schema", "ok", "%s is valid", path)
+	}
+}
+
+// doctorTables checks that every table exists, with every column, and that the
+// database user may do what the server needs to with them.
+func doctorTables(ctx context.Context, db *sqlx.DB, add func(check, status, format string, args ...interface{})) {
+	for _, required := range requiredTables {
+		table := required.Name
+		var columns []string
+		err := db.SelectContext(ctx, &columns, `
+			select column_name from information_schema.columns
+			where table_schema = current_schema() and table_name = $1
+		`, table)
+
+		if err != nil {
+			add("table "+table, "fail", "%s", err)
+			continue
+		}
+
+		if len(columns) == 0 {
+			add("table "+table, "fail", "missing; see schema.sql")
+			continue
+		}
+
+		present := map[string]bool{}
+		for _, column := range columns {
+			present[column] = true
+		}
+
+		missing := []string{}
+		for _, column := range required.Columns {
+			if !present[column] {
+				missing = append(missing, column)
+			}
+		}
+
+		if len(missing) != 0 {
+			add("table "+table, "fail", "missing columns %v; see schema.sql", missing)
+			continue
+		}
+
+		var privileges struct {
+			Select bool `db:"can_select"`
+			Insert bool `db:"can_insert"`
+			Update bool `db:"can_update"`
+			Delete bool `db:"can_delete"`
+			Index  bool `db:"has_pkey"`
+		}
+
+		err = db.GetContext(ctx, &privileges, `
+			select
+				has_table_privilege($1, 'select') as can_select,
+				has_table_privilege($1, 'insert') as can_insert,
+				has_table_privilege($1, 'update') as can_update,
+				has_table_privilege($1, 'delete') as can_delete,
+				exists (
+					select 1 from pg_index where indrelid = $1::regclass and indisprimary
+				) as has_pkey
+		`, table)
+
+		switch {
+		case err != nil:
+			add("table "+table, "fail", "%s", err)
+		case !privileges.Select || !privileges.Insert || !privileges.Update || !privileges.Delete:
+			add("table "+table, "fail", "the database user needs select, insert, update, and delete on it")
+		case !privileges.Index:
+			add("table "+table, "warn", "has no primary key index")
+		default:
+			add("table "+table, "ok", "present, with permissions")
+		}
+	}
+
+	// Analytics read events through events_expanded, which expands events
+	// stored by a codec in SQL.
+	var canSelect bool
+	err := db.GetContext(ctx, &canSelect, `select has_table_privilege('events_expanded', 'select')`)
+	switch {
+	case err != nil:
+		add("view events_expanded", "fail", "%s; see schema.sql", err)
+	case !canSelect:
+		add("view events_expanded", "fail", "the database user needs select on it")
+	default:
+		add("view events_expanded", "ok", "present, with permissions")
+	}
+}
+
+// doctorClock checks that the local clock agrees with the database's.
+func doctorClock(ctx context.Context, db *sqlx.DB, add func(check, status, format string, args ...interface{})) {
+	before := time.Now()
+	var dbNow time.Time
+	if err := db.GetContext(ctx, &dbNow, `select now()`); err != nil {
+		add("clock", "fail", "%s", err)
+		return
+	}
+
+	// Assume the database read its clock halfway through the round trip.
+	after := time.Now()
+	local := before.Add(after.Sub(before) / 2)
+	skew := local.Sub(dbNow)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	if skew > maxClockSkew {
+		add("clock", "warn", "local clock is %s off from the database's", skew)
+	} else {
+		add("clock", "ok", "within %s of the database's", skew.Round(time.Millisecond))
+	}
+}
+
+// doctorWebhooks checks that the hosts of LTV webhooks can be connected to.
+// It doesn't send them anything.
+func doctorWebhooks(ctx context.Context, db *sqlx.DB, add func(check, status, format string, args ...interface{})) {
+	var urls []string
+	if err := db.SelectContext(ctx, &urls, `select url from ltv_webhooks`); err != nil {
+		add("webhooks", "fail", "%s", err)
+		return
+	}
+
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			add("webhook "+raw, "fail", "%s", err)
+			continue
+		}
+
+		host := u.Host
+		if u.Port() == "" {
+			port := "443"
+			if u.Scheme == "http" {
+				port = "80"
+			}
+
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+
+		conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+		if err != nil {
+			add("webhook "+raw, "warn", "unreachable: %s", err)
+			continue
+		}
+
+		conn.Close()
+		add("webhook "+raw, "ok", "reachable")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// doctorDisk checks that there's free disk space in the working directory.
+func doctorDisk(add func(check, status, format string, args ...interface{})) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(".", &stat); err != nil {
+		add("disk", "warn", "%s", err)
+		return
+	}
+
+	free := stat.Bavail * uint64(stat.Bsize)
+	if free < minFreeDisk {
+		add("disk", "warn", "only %d MiB free", free>>20)
+	} else {
+		add("disk", "ok", "%d MiB free", free>>20)
+	}
+}
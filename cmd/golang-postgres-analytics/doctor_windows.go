@@ -0,0 +1,6 @@
+package main
+
+// doctorDisk would check free disk space, but isn't implemented on Windows.
+func doctorDisk(add func(check, status, format string, args ...interface{})) {
+	add("disk", "warn", "free disk space can't be checked on Windows")
+}
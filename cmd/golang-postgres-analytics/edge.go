@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/deprecation"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxEdgeBody is the largest batch POST /v1/ingest/edge accepts, in bytes.
+const maxEdgeBody = 16 << 20
+
+// maxEdgeEvents is the most events a batch from an edge collector may have.
+const maxEdgeEvents = 1000
+
+// edgeBatch is the body of POST /v1/ingest/edge.
+type edgeBatch struct {
+	Events []edgeEvent `json:"events"`
+}
+
+// edgeEvent is an event as an edge collector relays it: the event its client
+// sent, along with who that client was.
+type edgeEvent struct {
+	// Tenant is the tenant the client belongs to.
+	Tenant string `json:"tenant"`
+
+	// ClientIP and UserAgent are the client's address and User-Agent, as the
+	// collector saw them.
+	ClientIP  string `json:"clientIp"`
+	UserAgent string `json:"userAgent"`
+
+	Event json.RawMessage `json:"event"`
+}
+
+// edgeClient is the client an edge collector relayed an event from.
+type edgeClient struct {
+	IP        string
+	UserAgent string
+}
+
+type edgeClientKey struct{}
+
+// withEdgeClient returns a copy of ctx carrying the client an event was
+// relayed from.
+func withEdgeClient(ctx context.Context, client edgeClient) context.Context {
+	return context.WithValue(ctx, edgeClientKey{}, client)
+}
+
+// edgeClientFrom returns the client an event being ingested with ctx was
+// relayed from by an edge collector, if it was.
+func edgeClientFrom(ctx context.Context) (edgeClient, bool) {
+	client, ok := ctx.Value(edgeClientKey{}).(edgeClient)
+	return client, ok
+}
+
+// ingestEdge stores a batch of events relayed by an edge collector: a proxy
+// that takes events from clients close to them, and sends them on here.
+//
+// Collectors authenticate with credentials that have the "collector" scope,
+// and are trusted to say who each event came from. So each event is ingested
+// as if its client had sent it: it counts against the client's rate limit,
+// by IP address, rather than the collector's, carries its tenant in
+// auth.FromContext, and its address and User-Agent in edgeClientFrom. The
+// collector's own restrictions on what types of events it may send still
+// apply.
+//
+// Like the NDJSON and CSV imports, a bad event doesn't stop the rest: the
+// response reports how many events were stored, and what was wrong with each
+// rejected one, with "row" as its position in the batch, from 1. Events
+// rejected for the server's own reasons, like a full write buffer, can be
+// sent again.
+//
+// This lives at POST /v1/ingest/edge.
+func (s *server) ingestEdge(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	collector := auth.FromContext(r.Context())
+	if collector == nil {
+		writeAPIError(w, http.StatusUnauthorized, "auth_required", "edge collectors must authenticate")
+		return
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEdgeBody+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if len(buf) > maxEdgeBody {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("a batch may be at most %d bytes", maxEdgeBody))
+		return
+	}
+
+	var batch edgeBatch
+	if err := json.Unmarshal(buf, &batch); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "batch_invalid", err.Error())
+		return
+	}
+
+	if len(batch.Events) > maxEdgeEvents {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "batch_too_large", fmt.Sprintf("a batch may have at most %d events", maxEdgeEvents))
+		return
+	}
+
+	report := importReport{Errors: []importRowError{}}
+	for i, e := range batch.Events {
+		row := i + 1
+		warnings, err := s.ingestEdgeEvent(r, collector, e)
+		if err != nil {
+			report.Rejected++
+			if err, ok := err.(*ingestError); ok && err.ValidationErrors != nil {
+				report.Errors = append(report.Errors, importRowError{Row: row, ValidationErrors: err.ValidationErrors})
+			} else {
+				report.Errors = append(report.Errors, importRowError{Row: row, Message: err.Error()})
+			}
+
+			continue
+		}
+
+		report.Inserted++
+		report.warn(row, warnings)
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+// ingestEdgeEvent ingests one event from an edge collector's batch, on behalf
+// of the client that sent it, and returns what's deprecated in it.
+func (s *server) ingestEdgeEvent(r *http.Request, collector *auth.Principal, e edgeEvent) ([]deprecation.Warning, error) {
+	if e.Tenant == "" {
+		return nil, &ingestError{Status: http.StatusBadRequest, Code: "tenant_required", Message: "tenant is required"}
+	}
+
+	if net.ParseIP(e.ClientIP) == nil {
+		return nil, &ingestError{Status: http.StatusBadRequest, Code: "client_ip_invalid", Message: "clientIp must be an IP address"}
+	}
+
+	principal := *collector
+	principal.Tenant = e.Tenant
+	ctx := auth.NewContext(r.Context(), &principal)
+	ctx = withEdgeClient(ctx, edgeClient{IP: e.ClientIP, UserAgent: e.UserAgent})
+
+	if s.RateLimit != nil {
+		if ok, wait := s.RateLimit.Allow(rateLimitKey(r.WithContext(ctx))); !ok {
+			return nil, &ingestError{Status: http.StatusTooManyRequests, Code: "rate_limited", Message: fmt.Sprintf("%s is sending too many events; retry in %s", e.ClientIP, wait.Round(time.Millisecond))}
+		}
+	}
+
+	var eventRaw interface{}
+	if err := json.Unmarshal(e.Event, &eventRaw); err != nil || eventRaw == nil {
+		return nil, &ingestError{Status: http.StatusBadRequest, Code: "event_invalid", Message: "event must be a JSON object"}
+	}
+
+	event, _ := eventRaw.(map[string]interface{})
+	eventType, _ := event[s.EventSchema.Discriminator.Tag].(string)
+	if _, _, err := s.ingestEvent(ctx, e.Event, eventRaw); err != nil {
+		return nil, err
+	}
+
+	return s.Deprecations.Check(eventType, event), nil
+}
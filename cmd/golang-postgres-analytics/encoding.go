@@ -0,0 +1,59 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxEventBody is the most a single event's body may decompress to. The
+// schema's limits are far smaller; this just stops a small, highly compressed
+// body from being inflated into memory without bound.
+const maxEventBody = 1 << 20
+
+// withContentEncoding wraps an endpoint, so that it sees request bodies
+// decompressed, whatever Content-Encoding they were sent with: "gzip",
+// "deflate", or none at all.
+//
+// Bodies are decompressed as they're read, so streams stay streams. Signatures
+// are checked before this, against the body as it was sent, so it goes inside
+// withAuth.
+//
+// zstd isn't supported, since the standard library has no decoder for it.
+// Bodies in any encoding other than these are rejected with a 415.
+func (s *server) withContentEncoding(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var body io.ReadCloser
+		var err error
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+			h(w, r, p)
+			return
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(r.Body)
+		case "deflate":
+			body, err = zlib.NewReader(r.Body)
+		default:
+			writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_encoding", fmt.Sprintf("Content-Encoding %q isn't supported; use gzip or deflate", encoding))
+			return
+		}
+
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_encoding", fmt.Sprintf("decompressing request body: %s", err))
+			return
+		}
+
+		defer r.Body.Close()
+		defer body.Close()
+
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		h(w, r, p)
+	}
+}
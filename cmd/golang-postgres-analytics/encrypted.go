@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf/jddf-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxEncryptedEventBytes is the largest encrypted event accepted. The schema's
+// size limits can't apply, because the server can't see inside the ciphertext.
+const maxEncryptedEventBytes = 64 << 10
+
+// encryptedEventSchema returns the schema of encrypted events: the cleartext
+// metadata the server can see and validate, and the ciphertext it can't.
+//
+// type must be one of the types in eventSchema. The user's ID is only sent as
+// a SHA-256 hash, so that users can be counted without being identified.
+func encryptedEventSchema(eventSchema jddf.Schema) jddf.Schema {
+	types := make([]string, 0, len(eventSchema.Discriminator.Mapping))
+	for eventType := range eventSchema.Discriminator.Mapping {
+		types = append(types, eventType)
+	}
+
+	sort.Strings(types)
+	return jddf.Schema{
+		RequiredProperties: map[string]jddf.Schema{
+			"type":       {Enum: types},
+			"userIdHash": {Type: jddf.TypeString},
+			"timestamp":  {Type: jddf.TypeTimestamp},
+			"ciphertext": {Type: jddf.TypeString},
+		},
+		OptionalProperties: map[string]jddf.Schema{
+			"keyId": {Type: jddf.TypeString},
+		},
+	}
+}
+
+// createEncryptedEvent stores an event whose contents are encrypted end to
+// end, so only the client and whoever holds the key can read them.
+//
+// Alongside the ciphertext, the client sends, in the clear, the event's type
+// and timestamp, and a hash of the user's ID. Only that metadata is validated;
+// the ciphertext is stored as-is. So encrypted events still count towards
+// anything that only needs the metadata, like event counts per type, but
+// nothing that needs their contents, like LTVs.
+//
+// Encrypted events are always stored in Postgres, whatever routes.json says,
+// because other sinks may not expect them.
+//
+// This lives at POST /v1/events/encrypted.
+func (s *server) createEncryptedEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEncryptedEventBytes+1))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if len(buf) > maxEncryptedEventBytes {
+		writeAPIError(w, http.StatusBadRequest, "event_limit_exceeded", fmt.Sprintf("encrypted events may be at most %d bytes", maxEncryptedEventBytes))
+		return
+	}
+
+	var eventRaw interface{}
+	if err := json.Unmarshal(buf, &eventRaw); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	validator := jddf.Validator{}
+	validationResult, _ := validator.Validate(s.EncryptedEventSchema, eventRaw)
+	if len(validationResult.Errors) != 0 {
+		respondJSON(w, http.StatusBadRequest, validationResult.Errors)
+		return
+	}
+
+	// The schema can't check these are well-formed, but a hash that isn't a
+	// hash, or ciphertext that isn't base64, is a bug in the client worth
+	// catching early.
+	event := eventRaw.(map[string]interface{})
+	if hash, err := hex.DecodeString(event["userIdHash"].(string)); err != nil || len(hash) != 32 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_user_id_hash", "userIdHash must be a hex-encoded SHA-256 hash")
+		return
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(event["ciphertext"].(string)); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_ciphertext", "ciphertext must be base64-encoded")
+		return
+	}
+
+	eventType := event["type"].(string)
+	if principal := auth.FromContext(r.Context()); principal != nil && !principal.Allows(eventType) {
+		writeAPIError(w, http.StatusForbidden, "event_type_forbidden", fmt.Sprintf("%s may not send %q events", principal.Subject, eventType))
+		return
+	}
+
+	if err := s.checkSigned(r.Context(), eventType); err != nil {
+		writeAPIError(w, err.Status, err.Code, err.Message)
+		return
+	}
+
+	id := s.newEventID()
+	if err := s.insertSpooledEvent(r.Context(), buf, id, s.Clock.Now()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if id != "" {
+		w.Header().Set("X-Event-Id", id)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/dbtimeout"
+)
+
+// apiError is an error response with a machine-readable code, for errors that
+// clients are expected to handle programmatically rather than just log.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// Params lists the query parameters that were invalid, if that's the
+	// problem.
+	Params []paramError `json:"params,omitempty"`
+}
+
+// writeAPIError sends an apiError to the client.
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	respondJSON(w, status, apiError{Code: code, Message: message})
+}
+
+// writeAPIErrorWithParams sends an apiError about invalid query parameters.
+func writeAPIErrorWithParams(w http.ResponseWriter, status int, code, message string, params []paramError) {
+	respondJSON(w, status, apiError{Code: code, Message: message, Params: params})
+}
+
+// writeQueryError responds to a query that failed. If it ran out of time, and
+// Postgres cancelled it, that's a 504 with a query_timeout code, so that clients
+// can tell it apart from the query being wrong. Anything else is a 500, with
+// an internal_error code.
+func writeQueryError(w http.ResponseWriter, err error) {
+	if dbtimeout.IsTimeout(err) {
+		writeAPIError(w, http.StatusGatewayTimeout, "query_timeout", "the query took too long, and was cancelled; try asking for less")
+		return
+	}
+
+	writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+}
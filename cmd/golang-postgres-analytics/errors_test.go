@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/adapter"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+	"github.com/jddf/jddf-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// testKeys authenticates requests by their X-API-Key header, without a
+// database.
+type testKeys map[string]*auth.Principal
+
+func (k testKeys) Authenticate(r *http.Request) (*auth.Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, auth.ErrNoCredentials
+	}
+
+	principal, ok := k[key]
+	if !ok {
+		return nil, &auth.Error{Status: http.StatusUnauthorized, Code: "invalid_api_key", Message: "unknown API key"}
+	}
+
+	return principal, nil
+}
+
+// newErrorTestServer returns a server for requests that fail before they
+// need a database, wired up like main does.
+func newErrorTestServer(t *testing.T) http.Handler {
+	t.Helper()
+
+	schema, err := loadSchema("../../event.jddf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventLimits, err := loadLimits("../../event.jddf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{
+		EventSchema:       schema,
+		TypeCounts:        newTypeCounts(schema),
+		Limits:            eventLimits,
+		SignedTypes:       map[string]bool{"Order Completed": true},
+		IdempotencyWindow: time.Hour,
+		Adapters:          map[string]adapter.Adapter{"shop": &adapter.Mapping{}, "stripe": &adapter.Stripe{Secret: "whsec_test"}},
+		Clock:             clock.NewFake(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)),
+		Auth: testKeys{
+			"web":    {Provider: "api-key", Subject: "web", DeniedTypes: []string{"Heartbeat"}},
+			"reader": {Provider: "api-key", Subject: "reader", Scopes: []string{"read"}},
+			"edge":   {Provider: "api-key", Subject: "edge", Scopes: []string{"collector"}},
+			"signed": {Provider: "api-key", Subject: "signed", Signed: true},
+		},
+	}
+
+	router := httprouter.New()
+	router.POST("/v1/events", s.withAuth(s.withScope("ingest", s.createEvent)))
+	router.GET("/v1/ltv", s.withAuth(s.withScope("read", s.getLTV)))
+	router.POST("/v1/adapters/:name", s.adaptEvent)
+	router.POST("/v1/import/csv", s.withAuth(s.withScope("ingest", s.importCSV)))
+	router.GET("/admin/v1/types", s.withAdmin(s.getTypes))
+	return router
+}
+
+func TestErrorResponses(t *testing.T) {
+	h := newErrorTestServer(t)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		headers map[string]string
+
+		status int
+
+		// The response is an apiError with code, if it's set, or validation
+		// errors, if validation is.
+		code       string
+		validation bool
+	}{
+		{
+			name:   "invalid JSON",
+			method: "POST", path: "/v1/events", body: `{"type": "Heartbeat",`,
+			status: http.StatusBadRequest, code: "invalid_json",
+		},
+		{
+			name:   "too large",
+			method: "POST", path: "/v1/events", body: strings.Repeat(" ", maxEventBody+1),
+			status: http.StatusRequestEntityTooLarge, code: "body_too_large",
+		},
+		{
+			name:   "unknown type",
+			method: "POST", path: "/v1/events", body: `{"type": "Signed Up"}`,
+			status: http.StatusBadRequest, validation: true,
+		},
+		{
+			name:   "invalid event",
+			method: "POST", path: "/v1/events", body: `{"type": "Heartbeat", "userId": 1}`,
+			status: http.StatusBadRequest, validation: true,
+		},
+		{
+			name:   "over limits",
+			method: "POST", path: "/v1/events", body: `{"type": "Heartbeat", "userId": "` + strings.Repeat("a", 300) + `", "timestamp": "2020-01-01T12:00:00Z"}`,
+			status: http.StatusBadRequest, code: "event_limit_exceeded",
+		},
+		{
+			name:   "from the future",
+			method: "POST", path: "/v1/events", body: `{"type": "Heartbeat", "userId": "alice", "timestamp": "2020-01-03T12:00:00Z"}`,
+			status: http.StatusBadRequest, code: "event_limit_exceeded",
+		},
+		{
+			name:   "revenue that isn't a decimal",
+			method: "POST", path: "/v1/events", body: `{"type": "Order Completed", "userId": "alice", "timestamp": "2020-01-01T12:00:00Z", "revenue": "1e3"}`,
+			headers: map[string]string{"X-API-Key": "signed"},
+			status:  http.StatusBadRequest, code: "invalid_decimal",
+		},
+		{
+			name:   "forbidden type",
+			method: "POST", path: "/v1/events", body: `{"type": "Heartbeat", "userId": "alice", "timestamp": "2020-01-01T12:00:00Z"}`,
+			headers: map[string]string{"X-API-Key": "web"},
+			status:  http.StatusForbidden, code: "event_type_forbidden",
+		},
+		{
+			name:   "unsigned",
+			method: "POST", path: "/v1/events", body: `{"type": "Order Completed", "userId": "alice", "timestamp": "2020-01-01T12:00:00Z", "revenue": "9.99"}`,
+			status: http.StatusForbidden, code: "signature_required",
+		},
+		{
+			name:   "long idempotency key",
+			method: "POST", path: "/v1/events", body: `{"type": "Heartbeat", "userId": "alice", "timestamp": "2020-01-01T12:00:00Z"}`,
+			headers: map[string]string{"Idempotency-Key": strings.Repeat("k", maxIdempotencyKey+1)},
+			status:  http.StatusBadRequest, code: "invalid_idempotency_key",
+		},
+		{
+			name:   "unknown key",
+			method: "POST", path: "/v1/events", body: `{}`,
+			headers: map[string]string{"X-API-Key": "nope"},
+			status:  http.StatusUnauthorized, code: "invalid_api_key",
+		},
+		{
+			name:   "missing scope",
+			method: "POST", path: "/v1/events", body: `{}`,
+			headers: map[string]string{"X-API-Key": "reader"},
+			status:  http.StatusForbidden, code: "scope_required",
+		},
+		{
+			name:   "collector sending events",
+			method: "POST", path: "/v1/events", body: `{}`,
+			headers: map[string]string{"X-API-Key": "edge"},
+			status:  http.StatusForbidden, code: "scope_required",
+		},
+		{
+			name:   "reading without credentials",
+			method: "GET", path: "/v1/ltv",
+			status: http.StatusUnauthorized, code: "auth_required",
+		},
+		{
+			name:   "invalid parameters",
+			method: "GET", path: "/v1/ltv",
+			headers: map[string]string{"X-API-Key": "reader"},
+			status:  http.StatusBadRequest, code: "invalid_parameters",
+		},
+		{
+			name:   "unknown adapter",
+			method: "POST", path: "/v1/adapters/nope", body: `{}`,
+			status: http.StatusNotFound, code: "unknown_adapter",
+		},
+		{
+			name:   "webhook that isn't JSON",
+			method: "POST", path: "/v1/adapters/shop", body: `{`,
+			headers: map[string]string{"X-API-Key": "web"},
+			status:  http.StatusBadRequest, code: "invalid_webhook",
+		},
+		{
+			name:   "Stripe webhook without a signature",
+			method: "POST", path: "/v1/adapters/stripe", body: `{}`,
+			status: http.StatusUnauthorized, code: "invalid_signature",
+		},
+		{
+			name:   "CSV import without a mapping",
+			method: "POST", path: "/v1/import/csv", body: "customer,amount\n",
+			status: http.StatusBadRequest, code: "invalid_import",
+		},
+		{
+			name:   "adapter without credentials",
+			method: "POST", path: "/v1/adapters/shop", body: `{}`,
+			status: http.StatusUnauthorized, code: "auth_required",
+		},
+		{
+			name:   "admin without credentials",
+			method: "GET", path: "/admin/v1/types",
+			status: http.StatusUnauthorized, code: "auth_required",
+		},
+		{
+			name:   "admin without scope",
+			method: "GET", path: "/admin/v1/types",
+			headers: map[string]string{"X-API-Key": "reader"},
+			status:  http.StatusForbidden, code: "scope_required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d; body: %s", w.Code, tt.status, w.Body)
+			}
+
+			switch {
+			case tt.code != "":
+				var body apiError
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("body isn't an apiError: %s: %s", err, w.Body)
+				}
+
+				if body.Code != tt.code || body.Message == "" {
+					t.Errorf("body = %+v, want code %q and a message", body, tt.code)
+				}
+
+				if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+					t.Errorf("Content-Type = %q", ct)
+				}
+			case tt.validation:
+				var body []jddf.ValidationError
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body) == 0 {
+					t.Errorf("body isn't validation errors: %v: %s", err, w.Body)
+				}
+			}
+		})
+	}
+}
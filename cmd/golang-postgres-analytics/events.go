@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/eventid"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxListLimit is the most events GET /admin/v1/events returns at once.
+const maxListLimit = 1000
+
+// listEventsRequest is the parameters of GET /admin/v1/events.
+type listEventsRequest struct {
+	// After is the ID of the event to list from, not including it.
+	After string
+	Limit int
+
+	// Type, if set, lists only events of that type, and Predicates only events
+	// whose fields satisfy them.
+	Type       string
+	Predicates []querybuilder.Predicate
+}
+
+// listedEvent is an event as returned by GET /admin/v1/events.
+type listedEvent struct {
+	ID         string          `json:"id" db:"event_id"`
+	ReceivedAt time.Time       `json:"receivedAt" db:"received_at"`
+	Payload    json.RawMessage `json:"payload" db:"payload"`
+
+	// Events stored by a codec are expanded back into Payload.
+	CodecID sql.NullInt64 `json:"-" db:"codec_id"`
+	Compact []byte        `json:"-" db:"payload_compact"`
+}
+
+// listEvents pages through events in the order of their IDs, which is the
+// order they were received in. Only events given an ID (see -event-ids) are
+// listed.
+//
+// Each page's "next" cursor fetches the page after it. Events that arrive
+// while paging show up on later pages, without disturbing the earlier ones.
+//
+// Events can be narrowed to a type, and by filters on their fields, like
+// filter=revenue:gte:10. Filters are checked against the schema: fields must
+// exist, in events of the type if there is one, and the comparison and value
+// must suit their types. Events stored by a codec are read through
+// events_expanded, so they can be filtered on like any other.
+//
+// This lives at GET /admin/v1/events?after=XXX&limit=YYY&type=ZZZ&filter=AAA.
+func (s *server) listEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	p := params{values: r.URL.Query()}
+	req := listEventsRequest{Limit: p.int("limit", 100, 1, maxListLimit)}
+	if cursor := p.string("after", ""); cursor != "" {
+		var err error
+		if req.After, err = eventid.ParseCursor(cursor); err != nil {
+			p.fail("after", "must be a cursor from a previous page")
+		}
+	}
+
+	req.Type = p.string("type", "")
+	if req.Type != "" {
+		if _, ok := s.EventSchema.Discriminator.Mapping[req.Type]; !ok {
+			p.fail("type", "must be a type of event in the schema")
+		}
+	}
+
+	for _, expr := range p.values["filter"] {
+		predicate, err := querybuilder.ParsePredicate(s.EventSchema, s.EventSchemaMeta, req.Type, expr)
+		if err != nil {
+			p.fail("filter", "%s", err)
+			continue
+		}
+
+		req.Predicates = append(req.Predicates, predicate)
+	}
+
+	if p.failed(w) {
+		return
+	}
+
+	var q querybuilder.Query
+	where := q.Where(querybuilder.Filter{Predicates: req.Predicates})
+	if req.Type != "" {
+		where += fmt.Sprintf(" and payload->>%s = %s", q.Arg(s.EventSchema.Discriminator.Tag), q.Arg(req.Type))
+	}
+
+	events := []listedEvent{}
+	err := s.DB.SelectContext(r.Context(), &events, fmt.Sprintf(`
+		select event_id, received_at, payload from events_expanded
+		where event_id > %s and %s
+		order by event_id
+		limit %s
+	`, q.Arg(req.After), where, q.Arg(req.Limit)), q.Args()...)
+
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	page := struct {
+		Events []listedEvent `json:"events"`
+		Next   string        `json:"next,omitempty"`
+	}{Events: events}
+
+	// The cursor doesn't carry the type or filters: they're passed again with
+	// it for the next page.
+	if len(events) == req.Limit {
+		page.Next = eventid.Cursor(events[len(events)-1].ID)
+	}
+
+	respondJSON(w, http.StatusOK, page)
+}
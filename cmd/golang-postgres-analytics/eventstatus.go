@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+)
+
+// maxStatusIDs is the most events GET /v1/events/status can be asked about at
+// once.
+const maxStatusIDs = 100
+
+// maxStatusWait is the longest GET /v1/events/status will wait for events to
+// be committed.
+const maxStatusWait = 30 * time.Second
+
+// statusPollInterval is how often GET /v1/events/status checks the database
+// while it waits. Events this instance is writing wake it up sooner, but other
+// instances' don't.
+const statusPollInterval = time.Second
+
+// The statuses GET /v1/events/status reports for each event.
+const (
+	// The event is in the database.
+	eventCommitted = "committed"
+
+	// The event was accepted by this instance, and is waiting to be written.
+	eventPending = "pending"
+
+	// The event isn't in the database, and isn't waiting to be written here.
+	// It may be waiting on another instance, or it may never have been
+	// accepted, or it may have been lost.
+	eventUnknown = "unknown"
+)
+
+// eventStatuses is the response of GET /v1/events/status.
+type eventStatuses struct {
+	Statuses map[string]string `json:"statuses"`
+}
+
+// getEventStatus reports whether events accepted with a 202 have been
+// committed. Clients can hold on to events until they're confirmed, and
+// resend any that come back "unknown". Resending with the same
+// Idempotency-Key keeps an event that was committed after all from being
+// stored twice.
+//
+// With wait, the request is held until every event is committed, or until
+// that long has passed, whichever is first. That spares clients polling.
+//
+// This lives at GET /v1/events/status?ids=XXX,YYY&wait=10s
+func (s *server) getEventStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.EventIDs == nil {
+		writeAPIError(w, http.StatusNotFound, "event_ids_disabled", "this server doesn't give events IDs; see -event-ids")
+		return
+	}
+
+	p := params{values: r.URL.Query()}
+	var ids []string
+	for _, value := range p.values["ids"] {
+		for _, id := range strings.Split(value, ",") {
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		p.fail("ids", "is required")
+	} else if len(ids) > maxStatusIDs {
+		p.fail("ids", "must list at most %d events", maxStatusIDs)
+	}
+
+	wait := p.duration("wait", 0, maxStatusWait)
+	if p.failed(w) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	statuses := eventStatuses{Statuses: map[string]string{}}
+	for {
+		// Waiting on the writer first means events it writes while the database
+		// is being checked aren't missed.
+		var flushed <-chan struct{}
+		if s.Writer != nil {
+			flushed = s.Writer.flushedChan()
+		}
+
+		var committed []string
+		err := s.DB.SelectContext(r.Context(), &committed, `
+			select event_id from events where event_id = any($1)
+		`, pq.Array(ids))
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+
+		for _, id := range ids {
+			statuses.Statuses[id] = eventUnknown
+			if s.Writer != nil && s.Writer.isPending(id) || s.Pipeline != nil && s.Pipeline.Pending(id) {
+				statuses.Statuses[id] = eventPending
+			}
+		}
+
+		for _, id := range committed {
+			statuses.Statuses[id] = eventCommitted
+		}
+
+		if len(committed) == len(statuses.Statuses) {
+			break
+		}
+
+		poll := time.NewTimer(statusPollInterval)
+		select {
+		case <-flushed:
+		case <-poll.C:
+		case <-ctx.Done():
+		}
+
+		poll.Stop()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	respondJSON(w, http.StatusOK, statuses)
+}
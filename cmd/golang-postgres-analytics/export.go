@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/julienschmidt/httprouter"
+)
+
+// exportFlushEvery is how many events are exported between flushes of the
+// response, so that clients see progress on long exports.
+const exportFlushEvery = 1000
+
+// exportRequest is the parameters of GET /v1/events/export.
+type exportRequest struct {
+	Filter querybuilder.Filter
+
+	// After and Until are the range of event ids to export: those after After,
+	// up to and including Until. They come from a resume token, if there is
+	// one.
+	After int64
+	Until int64
+}
+
+// exportedEvent is a line of an export.
+type exportedEvent struct {
+	ID         int64           `json:"id"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Payload    json.RawMessage `json:"payload"`
+
+	// Resume is a token that continues the export after this event.
+	Resume string `json:"resume"`
+}
+
+// exportEvents streams every matching event, as newline-delimited JSON, in the
+// order they were stored.
+//
+// An export covers the events stored when it started: later ones are left for
+// the next export. So that a long export can be picked up where it left off if
+// the connection drops, each line has a resume token. Passing the token of the
+// last line received, along with the same filters, exports the rest of the
+// same range.
+//
+// Events are read with a single query, which lib/pq streams rather than
+// buffering, so memory use doesn't grow with the size of the export. (lib/pq
+// doesn't support COPY TO STDOUT, only COPY FROM STDIN.)
+//
+// Exports need the "read" and "export" scopes.
+//
+// This lives at GET /v1/events/export?type=XXX&userId=XXX&from=XXX&to=XXX&resume=XXX.
+// Every parameter is optional. Parameters like trait.plan=pro only export
+// events from users with those traits.
+func (s *server) exportEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	principal := auth.FromContext(r.Context())
+	if principal == nil || !principal.HasScope("export") {
+		writeAPIError(w, http.StatusForbidden, "scope_required", "exporting events requires the \"export\" scope")
+		return
+	}
+
+	p := params{values: r.URL.Query()}
+	req := exportRequest{Filter: querybuilder.Filter{
+		Type:   p.string("type", ""),
+		UserID: p.optionalUserID("userId"),
+		From:   p.time("from", time.Time{}),
+		To:     p.time("to", time.Time{}),
+		Traits: p.traits(),
+	}}
+
+	if resume := p.string("resume", ""); resume != "" {
+		var err error
+		if req.After, req.Until, err = parseExportToken(resume); err != nil {
+			p.fail("resume", "must be a resume token from a previous export")
+		}
+	}
+
+	if p.failed(w) {
+		return
+	}
+
+	if req.Until == 0 {
+		if err := s.DB.GetContext(r.Context(), &req.Until, `select coalesce(max(id), 0) from events`); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+	}
+
+	var q querybuilder.Query
+	rows, err := s.DB.QueryxContext(r.Context(), fmt.Sprintf(`
+		select id, received_at, payload from events_expanded
+		where id > %s and id <= %s and %s
+		order by id
+	`, q.Arg(req.After), q.Arg(req.Until), q.Where(req.Filter)), q.Args()...)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	flusher, _ := w.(http.Flusher)
+
+	for n := 1; rows.Next(); n++ {
+		var e exportedEvent
+		if err = rows.Scan(&e.ID, &e.ReceivedAt, &e.Payload); err != nil {
+			break
+		}
+
+		e.Resume = exportToken(e.ID, req.Until)
+		if err = encoder.Encode(e); err != nil {
+			return // the client has gone away
+		}
+
+		if n%exportFlushEvery == 0 && flusher != nil {
+			out.Flush()
+			flusher.Flush()
+		}
+	}
+
+	if err == nil {
+		err = rows.Err()
+	}
+
+	// It's too late to change the status, so an error is reported as the last
+	// line. The client can resume from the line before it.
+	if err != nil {
+		encoder.Encode(apiError{Code: "export_failed", Message: err.Error()})
+	}
+
+	out.Flush()
+}
+
+// exportToken returns a resume token for the events after the one with id
+// after, up to and including until.
+func exportToken(after, until int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d-%d", after, until)))
+}
+
+// parseExportToken returns the range of a resume token made by exportToken.
+func parseExportToken(token string) (after, until int64, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := fmt.Sscanf(string(buf), "%d-%d", &after, &until); err != nil {
+		return 0, 0, err
+	}
+
+	if after < 0 || until < after {
+		return 0, 0, fmt.Errorf("invalid export range %d-%d", after, until)
+	}
+
+	return after, until, nil
+}
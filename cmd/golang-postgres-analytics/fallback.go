@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/spool"
+	"github.com/lib/pq"
+)
+
+// fallbackDrainInterval is how often events held while the database was
+// unavailable are tried again.
+const fallbackDrainInterval = 5 * time.Second
+
+// fallback holds events that couldn't be stored because the database was
+// unavailable, on disk, until it's back.
+//
+// Unlike the server's spool, which every event passes through on its way to
+// the database, this is a backlog: events go in when inserting them fails,
+// and are stored in bulk later, by drainFallback. They keep the ID and time
+// received the client was told, so an event stored late is no different from
+// one stored right away.
+type fallback struct {
+	// held is how many events have been held since the server started, and
+	// drained how many were stored from the fallback. The counters come first,
+	// so that they're 64-bit aligned for sync/atomic.
+	held    int64
+	drained int64
+
+	spool *spool.Spool
+}
+
+// heldEvent is an event in the fallback, as it's spooled.
+type heldEvent struct {
+	ID         string          `json:"id,omitempty"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Event      json.RawMessage `json:"event"`
+}
+
+// openFallback opens the fallback in dir. Events left in it by a previous
+// process are drained along with new ones.
+func openFallback(dir string) (*fallback, error) {
+	sp, err := spool.Open(dir, spool.DefaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fallback{spool: sp}, nil
+}
+
+// hold durably writes an event to the fallback.
+func (f *fallback) hold(buf []byte, id string, received time.Time) error {
+	record, err := json.Marshal(heldEvent{ID: id, ReceivedAt: received, Event: buf})
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.spool.Append(record); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&f.held, 1)
+	return nil
+}
+
+// shouldHold is whether an event that failed to insert with err should be held
+// for later, rather than failed: the database wasn't available, rather than
+// objecting to the event, and the client didn't go away.
+func shouldHold(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !isDataError(err)
+}
+
+// drainFallback stores the events held in the fallback every
+// fallbackDrainInterval, until ctx is done.
+func (s *server) drainFallback(ctx context.Context) {
+	ticker := time.NewTicker(fallbackDrainInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.drainFallbackOnce(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "draining fallback: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainFallbackOnce stores every event held in the fallback so far, oldest
+// first. It stops at the first event that can't be stored for want of the
+// database, to carry on from next time.
+//
+// Events in a segment that was partly drained are stored again when it's
+// carried on with. Those that have IDs are recognized as already stored, and
+// skipped; others are stored twice.
+func (s *server) drainFallbackOnce(ctx context.Context) error {
+	if err := s.Fallback.spool.Seal(); err != nil {
+		return err
+	}
+
+	_, err := s.Fallback.spool.Replay(func(record []byte) error {
+		var held heldEvent
+		if err := json.Unmarshal(record, &held); err != nil {
+			fmt.Fprintf(os.Stderr, "dropping unreadable fallback record: %s\n", err)
+			return nil
+		}
+
+		err := s.insertEvent(ctx, held.Event, held.ID, held.ReceivedAt)
+		if err != nil && !isDataError(err) {
+			return err
+		}
+
+		var pqErr *pq.Error
+		if err != nil && !(errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation") {
+			fmt.Fprintf(os.Stderr, "dropping fallback event %s: %s\n", held.Event, err)
+		}
+
+		atomic.AddInt64(&s.Fallback.drained, 1)
+		return nil
+	})
+
+	return err
+}
@@ -0,0 +1,122 @@
+//go:build faults
+// +build faults
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/faults"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/routing"
+	"github.com/julienschmidt/httprouter"
+)
+
+// faultInjector makes the database and sinks misbehave, as admins ask it to
+// with PUT /admin/v1/faults. It only exists in builds with the "faults" tag,
+// which are for integration tests and staging:
+//
+//	go build -tags faults ./cmd/golang-postgres-analytics
+var faultInjector = &faults.Injector{}
+
+// faultSettings is the body of the fault injection endpoints.
+type faultSettings struct {
+	DBLatency        string             `json:"dbLatency"`
+	DBFailureRate    float64            `json:"dbFailureRate"`
+	SinkFailureRates map[string]float64 `json:"sinkFailureRates"`
+}
+
+// injectDBFaults wraps the database's connector with faultInjector.
+func injectDBFaults(c driver.Connector) driver.Connector {
+	return faultInjector.Connector(c)
+}
+
+// injectSinkFaults wraps every sink routes sends to with faultInjector.
+func injectSinkFaults(routes *routing.Router) {
+	routes.WrapSinks(faultInjector.Sink)
+}
+
+// routeFaults adds the fault injection endpoints to router.
+func routeFaults(router *httprouter.Router, s *server) {
+	fmt.Fprintf(os.Stderr, "fault injection is enabled; this build is not for production\n")
+
+	router.GET("/admin/v1/faults", s.withAdmin(s.getFaults))
+	router.PUT("/admin/v1/faults", s.withAdmin(s.putFaults))
+	router.DELETE("/admin/v1/faults", s.withAdmin(s.deleteFaults))
+}
+
+// getFaults reports the faults being injected.
+//
+// This lives at GET /admin/v1/faults.
+func (s *server) getFaults(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	settings := faultInjector.Settings()
+	body := faultSettings{
+		DBLatency:        settings.DBLatency.String(),
+		DBFailureRate:    settings.DBFailureRate,
+		SinkFailureRates: settings.SinkFailureRates,
+	}
+
+	if body.SinkFailureRates == nil {
+		body.SinkFailureRates = map[string]float64{}
+	}
+
+	respondJSON(w, http.StatusOK, body)
+}
+
+// putFaults replaces the faults being injected, with a body like:
+//
+//	{"dbLatency": "200ms", "dbFailureRate": 0.1, "sinkFailureRates": {"clickhouse": 1}}
+//
+// Anything left out isn't injected.
+//
+// This lives at PUT /admin/v1/faults.
+func (s *server) putFaults(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	var body faultSettings
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	settings := faults.Settings{DBFailureRate: body.DBFailureRate, SinkFailureRates: body.SinkFailureRates}
+	if body.DBLatency != "" {
+		latency, err := time.ParseDuration(body.DBLatency)
+		if err != nil || latency < 0 {
+			writeAPIError(w, http.StatusBadRequest, "faults_invalid", "dbLatency must be a duration, like 200ms")
+			return
+		}
+
+		settings.DBLatency = latency
+	}
+
+	rates := []float64{body.DBFailureRate}
+	for _, rate := range body.SinkFailureRates {
+		rates = append(rates, rate)
+	}
+
+	for _, rate := range rates {
+		if rate < 0 || rate > 1 {
+			writeAPIError(w, http.StatusBadRequest, "faults_invalid", "failure rates must be from 0 to 1")
+			return
+		}
+	}
+
+	faultInjector.Set(settings)
+	fmt.Fprintf(os.Stderr, "injecting faults: dbLatency=%s dbFailureRate=%g sinkFailureRates=%v\n", settings.DBLatency, settings.DBFailureRate, settings.SinkFailureRates)
+	s.getFaults(w, r, p)
+}
+
+// deleteFaults stops injecting faults.
+//
+// This lives at DELETE /admin/v1/faults.
+func (s *server) deleteFaults(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	faultInjector.Set(faults.Settings{})
+	fmt.Fprintf(os.Stderr, "no longer injecting faults\n")
+	s.getFaults(w, r, p)
+}
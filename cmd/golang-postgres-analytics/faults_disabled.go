@@ -0,0 +1,22 @@
+//go:build !faults
+// +build !faults
+
+package main
+
+import (
+	"database/sql/driver"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/routing"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Fault injection is left out of builds without the "faults" tag, so that
+// production servers can't be made to fail on purpose. See faults.go.
+
+func injectDBFaults(c driver.Connector) driver.Connector {
+	return c
+}
+
+func injectSinkFaults(routes *routing.Router) {}
+
+func routeFaults(router *httprouter.Router, s *server) {}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// featureDefaults are the feature flags the server knows about, and whether
+// they're on unless configured otherwise. Features that were around before
+// flags were are on by default; new, riskier ones should start off.
+var featureDefaults = map[string]bool{
+	"csv-import":       true,
+	"webhook-adapters": true,
+}
+
+// withFeature wraps an endpoint so that it only exists while a feature flag is
+// on. While the flag is off, the endpoint responds as if it weren't there.
+func (s *server) withFeature(name string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !s.Features.Enabled(name) {
+			writeAPIError(w, http.StatusNotFound, "feature_disabled", "this endpoint is turned off by the "+name+" feature flag")
+			return
+		}
+
+		h(w, r, p)
+	}
+}
+
+// getFeatures reports the state of every feature flag.
+//
+// This lives at GET /admin/v1/features.
+func (s *server) getFeatures(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondJSON(w, http.StatusOK, s.Features.All())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxFields is the most fields a request may ask for.
+const maxFields = 50
+
+// withFields lets clients ask for only some fields of a JSON response, with a
+// fields parameter like ?fields=userId,timestamp,revenue, so that dashboards
+// on phones don't download what they don't show.
+//
+// The response's top-level fields, like "next" cursors, are always kept. Below
+// them, objects keep only the fields asked for, wherever they are, and the
+// objects and arrays leading to them. So on GET /admin/v1/events,
+// fields=userId,revenue keeps each event's payload, with only those two fields
+// in it. Errors are sent as they are.
+//
+// It goes inside withMsgpack, so that what's converted to MessagePack has
+// already been trimmed.
+func (s *server) withFields(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		p := params{values: r.URL.Query()}
+		fields := p.fields("fields")
+		if p.failed(w) {
+			return
+		}
+
+		if fields == nil {
+			h(w, r, ps)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+		h(rec, r, ps)
+
+		body := rec.body.Bytes()
+		mediaType, _, _ := mime.ParseMediaType(rec.header.Get("Content-Type"))
+		if mediaType == "application/json" && rec.status/100 == 2 {
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+
+			var v interface{}
+			err := decoder.Decode(&v)
+			if err == nil {
+				body, err = json.Marshal(selectTopLevelFields(v, fields))
+			}
+
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+
+			body = append(body, '\n')
+			rec.header.Del("Content-Length")
+		}
+
+		for name, values := range rec.header {
+			w.Header()[name] = values
+		}
+
+		w.WriteHeader(rec.status)
+		w.Write(body)
+	}
+}
+
+// fields parses a comma-separated list of field names. It returns nil if the
+// parameter isn't there.
+func (p *params) fields(name string) map[string]bool {
+	value, ok := p.values[name]
+	if !ok {
+		return nil
+	}
+
+	fields := map[string]bool{}
+	for _, field := range strings.Split(strings.Join(value, ","), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			p.fail(name, "must be a comma-separated list of field names")
+			return nil
+		}
+
+		fields[field] = true
+	}
+
+	if len(fields) > maxFields {
+		p.fail(name, "may have at most %d fields", maxFields)
+	}
+
+	return fields
+}
+
+// selectTopLevelFields trims v to fields, keeping every field of it if it's
+// an object. Arrays at the top level are trimmed element by element.
+func selectTopLevelFields(v interface{}, fields map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if !fields[k] {
+				v[k], _ = selectFields(value, fields)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i], _ = selectFields(value, fields)
+		}
+	}
+
+	return v
+}
+
+// selectFields trims v to fields, and returns whether anything's left of it.
+// Objects keep the fields named, and any others which are objects or arrays
+// with something left in them. Elements of arrays that aren't objects are
+// kept as they are.
+func selectFields(v interface{}, fields map[string]bool) (interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if fields[k] {
+				continue
+			}
+
+			if value, ok := selectFields(value, fields); ok {
+				v[k] = value
+			} else {
+				delete(v, k)
+			}
+		}
+
+		return v, len(v) != 0
+	case []interface{}:
+		kept := false
+		for i, value := range v {
+			var ok bool
+			v[i], ok = selectFields(value, fields)
+			kept = kept || ok
+		}
+
+		return v, kept
+	}
+
+	return v, false
+}
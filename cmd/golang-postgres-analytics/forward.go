@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/envelope"
+	"github.com/jmoiron/sqlx"
+)
+
+// forward is the "forward" subcommand. It replicates this instance's events to
+// another instance, for multi-region deployments.
+//
+// It tails the events table in id order, sends new events to the remote
+// instance's POST /v1/forwarded endpoint, and records how far it's gotten in the
+// forward_checkpoints table. So it can be stopped and restarted at will. Events
+// are delivered at least once: if the remote stores a batch but the response is
+// lost, the batch is sent again.
+//
+// Ids are handed out before the transactions that insert events commit, so an
+// event can show up with a lower id than one already forwarded. To make that
+// unlikely, events are only forwarded once they're -settle old.
+func forward(args []string) error {
+	flags := flag.NewFlagSet("forward", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	batchSize := flags.Int("batch-size", 1000, "number of events to send per request")
+	pollInterval := flags.Duration("poll-interval", time.Second, "how long to wait for new events once caught up")
+	settle := flags.Duration("settle", 10*time.Second, "how old events must be before they're forwarded")
+	backfillSince := flags.String("backfill-since", "", "rewind to the first event received at or after this time (RFC3339), and forward everything from there")
+	metricsAddr := flags.String("metrics-addr", "", "address to serve lag metrics on, like :9100")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: forward [flags] https://remote.example.com")
+	}
+
+	target := strings.TrimSuffix(flags.Arg(0), "/")
+	apiKey := os.Getenv("FORWARD_API_KEY")
+	if apiKey == "" {
+		return errors.New("FORWARD_API_KEY must be set to an API key with the \"forward\" scope on the remote instance")
+	}
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	ctx := context.Background()
+	f := forwarder{db: db, codecs: newCodecs(db, "", nil), target: target, apiKey: apiKey}
+
+	if *backfillSince != "" {
+		since, err := time.Parse(time.RFC3339, *backfillSince)
+		if err != nil {
+			return err
+		}
+
+		if err := f.rewind(ctx, since); err != nil {
+			return err
+		}
+	}
+
+	if *metricsAddr != "" {
+		go http.ListenAndServe(*metricsAddr, http.HandlerFunc(f.serveMetrics))
+	}
+
+	for {
+		n, err := f.forwardBatch(ctx, *batchSize, *settle)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("forwarded %d events; %d behind, %s lag\n", n, atomic.LoadInt64(&f.lagEvents), time.Duration(atomic.LoadInt64(&f.lagNanos)))
+		if n < *batchSize {
+			time.Sleep(*pollInterval)
+		}
+	}
+}
+
+// forwarder holds the state of a run of the "forward" subcommand.
+type forwarder struct {
+	// These are read by serveMetrics, concurrently. They come first to keep them
+	// 64-bit aligned, as sync/atomic requires.
+	forwarded int64
+	lagEvents int64
+	lagNanos  int64
+
+	db     *sqlx.DB
+	codecs *codecs
+	target string
+	apiKey string
+}
+
+// forwardedEvent is an event, as read for forwarding.
+type forwardedEvent struct {
+	ID         int64     `db:"id"`
+	Type       string    `db:"type"`
+	Payload    []byte    `db:"payload"`
+	ReceivedAt time.Time `db:"received_at"`
+
+	CodecID sql.NullInt64 `db:"codec_id"`
+	Compact []byte        `db:"payload_compact"`
+}
+
+// checkpoint returns the id of the last event forwarded to the target.
+func (f *forwarder) checkpoint(ctx context.Context) (int64, error) {
+	var lastID int64
+	err := f.db.GetContext(ctx, &lastID, `
+		select last_id from forward_checkpoints where target = $1
+	`, f.target)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return lastID, err
+}
+
+// rewind moves the checkpoint back (or forward) to just before the first event
+// received at or after since.
+func (f *forwarder) rewind(ctx context.Context, since time.Time) error {
+	_, err := f.db.ExecContext(ctx, `
+		insert into forward_checkpoints (target, last_id)
+		values ($1, coalesce(
+			(select min(id) - 1 from events where received_at >= $2),
+			(select coalesce(max(id), 0) from events)
+		))
+		on conflict (target) do update set last_id = excluded.last_id, updated_at = now()
+	`, f.target, since)
+
+	return err
+}
+
+// forwardBatch forwards up to batchSize events after the checkpoint, and moves
+// the checkpoint past them. It returns how many events it forwarded.
+func (f *forwarder) forwardBatch(ctx context.Context, batchSize int, settle time.Duration) (int, error) {
+	lastID, err := f.checkpoint(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var events []forwardedEvent
+	err = f.db.SelectContext(ctx, &events, `
+		select
+			id,
+			coalesce(payload->>'type', (select event_type from event_codecs where event_codecs.id = events.codec_id)) as type,
+			payload,
+			received_at,
+			codec_id,
+			payload_compact
+		from events
+		where id > $1 and received_at < now() - make_interval(secs => $2)
+		order by id
+		limit $3
+	`, lastID, settle.Seconds(), batchSize)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i, e := range events {
+		if events[i].Payload, err = f.codecs.expand(ctx, e.Payload, e.CodecID, e.Compact); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(events) != 0 {
+		if err := f.send(ctx, events); err != nil {
+			return 0, err
+		}
+
+		lastID = events[len(events)-1].ID
+		_, err = f.db.ExecContext(ctx, `
+			insert into forward_checkpoints (target, last_id) values ($1, $2)
+			on conflict (target) do update set last_id = excluded.last_id, updated_at = now()
+		`, f.target, lastID)
+
+		if err != nil {
+			return 0, err
+		}
+
+		atomic.AddInt64(&f.forwarded, int64(len(events)))
+	}
+
+	return len(events), f.measureLag(ctx, lastID)
+}
+
+// measureLag works out how far behind the forwarder is, in events and in time,
+// once it's forwarded everything up to lastID.
+func (f *forwarder) measureLag(ctx context.Context, lastID int64) error {
+	var lag struct {
+		Events int64           `db:"events"`
+		Oldest sql.NullFloat64 `db:"oldest"`
+	}
+
+	err := f.db.GetContext(ctx, &lag, `
+		select
+			count(*) as events,
+			extract(epoch from now() - min(received_at)) as oldest
+		from
+			events
+		where
+			id > $1
+	`, lastID)
+
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&f.lagEvents, lag.Events)
+	atomic.StoreInt64(&f.lagNanos, int64(lag.Oldest.Float64*float64(time.Second)))
+	return nil
+}
+
+// send posts a batch of events to the target as envelopes, retrying with
+// exponential backoff for as long as the target is unavailable.
+//
+// Errors that retrying won't fix, like a bad API key, are returned right away.
+func (f *forwarder) send(ctx context.Context, events []forwardedEvent) error {
+	var body bytes.Buffer
+	w := envelope.NewWriter(&body)
+	for _, e := range events {
+		if err := w.Write(envelope.Envelope{Type: e.Type, ReceivedAt: e.ReceivedAt, Body: e.Payload}); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for {
+		err := f.post(ctx, body.Bytes())
+		if err == nil {
+			return nil
+		}
+
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "forwarding to %s: %s; retrying in %s\n", f.target, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// permanentError is an error sending to the target that retrying won't fix.
+type permanentError struct {
+	error
+}
+
+// post makes one attempt to post a batch of envelopes to the target.
+func (f *forwarder) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", f.target+"/v1/forwarded", bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+
+	req.Header.Set("Content-Type", envelope.ContentType)
+	req.Header.Set("X-API-Key", f.apiKey)
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	message, _ := ioutil.ReadAll(res.Body)
+	err = fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(message))
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+
+	return permanentError{err}
+}
+
+// serveMetrics reports the forwarder's progress and lag, in the Prometheus text
+// format.
+func (f *forwarder) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP analytics_forwarder_events_total Events forwarded since the forwarder started.\n")
+	fmt.Fprintf(w, "# TYPE analytics_forwarder_events_total counter\n")
+	fmt.Fprintf(w, "analytics_forwarder_events_total %d\n", atomic.LoadInt64(&f.forwarded))
+	fmt.Fprintf(w, "# HELP analytics_forwarder_lag_events Events not yet forwarded.\n")
+	fmt.Fprintf(w, "# TYPE analytics_forwarder_lag_events gauge\n")
+	fmt.Fprintf(w, "analytics_forwarder_lag_events %d\n", atomic.LoadInt64(&f.lagEvents))
+	fmt.Fprintf(w, "# HELP analytics_forwarder_lag_seconds Age of the oldest event not yet forwarded.\n")
+	fmt.Fprintf(w, "# TYPE analytics_forwarder_lag_seconds gauge\n")
+	fmt.Fprintf(w, "analytics_forwarder_lag_seconds %f\n", time.Duration(atomic.LoadInt64(&f.lagNanos)).Seconds())
+}
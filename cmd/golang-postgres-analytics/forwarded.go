@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/envelope"
+	"github.com/julienschmidt/httprouter"
+)
+
+// receiveForwarded stores events forwarded from another analytics instance, as
+// a stream of binary envelopes (see package envelope).
+//
+// The instance that first received these events already validated them, so
+// they're stored as-is. That makes this endpoint powerful: only clients with
+// the "forward" scope may use it. Event type restrictions still apply, though;
+// those only need the type in each envelope's header.
+//
+// Either every event in the request is stored, or, if any is rejected, none
+// are.
+//
+// This lives at POST /v1/forwarded.
+func (s *server) receiveForwarded(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	principal := auth.FromContext(r.Context())
+	if principal == nil || !principal.HasScope("forward") {
+		writeAPIError(w, http.StatusForbidden, "scope_required", "forwarding events requires the \"forward\" scope")
+		return
+	}
+
+	if r.Header.Get("Content-Type") != envelope.ContentType {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_content_type", "the body must be of type "+envelope.ContentType)
+		return
+	}
+
+	var envelopes []envelope.Envelope
+	reader := envelope.NewReader(r.Body)
+	for {
+		e, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_envelope", err.Error())
+			return
+		}
+
+		if !principal.Allows(e.Type) {
+			writeAPIError(w, http.StatusForbidden, "event_type_forbidden", fmt.Sprintf("%s may not send %q events", principal.Subject, e.Type))
+			return
+		}
+
+		envelopes = append(envelopes, e)
+	}
+
+	// copyEnvelopes inserts everything in one transaction, so the request
+	// succeeds or fails as a whole.
+	if err := copyEnvelopes(r.Context(), s.DB, envelopes); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]int{"inserted": len(envelopes)})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// freshnessSample is how many of the most recently inserted events are looked
+// at to find the latest received_at. Events forwarded from other regions keep
+// the time they were first received, so the very last row isn't always the
+// latest, but one of the last few is.
+const freshnessSample = 1000
+
+// freshnessBackend is how up to date one place events are queried from is.
+type freshnessBackend struct {
+	Name string `json:"name"`
+
+	// AsOf is the time the backend's data is known to be complete up to, or
+	// null if it has none.
+	AsOf *time.Time `json:"asOf"`
+
+	// LagSeconds estimates how long after an event is received it can be
+	// queried from the backend.
+	LagSeconds float64 `json:"lagSeconds"`
+}
+
+// freshness is the response of GET /v1/freshness.
+type freshness struct {
+	Now time.Time `json:"now"`
+
+	// LatestReceivedAt is when the most recently stored event was received, or
+	// null if there are no events.
+	LatestReceivedAt *time.Time `json:"latestReceivedAt"`
+
+	// Watermark is the end of the last hour whose aggregates are final. Hours
+	// before it won't change any more, except for events that arrive later
+	// than -finalize-after; see GET /admin/v1/lateness for how often that is.
+	Watermark time.Time `json:"watermark"`
+
+	Backends []freshnessBackend `json:"backends"`
+}
+
+// getFreshness reports how up to date the data behind the other endpoints is,
+// so that dashboards can honestly say what their numbers are "as of".
+//
+// There are two backends. Postgres answers every endpoint but /v1/realtime,
+// and an event is in it as soon as POST /v1/events responds. The hot cache
+// answers /v1/realtime, and has this instance's events straight away, but
+// other instances' only once it's next reconciled.
+//
+// This lives at GET /v1/freshness.
+func (s *server) getFreshness(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := s.Clock.Now()
+	report := freshness{
+		Now:       now,
+		Watermark: now.Add(-s.Lateness.FinalizeAfter).Truncate(time.Hour),
+	}
+
+	var latest sql.NullTime
+	err := s.DB.GetContext(r.Context(), &latest, fmt.Sprintf(`
+		select max(received_at) from (select received_at from events order by id desc limit %d) latest
+	`, freshnessSample))
+
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	if latest.Valid {
+		report.LatestReceivedAt = &latest.Time
+	}
+
+	report.Backends = append(report.Backends, freshnessBackend{Name: "postgres", AsOf: report.LatestReceivedAt})
+
+	if s.Hot != nil {
+		backend := freshnessBackend{Name: "hotcache"}
+		if reconciledAt := s.Hot.ReconciledAt(); !reconciledAt.IsZero() {
+			backend.AsOf = &reconciledAt
+			backend.LagSeconds = now.Sub(reconciledAt).Seconds()
+		}
+
+		report.Backends = append(report.Backends, backend)
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/grpcapi"
+	"github.com/julienschmidt/httprouter"
+)
+
+// grpcBackend stores events sent over gRPC, exactly the way POST /v1/events
+// stores them.
+type grpcBackend struct {
+	s *server
+}
+
+// CreateEvent implements grpcapi.Backend.
+func (b grpcBackend) CreateEvent(ctx context.Context, buf []byte) (string, error) {
+	if len(buf) > maxEventBody {
+		return "", &grpcapi.Error{Code: grpcapi.InvalidArgument, Message: fmt.Sprintf("an event may be at most %d bytes", maxEventBody)}
+	}
+
+	var eventRaw interface{}
+	if err := json.Unmarshal(buf, &eventRaw); err != nil {
+		return "", &grpcapi.Error{Code: grpcapi.InvalidArgument, Message: err.Error()}
+	}
+
+	id, _, err := b.s.ingestEvent(ctx, buf, eventRaw)
+	if err, ok := err.(*ingestError); ok {
+		code := grpcapi.InvalidArgument
+		if err.Status == http.StatusForbidden {
+			code = grpcapi.PermissionDenied
+		}
+
+		return "", &grpcapi.Error{Code: code, Message: err.Message}
+	}
+
+	return id, err
+}
+
+// grpcHandler serves the gRPC ingestion service. It goes through the same
+// middleware as POST /v1/events, which answers in plain HTTP statuses when
+// it rejects a request; gRPC clients turn those into status codes, like
+// UNAUTHENTICATED for a 401.
+func (s *server) grpcHandler() http.Handler {
+	service := &grpcapi.Server{Backend: grpcBackend{s: s}}
+	handle := s.withIngest(s.withPriority("normal", s.withAuth(s.withScope("ingest", s.withRateLimit(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		service.ServeHTTP(w, r)
+	})))))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle(w, r, nil)
+	})
+}
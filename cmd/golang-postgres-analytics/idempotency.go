@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+)
+
+// maxIdempotencyKey is the longest Idempotency-Key accepted. UUIDs, which is
+// what clients usually send, are 36 characters.
+const maxIdempotencyKey = 255
+
+// idempotencyAbandonAfter is how long a key may be claimed by a request that
+// hasn't finished before it's assumed the request never will, like if the
+// server died handling it, and the key can be claimed again.
+const idempotencyAbandonAfter = time.Minute
+
+// idempotencyKey is an Idempotency-Key a request was sent with, claimed by this
+// request until it's completed or released.
+//
+// Keys are scoped to whoever sent them, so that two clients that happen to
+// pick the same key don't see each other's events. sum is the SHA-256 of the
+// event, to tell a retry from a different event reusing a key.
+type idempotencyKey struct {
+	scope string
+	key   string
+	sum   []byte
+}
+
+// idempotentResult is what became of the first request sent with a key.
+type idempotentResult struct {
+	EventID  sql.NullString `db:"event_id"`
+	Received time.Time      `db:"received_at"`
+}
+
+// claimIdempotencyKey claims the request's Idempotency-Key, if it has one, for
+// an event whose JSON is buf.
+//
+// If the key was already used for the same event, and that request completed,
+// claimIdempotencyKey returns what it stored, to respond with again instead of
+// storing the event twice. If the key is in use by a request still in flight,
+// or was used for a different event, it returns an *ingestError. Keys are only
+// remembered for s.IdempotencyWindow; after that, they're free to be claimed
+// again.
+//
+// Otherwise, it returns the claimed key, to be completed or released once the
+// event is stored or not. It returns neither if there's no key, or the server
+// doesn't remember keys.
+func (s *server) claimIdempotencyKey(ctx context.Context, r *http.Request, buf []byte) (*idempotencyKey, *idempotentResult, error) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || s.IdempotencyWindow == 0 {
+		return nil, nil, nil
+	}
+
+	if len(key) > maxIdempotencyKey {
+		return nil, nil, &ingestError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_idempotency_key",
+			Message: fmt.Sprintf("Idempotency-Key must be at most %d bytes", maxIdempotencyKey),
+		}
+	}
+
+	sum := sha256.Sum256(buf)
+	k := &idempotencyKey{key: key, sum: sum[:]}
+	if principal := auth.FromContext(ctx); principal != nil {
+		k.scope = principal.Provider + ":" + principal.Subject
+	}
+
+	// A key that's never been seen, was last seen before the window, or was
+	// abandoned is claimed by inserting it, or by taking over the old row.
+	// Either way, only one request can win.
+	now := s.Clock.Now()
+	res, err := s.DB.ExecContext(ctx, `
+		insert into idempotency_keys (scope, key, request_sha256, created_at)
+		values ($1, $2, $3, $4)
+		on conflict (scope, key) do update set
+			request_sha256 = excluded.request_sha256,
+			created_at = excluded.created_at,
+			completed = false,
+			event_id = null,
+			received_at = null
+		where idempotency_keys.created_at < $5
+			or (not idempotency_keys.completed and idempotency_keys.created_at < $6)
+	`, k.scope, k.key, k.sum, now, now.Add(-s.IdempotencyWindow), now.Add(-idempotencyAbandonAfter))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, nil, err
+	} else if n == 1 {
+		return k, nil, nil
+	}
+
+	var prior struct {
+		idempotentResult
+		Sum       []byte `db:"request_sha256"`
+		Completed bool   `db:"completed"`
+	}
+
+	err = s.DB.GetContext(ctx, &prior, `
+		select request_sha256, completed, event_id, coalesce(received_at, created_at) as received_at
+		from idempotency_keys
+		where scope = $1 and key = $2
+	`, k.scope, k.key)
+
+	// The key may have been released between the insert and now, if the
+	// request holding it failed. It's simplest to have the client retry.
+	if err == sql.ErrNoRows {
+		return nil, nil, &ingestError{
+			Status:  http.StatusConflict,
+			Code:    "idempotency_key_in_use",
+			Message: "a request with this Idempotency-Key is still being handled; retry it shortly",
+		}
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(prior.Sum, k.sum) {
+		return nil, nil, &ingestError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "idempotency_key_reused",
+			Message: "this Idempotency-Key was already used for a different event",
+		}
+	}
+
+	if !prior.Completed {
+		return nil, nil, &ingestError{
+			Status:  http.StatusConflict,
+			Code:    "idempotency_key_in_use",
+			Message: "a request with this Idempotency-Key is still being handled; retry it shortly",
+		}
+	}
+
+	return nil, &prior.idempotentResult, nil
+}
+
+// completeIdempotencyKey records that the event k was claimed for was stored,
+// with the given ID (which may be empty) and time. Retries with the key are
+// answered with those from now on.
+//
+// This happens even if the client has gone away: it's most likely to retry
+// exactly then.
+func (s *server) completeIdempotencyKey(k *idempotencyKey, id string, received time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), idempotencyAbandonAfter)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, `
+		update idempotency_keys
+		set completed = true, event_id = nullif($3, ''), received_at = $4
+		where scope = $1 and key = $2
+	`, k.scope, k.key, id, received)
+
+	return err
+}
+
+// releaseIdempotencyKey gives up a key whose event wasn't stored, so that the
+// client can retry with it. Errors are ignored: at worst, retries are told the
+// key is in use until it's abandoned.
+func (s *server) releaseIdempotencyKey(k *idempotencyKey) {
+	ctx, cancel := context.WithTimeout(context.Background(), idempotencyAbandonAfter)
+	defer cancel()
+
+	s.DB.ExecContext(ctx, `
+		delete from idempotency_keys
+		where scope = $1 and key = $2 and not completed
+	`, k.scope, k.key)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/csvimport"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/deprecation"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/limits"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/routing"
+	"github.com/jddf/jddf-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// importBatchSize is how many rows of a CSV import are inserted at a time.
+const importBatchSize = 1000
+
+// maxImportErrors is how many row errors an import reports back. Past that,
+// rows with errors are still counted, but not described.
+const maxImportErrors = 1000
+
+// importRowError describes why a row of an import was rejected. Either Message
+// or ValidationErrors is set, depending on whether the row couldn't be turned
+// into an event at all, or was turned into an invalid event.
+type importRowError struct {
+	Row              int                    `json:"row"`
+	Message          string                 `json:"message,omitempty"`
+	ValidationErrors []jddf.ValidationError `json:"validationErrors,omitempty"`
+}
+
+// importRowWarning is something deprecated in a row that was inserted anyway.
+type importRowWarning struct {
+	Row int `json:"row"`
+	deprecation.Warning
+}
+
+// importReport is what the CSV import endpoint responds with. Endpoints that
+// take batches of events also report Warnings.
+type importReport struct {
+	Inserted int                `json:"inserted"`
+	Rejected int                `json:"rejected"`
+	Errors   []importRowError   `json:"errors"`
+	Warnings []importRowWarning `json:"warnings,omitempty"`
+}
+
+// warn adds warnings about row to the report.
+func (report *importReport) warn(row int, warnings []deprecation.Warning) {
+	for _, warning := range warnings {
+		report.Warnings = append(report.Warnings, importRowWarning{Row: row, Warning: warning})
+	}
+}
+
+// importCSV bulk-imports events from a CSV file. It's bound to POST
+// /v1/import/csv.
+//
+// The mapping from CSV columns to event fields is a JSON object, like
+// {"user_id": "userId"}. It's either passed in the "mapping" query parameter,
+// or the request is a multipart form with a "mapping" part followed by a "file"
+// part. If no column holds the event type, pass it in the "type" query
+// parameter.
+//
+// The file is streamed, rather than read into memory, so it can be as large as
+// you like. Valid rows are inserted, and invalid ones are reported back; one bad
+// row doesn't stop the rest of the import. Like a stream of NDJSON, rows go
+// through the rest of what ingestEvent does too, except for the shadow, the hot
+// cache and LTV notifications; see createEventStream.
+func (s *server) importCSV(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+
+	file, mapping, err := importSource(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_import", err.Error())
+		return
+	}
+
+	reader, err := csvimport.NewReader(file, s.EventSchema, mapping, r.URL.Query().Get("type"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_import", err.Error())
+		return
+	}
+
+	report := importReport{Errors: []importRowError{}}
+	reject := func(rowErr importRowError) {
+		report.Rejected++
+		if len(report.Errors) < maxImportErrors {
+			report.Errors = append(report.Errors, rowErr)
+		}
+	}
+
+	var batch [][]byte
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := s.copier().copyEvents(r.Context(), s.DB, batch, s.Clock.Now()); err != nil {
+			return err
+		}
+
+		report.Inserted += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	// Routes hand the events they store to Postgres to the batch.
+	toBatch := routing.SinkFunc(func(_ context.Context, events []routing.Event) error {
+		for _, event := range events {
+			batch = append(batch, event)
+		}
+
+		return nil
+	})
+
+	validator := jddf.Validator{}
+	for {
+		eventRaw, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if rowErr, ok := err.(*csvimport.RowError); ok {
+			reject(importRowError{Row: rowErr.Row, Message: rowErr.Err.Error()})
+			continue
+		}
+
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_csv", err.Error())
+			return
+		}
+
+		buf, err := json.Marshal(eventRaw)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+
+		// As in createEvent, this can only error for cyclic schemas.
+		validationResult, _ := validator.Validate(s.EventSchema, eventRaw)
+		if len(validationResult.Errors) != 0 {
+			if s.DeadLetters != nil {
+				s.recordDeadLetter(r.Context(), buf, eventRaw, validationResult.Errors, s.Clock.Now())
+			}
+
+			reject(importRowError{Row: reader.Row(), ValidationErrors: validationResult.Errors})
+			continue
+		}
+
+		eventType := eventRaw[s.EventSchema.Discriminator.Tag].(string)
+		if s.Candidate != nil {
+			s.checkCandidate(buf, eventRaw, eventType)
+		}
+
+		if principal := auth.FromContext(r.Context()); principal != nil && !principal.Allows(eventType) {
+			reject(importRowError{Row: reader.Row(), Message: fmt.Sprintf("%s may not send %q events", principal.Subject, eventType)})
+			continue
+		}
+
+		if err := s.checkSigned(r.Context(), eventType); err != nil {
+			reject(importRowError{Row: reader.Row(), Message: err.Message})
+			continue
+		}
+
+		if err := s.Limits.Check(eventType, buf, eventRaw, s.Clock.Now()); err != nil {
+			reject(importRowError{Row: reader.Row(), Message: err.(*limits.Violation).Message})
+			continue
+		}
+
+		route := s.Routes.Route(eventType)
+		if err := route.Send(r.Context(), buf, toBatch); err != nil {
+			reject(importRowError{Row: reader.Row(), Message: err.Error()})
+			continue
+		}
+
+		if !route.Stores() {
+			report.Inserted++
+		}
+
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+				return
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+// importSource finds the CSV file and column mapping in an import request.
+func importSource(r *http.Request) (io.Reader, csvimport.Mapping, error) {
+	var mapping csvimport.Mapping
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("mapping")), &mapping); err != nil {
+			return nil, nil, fmt.Errorf("mapping query parameter: %s", err)
+		}
+
+		return r.Body, mapping, nil
+	}
+
+	// Read the parts in order, without buffering them. That's why the mapping
+	// has to come before the file.
+	parts, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil, nil, errors.New("multipart form has no file part")
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch part.FormName() {
+		case "mapping":
+			if err := json.NewDecoder(part).Decode(&mapping); err != nil {
+				return nil, nil, fmt.Errorf("mapping part: %s", err)
+			}
+		case "file":
+			if mapping == nil {
+				return nil, nil, errors.New("multipart form must have a mapping part before its file part")
+			}
+
+			return part, mapping, nil
+		}
+	}
+}
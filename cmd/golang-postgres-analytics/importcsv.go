@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/csvimport"
+	"github.com/jddf/jddf-go"
+)
+
+// importCSVFile is the "import-csv" subcommand. It loads events from a CSV file
+// straight into the database, for backfills too big to send through POST
+// /v1/import/csv. Rows are turned into events and checked exactly as that
+// endpoint does, then inserted in batches with COPY; see eventCopier.
+//
+// Unlike the "import" subcommand, there are no checkpoints: each batch is
+// committed as it's read, so an interrupted import has to be resumed by hand,
+// from the row after the last batch it reported.
+func importCSVFile(args []string) error {
+	flags := flag.NewFlagSet("import-csv", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	mappingJSON := flags.String("mapping", "", `JSON object mapping CSV columns to event fields, like {"customer": "userId"}`)
+	eventType := flags.String("type", "", "type of every event, if no column holds it")
+	batchSize := flags.Int("batch-size", 5000, "number of events to insert per transaction")
+	dryRun := flags.Bool("dry-run", false, "check every row, but don't insert anything")
+	bulk := addCopyFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: import-csv [flags] -mapping '{...}' file.csv (or - for stdin)")
+	}
+
+	var mapping csvimport.Mapping
+	if err := json.Unmarshal([]byte(*mappingJSON), &mapping); err != nil {
+		return fmt.Errorf("-mapping: %s", err)
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	eventLimits, err := loadLimits(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	path := flags.Arg(0)
+	var file io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		file = f
+	}
+
+	reader, err := csvimport.NewReader(file, schema, mapping, *eventType)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var copier eventCopier
+	var flush func(batch [][]byte) error
+	var recordRejected func(buf []byte, rejection error) error
+	if *dryRun {
+		flush = func([][]byte) error { return nil }
+		recordRejected = func([]byte, error) error { return nil }
+	} else {
+		db, err := database.open()
+		if err != nil {
+			return err
+		}
+
+		defer db.Close()
+		if copier, err = bulk.copier(ctx, db, *schemaPath, schema); err != nil {
+			return err
+		}
+
+		flush = func(batch [][]byte) error {
+			return copier.copyEvents(ctx, db, batch, copier.now())
+		}
+
+		recordRejected = func(buf []byte, rejection error) error {
+			return copier.recordRejected(ctx, db, buf, rejection, copier.now())
+		}
+	}
+
+	validator := jddf.Validator{}
+	var batch [][]byte
+	inserted, rejected := 0, 0
+	for {
+		eventRaw, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if rowErr, ok := err.(*csvimport.RowError); ok {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, rowErr.Row, rowErr.Err)
+			rejected++
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(eventRaw)
+		if err != nil {
+			return err
+		}
+
+		if err := checkEventLine(validator, schema, eventLimits, buf, copier.now()); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, reader.Row(), err)
+			rejected++
+			if err := recordRejected(buf, err); err != nil {
+				return fmt.Errorf("recording row %d as a dead letter: %s", reader.Row(), err)
+			}
+
+			continue
+		}
+
+		batch = append(batch, buf)
+		if len(batch) >= *batchSize {
+			if err := flush(batch); err != nil {
+				return fmt.Errorf("inserting rows up to %d: %s", reader.Row(), err)
+			}
+
+			inserted += len(batch)
+			batch = batch[:0]
+			fmt.Printf("%s: %d rows done\n", path, reader.Row())
+		}
+	}
+
+	if len(batch) != 0 {
+		if err := flush(batch); err != nil {
+			return fmt.Errorf("inserting rows up to %d: %s", reader.Row(), err)
+		}
+
+		inserted += len(batch)
+	}
+
+	if *dryRun {
+		fmt.Printf("%d events would be imported, %d rejected\n", inserted, rejected)
+	} else {
+		fmt.Printf("imported %d events, rejected %d\n", inserted, rejected)
+	}
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/limits"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/objstore"
+	"github.com/jddf/jddf-go"
+	"github.com/jmoiron/sqlx"
+)
+
+// importObjects is the "import" subcommand. It bulk-loads events from NDJSON
+// files (optionally gzipped) in S3, GCS, or a local directory.
+//
+// Progress is checkpointed in the import_checkpoints table, in the same
+// transaction as the events themselves. So if an import is interrupted, just
+// run the same command again: it picks up exactly where it left off, without
+// skipping or duplicating anything. Dead letters, with -dead-letters, are
+// committed with the events they were read alongside, so they aren't recorded
+// twice either. See eventCopier for how events are stored.
+func importObjects(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	batchSize := flags.Int("batch-size", 5000, "number of events to insert per transaction")
+	bulk := addCopyFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [flags] s3://bucket/prefix | gs://bucket/prefix | file:///path/to/dir")
+	}
+
+	source := flags.Arg(0)
+	bucket, prefix, err := objstore.Open(source)
+	if err != nil {
+		return err
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	eventLimits, err := loadLimits(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	ctx := context.Background()
+	copier, err := bulk.copier(ctx, db, *schemaPath, schema)
+	if err != nil {
+		return err
+	}
+
+	keys, err := bucket.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	imp := importer{
+		db:        db,
+		copier:    copier,
+		schema:    schema,
+		limits:    eventLimits,
+		bucket:    bucket,
+		source:    source,
+		batchSize: *batchSize,
+	}
+
+	for _, key := range keys {
+		if err := imp.importObject(ctx, key); err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+	}
+
+	fmt.Printf("imported %d events from %d objects, rejected %d\n", imp.inserted, len(keys), imp.rejected)
+	return nil
+}
+
+// importer holds the state of a run of the "import" subcommand.
+type importer struct {
+	db        *sqlx.DB
+	copier    eventCopier
+	schema    jddf.Schema
+	limits    *limits.Set
+	bucket    objstore.Bucket
+	source    string
+	batchSize int
+
+	inserted int
+	rejected int
+}
+
+// importObject imports the events in one object, resuming from its checkpoint.
+func (imp *importer) importObject(ctx context.Context, key string) error {
+	var checkpoint struct {
+		Lines int64 `db:"lines"`
+		Done  bool  `db:"done"`
+	}
+
+	err := imp.db.GetContext(ctx, &checkpoint, `
+		select lines, done from import_checkpoints where source = $1 and object_key = $2
+	`, imp.source, key)
+
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if checkpoint.Done {
+		fmt.Printf("%s: already imported, skipping\n", key)
+		return nil
+	}
+
+	object, err := imp.bucket.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	defer object.Close()
+
+	lines, err := ndjsonLines(object)
+	if err != nil {
+		return err
+	}
+
+	validator := jddf.Validator{}
+	var batch [][]byte
+	var rejections []rejectedLine
+	var line int64
+	for {
+		buf, err := lines.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		eof := err == io.EOF
+		buf = bytes.TrimSpace(buf)
+
+		if len(buf) != 0 || !eof {
+			line++
+		}
+
+		// Skip over the lines a previous run already got through.
+		if line > checkpoint.Lines && len(buf) != 0 {
+			if err := checkEventLine(validator, imp.schema, imp.limits, buf, imp.copier.now()); err != nil {
+				fmt.Fprintf(os.Stderr, "%s:%d: %s\n", key, line, err)
+				imp.rejected++
+				rejections = append(rejections, rejectedLine{buf: buf, err: err})
+			} else {
+				batch = append(batch, buf)
+			}
+		}
+
+		if len(batch) >= imp.batchSize || eof {
+			if err := imp.commit(ctx, key, batch, rejections, line, eof); err != nil {
+				return err
+			}
+
+			imp.inserted += len(batch)
+			batch, rejections = nil, nil
+			fmt.Printf("%s: %d lines done\n", key, line)
+		}
+
+		if eof {
+			return nil
+		}
+	}
+}
+
+// rejectedLine is a line of an object checkEventLine rejected, and why.
+type rejectedLine struct {
+	buf []byte
+	err error
+}
+
+// commit inserts a batch of events from an object, records the lines rejected
+// alongside them as dead letters, and records how many of the object's lines
+// are done, in one transaction.
+func (imp *importer) commit(ctx context.Context, key string, batch [][]byte, rejections []rejectedLine, lines int64, done bool) error {
+	tx, err := imp.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := imp.copier.copyEventsTx(ctx, tx, batch, imp.copier.now()); err != nil {
+		return err
+	}
+
+	for _, rejected := range rejections {
+		if err := imp.copier.recordRejected(ctx, tx, rejected.buf, rejected.err, imp.copier.now()); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into import_checkpoints (source, object_key, lines, done)
+		values ($1, $2, $3, $4)
+		on conflict (source, object_key) do update set lines = $3, done = $4
+	`, imp.source, key, lines, done)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// invalidEventError is what checkEventLine returns for an event that doesn't
+// match the schema.
+type invalidEventError struct {
+	Errors []jddf.ValidationError
+}
+
+func (e *invalidEventError) Error() string {
+	errs, _ := json.Marshal(e.Errors)
+	return string(errs)
+}
+
+// checkEventLine checks one line of NDJSON the same way the server checks an
+// event: that it's JSON, valid against the schema, and within its limits if
+// it were received at received.
+func checkEventLine(validator jddf.Validator, schema jddf.Schema, eventLimits *limits.Set, buf []byte, received time.Time) error {
+	var eventRaw interface{}
+	if err := json.Unmarshal(buf, &eventRaw); err != nil {
+		return err
+	}
+
+	if result, _ := validator.Validate(schema, eventRaw); len(result.Errors) != 0 {
+		return &invalidEventError{Errors: result.Errors}
+	}
+
+	return eventLimits.Check(eventRaw.(map[string]interface{})[schema.Discriminator.Tag].(string), buf, eventRaw, received)
+}
+
+// ndjsonLines returns a reader for the lines of an NDJSON object, transparently
+// decompressing it if it's gzipped. Gzip is detected from the content itself,
+// rather than from the key, since not everyone names their files ".gz".
+func ndjsonLines(r io.Reader) (*bufio.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+
+		return bufio.NewReader(gz), nil
+	}
+
+	return buffered, nil
+}
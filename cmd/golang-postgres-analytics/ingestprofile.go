@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxProfileRange is the longest range GET /admin/v1/ingest-profile looks
+// at, since it reads every event in it.
+const maxProfileRange = 7 * 24 * time.Hour
+
+// topSenders is how many senders GET /admin/v1/ingest-profile lists.
+const topSenders = 10
+
+// senderVolumes counts the events each sender has had stored, and their
+// bytes. Events don't record who sent them, so this is counted as they're
+// ingested, by this instance, since it started.
+type senderVolumes struct {
+	mu      sync.Mutex
+	volumes map[string]*senderVolume
+}
+
+// senderVolume is how much one sender has sent, as reported by GET
+// /admin/v1/ingest-profile. Senders are named by the provider that
+// authenticated them and their subject within it, like "api-key:ios-app".
+// Events sent without credentials are from "anonymous".
+type senderVolume struct {
+	Sender string `json:"sender"`
+	Events int64  `json:"events"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func newSenderVolumes() *senderVolumes {
+	return &senderVolumes{volumes: map[string]*senderVolume{}}
+}
+
+// add counts an event of size bytes from principal, which may be nil.
+func (sv *senderVolumes) add(principal *auth.Principal, size int) {
+	sender := "anonymous"
+	if principal != nil {
+		sender = principal.Provider + ":" + principal.Subject
+	}
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	v, ok := sv.volumes[sender]
+	if !ok {
+		v = &senderVolume{Sender: sender}
+		sv.volumes[sender] = v
+	}
+
+	v.Events++
+	v.Bytes += int64(size)
+}
+
+// top returns copies of the n senders with the most events.
+func (sv *senderVolumes) top(n int) []senderVolume {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	out := make([]senderVolume, 0, len(sv.volumes))
+	for _, v := range sv.volumes {
+		out = append(out, *v)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Events != out[j].Events {
+			return out[i].Events > out[j].Events
+		}
+
+		return out[i].Sender < out[j].Sender
+	})
+
+	if len(out) > n {
+		out = out[:n]
+	}
+
+	return out
+}
+
+// sizeBucket is a range of payload sizes, and how many events are in it. The
+// ranges are powers of two: an event is in the bucket with the smallest
+// UpTo at least its size.
+type sizeBucket struct {
+	UpTo   int64 `json:"upTo" db:"up_to"`
+	Events int64 `json:"events" db:"events"`
+}
+
+// sizeProfile is the distribution of payload sizes, in bytes.
+type sizeProfile struct {
+	Events  int64        `json:"events" db:"events"`
+	P50     int64        `json:"p50" db:"p50"`
+	P95     int64        `json:"p95" db:"p95"`
+	P99     int64        `json:"p99" db:"p99"`
+	Max     int64        `json:"max" db:"max"`
+	Buckets []sizeBucket `json:"buckets"`
+}
+
+// hourlyTypeCount is how many events of a type were received in an hour.
+type hourlyTypeCount struct {
+	Hour   time.Time `json:"hour" db:"hour"`
+	Type   string    `json:"type" db:"type"`
+	Events int64     `json:"events" db:"events"`
+}
+
+// ingestProfile is the response of GET /admin/v1/ingest-profile.
+type ingestProfile struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+
+	Sizes  sizeProfile       `json:"sizes"`
+	Hourly []hourlyTypeCount `json:"hourly"`
+
+	// TopSenders are since this instance started, not over from and to.
+	TopSenders []senderVolume `json:"topSenders"`
+}
+
+// getIngestProfile describes what's being ingested, to help decide what to
+// sample and how long to keep it: how big events are, how many of each type
+// arrive each hour, and who sends the most.
+//
+// Sizes are of events as they're stored, after jsonb or a codec has compacted
+// them, and before Postgres compresses them. Sizes and types are of events
+// received from "from" (default a day ago) to "to" (default now).
+//
+// This lives at GET /admin/v1/ingest-profile?from=XXX&to=YYY.
+func (s *server) getIngestProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := s.Clock.Now()
+	p := params{values: r.URL.Query()}
+	to := p.time("to", now)
+	from := p.time("from", to.Add(-24*time.Hour))
+	p.timeRange("from", from, "to", to)
+	if to.Sub(from) > maxProfileRange {
+		p.fail("from", "must be at most %s before to", maxProfileRange)
+	}
+
+	if p.failed(w) {
+		return
+	}
+
+	profile := ingestProfile{From: from, To: to, Hourly: []hourlyTypeCount{}, TopSenders: s.Senders.top(topSenders)}
+	profile.Sizes.Buckets = []sizeBucket{}
+
+	// Compacted events have no payload, so their size is that of their
+	// compact form, and their type is their codec's.
+	const sized = `
+		select coalesce(octet_length(e.payload::text), octet_length(e.payload_compact)) as size
+		from events e
+		where e.received_at >= $1 and e.received_at < $2
+	`
+
+	err := s.DB.GetContext(r.Context(), &profile.Sizes, `
+		select
+			count(*) as events,
+			coalesce(percentile_disc(0.5) within group (order by size), 0) as p50,
+			coalesce(percentile_disc(0.95) within group (order by size), 0) as p95,
+			coalesce(percentile_disc(0.99) within group (order by size), 0) as p99,
+			coalesce(max(size), 0) as max
+		from (`+sized+`) sizes
+	`, from, to)
+
+	if err == nil {
+		err = s.DB.SelectContext(r.Context(), &profile.Sizes.Buckets, `
+			select (2 ^ ceil(log(2, greatest(size, 1))))::bigint as up_to, count(*) as events
+			from (`+sized+`) sizes
+			group by 1
+			order by 1
+		`, from, to)
+	}
+
+	if err == nil {
+		err = s.DB.SelectContext(r.Context(), &profile.Hourly, `
+			select
+				date_trunc('hour', e.received_at) as hour,
+				coalesce(e.payload->>$3, c.event_type) as type,
+				count(*) as events
+			from events e
+			left join event_codecs c on c.id = e.codec_id
+			where e.received_at >= $1 and e.received_at < $2
+			group by 1, 2
+			order by 1, 2
+		`, from, to, s.EventSchema.Discriminator.Tag)
+	}
+
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, profile)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jddf/jddf-go"
+)
+
+// ingestStdin is the "ingest-stdin" subcommand. It reads NDJSON events from
+// standard input, optionally gzipped, and stores the valid ones, so ad-hoc
+// loads can be piped in without going through HTTP:
+//
+//	zcat dump.gz | golang-postgres-analytics ingest-stdin
+//
+// Invalid lines are reported on stderr, and skipped, and recorded as dead
+// letters with -dead-letters. Unlike "import", there's no checkpoint to resume
+// from: if a load is interrupted, the batches already inserted stay inserted,
+// and the output says how far it got. See eventCopier for how events are
+// stored.
+func ingestStdin(args []string) error {
+	flags := flag.NewFlagSet("ingest-stdin", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	batchSize := flags.Int("batch-size", 5000, "number of events to insert per transaction")
+	bulk := addCopyFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	eventLimits, err := loadLimits(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	ctx := context.Background()
+	copier, err := bulk.copier(ctx, db, *schemaPath, schema)
+	if err != nil {
+		return err
+	}
+
+	lines, err := ndjsonLines(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	validator := jddf.Validator{}
+	var batch [][]byte
+	var line, inserted, rejected int64
+	for {
+		buf, err := lines.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		eof := err == io.EOF
+		buf = bytes.TrimSpace(buf)
+		if len(buf) != 0 || !eof {
+			line++
+		}
+
+		if len(buf) != 0 {
+			if err := checkEventLine(validator, schema, eventLimits, buf, copier.now()); err != nil {
+				fmt.Fprintf(os.Stderr, "stdin:%d: %s\n", line, err)
+				rejected++
+				if err := copier.recordRejected(ctx, db, buf, err, copier.now()); err != nil {
+					return fmt.Errorf("stdin:%d: recording dead letter: %s", line, err)
+				}
+			} else {
+				batch = append(batch, buf)
+			}
+		}
+
+		if len(batch) != 0 && (len(batch) >= *batchSize || eof) {
+			if err := copier.copyEvents(ctx, db, batch, copier.now()); err != nil {
+				return fmt.Errorf("stdin:%d: %s (%d events inserted before this batch)", line, err, inserted)
+			}
+
+			inserted += int64(len(batch))
+			batch = nil
+		}
+
+		if eof {
+			break
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "ingested %d events from %d lines, rejected %d\n", inserted, line, rejected)
+	return nil
+}
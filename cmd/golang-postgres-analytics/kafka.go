@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/kafkarest"
+	"github.com/jddf/jddf-go"
+	"github.com/jmoiron/sqlx"
+)
+
+// consumeKafka is the "consume-kafka" subcommand. It consumes events from a
+// Kafka topic, as a member of a consumer group, and stores the valid ones, so
+// that producers can write to Kafka and not wait on Postgres:
+//
+//	golang-postgres-analytics consume-kafka -topic events http://kafka-rest:8082
+//
+// Kafka is reached through a Kafka REST Proxy, like the KafkaREST route sink.
+// Each poll's events are checked against the schema, and the valid ones
+// inserted in one transaction, which also moves the group's offsets in the
+// kafka_offsets table past the whole poll. So events are stored exactly once:
+// records behind those offsets, which another member of the group already
+// stored, are skipped, and their partition is sought to where it should be.
+// Invalid events are reported on stderr, and skipped, and recorded as dead
+// letters with -dead-letters, in the same transaction. See eventCopier for how
+// events are stored.
+//
+// Run as many as the topic has partitions, to share the load.
+func consumeKafka(args []string) error {
+	flags := flag.NewFlagSet("consume-kafka", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	topic := flags.String("topic", "events", "topic to consume events from")
+	group := flags.String("group", "golang-postgres-analytics", "consumer group to consume as")
+	pollTimeout := flags.Duration("poll-timeout", 5*time.Second, "how long each poll waits for records")
+	maxBytes := flags.Int("max-bytes", 4<<20, "most bytes of records to fetch per poll, and so to insert per transaction")
+	bulk := addCopyFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: consume-kafka [flags] http://kafka-rest:8082")
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	eventLimits, err := loadLimits(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	// Stop between polls when asked to, and leave the group cleanly, so its
+	// partitions are handed over straight away.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	copier, err := bulk.copier(ctx, db, *schemaPath, schema)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	consumer := &kafkarest.Consumer{URL: flags.Arg(0), Group: *group}
+	if err := consumer.Open(ctx, *topic); err != nil {
+		return err
+	}
+
+	defer consumer.Close(context.Background())
+
+	validator := jddf.Validator{}
+	for ctx.Err() == nil {
+		records, err := consumer.Poll(ctx, *pollTimeout, *maxBytes)
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		stored, behind, err := storeKafkaRecords(ctx, db, copier, *group, records, func(record kafkarest.Record) error {
+			err := checkEventLine(validator, schema, eventLimits, record.Value, copier.now())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s/%d@%d: %s\n", record.Topic, record.Partition, record.Offset, err)
+			}
+
+			return err
+		})
+
+		// Stopping mid-transaction is fine: neither the events nor the offsets
+		// are stored, so whoever takes over the partitions stores them.
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Seeking only saves polling through records that would be skipped
+		// anyway, so it's fine if it fails, say because the partition was
+		// just reassigned.
+		if err := consumer.Seek(ctx, behind); err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "seeking past stored records: %s\n", err)
+		}
+
+		if len(records) != 0 {
+			fmt.Printf("consumed %d events, stored %d\n", len(records), stored)
+		}
+	}
+
+	return nil
+}
+
+// storeKafkaRecords inserts the records that check doesn't reject with copier,
+// records those it does as dead letters, and moves group's offsets in
+// kafka_offsets past all of records, in one transaction.
+//
+// Records behind their partition's offset were stored already, and are
+// skipped. It returns how many events were stored, and where to seek the
+// partitions that were behind, so the rest of them aren't polled for nothing.
+func storeKafkaRecords(ctx context.Context, db *sqlx.DB, copier eventCopier, group string, records []kafkarest.Record, check func(kafkarest.Record) error) (int, []kafkarest.Offset, error) {
+	if len(records) == 0 {
+		return 0, nil, nil
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer tx.Rollback()
+
+	// Lock each partition's offset, so that if the group rebalances mid-poll,
+	// whoever got the partition waits for us, and then skips what we stored.
+	var offsets []kafkarest.Offset
+	index := map[kafkarest.Offset]int{}
+	for _, r := range records {
+		k := kafkarest.Offset{Topic: r.Topic, Partition: r.Partition}
+		if _, ok := index[k]; ok {
+			continue
+		}
+
+		_, err := tx.ExecContext(ctx, `
+			insert into kafka_offsets (consumer_group, topic, partition, next_offset)
+			values ($1, $2, $3, 0)
+			on conflict (consumer_group, topic, partition) do nothing
+		`, group, r.Topic, r.Partition)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		offset := kafkarest.Offset{Topic: r.Topic, Partition: r.Partition}
+		err = tx.GetContext(ctx, &offset.Offset, `
+			select next_offset from kafka_offsets
+			where consumer_group = $1 and topic = $2 and partition = $3
+			for update
+		`, group, r.Topic, r.Partition)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		index[k] = len(offsets)
+		offsets = append(offsets, offset)
+	}
+
+	var batch [][]byte
+	behind := map[int]bool{}
+	for _, r := range records {
+		i := index[kafkarest.Offset{Topic: r.Topic, Partition: r.Partition}]
+		if r.Offset < offsets[i].Offset {
+			behind[i] = true
+			continue
+		}
+
+		if err := check(r); err != nil {
+			if err := copier.recordRejected(ctx, tx, r.Value, err, copier.now()); err != nil {
+				return 0, nil, err
+			}
+		} else {
+			batch = append(batch, r.Value)
+		}
+
+		offsets[i].Offset = r.Offset + 1
+	}
+
+	if len(batch) != 0 {
+		if err := copier.copyEventsTx(ctx, tx, batch, copier.now()); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	for _, offset := range offsets {
+		_, err := tx.ExecContext(ctx, `
+			update kafka_offsets set next_offset = $4, updated_at = now()
+			where consumer_group = $1 and topic = $2 and partition = $3
+		`, group, offset.Topic, offset.Partition, offset.Offset)
+
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	var seek []kafkarest.Offset
+	for i, offset := range offsets {
+		if behind[i] {
+			seek = append(seek, offset)
+		}
+	}
+
+	return len(batch), seek, nil
+}
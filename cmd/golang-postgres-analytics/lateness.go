@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/lateness"
+	"github.com/julienschmidt/httprouter"
+)
+
+// latenessLookback is how far back, by event timestamp, the lateness
+// reconciliation looks.
+const latenessLookback = 7 * 24 * time.Hour
+
+// latenessReport is the response of GET /admin/v1/lateness.
+type latenessReport struct {
+	FinalizeAfter string `json:"finalizeAfter"`
+
+	// Observed is how late the events this instance stored, since it started,
+	// were.
+	Observed lateness.Histogram `json:"observed"`
+
+	// Reconciled is the latest reconciliation against the events table, which
+	// covers every instance, or null if there hasn't been one yet.
+	Reconciled *lateness.Report `json:"reconciled"`
+}
+
+// observeLateness records how late a stored event arrived, going by its
+// timestamp.
+func (s *server) observeLateness(event map[string]interface{}, received time.Time) {
+	timestamp, _ := event["timestamp"].(string)
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		s.Lateness.Observe(t, received)
+	}
+}
+
+// getLateness reports how late events have been arriving, and which hours
+// they changed after those hours were treated as final. That's what to go on
+// when tuning -finalize-after.
+//
+// This lives at GET /admin/v1/lateness.
+func (s *server) getLateness(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondJSON(w, http.StatusOK, latenessReport{
+		FinalizeAfter: s.Lateness.FinalizeAfter.String(),
+		Observed:      s.Lateness.Histogram(),
+		Reconciled:    s.Lateness.Report(),
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/livefeed"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/typescan"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+)
+
+// liveBuffer is how many events a client tailing the live feed may fall
+// behind before it's disconnected.
+const liveBuffer = 1000
+
+// liveKeepalive is how often an idle live tail is sent something, so that
+// proxies don't close it.
+const liveKeepalive = 15 * time.Second
+
+// startLiveFeed starts following the events table, waking up whenever
+// Postgres notifies the "events" channel that events were inserted (see the
+// trigger in schema.sql), and every poll regardless.
+//
+// Connections that can't LISTEN, like through a transaction-pooling
+// PgBouncer, fall back to polling alone.
+func (s *server) startLiveFeed(ctx context.Context, databaseURL string, poll time.Duration) error {
+	var last int64
+	if err := s.DB.GetContext(ctx, &last, "select coalesce(max(id), 0) from events"); err != nil {
+		return err
+	}
+
+	s.Feed = livefeed.New(s.fetchLiveEvents, last)
+
+	// Every instance sees every event in the feed, so the hot cache is kept
+	// from it, rather than from only the events this instance stores.
+	s.Feed.OnEvent = func(e livefeed.Event) {
+		if s.Hot == nil {
+			return
+		}
+
+		var event map[string]interface{}
+		if err := json.Unmarshal(e.Payload, &event); err != nil {
+			return
+		}
+
+		eventType, _ := event[s.EventSchema.Discriminator.Tag].(string)
+		userID, _ := event["userId"].(string)
+		revenue, _ := event["revenue"].(string)
+		s.Hot.Add(e.ReceivedAt, eventType, userID, revenue)
+	}
+
+	listener := pq.NewListener(databaseURL, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "live feed listener: %s\n", err)
+		}
+	})
+
+	wake := make(chan struct{}, 1)
+	if err := listener.Listen("events"); err != nil {
+		fmt.Fprintf(os.Stderr, "live feed: can't LISTEN, polling every %s instead: %s\n", poll, err)
+		listener.Close()
+	} else {
+		// A nil notification means the listener reconnected, and may have
+		// missed some, so it wakes the feed up too.
+		go func() {
+			for range listener.Notify {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	go s.Feed.Run(ctx, wake, poll, func(err error) {
+		fmt.Fprintf(os.Stderr, "live feed: %s\n", err)
+	})
+
+	return nil
+}
+
+// fetchLiveEvents is the live feed's livefeed.Fetch.
+func (s *server) fetchLiveEvents(ctx context.Context, after int64, limit int) ([]livefeed.Event, error) {
+	var rows []struct {
+		Seq int64 `db:"id"`
+		listedEvent
+	}
+
+	err := s.DB.SelectContext(ctx, &rows, `
+		select id, coalesce(event_id, '') as event_id, received_at, payload, codec_id, payload_compact
+		from events
+		where id > $1
+		order by id
+		limit $2
+	`, after, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]livefeed.Event, len(rows))
+	for i, row := range rows {
+		payload, err := s.Codecs.expand(ctx, row.Payload, row.CodecID, row.Compact)
+		if err != nil {
+			return nil, err
+		}
+
+		events[i] = livefeed.Event{Seq: row.Seq, ID: row.ID, ReceivedAt: row.ReceivedAt, Payload: payload}
+	}
+
+	return events, nil
+}
+
+// liveFilter returns whether an event in the live feed is of one of types, or
+// true for every event if there are none.
+func (s *server) liveFilter(types []string) func(livefeed.Event) bool {
+	return func(e livefeed.Event) bool {
+		if len(types) == 0 {
+			return true
+		}
+
+		eventType, _ := typescan.Find(e.Payload, s.EventSchema.Discriminator.Tag)
+		for _, t := range types {
+			if string(eventType) == t {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// getLiveEvents streams events as they're stored, as server-sent events, for
+// watching what's coming in. Only events of the given types are sent, if any
+// are given.
+//
+// Clients that fall too far behind are sent a "dropped" event, and
+// disconnected, so they can reconnect and carry on from the latest events.
+//
+// This lives at GET /v1/events/live?type=XXX&type=YYY.
+func (s *server) getLiveEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.Feed == nil {
+		writeAPIError(w, http.StatusNotFound, "live_feed_disabled", "this server doesn't follow new events; see -live-feed")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "streaming is not supported")
+		return
+	}
+
+	keep := s.liveFilter(r.URL.Query()["type"])
+	sub := s.Feed.Subscribe(liveBuffer)
+	defer s.Feed.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(liveKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		case e, ok := <-sub.C:
+			if !ok {
+				fmt.Fprintf(w, "event: dropped\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+
+			if !keep(e) {
+				continue
+			}
+
+			buf, _ := json.Marshal(e)
+			fmt.Fprintf(w, "data: %s\n\n", buf)
+		}
+
+		flusher.Flush()
+	}
+}
+
+// getLiveEventsWebSocket is getLiveEvents over a WebSocket, one event per text
+// message. Anything the client sends is ignored.
+//
+// This lives at GET /v1/events/live/ws?type=XXX&type=YYY.
+func (s *server) getLiveEventsWebSocket(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.Feed == nil {
+		writeAPIError(w, http.StatusNotFound, "live_feed_disabled", "this server doesn't follow new events; see -live-feed")
+		return
+	}
+
+	keep := s.liveFilter(r.URL.Query()["type"])
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	sub := s.Feed.Subscribe(liveBuffer)
+	defer s.Feed.Unsubscribe(sub)
+
+	// Reading is the only way to notice the client closing the connection.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				conn.Close(websocket.CloseGoingAway, "fell too far behind; reconnect")
+				return
+			}
+
+			if !keep(e) {
+				continue
+			}
+
+			buf, _ := json.Marshal(e)
+			if err := conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+				return
+			}
+		}
+	}
+}
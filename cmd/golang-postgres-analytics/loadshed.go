@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// loadSampleInterval is how often the database pool's wait times are sampled.
+const loadSampleInterval = time.Second
+
+// loadShedder turns events away while the server can't keep up with them, so
+// that clients back off and retry, rather than waiting ever longer for
+// answers. See withIngest.
+type loadShedder struct {
+	// shed is how many requests have been turned away. It comes first, so that
+	// it's 64-bit aligned for sync/atomic.
+	shed int64
+
+	// QueueThreshold is how full, from 0 to 1, the write buffer or ingest queue
+	// may get before events are shed, or 0 to not watch them.
+	QueueThreshold float64
+
+	// MaxPoolWait is how long, on average, requests may have waited for a
+	// database connection over the last loadSampleInterval before events are
+	// shed, or 0 to not watch it.
+	MaxPoolWait time.Duration
+
+	// poolWait is the average wait for a connection, in nanoseconds, as of the
+	// last sample.
+	poolWait int64
+}
+
+// loadSheddingStatus is how the load shedder is doing, as reported by GET
+// /admin/v1/runtime.
+type loadSheddingStatus struct {
+	// Reason is why events are being shed now, or empty if they aren't.
+	Reason string `json:"reason,omitempty"`
+
+	// Shed is how many requests have been turned away since the server started.
+	Shed int64 `json:"shed"`
+
+	// PoolWait is how long requests waited for a database connection, on
+	// average, over the last second.
+	PoolWait string `json:"poolWait"`
+}
+
+// overloaded returns why the server can't take more events right now, or ""
+// if it can.
+//
+// The queues are checked as it's called, since they can fill up in an
+// instant. Pool waits are only known after the fact, and are sampled by
+// watchLoad.
+func (s *server) overloaded() string {
+	l := s.LoadShedder
+	if l.QueueThreshold > 0 {
+		if s.Writer != nil {
+			if full := float64(len(s.Writer.queue)) / float64(cap(s.Writer.queue)); full >= l.QueueThreshold {
+				return fmt.Sprintf("the write buffer is %.0f%% full", full*100)
+			}
+		}
+
+		if s.Pipeline != nil {
+			stats := s.Pipeline.Stats()
+			if full := float64(stats.Queued) / float64(stats.Capacity); full >= l.QueueThreshold {
+				return fmt.Sprintf("the ingest queue is %.0f%% full", full*100)
+			}
+		}
+	}
+
+	if wait := time.Duration(atomic.LoadInt64(&l.poolWait)); l.MaxPoolWait > 0 && wait >= l.MaxPoolWait {
+		return fmt.Sprintf("requests are waiting %s for a database connection", wait.Round(time.Millisecond))
+	}
+
+	return ""
+}
+
+// shedLoad rejects a request because the server is overloaded. It's a 503,
+// since it's the server that's struggling, not the client sending too much.
+func (s *server) shedLoad(w http.ResponseWriter, reason string) {
+	atomic.AddInt64(&s.LoadShedder.shed, 1)
+	w.Header().Set("Retry-After", "1")
+	writeAPIError(w, http.StatusServiceUnavailable, "overloaded", reason+"; retry later")
+}
+
+// watchLoad samples how long requests wait for a database connection every
+// loadSampleInterval, until ctx is done, and logs when the server starts and
+// stops shedding events.
+func (s *server) watchLoad(ctx context.Context) {
+	ticker := time.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+
+	l := s.LoadShedder
+	last := s.DB.Stats()
+	wasOverloaded := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// WaitDuration only grows once a wait is over, so requests stuck
+		// waiting now aren't counted until they get a connection.
+		stats := s.DB.Stats()
+		var wait time.Duration
+		if waits := stats.WaitCount - last.WaitCount; waits > 0 {
+			wait = (stats.WaitDuration - last.WaitDuration) / time.Duration(waits)
+		}
+
+		atomic.StoreInt64(&l.poolWait, int64(wait))
+		last = stats
+
+		reason := s.overloaded()
+		if overloaded := reason != ""; overloaded != wasOverloaded {
+			if overloaded {
+				fmt.Fprintf(os.Stderr, "shedding load: %s\n", reason)
+			} else {
+				fmt.Fprintf(os.Stderr, "no longer shedding load\n")
+			}
+
+			wasOverloaded = overloaded
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/signature"
+	"github.com/lib/pq"
+)
+
+// ltvWebhookAttempts is how many times an LTV notification is tried before
+// giving up on it.
+const ltvWebhookAttempts = 3
+
+// ltvWebhook is a row of the ltv_webhooks table: somewhere to notify when a
+// user's LTV crosses a threshold.
+type ltvWebhook struct {
+	URL           string         `db:"url"`
+	FirstPurchase bool           `db:"first_purchase"`
+	Thresholds    pq.StringArray `db:"thresholds"`
+	Secret        sql.NullString `db:"secret"`
+}
+
+// ltvNotification is what's posted to an LTV webhook.
+type ltvNotification struct {
+	UserID string `json:"userId"`
+
+	// Trigger is "first_purchase" or "threshold".
+	Trigger string `json:"trigger"`
+
+	// Threshold is the threshold that was crossed, for "threshold" triggers.
+	Threshold json.Number `json:"threshold,omitempty"`
+
+	PreviousLTV *money.Sum `json:"previousLtv"`
+	LTV         *money.Sum `json:"ltv"`
+
+	// Event is the Order Completed event that crossed the threshold.
+	Event json.RawMessage `json:"event"`
+}
+
+// notifyLTV is called after an Order Completed event has been stored. It works
+// out the user's LTV before and after the order, and notifies every webhook
+// with a threshold in between. Notifications are sent in the background, so
+// slow webhooks don't hold up ingestion.
+//
+// Two orders from the same user stored at the very same moment can each see
+// the other's revenue, so a threshold may occasionally be reported twice, or
+// not at all. Webhooks that need exactly-once should track what they've seen.
+func (s *server) notifyLTV(ctx context.Context, buf []byte, eventRaw map[string]interface{}) error {
+	var webhooks []ltvWebhook
+	if err := s.DB.SelectContext(ctx, &webhooks, `
+		select url, first_purchase, thresholds, secret from ltv_webhooks
+	`); err != nil {
+		return err
+	}
+
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	userID := eventRaw["userId"].(string)
+	revenue := eventRaw["revenue"].(string)
+
+	var q querybuilder.Query
+	var totals struct {
+		LTV    money.Sum `db:"ltv"`
+		Orders int64     `db:"orders"`
+	}
+
+	err := s.DB.GetContext(ctx, &totals, `
+		select
+			coalesce(sum((payload->>'revenue')::numeric), 0) as ltv,
+			count(*) as orders
+		from
+			events_expanded
+		where
+			`+q.Where(querybuilder.Filter{Type: "Order Completed", UserID: userID}), q.Args()...)
+
+	if err != nil {
+		return err
+	}
+
+	// The order has already been stored, so it's included in the totals.
+	var previousLTV money.Sum
+	previousLTV.AddSum(&totals.LTV)
+	previousLTV.Sub(revenue)
+	for _, webhook := range webhooks {
+		var notifications []ltvNotification
+		if webhook.FirstPurchase && totals.Orders == 1 {
+			notifications = append(notifications, ltvNotification{Trigger: "first_purchase"})
+		}
+
+		for _, threshold := range webhook.Thresholds {
+			if previousLTV.Cmp(threshold) < 0 && totals.LTV.Cmp(threshold) >= 0 {
+				notifications = append(notifications, ltvNotification{Trigger: "threshold", Threshold: json.Number(threshold)})
+			}
+		}
+
+		for _, n := range notifications {
+			n.UserID = userID
+			n.PreviousLTV = &previousLTV
+			n.LTV = &totals.LTV
+			n.Event = buf
+
+			atomic.AddInt64(&s.ltvDeliveries, 1)
+			go func(webhook ltvWebhook, n ltvNotification) {
+				defer atomic.AddInt64(&s.ltvDeliveries, -1)
+				deliverLTVNotification(webhook, n)
+			}(webhook, n)
+		}
+	}
+
+	return nil
+}
+
+// deliverLTVNotification posts a notification to a webhook, retrying a few
+// times if it fails. If the webhook has a secret, the notification is signed
+// with it, in the same X-Signature format clients sign events with.
+func deliverLTVNotification(webhook ltvWebhook, n ltvNotification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ltv webhook %s: %s\n", webhook.URL, err)
+		return
+	}
+
+	for attempt := 1; attempt <= ltvWebhookAttempts; attempt++ {
+		if err = postLTVNotification(webhook, body); err == nil {
+			return
+		}
+
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	fmt.Fprintf(os.Stderr, "ltv webhook %s: giving up after %d attempts: %s\n", webhook.URL, ltvWebhookAttempts, err)
+}
+
+// postLTVNotification makes one attempt at posting a notification.
+func postLTVNotification(webhook ltvWebhook, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.Secret.Valid {
+		req.Header.Set("X-Signature", signature.Sign(webhook.Secret.String, body, time.Now()))
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", res.Status)
+	}
+
+	return nil
+}
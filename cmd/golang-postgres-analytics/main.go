@@ -1,17 +1,50 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/jddf-examples/golang-postgres-analytics/internal/adapter"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/avro"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/codec"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/dbtimeout"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/dbtrace"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/deprecation"
 	"github.com/jddf-examples/golang-postgres-analytics/internal/event"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/eventid"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/features"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/hotcache"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/lateness"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/limits"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/livefeed"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/oidc"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/pipeline"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/ratelimit"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/routing"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/signature"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/spool"
 	"github.com/jddf/jddf-go"
 	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // The comments below are meant to be used with the "go generate" command.
@@ -20,37 +53,596 @@ import (
 //
 //go:generate ../../node_modules/.bin/yaml2json --save ../../event.jddf.yaml
 //go:generate jddf-codegen --go-out=../../internal/event -- ../../event.jddf.json
+//go:generate jddf-codegen --ts-out=../../sdk/typescript -- ../../event.jddf.json
+//go:generate go run . views -schema ../../event.jddf.json -o ../../views.sql
+//go:generate go run . proto -schema ../../event.jddf.json -proto-out ../../internal/eventpb/event.proto -go-out ../../internal/eventpb/event.go
 
-// main is the entrypoint of the server.
+// defaultDatabaseURL is the Postgres instance started by docker-compose.yml.
+const defaultDatabaseURL = "postgres://postgres@localhost?sslmode=disable"
+
+// commands are the subcommands this binary supports, keyed by the name you
+// pass as its first argument. Each one receives the remaining arguments.
+var commands = map[string]func(args []string) error{
+	"serve":         serve,
+	"delete-events": deleteEvents,
+	"schema":        schemaCommand,
+	"views":         views,
+	"import":        importObjects,
+	"anomalies":     anomalies,
+	"forward":       forward,
+	"doctor":        doctor,
+	"ingest-stdin":  ingestStdin,
+	"consume-kafka": consumeKafka,
+	"seed":          seed,
+	"proto":         proto,
+	"import-csv":    importCSVFile,
+	"query-archive": queryArchive,
+}
+
+// main is the entrypoint of the program. Running it without any arguments
+// starts the server, just like "serve" does.
 func main() {
+	name, args := "serve", []string{}
+	if len(os.Args) > 1 {
+		name, args = os.Args[1], os.Args[2:]
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+		os.Exit(2)
+	}
+
+	if err := command(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the HTTP server.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	authProviders := flags.String("auth", "api-key", "comma-separated auth providers to accept, in order: api-key, jwt, client-cert")
+	requireAuth := flags.Bool("require-auth", false, "reject events sent without credentials")
+	signedTypes := flags.String("signed-types", "", "comma-separated event types to only accept in requests signed with an API key's secret, like \"Order Completed\"")
+	jwtIssuer := flags.String("jwt-issuer", "", "the only JWT issuer to accept")
+	jwtAudience := flags.String("jwt-audience", "", "the JWT audience to require")
+	jwtPublicKey := flags.String("jwt-public-key", "", "path to a PEM-encoded RSA key to verify RS256 JWTs with")
+	jwtJWKSURL := flags.String("jwt-jwks-url", "", "URL of a JSON Web Key Set to verify RS256 JWTs with, refetched hourly")
+	jwtTenantClaim := flags.String("jwt-tenant-claim", "tenant", "the JWT claim naming the tenant a client belongs to")
+	oidcIssuer := flags.String("oidc-issuer", "", "issuer URL of the OIDC provider admins log in with")
+	oidcClientID := flags.String("oidc-client-id", "", "OIDC client ID for admin logins")
+	oidcRedirectURL := flags.String("oidc-redirect-url", "http://localhost:3000/admin/callback", "URL the OIDC provider redirects back to after logging in")
+	oidcGroupsClaim := flags.String("oidc-groups-claim", "groups", "ID token claim listing the groups a person is in")
+	adminGroup := flags.String("admin-group", "", "group admins must be in")
+	traceQueries := flags.Bool("trace-queries", false, "log every query's endpoint, statement, duration, and row count")
+	slowQuery := flags.Duration("slow-query", 0, "with -trace-queries, only log queries at least this slow")
+	warmConns := flags.Int("warm-conns", 4, "number of database connections to open at startup")
+	featureRefresh := flags.Duration("feature-refresh", 0, "how often to re-read the feature_flags table (0 to not use it)")
+	interactiveConcurrency := flags.Int("interactive-concurrency", 64, "max requests of high or normal priority to handle at once")
+	bulkConcurrency := flags.Int("bulk-concurrency", 4, "max requests of low priority, like imports, to handle at once")
+	shedQueue := flags.Float64("shed-queue", 0.9, "turn events away while the write buffer or ingest queue is this full, from 0 to 1 (0 to not)")
+	shedPoolWait := flags.Duration("shed-pool-wait", 500*time.Millisecond, "turn events away while requests wait this long on average for a database connection (0 to not)")
+	rateLimit := flags.Float64("rate-limit", 0, "requests a second each client may send events at, over time (0 for no limit)")
+	rateBurst := flags.Int("rate-burst", 0, "with -rate-limit, requests each client may send at once (0 for a second's worth)")
+	queueTimeout := flags.Duration("queue-timeout", 5*time.Second, "how long a request may wait for its pool before it's rejected")
+	queryTimeout := flags.Duration("query-timeout", 30*time.Second, "how long analytics endpoints' queries may run before Postgres cancels them (0 for no limit)")
+	latencyBudget := flags.Duration("latency-budget", 2*time.Second, "how long composite endpoints, like /v1/dashboard, may take before answering with what they have")
+	shadowDatabaseURL := flags.String("shadow-database-url", "", "database to mirror a fraction of events to")
+	shadowSchema := flags.String("shadow-schema", "", "path to a proposed event schema to validate a fraction of events against")
+	candidateSchema := flags.String("candidate-schema", "", "path to a schema being rolled out, to validate every event against and report on, without rejecting any")
+	keepDeadLetters := flags.Bool("dead-letters", false, "record events the schema rejects in events_dead_letter, for GET /v1/dead-letters")
+	shadowFraction := flags.Float64("shadow-fraction", 0.01, "with -shadow-database-url or -shadow-schema, the fraction of events to mirror")
+	hotWindow := flags.Duration("hot-window", 0, "keep this much recent history in memory, to serve /v1/realtime from (0 to not)")
+	hotReconcile := flags.Duration("hot-reconcile", 5*time.Minute, "with -hot-window, how often to rebuild the in-memory history from the database")
+	finalizeAfter := flags.Duration("finalize-after", time.Hour, "how long after an hour ends that its aggregates are treated as final, for lateness tracking")
+	latenessReconcile := flags.Duration("lateness-reconcile", time.Hour, "how often to reconcile event lateness against the database (0 to not)")
+	usersRollup := flags.Duration("users-rollup", time.Minute, "how often to roll new events up into users_activity, for /v1/users (0 to not)")
+	eventIDs := flags.String("event-ids", "", "give events IDs, stored in events.event_id: uuidv7, ulid, or snowflake")
+	nodeID := flags.Int("node-id", 0, "with -event-ids snowflake, this instance's node number, unique among instances")
+	issueReceipts := flags.Bool("receipts", false, "with -event-ids, return a receipt signed with RECEIPT_SECRET for every event stored")
+	idempotencyWindow := flags.Duration("idempotency-window", 24*time.Hour, "how long to remember Idempotency-Keys sent with events (0 to ignore them)")
+	asyncWrites := flags.Bool("async-writes", false, "store events in the background, in batches, answering 202 once they're queued")
+	flushInterval := flags.Duration("flush-interval", 50*time.Millisecond, "with -async-writes, the longest an event waits to be written")
+	flushSize := flags.Int("flush-size", 1000, "with -async-writes, the most events written at once")
+	writeBuffer := flags.Int("write-buffer", 100000, "with -async-writes, the most events that may wait to be written")
+	ingestWorkers := flags.Int("ingest-workers", 0, "validate and store events on this many workers, answering 202 once they're queued (0 to do it while the client waits)")
+	ingestQueue := flags.Int("ingest-queue", 10000, "with -ingest-workers, the most events that may wait for a worker")
+	liveFeed := flags.Bool("live-feed", false, "follow new events, with LISTEN/NOTIFY, for /v1/events/live and the hot cache")
+	livePoll := flags.Duration("live-poll", time.Second, "with -live-feed, how often to check for new events regardless of notifications")
+	spoolFallback := flags.Bool("spool-fallback", false, "with -spool-dir, hold events there while the database is unavailable, and store them once it's back")
+	spoolDir := flags.String("spool-dir", "", "write events to a spool in this directory before the database, to replay after a crash")
+	grpcAddr := flags.String("grpc-addr", "", "also serve the gRPC ingestion service on this address, like :3001 (needs -grpc-cert and -grpc-key)")
+	grpcCert := flags.String("grpc-cert", "", "path to the PEM-encoded TLS certificate to serve gRPC with")
+	grpcKey := flags.String("grpc-key", "", "path to the PEM-encoded TLS key to serve gRPC with")
+	addr := flags.String("addr", ":3000", "address to serve HTTP on, or HTTPS with -tls-cert, like :443")
+	tlsCert := flags.String("tls-cert", "", "path to the PEM-encoded TLS certificate to serve HTTPS with, instead of HTTP; reloaded when it changes")
+	tlsKey := flags.String("tls-key", "", "path to the PEM-encoded TLS key to serve HTTPS with")
+	tlsClientCA := flags.String("tls-client-ca", "", "with -tls-cert, path to a PEM bundle of CAs to verify client certificates with, for the client-cert auth provider")
+	tlsClientAuth := flags.String("tls-client-auth", "require", "with -tls-client-ca, whether clients must send a certificate: require or optional")
+	tlsRedirectAddr := flags.String("tls-redirect-addr", "", "with -tls-cert, also listen for plain HTTP on this address, like :80, and redirect it to HTTPS")
+	acmeWebroot := flags.String("acme-webroot", "", "with -tls-redirect-addr, serve ACME HTTP-01 challenges from this directory, for certbot --webroot")
+	failFast := flags.Bool("fail-fast", false, "exit at startup if the schema or database has problems, instead of only warning")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// Tracing queries helps track down slow endpoints, by tying each one to the
+	// SQL it ran.
+	var tracer dbtrace.Tracer
+	if *traceQueries {
+		tracer = &dbtrace.LogTracer{Out: os.Stderr, Slow: *slowQuery}
+	}
+
 	// Construct a new "server"; its methods are HTTP endpoints.
-	server, err := newServer()
+	server, err := newServer(database.URL(), tracer)
+	if err != nil {
+		return err
+	}
+
+	// The Stripe adapter checks webhooks' signatures by the server's clock.
+	if stripe, ok := server.Adapters["stripe"].(*adapter.Stripe); ok {
+		stripe.Clock = server.Clock
+	}
+
+	server.RequireAuth = *requireAuth
+	server.SignedTypes = map[string]bool{}
+	for _, t := range strings.Split(*signedTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			server.SignedTypes[t] = true
+		}
+	}
+	server.Pools = newPools(*interactiveConcurrency, *bulkConcurrency)
+	server.QueueTimeout = *queueTimeout
+	if *rateLimit > 0 {
+		burst := *rateBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(*rateLimit))
+		}
+
+		server.RateLimit = ratelimit.New(*rateLimit, burst)
+		server.RateLimit.Clock = server.Clock
+	}
+
+	server.LatencyBudget = *latencyBudget
+	server.QueryTimeout = *queryTimeout
+	server.IdempotencyWindow = *idempotencyWindow
+	server.Auth, err = server.authProviders(*authProviders, jwtConfig{
+		Issuer:        *jwtIssuer,
+		Audience:      *jwtAudience,
+		PublicKeyPath: *jwtPublicKey,
+		JWKSURL:       *jwtJWKSURL,
+		TenantClaim:   *jwtTenantClaim,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Events are only given IDs of their own if asked. They always have the
+	// events table's serial id, but that doesn't suit every deployment.
+	if *eventIDs != "" {
+		if server.EventIDs, err = eventid.New(*eventIDs, *nodeID); err != nil {
+			return err
+		}
+	}
+
+	// Receipts are signed with a secret, and name events by their IDs, so they
+	// need both.
+	if *issueReceipts {
+		secret := os.Getenv("RECEIPT_SECRET")
+		if secret == "" {
+			return errors.New("RECEIPT_SECRET must be set to use -receipts")
+		}
+
+		if server.EventIDs == nil {
+			return errors.New("-receipts needs -event-ids")
+		}
+
+		server.Receipts = &receipts{secret: []byte(secret)}
+	}
+
+	// A new schema can be tried against every event before it's enforced.
+	if *candidateSchema != "" {
+		if server.Candidate, err = loadCandidate(*candidateSchema); err != nil {
+			return err
+		}
+	}
+
+	if *keepDeadLetters {
+		server.DeadLetters = newDeadLetters()
+	}
+
+	// A fraction of events can be mirrored, to try out a migration.
+	if *shadowDatabaseURL != "" || *shadowSchema != "" {
+		server.Shadow, err = openShadow(*shadowDatabaseURL, *shadowSchema, *shadowFraction, tracer)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Admins log in with OIDC, if it's configured. Otherwise, the admin
+	// endpoints are open to anyone who can reach them.
+	if *oidcIssuer != "" {
+		server.Admin, err = newAdminAuth(oidc.Config{
+			Issuer:      *oidcIssuer,
+			ClientID:    *oidcClientID,
+			RedirectURL: *oidcRedirectURL,
+			GroupsClaim: *oidcGroupsClaim,
+		}, *adminGroup)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Get everything ready before taking any traffic. Problems are fatal with
+	// -fail-fast; otherwise the server starts anyway, in case they clear up, like
+	// a database that's still starting.
+	if problems := server.warmUp("event.jddf.json", *warmConns); len(problems) != 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "warm-up: %s\n", problem)
+		}
+
+		if *failFast {
+			return fmt.Errorf("%d problems found while warming up", len(problems))
+		}
+	}
+
+	// Events accepted but not stored before a crash are in the spool. Store them
+	// before taking any new ones.
+	if *spoolDir != "" {
+		if server.Spool, err = spool.Open(*spoolDir, spool.DefaultSegmentSize); err != nil {
+			return err
+		}
+
+		replayed, err := server.Spool.Replay(func(buf []byte) error {
+			return server.insertEvent(context.Background(), buf, server.newEventID(), server.Clock.Now())
+		})
+
+		if err != nil {
+			return fmt.Errorf("replaying spool: %s", err)
+		}
+
+		if replayed != 0 {
+			fmt.Fprintf(os.Stderr, "replayed %d events from the spool\n", replayed)
+		}
+	}
+
+	// Events can be written in the background, to take many more of them than
+	// one insert each allows. Those left waiting when the server stops are
+	// lost, unless there's a spool.
+	if *asyncWrites {
+		server.Writer = newEventWriter(&server, *flushInterval, *flushSize, *writeBuffer, func(err error) {
+			fmt.Fprintf(os.Stderr, "async writes: %s\n", err)
+		})
+
+		go server.Writer.run(context.Background())
+	}
+
+	// Events can also be validated in the background, so that slow inserts tie
+	// up only the workers, and not every client sending events.
+	if *ingestWorkers != 0 {
+		server.Pipeline = pipeline.New(*ingestWorkers, *ingestQueue, func(err error) {
+			fmt.Fprintf(os.Stderr, "ingest pipeline: %s\n", err)
+		})
+
+		server.Pipeline.Start(context.Background())
+	}
+
+	// Events can be held on disk while the database is down, instead of being
+	// turned away, and stored in the background once it's back.
+	if *spoolFallback {
+		if *spoolDir == "" {
+			return errors.New("-spool-fallback needs -spool-dir")
+		}
+
+		if server.Fallback, err = openFallback(filepath.Join(*spoolDir, "fallback")); err != nil {
+			return err
+		}
+
+		go server.drainFallback(context.Background())
+	}
+
+	// Events are shed, rather than left to wait longer and longer, when the
+	// server falls behind.
+	if *shedQueue > 0 || *shedPoolWait > 0 {
+		server.LoadShedder = &loadShedder{QueueThreshold: *shedQueue, MaxPoolWait: *shedPoolWait}
+		go server.watchLoad(context.Background())
+	}
+
+	// Events routed to sinks besides Postgres are delivered in the background.
+	// Their queues are spooled alongside the server's own, if it has one.
+	sinkSpoolDir := ""
+	if *spoolDir != "" {
+		sinkSpoolDir = filepath.Join(*spoolDir, "sinks")
+	}
+
+	injectSinkFaults(server.Routes)
+	err = server.Routes.Start(context.Background(), sinkSpoolDir, func(err error) {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	})
+
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	// Feature flags can also be flipped at runtime, in the feature_flags table.
+	if *featureRefresh != 0 {
+		go server.Features.Watch(context.Background(), server.DB, *featureRefresh, func(err error) {
+			fmt.Fprintf(os.Stderr, "refreshing feature flags: %s\n", err)
+		})
 	}
 
+	// Recent events are kept in memory, if asked, and rebuilt from the database
+	// now and then to pick up what other instances stored.
+	if *hotWindow != 0 {
+		server.Hot = hotcache.New(*hotWindow)
+		server.Hot.Clock = server.Clock
+		go server.Hot.Watch(context.Background(), server.DB, *hotReconcile, func(err error) {
+			fmt.Fprintf(os.Stderr, "reconciling hot cache: %s\n", err)
+		})
+	}
+
+	// New events can be followed as they're stored, by every instance, to tail
+	// them live and keep the hot cache without waiting for it to reconcile.
+	if *liveFeed {
+		if err := server.startLiveFeed(context.Background(), database.URL(), *livePoll); err != nil {
+			return err
+		}
+	}
+
+	// How late events arrive is tracked as they're stored, and reconciled
+	// against the database for the whole picture.
+	server.Lateness = lateness.New(*finalizeAfter)
+	server.Lateness.Clock = server.Clock
+	if *latenessReconcile != 0 {
+		go server.Lateness.Watch(context.Background(), server.DB, latenessLookback, *latenessReconcile, func(err error) {
+			fmt.Fprintf(os.Stderr, "reconciling lateness: %s\n", err)
+		})
+	}
+
+	// Who's sent events, and when, is rolled up from the events table.
+	if *usersRollup != 0 {
+		go server.rollUpUsers(context.Background(), *usersRollup)
+	}
+
+	// Derived data can be rebuilt on demand, by admins, one job at a time.
+	server.Rebuilds = newRebuilds()
+	go server.runRebuilds(context.Background())
+
+	// Saved reports are written to Google Sheets, if any are configured.
+	if server.SheetExports != nil {
+		go server.exportSheets(context.Background())
+	}
+
+	// Maintenance mode can also be toggled with a signal, in case the admin
+	// endpoints aren't reachable.
+	go server.toggleMaintenanceOnSignal()
+
 	// Construct a router which binds URLs + HTTP verbs to methods of server.
 	router := httprouter.New()
-	router.POST("/v1/events", server.createEvent)
-	router.GET("/v1/ltv", server.getLTV)
+	router.POST("/v1/events", server.withIngest(server.withPriority("normal", server.withMaxSignedBody(maxSignedBulkBody, server.withAuth(server.withScope("ingest", server.withRateLimit(server.withContentEncoding(server.withMsgpack(server.createEvent)))))))))
+	router.GET("/v1/events/ws", server.withIngest(server.withAuth(server.withScope("ingest", server.withRateLimit(server.createEventsWebSocket)))))
+	router.POST("/v1/track", server.withIngest(server.withPriority("normal", server.withSegmentWriteKey(server.withAuth(server.withScope("ingest", server.withRateLimit(server.trackEvent)))))))
+	router.POST("/v1/events/encrypted", server.withIngest(server.withPriority("normal", server.withAuth(server.withScope("ingest", server.withRateLimit(server.createEncryptedEvent))))))
+	router.POST("/v1/ingest/edge", server.withIngest(server.withPriority("normal", server.withMaxSignedBody(maxEdgeBody, server.withAuth(server.withScope("collector", server.withContentEncoding(server.ingestEdge)))))))
+	router.GET("/v1/events/live", server.withAuth(server.withScope("read", server.getLiveEvents)))
+	router.GET("/v1/events/live/ws", server.withAuth(server.withScope("read", server.getLiveEventsWebSocket)))
+	router.GET("/v1/events/status", server.withAuth(server.withScope("read", server.getEventStatus)))
+	router.GET("/v1/receipts/:id", server.withAuth(server.withScope("read", server.getReceipt)))
+	router.GET("/v1/dead-letters", server.withAuth(server.withScope("read", server.withFields(server.getDeadLetters))))
+	router.GET("/v1/ltv", server.withAuth(server.withScope("read", server.withFields(server.withQueryTimeout(server.getLTV)))))
+	router.GET("/v1/versions", server.withAuth(server.withScope("read", server.withMsgpack(server.withFields(server.withQueryTimeout(server.getVersions))))))
+	router.GET("/v1/realtime", server.withAuth(server.withScope("read", server.withMsgpack(server.withFields(server.withQueryTimeout(server.getRealtime))))))
+	router.GET("/v1/dashboard", server.withAuth(server.withScope("read", server.withMsgpack(server.withFields(server.withQueryTimeout(server.withLatencyBudget(server.getDashboard)))))))
+	router.GET("/v1/reliability", server.withAuth(server.withScope("read", server.withMsgpack(server.withFields(server.withQueryTimeout(server.getReliability))))))
+	router.GET("/v1/users", server.withAuth(server.withScope("read", server.withMsgpack(server.withFields(server.withQueryTimeout(server.getUsers))))))
+	router.GET("/v1/freshness", server.withAuth(server.withScope("read", server.withMsgpack(server.withFields(server.withQueryTimeout(server.getFreshness))))))
+	router.GET("/v1/events/export", server.withPriority("low", server.withAuth(server.withScope("read", server.exportEvents))))
+	router.POST("/v1/adapters/:name", server.withIngest(server.withPriority("normal", server.withFeature("webhook-adapters", server.adaptEvent))))
+	router.POST("/v1/forwarded", server.withIngest(server.withPriority("low", server.withAuth(server.receiveForwarded))))
+	router.POST("/v1/import/csv", server.withIngest(server.withPriority("low", server.withFeature("csv-import", server.withMaxSignedBody(maxSignedBulkBody, server.withAuth(server.withScope("ingest", server.withRateLimit(server.withContentEncoding(server.importCSV)))))))))
+	router.GET("/admin/login", server.adminLoginStart)
+	router.GET("/admin/callback", server.adminLoginCallback)
+	router.POST("/admin/logout", server.adminLogout)
+	router.GET("/admin/v1/storage", server.withAdmin(server.getStorage))
+	router.GET("/admin/v1/features", server.withAdmin(server.getFeatures))
+	router.GET("/admin/v1/maintenance", server.withAdmin(server.getMaintenance))
+	router.PUT("/admin/v1/maintenance", server.withAdmin(server.putMaintenance))
+	router.GET("/admin/v1/shadow", server.withAdmin(server.getShadow))
+	router.GET("/admin/v1/candidate", server.withAdmin(server.withQueryTimeout(server.getCandidate)))
+	router.GET("/admin/v1/routes", server.withAdmin(server.getRoutes))
+	router.GET("/admin/v1/sinks", server.withAdmin(server.getSinks))
+	router.GET("/admin/v1/pipeline", server.withAdmin(server.getPipeline))
+	router.GET("/admin/v1/events", server.withAdmin(server.withFields(server.listEvents)))
+	router.GET("/admin/v1/deprecations", server.withAdmin(server.getDeprecations))
+	router.GET("/admin/v1/sheets", server.withAdmin(server.getSheets))
+	router.GET("/admin/v1/runtime", server.withAdmin(server.getRuntime))
+	router.GET("/admin/v1/lateness", server.withAdmin(server.getLateness))
+	router.GET("/admin/v1/types", server.withAdmin(server.getTypes))
+	router.GET("/admin/v1/ingest-profile", server.withAdmin(server.withQueryTimeout(server.getIngestProfile)))
+	router.POST("/admin/v1/rebuild", server.withAdmin(server.postRebuild))
+	router.GET("/admin/v1/rebuild", server.withAdmin(server.listRebuilds))
+	router.GET("/admin/v1/rebuild/:id", server.withAdmin(server.getRebuild))
+	routeFaults(router, &server)
+
+	// Serve the TypeScript SDK, so web producers can fetch the types generated
+	// from the very same schema this server validates against.
+	router.ServeFiles("/sdk/*filepath", http.Dir("sdk"))
+
+	// gRPC needs HTTP/2, which net/http only speaks over TLS.
+	if *grpcAddr != "" {
+		if *grpcCert == "" || *grpcKey == "" {
+			return fmt.Errorf("-grpc-addr needs -grpc-cert and -grpc-key")
+		}
+
+		go func() {
+			err := http.ListenAndServeTLS(*grpcAddr, *grpcCert, *grpcKey, dbtrace.Handler(server.grpcHandler()))
+			fmt.Fprintf(os.Stderr, "serving gRPC: %s\n", err)
+			os.Exit(1)
+		}()
+	}
+
+	// Label every query with the endpoint it's for, in case they're traced.
+	//
+	// Listen and serve HTTP traffic on -addr, port 3000 by default.
+	if *tlsCert == "" {
+		if *tlsClientCA != "" || *tlsRedirectAddr != "" {
+			return fmt.Errorf("-tls-client-ca and -tls-redirect-addr need -tls-cert and -tls-key")
+		}
 
-	// Listen and serve HTTP traffic on port 3000.
-	if err := http.ListenAndServe(":3000", router); err != nil {
-		panic(err)
+		return http.ListenAndServe(*addr, dbtrace.Handler(router))
 	}
+
+	if *tlsKey == "" {
+		return fmt.Errorf("-tls-cert needs -tls-key")
+	}
+
+	// Or HTTPS, verifying the client certificates of mutual TLS, if asked.
+	tlsConfig, err := serverTLSConfig(*tlsClientCA, *tlsClientAuth)
+	if err != nil {
+		return err
+	}
+
+	if *tlsClientCA != "" && !strings.Contains(*authProviders, "client-cert") {
+		return fmt.Errorf("-tls-client-ca needs client-cert in -auth, to identify clients by their certificates")
+	}
+
+	// The certificate is reloaded when its files change, so renewing it doesn't
+	// take a restart.
+	certs, err := newCertReloader(*tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.GetCertificate = certs.GetCertificate
+
+	// Plain HTTP, if it's listened for, only redirects to HTTPS, and answers
+	// ACME challenges.
+	if *tlsRedirectAddr != "" {
+		go func() {
+			err := http.ListenAndServe(*tlsRedirectAddr, httpsRedirect(*addr, *acmeWebroot))
+			fmt.Fprintf(os.Stderr, "redirecting HTTP to HTTPS: %s\n", err)
+			os.Exit(1)
+		}()
+	}
+
+	httpServer := &http.Server{Addr: *addr, Handler: dbtrace.Handler(router), TLSConfig: tlsConfig}
+	return httpServer.ListenAndServeTLS("", "")
 }
 
 // server holds together all the things we need to run an analytics-event
 // server.
 type server struct {
+	// ltvDeliveries is how many LTV notifications are being delivered. It comes
+	// first, so that it's 64-bit aligned for sync/atomic.
+	ltvDeliveries int64
+
 	EventSchema jddf.Schema
 	DB          *sqlx.DB
+	Adapters    map[string]adapter.Adapter
+	Limits      *limits.Set
+	Features    *features.Flags
+	InsertEvent *sqlx.Stmt
+	Auth        auth.Provider
+	RequireAuth bool
+	SignedTypes map[string]bool
+	Admin       *adminAuth
+	Signatures  *signature.Cache
+	Shadow      *shadow
+	Routes      *routing.Router
+	Hot         *hotcache.Cache
+	EventIDs    eventid.Generator
+	Spool       *spool.Spool
+	Codecs      *codecs
+	Lateness    *lateness.Tracker
+	AvroSchemas *avro.Registry
+	TypeCounts  *typeCounts
+	Senders     *senderVolumes
+	Rebuilds    *rebuilds
+	Receipts    *receipts
+
+	// Deprecations are the deprecated event types and fields, and
+	// DeprecationUses counts who still sends them. See countDeprecations.
+	Deprecations    *deprecation.Set
+	DeprecationUses *deprecationUses
+
+	// SheetExports, if not nil, writes saved reports to Google Sheets. See
+	// exportSheets.
+	SheetExports *sheetExports
+
+	// Writer, if not nil, stores events in the background, in batches, and
+	// events are accepted with a 202 as soon as they're queued.
+	Writer *eventWriter
+
+	// Candidate, if not nil, is a schema being rolled out, that events are
+	// validated against as well as EventSchema.
+	Candidate *candidate
+
+	// DeadLetters, if not nil, records events the schema rejects.
+	DeadLetters *deadLetters
+
+	// Fallback, if not nil, holds events while the database is unavailable.
+	Fallback *fallback
+
+	// Feed, if not nil, follows the events table, for clients tailing it live.
+	Feed *livefeed.Feed
+
+	// Pipeline, if not nil, ingests events on a pool of workers, and events are
+	// accepted with a 202 as soon as they're submitted to it, before they're
+	// even validated.
+	Pipeline *pipeline.Pipeline
+
+	// IdempotencyWindow is how long Idempotency-Keys are remembered, or zero
+	// to ignore them.
+	IdempotencyWindow time.Duration
+
+	// Clock is what the server asks for the time, from when an event was
+	// received to when an admin session expires. Tests can swap in a
+	// clock.Fake.
+	Clock clock.Clock
+
+	// EventSchemaMeta is the metadata of EventSchema, which jddf-go doesn't
+	// keep.
+	EventSchemaMeta schemameta.Schema
+
+	// EncryptedEventSchema is the schema of the cleartext metadata of
+	// end-to-end encrypted events. See createEncryptedEvent.
+	EncryptedEventSchema jddf.Schema
+
+	// Pools limit how many requests of each priority are handled at once. See
+	// withPriority.
+	Pools        map[string]chan struct{}
+	QueueTimeout time.Duration
+
+	// RateLimit, if not nil, limits how often each client may send events. See
+	// withRateLimit.
+	RateLimit *ratelimit.Limiter
+
+	// LoadShedder, if not nil, turns events away while the server can't keep
+	// up with them. See withIngest.
+	LoadShedder *loadShedder
+
+	// LatencyBudget is how long composite endpoints may take. See
+	// withLatencyBudget.
+	LatencyBudget time.Duration
+
+	// QueryTimeout is how long analytics endpoints' queries may run. See
+	// withQueryTimeout.
+	QueryTimeout time.Duration
+
+	// maintenance is 1 while the server is in maintenance mode. See withIngest.
+	maintenance int32
 }
 
-// newServer constructs a new instance of a server using hard-coded defaults.
-func newServer() (server, error) {
+// newServer constructs a new instance of a server, connecting to the database
+// at databaseURL. If tracer isn't nil, every query the server makes is reported
+// to it.
+func newServer(databaseURL string, tracer dbtrace.Tracer) (server, error) {
 	// Connect to postgresql.
-	db, err := sqlx.Open("postgres", "postgres://postgres@localhost?sslmode=disable")
+	db, err := openDB(databaseURL, tracer)
 	if err != nil {
 		return server{}, err
 	}
@@ -59,34 +651,154 @@ func newServer() (server, error) {
 	// schemas; ultimately, you could hard-code them, pass them in from
 	// environment variables, download them from the network, or whatever other
 	// approach best meets your requirements.
-	eventSchemaFile, err := os.Open("event.jddf.json")
+	eventSchema, err := loadSchema("event.jddf.json")
 	if err != nil {
 		return server{}, err
 	}
 
-	defer eventSchemaFile.Close()
+	// The schema's metadata also says how big each type of event may be.
+	eventLimits, err := loadLimits("event.jddf.json")
+	if err != nil {
+		return server{}, err
+	}
 
-	// Here, we parse a jddf.Schema from the JSON inside the "event.jddf.json"
-	// file.
-	//
-	// You can, if you prefer, also hard-code schemas using native Golang syntax.
-	// The README of jddf-go shows you how:
-	//
-	// https://github.com/jddf/jddf-go
-	var eventSchema jddf.Schema
-	schemaDecoder := json.NewDecoder(eventSchemaFile)
-	if err := schemaDecoder.Decode(&eventSchema); err != nil {
+	// Load the feature flags configured in "features.json", if there is one.
+	featureFlags := features.New(featureDefaults)
+	if err := featureFlags.LoadFile("features.json"); err != nil {
+		return server{}, err
+	}
+
+	// Load the webhook adapters configured in "adapters.json", if there is one.
+	adapters, err := adapter.LoadMappings("adapters.json")
+	if err != nil {
+		return server{}, err
+	}
+
+	// The Stripe adapter is built in, but it can't do anything without the
+	// secret Stripe signs its webhooks with.
+	if secret := os.Getenv("STRIPE_WEBHOOK_SECRET"); secret != "" {
+		adapters["stripe"] = &adapter.Stripe{Secret: secret}
+	}
+
+	// Some types of events may be stored compacted, and some strings are
+	// decimals that filters compare as numbers, as the schema's metadata says.
+	eventSchemaMeta, err := schemameta.Load("event.jddf.json")
+	if err != nil {
+		return server{}, err
+	}
+
+	schemaCodecs, err := codec.FromSchema(eventSchema, eventSchemaMeta)
+	if err != nil {
+		return server{}, err
+	}
+
+	// Load the per-event-type routes configured in "routes.json", if there is
+	// one. Without it, every event is stored in our own database.
+	routes, err := routing.Load("routes.json")
+	if err != nil {
+		return server{}, err
+	}
+
+	// Load the event types and fields deprecated in "deprecations.json", if
+	// there is one.
+	deprecations, err := deprecation.Load("deprecations.json")
+	if err != nil {
+		return server{}, err
+	}
+
+	// Load the reports to write to Google Sheets, in "sheets.json", if there
+	// is one.
+	sheetExports, err := loadSheetExports("sheets.json")
+	if err != nil {
+		return server{}, err
+	}
+
+	// Load the Avro schemas events may be sent with, in "avro-schemas.json", if
+	// there is one.
+	avroSchemas, err := avro.LoadRegistry("avro-schemas.json")
+	if err != nil {
 		return server{}, err
 	}
 
 	// Return the server with everything it needs. The main function will handle
 	// serving HTTP traffic using this server.
 	return server{
-		EventSchema: eventSchema,
-		DB:          db,
+		EventSchema:          eventSchema,
+		EventSchemaMeta:      eventSchemaMeta,
+		EncryptedEventSchema: encryptedEventSchema(eventSchema),
+		DB:                   db,
+		Adapters:             adapters,
+		AvroSchemas:          avroSchemas,
+		TypeCounts:           newTypeCounts(eventSchema),
+		Senders:              newSenderVolumes(),
+		Deprecations:         deprecations,
+		DeprecationUses:      newDeprecationUses(),
+		SheetExports:         sheetExports,
+		Limits:               eventLimits,
+		Features:             featureFlags,
+		Signatures:           signature.NewCache(2 * signatureTolerance),
+		Routes:               routes,
+		Codecs:               newCodecs(db, eventSchema.Discriminator.Tag, schemaCodecs),
+		Clock:                clock.Real{},
 	}, nil
 }
 
+// openDB connects to postgresql. Queries with a deadline time out in Postgres
+// too (see dbtimeout). If tracer isn't nil, the connection's driver is also
+// wrapped so that every query is reported to it.
+func openDB(url string, tracer dbtrace.Tracer) (*sqlx.DB, error) {
+	pqConnector, err := pq.NewConnector(url)
+	if err != nil {
+		return nil, err
+	}
+
+	connector := dbtimeout.Connector(pqConnector)
+	if tracer != nil {
+		connector = dbtrace.Connector(connector, tracer)
+	}
+
+	// Builds for testing can make the database slow, or drop connections, on
+	// demand.
+	connector = injectDBFaults(connector)
+
+	return sqlx.NewDb(sql.OpenDB(connector), "postgres"), nil
+}
+
+// loadLimits reads the limits on events configured in the metadata of the
+// schema in the JSON file at path.
+func loadLimits(path string) (*limits.Set, error) {
+	meta, err := schemameta.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return limits.FromSchema(meta)
+}
+
+// loadSchema reads a jddf.Schema from the JSON file at path.
+func loadSchema(path string) (jddf.Schema, error) {
+	schemaFile, err := os.Open(path)
+	if err != nil {
+		return jddf.Schema{}, err
+	}
+
+	defer schemaFile.Close()
+
+	// Here, we parse a jddf.Schema from the JSON inside the file.
+	//
+	// You can, if you prefer, also hard-code schemas using native Golang syntax.
+	// The README of jddf-go shows you how:
+	//
+	// https://github.com/jddf/jddf-go
+	var schema jddf.Schema
+	schemaDecoder := json.NewDecoder(schemaFile)
+	if err := schemaDecoder.Decode(&schema); err != nil {
+		return jddf.Schema{}, err
+	}
+
+	return schema, nil
+}
+
 // dbEvent is how we represent a single event in this API in the database layer.
 //
 // The `db` tag on this struct's fields is a convenience offered by the
@@ -101,12 +813,43 @@ type dbEvent struct {
 func (s *server) createEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	defer r.Body.Close()
 
+	// Streams of events are handled line by line, rather than read in whole.
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" {
+		s.createEventStream(w, r)
+		return
+	}
+
 	// Read the body out into a buffer.
-	buf, err := ioutil.ReadAll(r.Body)
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEventBody+1))
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s", err)
+		// Bodies are decompressed as they're read, so a corrupt one shows up
+		// here. That's the client's fault, not ours.
+		writeAPIError(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+
+	if len(buf) > maxEventBody {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("an event's body may be at most %d bytes", maxEventBody))
+		return
+	}
+
+	// Avro and MessagePack are decoded into the same generic values JSON would
+	// be, and then stored as JSON.
+	if mediaType == "avro/binary" || mediaType == "application/avro" {
+		s.createAvroEvent(w, r, buf)
+		return
+	}
+
+	if isMsgpack(mediaType) {
+		s.createMsgpackEvent(w, r, buf)
+		return
+	}
+
+	// Events of types the schema doesn't have are turned away before the
+	// expense of parsing them.
+	if s.rejectUnknownType(w, buf) {
 		return
 	}
 
@@ -115,11 +858,134 @@ func (s *server) createEvent(w http.ResponseWriter, r *http.Request, _ httproute
 	// If the request body is invalid JSON, send the user a 400 Bad Request.
 	var eventRaw interface{}
 	if err := json.Unmarshal(buf, &eventRaw); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", err)
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error())
 		return
 	}
 
+	s.storeEvent(w, r, buf, eventRaw)
+}
+
+// storeEvent validates an event against our schema and, if it's valid, inserts
+// it into the database, responding to the client either way. buf is the
+// event's JSON, and eventRaw is that same JSON parsed into generic Golang
+// values.
+//
+// Every HTTP endpoint that ingests events goes through here, so they all get
+// exactly the same validation.
+func (s *server) storeEvent(w http.ResponseWriter, r *http.Request, buf []byte, eventRaw interface{}) {
+	// Producers are warned about deprecated types and fields whether or not
+	// the event's accepted: either way, they should stop sending them.
+	event, _ := eventRaw.(map[string]interface{})
+	eventType, _ := event[s.EventSchema.Discriminator.Tag].(string)
+	warnDeprecations(w, s.Deprecations.Check(eventType, event))
+
+	// ingestEventAs checks this too, but with an ingest pipeline it only runs
+	// once the client's been told the event was accepted.
+	if err := s.checkSigned(r.Context(), eventType); err != nil {
+		writeAPIError(w, err.Status, err.Code, err.Message)
+		return
+	}
+
+	// A client that retries with the same Idempotency-Key gets the same answer
+	// as the first time, without storing the event again.
+	key, prior, err := s.claimIdempotencyKey(r.Context(), r, buf)
+	var id string
+	var received time.Time
+	if prior != nil {
+		id, received = prior.EventID.String, prior.Received
+		w.Header().Set("Idempotent-Replayed", "true")
+	} else if err == nil && s.Pipeline != nil {
+		s.submitEvent(w, r, key, buf, eventRaw)
+		return
+	} else if err == nil {
+		id, received, err = s.ingestEvent(r.Context(), buf, eventRaw)
+		if key != nil && err != nil {
+			s.releaseIdempotencyKey(key)
+		}
+
+		// The event is stored either way. Failing the request now would only
+		// have the client send it again.
+		if key != nil && err == nil {
+			if err := s.completeIdempotencyKey(key, id, received); err != nil {
+				fmt.Fprintf(os.Stderr, "completing idempotency key: %s\n", err)
+			}
+		}
+	}
+
+	// If there were validation errors, then we send the user a 400 Bad Request,
+	// with the errors in the response body.
+	if err, ok := err.(*ingestError); ok {
+		if err.ValidationErrors != nil {
+			respondJSON(w, err.Status, err.ValidationErrors)
+		} else {
+			writeAPIError(w, err.Status, err.Code, err.Message)
+		}
+
+		return
+	}
+
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	// We're done!
+	if id != "" {
+		w.Header().Set("X-Event-Id", id)
+	}
+
+	if s.Receipts != nil && id != "" {
+		rcpt, err := s.Receipts.issue(id, eventRaw, received)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+
+		w.Header().Set("X-Event-Receipt", rcpt.header())
+	}
+
+	// Events written in the background have only been accepted, so far.
+	if s.Writer != nil || s.Pipeline != nil {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	fmt.Fprintf(w, "%s", buf)
+}
+
+// ingestError is why ingestEvent rejected an event. Status is the HTTP status
+// to respond with.
+type ingestError struct {
+	Status  int
+	Code    string
+	Message string
+
+	// ValidationErrors are where the event doesn't match the schema, if that's
+	// the problem.
+	ValidationErrors []jddf.ValidationError
+}
+
+func (e *ingestError) Error() string {
+	return e.Message
+}
+
+// ingestEvent is what storeEvent does, minus talking HTTP, for ingestion
+// paths that don't. It returns the event's ID, if it was stored and the server
+// assigns them, and when it was stored. Events that are rejected get an
+// *ingestError; other errors are the server's fault.
+//
+// If the server assigns IDs to events, this one's is decided now, so that it
+// can be reported to the client. So is when it's received, to the microsecond,
+// which is all Postgres keeps of it; receipts are signed over the time as it's
+// stored.
+func (s *server) ingestEvent(ctx context.Context, buf []byte, eventRaw interface{}) (string, time.Time, error) {
+	return s.ingestEventAs(ctx, buf, eventRaw, s.newEventID(), s.Clock.Now().Truncate(time.Microsecond))
+}
+
+// ingestEventAs is ingestEvent for an event whose ID and time received have
+// already been decided, because it was accepted before it was ingested.
+func (s *server) ingestEventAs(ctx context.Context, buf []byte, eventRaw interface{}, id string, received time.Time) (string, time.Time, error) {
 	// Validate the event (in eventRaw) against our schema for JDDF events.
 	//
 	// In practice, there will never be errors arising here -- see the jddf-go
@@ -130,39 +996,193 @@ func (s *server) createEvent(w http.ResponseWriter, r *http.Request, _ httproute
 	validator := jddf.Validator{}
 	validationResult, _ := validator.Validate(s.EventSchema, eventRaw)
 
-	// If there were validation errors, then we write them out to the response
-	// body, and send the user a 400 Bad Request.
 	if len(validationResult.Errors) != 0 {
-		encoder := json.NewEncoder(w)
-		if err := encoder.Encode(validationResult.Errors); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "%s", err)
-			return
+		if s.DeadLetters != nil {
+			s.recordDeadLetter(ctx, buf, eventRaw, validationResult.Errors, received)
 		}
 
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		message, _ := json.Marshal(validationResult.Errors)
+		return "", time.Time{}, &ingestError{
+			Status:           http.StatusBadRequest,
+			Code:             "event_invalid",
+			Message:          fmt.Sprintf("event doesn't match the schema: %s", message),
+			ValidationErrors: validationResult.Errors,
+		}
+	}
+
+	// Clients may be restricted to sending only some types of events. Now that
+	// we know the event is valid, we know it has a type to check.
+	eventType := eventRaw.(map[string]interface{})[s.EventSchema.Discriminator.Tag].(string)
+
+	// While a new schema's being rolled out, events the current one accepts are
+	// tried against it too, but it doesn't reject anything yet.
+	if s.Candidate != nil {
+		s.checkCandidate(buf, eventRaw, eventType)
+	}
+
+	// A valid event can still be too big to store comfortably. The limits on
+	// each type of event come from the schema's metadata.
+	if err := s.Limits.Check(eventType, buf, eventRaw, received); err != nil {
+		violation := err.(*limits.Violation)
+		return "", time.Time{}, &ingestError{Status: http.StatusBadRequest, Code: violation.Code, Message: violation.Message}
+	}
+
+	if principal := auth.FromContext(ctx); principal != nil && !principal.Allows(eventType) {
+		return "", time.Time{}, &ingestError{Status: http.StatusForbidden, Code: "event_type_forbidden", Message: fmt.Sprintf("%s may not send %q events", principal.Subject, eventType)}
+	}
+
+	if err := s.checkSigned(ctx, eventType); err != nil {
+		return "", time.Time{}, err
 	}
 
 	// If we made it here, the request body contained JSON that passed our schema.
-	// Let's now write it into the database.
-	//
-	// The events table has a "payload" column of type "jsonb". In Golang-land,
-	// you can send that to Postgres by just using []byte. The user's request
-	// payload is already in that format, so we'll use that.
-	_, err = s.DB.ExecContext(r.Context(), `
-		insert into events (payload) values ($1)
-	`, buf)
+	// Let's now write it wherever events of its type go -- by default, just our
+	// own database.
+	route := s.Routes.Route(eventType)
+	postgres := routing.SinkFunc(func(ctx context.Context, events []routing.Event) error {
+		// Route.Send hands Postgres just the one event.
+		if s.Writer != nil {
+			return s.Writer.enqueue(events[0], id, received)
+		}
 
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s", err)
-		return
+		return s.insertSpooledEvent(ctx, events[0], id, received)
+	})
+
+	// With writes in the background, events are turned away once they back
+	// up, so that clients can send them again later.
+	if s.Writer != nil && route.Stores() && s.Writer.full() {
+		return "", time.Time{}, &ingestError{Status: http.StatusServiceUnavailable, Code: "write_buffer_full", Message: "events are arriving faster than they can be stored; retry later"}
 	}
 
-	// We're done!
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "%s", buf)
+	if err := route.Send(ctx, buf, postgres); err != nil {
+		return "", time.Time{}, err
+	}
+
+	// Deprecated types and fields are still accepted, but who sent them is
+	// noted, so they can be told before they're removed.
+	s.countDeprecations(ctx, eventType, eventRaw.(map[string]interface{}))
+
+	// Events routed away from Postgres are delivered, but not stored, so there's
+	// nothing more to do.
+	if !route.Stores() {
+		return "", time.Time{}, nil
+	}
+
+	// While a migration's being tried out, some events are also sent to the
+	// shadow. It only ever sees events that were stored for real.
+	if s.Shadow != nil {
+		s.Shadow.mirror(buf, eventRaw)
+	}
+
+	s.observeLateness(eventRaw.(map[string]interface{}), received)
+	s.Senders.add(auth.FromContext(ctx), len(buf))
+
+	// With a live feed, the hot cache gets every instance's events from it.
+	if s.Hot != nil && s.Feed == nil {
+		event := eventRaw.(map[string]interface{})
+		userID, _ := event["userId"].(string)
+		revenue, _ := event["revenue"].(string)
+		s.Hot.Add(received, eventType, userID, revenue)
+	}
+
+	// Orders may push the user's LTV past a threshold someone wants to hear
+	// about. The event is already stored by now, so a failure here is only
+	// logged.
+	if eventType == "Order Completed" {
+		if err := s.notifyLTV(ctx, buf, eventRaw.(map[string]interface{})); err != nil {
+			fmt.Fprintf(os.Stderr, "ltv notifications: %s\n", err)
+		}
+	}
+
+	return id, received, nil
+}
+
+// insertEvent writes an event into the events table, with the given ID if the
+// server assigns them, as received at the given time.
+//
+// The events table has a "payload" column of type "jsonb". In Golang-land, you
+// can send that to Postgres by just using []byte. The user's request payload is
+// already in that format, so we'll use that.
+//
+// If the server's warmed up, the insert statement is already prepared.
+func (s *server) insertEvent(ctx context.Context, buf []byte, id string, received time.Time) error {
+	// Types with a codec are stored compacted, rather than as jsonb.
+	if compact, codecID, ok := s.Codecs.encode(buf); ok {
+		args := []interface{}{codecID, compact, received}
+		if s.EventIDs != nil {
+			args = append(args, id)
+		}
+
+		_, err := s.DB.ExecContext(ctx, s.insertEventQuery("codec_id", "payload_compact"), args...)
+		return err
+	}
+
+	args := []interface{}{buf, received}
+	if s.EventIDs != nil {
+		args = append(args, id)
+	}
+
+	if s.InsertEvent != nil {
+		_, err := s.InsertEvent.ExecContext(ctx, args...)
+		return err
+	}
+
+	_, err := s.DB.ExecContext(ctx, s.insertEventQuery("payload"), args...)
+	return err
+}
+
+// insertSpooledEvent is like insertEvent, but if the server has a spool, the
+// event is on disk before it's sent to the database, so it survives the server
+// dying in between. If the server has a fallback, and the database is
+// unavailable, the event is held there, to be stored once it's back.
+func (s *server) insertSpooledEvent(ctx context.Context, buf []byte, id string, received time.Time) error {
+	if s.Spool != nil {
+		segment, err := s.Spool.Append(buf)
+		if err != nil {
+			return err
+		}
+
+		defer s.Spool.Done(segment)
+	}
+
+	err := s.insertEvent(ctx, buf, id, received)
+	if err != nil && s.Fallback != nil && shouldHold(ctx, err) {
+		return s.Fallback.hold(buf, id, received)
+	}
+
+	return err
+}
+
+// newEventID returns an ID for a new event, or "" if the server doesn't assign
+// them.
+func (s *server) newEventID() string {
+	if s.EventIDs == nil {
+		return ""
+	}
+
+	return s.EventIDs.New()
+}
+
+// insertEventQuery returns the statement insertEvent runs to insert the given
+// columns, followed by received_at. The event_id column is only written if the
+// server assigns IDs, so that databases created before it existed keep working.
+func (s *server) insertEventQuery(columns ...string) string {
+	columns = append(columns, "received_at")
+	if s.EventIDs != nil {
+		columns = append(columns, "event_id")
+	}
+
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	return fmt.Sprintf("insert into events (%s) values (%s)", strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+}
+
+// ltvRequest is the parameters of GET /v1/ltv.
+type ltvRequest struct {
+	UserID string
 }
 
 // This is the endpoint for getting the lifetime value ("LTV", in marketing
@@ -171,23 +1191,28 @@ func (s *server) createEvent(w http.ResponseWriter, r *http.Request, _ httproute
 // This lives at GET /v1/ltv?userId=XXX
 func (s *server) getLTV(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// Get a user ID from the query parameters.
-	userID := r.URL.Query().Get("userId")
+	p := params{values: r.URL.Query()}
+	req := ltvRequest{UserID: p.userID("userId")}
+	if p.failed(w) {
+		return
+	}
+
+	// Get all events, in raw format, from the database. The querybuilder package
+	// takes care of turning our filter into a parameterized "where" clause.
+	var q querybuilder.Query
+	filter := querybuilder.Filter{Type: "Order Completed", UserID: req.UserID}
 
-	// Get all events, in raw format, from the database.
 	var dbEvents []dbEvent
 	err := s.DB.SelectContext(r.Context(), &dbEvents, `
 		select
 			payload
 		from
-			events
+			events_expanded
 		where
-			payload->>'type' = 'Order Completed' and
-			payload->>'userId' = $1
-	`, userID)
+			`+q.Where(filter), q.Args()...)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s", err)
+		writeQueryError(w, err)
 		return
 	}
 
@@ -206,24 +1231,25 @@ func (s *server) getLTV(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		// uses the same JDDF schema, then parsing out raw Postgres jsonb data into
 		// our Golang structs is a safe and error-proof operation.
 		if err := json.Unmarshal(dbEvent.Payload, &events[i]); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "%s", err)
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
 			return
 		}
 	}
 
 	// Now that we have our raw jsonb data parsed into something conveninent for
 	// Golang manipulation, let's sum over the revenue of all the returned events.
-	sum := 0.0
+	//
+	// Revenue is a decimal string, which money.Sum adds up exactly.
+	var sum money.Sum
 	for _, event := range events {
 		// We happen to know, from how we wrote our SQL, that all of these events
 		// are of the "Order Completed" type. But if you're feeling cautious, you
 		// could do an assertion to ensure the event.Type is always
 		// EventTypeOrderCompleted.
-		sum += event.EventOrderCompleted.Revenue
+		sum.Add(event.EventOrderCompleted.Revenue)
 	}
 
 	// Send back the calculated sum to the user.
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "%f", sum)
+	fmt.Fprintf(w, "%s", sum)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maintenanceRetryAfter is how long, in seconds, clients are told to wait
+// before retrying while the server is in maintenance mode.
+const maintenanceRetryAfter = "60"
+
+// maintenanceStatus is the body of the maintenance mode endpoints.
+type maintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// inMaintenance returns whether the server is in maintenance mode.
+func (s *server) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) != 0
+}
+
+// setMaintenance turns maintenance mode on or off.
+func (s *server) setMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+
+	if atomic.SwapInt32(&s.maintenance, v) != v {
+		fmt.Fprintf(os.Stderr, "maintenance mode: %v\n", enabled)
+	}
+}
+
+// withIngest wraps an endpoint that writes events, so that it's unavailable
+// while the server is in maintenance mode, or overloaded. Read endpoints carry on as normal,
+// which is what makes maintenance mode useful for migrations and failovers:
+// dashboards keep working, and clients know to retry their writes later.
+func (s *server) withIngest(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if s.inMaintenance() {
+			w.Header().Set("Retry-After", maintenanceRetryAfter)
+			writeAPIError(w, http.StatusServiceUnavailable, "maintenance", "the server is in maintenance mode, and not accepting events; retry later")
+			return
+		}
+
+		// Events are also turned away while the server can't keep up with them.
+		if s.LoadShedder != nil {
+			if reason := s.overloaded(); reason != "" {
+				s.shedLoad(w, reason)
+				return
+			}
+		}
+
+		h(w, r, p)
+	}
+}
+
+// toggleMaintenanceOnSignal toggles maintenance mode whenever the process gets
+// a SIGUSR1, for when the admin endpoints aren't reachable.
+func (s *server) toggleMaintenanceOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	for range signals {
+		s.setMaintenance(!s.inMaintenance())
+	}
+}
+
+// getMaintenance reports whether the server is in maintenance mode.
+//
+// This lives at GET /admin/v1/maintenance.
+func (s *server) getMaintenance(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondJSON(w, http.StatusOK, maintenanceStatus{Enabled: s.inMaintenance()})
+}
+
+// putMaintenance turns maintenance mode on or off, with a body like
+// {"enabled": true}.
+//
+// This lives at PUT /admin/v1/maintenance.
+func (s *server) putMaintenance(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer r.Body.Close()
+
+	var status maintenanceStatus
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	s.setMaintenance(status.Enabled)
+	s.getMaintenance(w, r, p)
+}
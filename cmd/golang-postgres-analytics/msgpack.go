@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/msgpack"
+	"github.com/julienschmidt/httprouter"
+)
+
+// msgpackContentType is MessagePack's media type. application/x-msgpack is
+// accepted too, since older clients use it.
+const msgpackContentType = "application/msgpack"
+
+func isMsgpack(mediaType string) bool {
+	return mediaType == msgpackContentType || mediaType == "application/x-msgpack"
+}
+
+// createMsgpackEvent stores an event sent as MessagePack to POST /v1/events.
+// It's decoded into the same values its JSON would be, and from then on it's
+// treated just like that JSON: validated, and stored as JSON.
+func (s *server) createMsgpackEvent(w http.ResponseWriter, r *http.Request, body []byte) {
+	eventRaw, err := msgpack.Decode(body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "msgpack_invalid", err.Error())
+		return
+	}
+
+	buf, err := json.Marshal(eventRaw)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	s.storeEvent(w, r, buf, eventRaw)
+}
+
+// withMsgpack sends JSON responses as MessagePack instead, to clients that
+// say they accept it. Other responses, like plain-text errors, are sent as
+// they are.
+func (s *server) withMsgpack(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !acceptsMsgpack(r.Header.Get("Accept")) {
+			h(w, r, p)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+		h(rec, r, p)
+
+		body := rec.body.Bytes()
+		if mediaType, _, _ := mime.ParseMediaType(rec.header.Get("Content-Type")); mediaType == "application/json" {
+			// Numbers are kept as they were written, so integers stay integers.
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+
+			var v interface{}
+			err := decoder.Decode(&v)
+			if err == nil {
+				body, err = msgpack.Encode(v)
+			}
+
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+
+			rec.header.Set("Content-Type", msgpackContentType)
+			rec.header.Del("Content-Length")
+		}
+
+		for name, values := range rec.header {
+			w.Header()[name] = values
+		}
+
+		w.Header().Add("Vary", "Accept")
+		w.WriteHeader(rec.status)
+		w.Write(body)
+	}
+}
+
+// acceptsMsgpack returns whether an Accept header accepts MessagePack.
+func acceptsMsgpack(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil || !isMsgpack(mediaType) {
+			continue
+		}
+
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// responseRecorder holds on to a response, so that it can be changed before
+// it's sent.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wrote {
+		rec.status, rec.wrote = status, true
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wrote = true
+	return rec.body.Write(b)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/limits"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/routing"
+	"github.com/jddf/jddf-go"
+)
+
+// maxNDJSONLine is the longest line a streamed NDJSON request may have. It's
+// well past any event the limits allow, but stops a body without newlines from
+// being buffered whole.
+const maxNDJSONLine = 1 << 20
+
+// createEventStream stores a stream of events, one JSON object per line, for
+// POST /v1/events with Content-Type: application/x-ndjson.
+//
+// Lines are read, checked and inserted in batches as the body arrives, so a
+// stream of millions of historical events never has to fit in memory. Like
+// the CSV import, a bad line doesn't stop the rest: the response reports how
+// many events were inserted, and what was wrong with each rejected line, with
+// "row" as its line number. Deprecated types and fields are reported the same
+// way, in "warnings".
+//
+// Otherwise, events go through what ingestEvent does after validating an
+// event: they're given IDs, compacted if their type has a codec, and sent
+// wherever their route says, with rejected events kept as dead letters and
+// valid ones tried against a candidate schema. Their share for Postgres is
+// stored in bulk, though, and they skip the shadow, the hot cache and LTV
+// notifications, which are for live traffic. Events a route sends only
+// elsewhere count as inserted once they're queued.
+func (s *server) createEventStream(w http.ResponseWriter, r *http.Request) {
+	report := importReport{Errors: []importRowError{}}
+	reject := func(rowErr importRowError) {
+		report.Rejected++
+		if len(report.Errors) < maxImportErrors {
+			report.Errors = append(report.Errors, rowErr)
+		}
+	}
+
+	var batch [][]byte
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := s.copier().copyEvents(r.Context(), s.DB, batch, s.Clock.Now()); err != nil {
+			return err
+		}
+
+		report.Inserted += len(batch)
+		batch = nil
+		return nil
+	}
+
+	// Routes hand the events they store to Postgres to the batch.
+	toBatch := routing.SinkFunc(func(_ context.Context, events []routing.Event) error {
+		for _, event := range events {
+			batch = append(batch, event)
+		}
+
+		return nil
+	})
+
+	principal := auth.FromContext(r.Context())
+	validator := jddf.Validator{}
+	lines := bufio.NewScanner(r.Body)
+	lines.Buffer(make([]byte, 64*1024), maxNDJSONLine)
+	line := 0
+	for lines.Scan() {
+		line++
+		buf := bytes.TrimSpace(lines.Bytes())
+		if len(buf) == 0 {
+			continue
+		}
+
+		// The scanner reuses its buffer, so the line has to be copied to
+		// outlive the next Scan.
+		buf = append([]byte(nil), buf...)
+
+		var eventRaw interface{}
+		if err := json.Unmarshal(buf, &eventRaw); err != nil {
+			reject(importRowError{Row: line, Message: err.Error()})
+			continue
+		}
+
+		// As in createEvent, this can only error for cyclic schemas.
+		validationResult, _ := validator.Validate(s.EventSchema, eventRaw)
+		if len(validationResult.Errors) != 0 {
+			if s.DeadLetters != nil {
+				s.recordDeadLetter(r.Context(), buf, eventRaw, validationResult.Errors, s.Clock.Now())
+			}
+
+			reject(importRowError{Row: line, ValidationErrors: validationResult.Errors})
+			continue
+		}
+
+		eventType := eventRaw.(map[string]interface{})[s.EventSchema.Discriminator.Tag].(string)
+		if s.Candidate != nil {
+			s.checkCandidate(buf, eventRaw, eventType)
+		}
+
+		if principal != nil && !principal.Allows(eventType) {
+			reject(importRowError{Row: line, Message: fmt.Sprintf("%s may not send %q events", principal.Subject, eventType)})
+			continue
+		}
+
+		if err := s.checkSigned(r.Context(), eventType); err != nil {
+			reject(importRowError{Row: line, Message: err.Message})
+			continue
+		}
+
+		if err := s.Limits.Check(eventType, buf, eventRaw, s.Clock.Now()); err != nil {
+			reject(importRowError{Row: line, Message: err.(*limits.Violation).Message})
+			continue
+		}
+
+		route := s.Routes.Route(eventType)
+		if err := route.Send(r.Context(), buf, toBatch); err != nil {
+			reject(importRowError{Row: line, Message: err.Error()})
+			continue
+		}
+
+		if !route.Stores() {
+			report.Inserted++
+		}
+
+		report.warn(line, s.countDeprecations(r.Context(), eventType, eventRaw.(map[string]interface{})))
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+				return
+			}
+		}
+	}
+
+	if err := lines.Err(); err != nil {
+		// Whatever was read before the error is still stored, and reported, so
+		// the client knows where to pick up from.
+		if flushErr := flush(); flushErr != nil {
+			err = flushErr
+		}
+
+		writeAPIError(w, http.StatusBadRequest, "invalid_stream", fmt.Sprintf("reading line %d: %s (%d events inserted before it)", line+1, err, report.Inserted))
+		return
+	}
+
+	if err := flush(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
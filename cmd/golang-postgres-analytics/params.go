@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxUserIDLength is the longest user ID accepted in query parameters.
+const maxUserIDLength = 256
+
+// maxTraits is the most trait filters a request may have. Each one is another
+// condition on the users table.
+const maxTraits = 10
+
+// paramError is a problem with one query parameter.
+type paramError struct {
+	Param   string `json:"param"`
+	Message string `json:"message"`
+}
+
+// params parses query parameters, collecting every problem with them rather
+// than stopping at the first, so a client can fix them all at once.
+//
+// Each endpoint that takes parameters has a request struct, which it fills in
+// with params. For example:
+//
+//	p := params{values: r.URL.Query()}
+//	req := ltvRequest{UserID: p.userID("userId")}
+//	if p.failed(w) {
+//	  return
+//	}
+type params struct {
+	values url.Values
+	errors []paramError
+}
+
+func (p *params) fail(name, format string, args ...interface{}) {
+	p.errors = append(p.errors, paramError{Param: name, Message: fmt.Sprintf(format, args...)})
+}
+
+// failed reports whether any parameter was invalid. If so, it sends the client
+// a 400 listing them all.
+func (p *params) failed(w http.ResponseWriter) bool {
+	if len(p.errors) == 0 {
+		return false
+	}
+
+	messages := make([]string, len(p.errors))
+	for i, e := range p.errors {
+		messages[i] = e.Param + " " + e.Message
+	}
+
+	writeAPIErrorWithParams(w, http.StatusBadRequest, "invalid_parameters", strings.Join(messages, "; "), p.errors)
+	return true
+}
+
+// string returns a parameter, or def if it's not set.
+func (p *params) string(name, def string) string {
+	if v := p.values.Get(name); v != "" {
+		return v
+	}
+
+	return def
+}
+
+// oneOf returns a parameter, which must be one of choices, or def if it's not
+// set.
+func (p *params) oneOf(name, def string, choices ...string) string {
+	v := p.string(name, def)
+	for _, choice := range choices {
+		if v == choice {
+			return v
+		}
+	}
+
+	p.fail(name, "must be one of %s", strings.Join(choices, ", "))
+	return def
+}
+
+// userID returns a parameter which is required, and must look like a user ID:
+// not too long, and without control characters.
+func (p *params) userID(name string) string {
+	v := p.values.Get(name)
+	switch {
+	case v == "":
+		p.fail(name, "is required")
+	case len(v) > maxUserIDLength:
+		p.fail(name, "must be at most %d bytes", maxUserIDLength)
+	case strings.IndexFunc(v, unicode.IsControl) >= 0:
+		p.fail(name, "must not contain control characters")
+	}
+
+	return v
+}
+
+// optionalUserID is like userID, but returns "" if the parameter isn't set.
+func (p *params) optionalUserID(name string) string {
+	if p.values.Get(name) == "" {
+		return ""
+	}
+
+	return p.userID(name)
+}
+
+// traits returns every parameter like trait.plan=pro, as a map from the trait
+// name to its value, or nil if there aren't any.
+func (p *params) traits() map[string]string {
+	var traits map[string]string
+	for name := range p.values {
+		if !strings.HasPrefix(name, "trait.") {
+			continue
+		}
+
+		trait, v := strings.TrimPrefix(name, "trait."), p.values.Get(name)
+		switch {
+		case trait == "":
+			p.fail(name, "must name a trait, like trait.plan")
+		case len(p.values[name]) > 1:
+			p.fail(name, "may only be given once")
+		case strings.IndexFunc(trait+v, unicode.IsControl) >= 0:
+			p.fail(name, "must not contain control characters")
+		default:
+			if traits == nil {
+				traits = map[string]string{}
+			}
+
+			traits[trait] = v
+		}
+	}
+
+	if len(traits) > maxTraits {
+		p.fail("trait.*", "may be given for at most %d traits", maxTraits)
+	}
+
+	return traits
+}
+
+// time returns a parameter as an RFC3339 timestamp, or def if it's not set.
+func (p *params) time(name string, def time.Time) time.Time {
+	v := p.values.Get(name)
+	if v == "" {
+		return def
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		p.fail(name, "must be an RFC3339 timestamp, like 2020-01-01T00:00:00Z")
+		return def
+	}
+
+	return t
+}
+
+// timeZone returns a parameter as an IANA time zone, like "Europe/Berlin", or
+// UTC if it's not set.
+func (p *params) timeZone(name string) *time.Location {
+	v := p.values.Get(name)
+	if v == "" {
+		return time.UTC
+	}
+
+	// LoadLocation also accepts "Local", which means something different to
+	// Postgres.
+	loc, err := time.LoadLocation(v)
+	if err != nil || v == "Local" {
+		p.fail(name, "must be an IANA time zone, like Europe/Berlin")
+		return time.UTC
+	}
+
+	return loc
+}
+
+// duration returns a parameter as a positive duration, like "15m", no more
+// than max, or def if it's not set.
+func (p *params) duration(name string, def, max time.Duration) time.Duration {
+	v := p.values.Get(name)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	switch {
+	case err != nil || d <= 0:
+		p.fail(name, "must be a positive duration, like 15m")
+	case max != 0 && d > max:
+		p.fail(name, "must be at most %s", max)
+	default:
+		return d
+	}
+
+	return def
+}
+
+// int returns a parameter as an integer from min to max, or def if it's not
+// set.
+func (p *params) int(name string, def, min, max int) int {
+	v := p.values.Get(name)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		p.fail(name, "must be an integer from %d to %d", min, max)
+		return def
+	}
+
+	return n
+}
+
+// timeRange checks that a range of times, from two parameters, isn't
+// backwards.
+func (p *params) timeRange(fromName string, from time.Time, toName string, to time.Time) {
+	if to.Before(from) {
+		p.fail(toName, "must not be before %s", fromName)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/pipeline"
+	"github.com/julienschmidt/httprouter"
+)
+
+// submitEvent is storeEvent for servers with an ingest pipeline. The event is
+// handed to the pipeline's workers, to be validated and stored there, and the
+// client is told it was accepted without waiting for either.
+//
+// The event's ID and time received are decided now, so the client can ask
+// about it at GET /v1/events/status. There's no receipt: the event hasn't been
+// stored, and may yet be rejected. A claimed Idempotency-Key stays in use
+// until the event is stored, or released if it's rejected.
+func (s *server) submitEvent(w http.ResponseWriter, r *http.Request, key *idempotencyKey, buf []byte, eventRaw interface{}) {
+	id := s.newEventID()
+	received := s.Clock.Now().Truncate(time.Microsecond)
+
+	// The request's context is done as soon as this returns, but who sent the
+	// event still decides what they may send.
+	principal := auth.FromContext(r.Context())
+	err := s.Pipeline.Submit(id, func(ctx context.Context) error {
+		_, _, err := s.ingestEventAs(auth.NewContext(ctx, principal), buf, eventRaw, id, received)
+		if key != nil && err != nil {
+			s.releaseIdempotencyKey(key)
+		}
+
+		if key != nil && err == nil {
+			if err := s.completeIdempotencyKey(key, id, received); err != nil {
+				return fmt.Errorf("completing idempotency key: %s", err)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("event %s: %s", id, err)
+		}
+
+		return nil
+	})
+
+	if err == pipeline.ErrFull {
+		if key != nil {
+			s.releaseIdempotencyKey(key)
+		}
+
+		writeAPIError(w, http.StatusServiceUnavailable, "ingest_queue_full", "events are arriving faster than they can be handled; retry later")
+		return
+	}
+
+	if id != "" {
+		w.Header().Set("X-Event-Id", id)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "%s", buf)
+}
+
+// getPipeline reports how the ingest pipeline is doing: how many events are
+// waiting for a worker, and how many were stored or rejected.
+//
+// This lives at GET /admin/v1/pipeline.
+func (s *server) getPipeline(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.Pipeline == nil {
+		writeAPIError(w, http.StatusNotFound, "pipeline_disabled", "this server ingests events as they arrive; see -ingest-workers")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.Pipeline.Stats())
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxRequestTimeout caps the timeout clients may ask for with
+// X-Request-Timeout.
+const maxRequestTimeout = 5 * time.Minute
+
+// priorityPools maps the priorities clients may ask for, with X-Priority, to
+// the pool of workers their requests are handled by.
+var priorityPools = map[string]string{
+	"high":   "interactive",
+	"normal": "interactive",
+	"low":    "bulk",
+}
+
+// newPools returns the semaphores limiting how many requests each pool handles
+// at once.
+func newPools(interactive, bulk int) map[string]chan struct{} {
+	return map[string]chan struct{}{
+		"interactive": make(chan struct{}, interactive),
+		"bulk":        make(chan struct{}, bulk),
+	}
+}
+
+// withPriority wraps an endpoint, so that it's handled in the pool for the
+// request's priority. That way, a bulk backfill can't use up the capacity that
+// interactive clients need.
+//
+// Clients choose a priority with the X-Priority header: "high", "normal", or
+// "low". Requests without one, or with an unknown one, get defaultPriority.
+// If the pool is busy for longer than the server's queue timeout, the request
+// is rejected with a 503 and a Retry-After header.
+//
+// Clients may also send an X-Request-Timeout header, like "30s", to bound how
+// long the server spends on the request, including waiting for the pool.
+func (s *server) withPriority(defaultPriority string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		pool, ok := priorityPools[r.Header.Get("X-Priority")]
+		if !ok {
+			pool = priorityPools[defaultPriority]
+		}
+
+		ctx := r.Context()
+		if header := r.Header.Get("X-Request-Timeout"); header != "" {
+			timeout, err := time.ParseDuration(header)
+			if err != nil || timeout <= 0 {
+				writeAPIError(w, http.StatusBadRequest, "invalid_timeout", "X-Request-Timeout must be a positive duration, like \"30s\"")
+				return
+			}
+
+			if timeout > maxRequestTimeout {
+				timeout = maxRequestTimeout
+			}
+
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		queueTimeout := time.NewTimer(s.QueueTimeout)
+		defer queueTimeout.Stop()
+
+		select {
+		case s.Pools[pool] <- struct{}{}:
+			defer func() { <-s.Pools[pool] }()
+		case <-queueTimeout.C:
+			w.Header().Set("Retry-After", "1")
+			writeAPIError(w, http.StatusServiceUnavailable, "overloaded", "the server is too busy to handle "+pool+" requests right now; retry later")
+			return
+		case <-ctx.Done():
+			writeAPIError(w, http.StatusServiceUnavailable, "timeout", "the request timed out waiting to be handled")
+			return
+		}
+
+		h(w, r.WithContext(ctx), p)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/protogen"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+)
+
+// proto is the "proto" subcommand. It generates a protobuf definition of
+// events from the event schema, and Go types for it that convert to and from
+// event.Event.
+//
+// It's run by "go generate" to keep internal/eventpb in sync with
+// event.jddf.json.
+func proto(args []string) error {
+	flags := flag.NewFlagSet("proto", flag.ContinueOnError)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	protoOut := flags.String("proto-out", "event.proto", "write the .proto definition to this file")
+	goOut := flags.String("go-out", "", "write the Go types to this file, in the eventpb package (default: don't)")
+	pkg := flags.String("package", "analytics.events.v1", "protobuf package to define the messages in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	meta, err := schemameta.Load(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	def, err := protogen.Proto(schema, meta, *pkg)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(*protoOut, []byte(def), 0644); err != nil {
+		return err
+	}
+
+	if *goOut == "" {
+		return nil
+	}
+
+	src, err := protogen.Go(schema, meta, "eventpb", "github.com/jddf-examples/golang-postgres-analytics/internal/event")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(*goOut, []byte(src), 0644)
+}
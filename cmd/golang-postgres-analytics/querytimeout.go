@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// withQueryTimeout gives an analytics endpoint's queries until -query-timeout
+// to finish. The deadline reaches Postgres as a statement_timeout (see
+// dbtimeout), so a runaway query is killed where it runs, and the endpoint
+// responds with a 504; see writeQueryError.
+func (s *server) withQueryTimeout(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if s.QueryTimeout == 0 {
+			h(w, r, p)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), s.QueryTimeout)
+		defer cancel()
+
+		h(w, r.WithContext(ctx), p)
+	}
+}
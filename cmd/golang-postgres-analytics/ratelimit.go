@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/julienschmidt/httprouter"
+)
+
+// withRateLimit wraps an endpoint, so that each client may only call it so
+// often (see -rate-limit). Clients over the limit get a 429, with a
+// Retry-After header saying when to try again.
+//
+// Clients are told apart by their credentials, so it must be wrapped in
+// withAuth. Requests without credentials are limited by the IP address they
+// come from instead.
+func (s *server) withRateLimit(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if s.RateLimit == nil {
+			h(w, r, p)
+			return
+		}
+
+		ok, wait := s.RateLimit.Allow(rateLimitKey(r))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+			writeAPIError(w, http.StatusTooManyRequests, "rate_limited", fmt.Sprintf("too many requests; retry in %s", wait.Round(time.Millisecond)))
+			return
+		}
+
+		h(w, r, p)
+	}
+}
+
+// rateLimitKey is who a request counts against: "<provider>:<subject>" for
+// requests with credentials, or "ip:<address>" for those without. Events
+// relayed by an edge collector count against the client they came from.
+func rateLimitKey(r *http.Request) string {
+	if client, ok := edgeClientFrom(r.Context()); ok {
+		return "ip:" + client.IP
+	}
+
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		return principal.Provider + ":" + principal.Subject
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/hotcache"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultRealtimeWindow is how far back GET /v1/realtime looks by default.
+const defaultRealtimeWindow = 15 * time.Minute
+
+// realtimeRequest is the parameters of GET /v1/realtime.
+type realtimeRequest struct {
+	Window time.Duration
+}
+
+// getRealtime reports how many events, users, and how much revenue there's
+// been recently, in total and for each type of event.
+//
+// If the server keeps a hot cache (see -hot-window), the answer comes from
+// memory. Otherwise, it's queried from the database.
+//
+// This lives at GET /v1/realtime?window=XXX, where window is a duration like
+// "15m".
+func (s *server) getRealtime(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// The hot cache can only answer for as far back as it goes.
+	var maxWindow time.Duration
+	if s.Hot != nil {
+		maxWindow = s.Hot.Window
+	}
+
+	p := params{values: r.URL.Query()}
+	req := realtimeRequest{Window: p.duration("window", defaultRealtimeWindow, maxWindow)}
+	if p.failed(w) {
+		return
+	}
+
+	now := s.Clock.Now()
+	since := now.Add(-req.Window)
+
+	var summary hotcache.Summary
+	if s.Hot != nil {
+		summary = s.Hot.Summarize(since)
+	} else {
+		var err error
+		if summary, err = hotcache.Query(r.Context(), s.DB, since, now); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusOK, summary)
+}
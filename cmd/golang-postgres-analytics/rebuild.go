@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// rebuildHistory is how many finished rebuild jobs are remembered.
+const rebuildHistory = 100
+
+// rebuildScopes are the kinds of derived data that can be rebuilt from the
+// events table, and whether each can be limited to a time range.
+var rebuildScopes = map[string]bool{
+	// The lateness report, as at GET /admin/v1/lateness, for events with
+	// timestamps in the range.
+	"lateness": true,
+
+	// The hot cache behind GET /v1/realtime. It always covers -hot-window.
+	"hotcache": false,
+
+	// The users_activity summary behind GET /v1/users. It always covers every
+	// event.
+	"users": false,
+}
+
+// rebuildRequest is the body of POST /admin/v1/rebuild.
+type rebuildRequest struct {
+	Scopes []string   `json:"scopes"`
+	From   *time.Time `json:"from"`
+	To     *time.Time `json:"to"`
+}
+
+// rebuildJob is a rebuild of some derived data, as reported by the rebuild
+// endpoints. Steps are its scopes, rebuilt one after the other.
+type rebuildJob struct {
+	ID     string    `json:"id"`
+	Scopes []string  `json:"scopes"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+
+	// Status is "queued", "running", "done" or "failed".
+	Status string `json:"status"`
+
+	// StepsDone is how many of the scopes have been rebuilt so far, and Step
+	// is the one being rebuilt now.
+	StepsDone int    `json:"stepsDone"`
+	Step      string `json:"step,omitempty"`
+
+	Error      string     `json:"error,omitempty"`
+	QueuedAt   time.Time  `json:"queuedAt"`
+	StartedAt  *time.Time `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+// rebuilds queues rebuild jobs, and runs them one at a time, since each reads
+// through a lot of the events table. Jobs are only remembered in memory: they
+// don't survive a restart, and each instance has its own.
+type rebuilds struct {
+	queue chan string
+
+	mu     sync.Mutex
+	nextID int
+	jobs   map[string]*rebuildJob
+	order  []string
+}
+
+func newRebuilds() *rebuilds {
+	return &rebuilds{queue: make(chan string, rebuildHistory), jobs: map[string]*rebuildJob{}}
+}
+
+// enqueue adds a job to the queue, and returns a copy of it. It fails if the
+// queue is full.
+func (rb *rebuilds) enqueue(job rebuildJob) (rebuildJob, bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.nextID++
+	job.ID = strconv.Itoa(rb.nextID)
+	job.Status = "queued"
+
+	select {
+	case rb.queue <- job.ID:
+	default:
+		return rebuildJob{}, false
+	}
+
+	rb.jobs[job.ID] = &job
+	rb.order = append(rb.order, job.ID)
+
+	// Forget the oldest finished jobs. Queued and running ones are kept, and
+	// there can't be more of those than fit in the queue.
+	for i := 0; len(rb.order) > rebuildHistory && i < len(rb.order); {
+		if old := rb.jobs[rb.order[i]]; old.FinishedAt != nil {
+			delete(rb.jobs, old.ID)
+			rb.order = append(rb.order[:i], rb.order[i+1:]...)
+		} else {
+			i++
+		}
+	}
+
+	return job, true
+}
+
+// get returns a copy of a job, or false if there's no such job.
+func (rb *rebuilds) get(id string) (rebuildJob, bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	job, ok := rb.jobs[id]
+	if !ok {
+		return rebuildJob{}, false
+	}
+
+	return *job, true
+}
+
+// list returns copies of the jobs, newest first.
+func (rb *rebuilds) list() []rebuildJob {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	jobs := make([]rebuildJob, 0, len(rb.order))
+	for i := len(rb.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, *rb.jobs[rb.order[i]])
+	}
+
+	return jobs
+}
+
+// update changes a job while holding the lock.
+func (rb *rebuilds) update(id string, f func(job *rebuildJob)) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	f(rb.jobs[id])
+}
+
+// runRebuilds runs queued rebuild jobs until ctx is done.
+func (s *server) runRebuilds(ctx context.Context) {
+	for {
+		var id string
+		select {
+		case <-ctx.Done():
+			return
+		case id = <-s.Rebuilds.queue:
+		}
+
+		job, _ := s.Rebuilds.get(id)
+		started := s.Clock.Now()
+		s.Rebuilds.update(id, func(job *rebuildJob) {
+			job.Status = "running"
+			job.StartedAt = &started
+		})
+
+		var err error
+		for _, scope := range job.Scopes {
+			s.Rebuilds.update(id, func(job *rebuildJob) { job.Step = scope })
+			if err = s.rebuild(ctx, scope, job.From, job.To); err != nil {
+				err = fmt.Errorf("%s: %s", scope, err)
+				break
+			}
+
+			s.Rebuilds.update(id, func(job *rebuildJob) { job.StepsDone++ })
+		}
+
+		finished := s.Clock.Now()
+		s.Rebuilds.update(id, func(job *rebuildJob) {
+			job.Status = "done"
+			if err != nil {
+				job.Status = "failed"
+				job.Error = err.Error()
+			}
+
+			job.Step = ""
+			job.FinishedAt = &finished
+		})
+	}
+}
+
+// rebuild recomputes one scope of derived data from the events table.
+func (s *server) rebuild(ctx context.Context, scope string, from, to time.Time) error {
+	switch scope {
+	case "lateness":
+		return s.Lateness.Reconcile(ctx, s.DB, from, to)
+	case "hotcache":
+		if s.Hot == nil {
+			return fmt.Errorf("the hot cache is off; see -hot-window")
+		}
+
+		return s.Hot.Reconcile(ctx, s.DB)
+	case "users":
+		return s.rebuildUsers(ctx)
+	default:
+		return fmt.Errorf("unknown scope")
+	}
+}
+
+// postRebuild queues a job to rebuild derived data from the raw events, like
+// after fixing a bug in how it's worked out. The body names the scopes to
+// rebuild and, for those that can be limited, a time range:
+//
+//	{"scopes": ["lateness"], "from": "2019-11-01T00:00:00Z", "to": "2019-11-08T00:00:00Z"}
+//
+// The range defaults to the week up to now. The job's progress can be
+// followed at GET /admin/v1/rebuild/:id.
+//
+// This lives at POST /admin/v1/rebuild.
+func (s *server) postRebuild(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req rebuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "rebuild_invalid", err.Error())
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "rebuild_invalid", "scopes must name at least one of lateness, hotcache, or users")
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		ranged, ok := rebuildScopes[scope]
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "rebuild_scope_unknown", fmt.Sprintf("there's no %q to rebuild; the scopes are lateness, hotcache, and users", scope))
+			return
+		}
+
+		if !ranged && (req.From != nil || req.To != nil) {
+			writeAPIError(w, http.StatusBadRequest, "rebuild_invalid", fmt.Sprintf("%s can't be limited to a time range", scope))
+			return
+		}
+	}
+
+	job := rebuildJob{Scopes: req.Scopes, QueuedAt: s.Clock.Now()}
+	job.To = job.QueuedAt
+	if req.To != nil {
+		job.To = *req.To
+	}
+
+	job.From = job.To.Add(-latenessLookback)
+	if req.From != nil {
+		job.From = *req.From
+	}
+
+	if !job.From.Before(job.To) {
+		writeAPIError(w, http.StatusBadRequest, "rebuild_invalid", "from must be before to")
+		return
+	}
+
+	job, ok := s.Rebuilds.enqueue(job)
+	if !ok {
+		writeAPIError(w, http.StatusServiceUnavailable, "rebuild_queue_full", "too many rebuilds are queued; try again once some have finished")
+		return
+	}
+
+	w.Header().Set("Location", "/admin/v1/rebuild/"+job.ID)
+	respondJSON(w, http.StatusAccepted, job)
+}
+
+// getRebuild reports how a rebuild job is getting on.
+//
+// This lives at GET /admin/v1/rebuild/:id.
+func (s *server) getRebuild(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	job, ok := s.Rebuilds.get(p.ByName("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "rebuild_not_found", "there's no such rebuild job")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// listRebuilds lists the rebuild jobs this instance remembers, newest first.
+//
+// This lives at GET /admin/v1/rebuild.
+func (s *server) listRebuilds(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondJSON(w, http.StatusOK, s.Rebuilds.list())
+}
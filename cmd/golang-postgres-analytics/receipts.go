@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// receipt proves that an event was stored. It's returned in the X-Event-Receipt
+// header when the event is ingested, and GET /v1/receipts/:id works out the
+// same receipt afresh from what's in the database.
+type receipt struct {
+	EventID string `json:"eventId"`
+
+	// PayloadSHA256 is the hex SHA-256 of the event's canonical JSON: its keys
+	// sorted, and its whitespace and number formatting as encoding/json writes
+	// them. That's what the stored jsonb reads back as, however the event was
+	// sent.
+	PayloadSHA256 string `json:"payloadSha256"`
+
+	// ReceivedAt is when the event was stored, to the microsecond, as Postgres
+	// keeps it.
+	ReceivedAt time.Time `json:"receivedAt"`
+
+	// Signature is the hex HMAC-SHA256 of "v1", the event ID, the payload hash,
+	// and the RFC 3339 time it was received, each on a line of its own, keyed
+	// with RECEIPT_SECRET.
+	Signature string `json:"signature"`
+}
+
+// receipts signs receipts for stored events. Receipts need events to have IDs
+// of their own, so they're only issued with -event-ids.
+type receipts struct {
+	secret []byte
+}
+
+// issue returns the receipt for an event, given as generic JSON values.
+func (rc *receipts) issue(id string, eventRaw interface{}, received time.Time) (receipt, error) {
+	canonical, err := json.Marshal(eventRaw)
+	if err != nil {
+		return receipt{}, err
+	}
+
+	sum := sha256.Sum256(canonical)
+	rcpt := receipt{
+		EventID:       id,
+		PayloadSHA256: hex.EncodeToString(sum[:]),
+		ReceivedAt:    received.UTC(),
+	}
+
+	mac := hmac.New(sha256.New, rc.secret)
+	fmt.Fprintf(mac, "v1\n%s\n%s\n%s", rcpt.EventID, rcpt.PayloadSHA256, rcpt.ReceivedAt.Format(time.RFC3339Nano))
+	rcpt.Signature = hex.EncodeToString(mac.Sum(nil))
+	return rcpt, nil
+}
+
+// header returns the receipt as it's sent in the X-Event-Receipt header.
+func (r receipt) header() string {
+	buf, _ := json.Marshal(r)
+	return string(buf)
+}
+
+// getReceipt re-issues the receipt for a stored event, from the payload and
+// time in the database. A receipt checks out if it's identical to this one: a
+// different payload hash means the stored event isn't what was sent, and a
+// 404 means it isn't stored at all.
+//
+// This lives at GET /v1/receipts/:id.
+func (s *server) getReceipt(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if s.Receipts == nil {
+		writeAPIError(w, http.StatusNotFound, "receipts_disabled", "this server doesn't issue receipts; see -receipts")
+		return
+	}
+
+	var event listedEvent
+	err := s.DB.GetContext(r.Context(), &event, `
+		select event_id, received_at, payload, codec_id, payload_compact from events
+		where event_id = $1
+	`, p.ByName("id"))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		writeAPIError(w, http.StatusNotFound, "event_not_found", "there's no stored event with that ID")
+		return
+	}
+
+	if err == nil {
+		event.Payload, err = s.Codecs.expand(r.Context(), event.Payload, event.CodecID, event.Compact)
+	}
+
+	var eventRaw interface{}
+	if err == nil {
+		err = json.Unmarshal(event.Payload, &eventRaw)
+	}
+
+	var rcpt receipt
+	if err == nil {
+		rcpt, err = s.Receipts.issue(event.ID, eventRaw, event.ReceivedAt)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rcpt)
+}
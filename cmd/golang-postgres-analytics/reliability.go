@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxReliabilityRange is the longest range GET /v1/reliability looks at, since
+// it reads every heartbeat in it.
+const maxReliabilityRange = 7 * 24 * time.Hour
+
+// reliabilityRequest is the parameters of GET /v1/reliability.
+type reliabilityRequest struct {
+	From time.Time
+	To   time.Time
+
+	// Traits, if set, only looks at users with those traits.
+	Traits map[string]string
+
+	// SessionGap is the longest interval between heartbeats within a session.
+	// Longer ones are between sessions -- the app was closed -- and ignored.
+	SessionGap time.Duration
+
+	// Factor is how many times longer than a user's median interval a gap
+	// must be to count as one.
+	Factor float64
+
+	// MinIntervals is how many intervals a user must have for their median to
+	// be trusted.
+	MinIntervals int
+
+	Limit int
+}
+
+// intervalBucket is a range of intervals between heartbeats, in seconds, and
+// how many are in it. The ranges are powers of two: an interval is in the
+// bucket with the smallest UpTo at least its length.
+type intervalBucket struct {
+	UpTo      int64 `json:"upTo" db:"up_to"`
+	Intervals int64 `json:"intervals" db:"intervals"`
+}
+
+// unreliableUser is a user whose heartbeats had gaps, as reported by GET
+// /v1/reliability. Intervals are in seconds.
+type unreliableUser struct {
+	UserID     string  `json:"userId" db:"user_id"`
+	Platform   string  `json:"platform" db:"platform"`
+	AppVersion string  `json:"appVersion" db:"app_version"`
+	Intervals  int64   `json:"intervals" db:"intervals"`
+	Median     float64 `json:"median" db:"median"`
+	P95        float64 `json:"p95" db:"p95"`
+	Max        float64 `json:"max" db:"max"`
+	Gaps       int64   `json:"gaps" db:"gaps"`
+}
+
+// reliability is the response of GET /v1/reliability.
+type reliability struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+
+	// Histogram is the distribution of intervals between each user's
+	// heartbeats, within sessions, across every user.
+	Histogram []intervalBucket `json:"histogram"`
+
+	// Users are the users with the most gaps, most first.
+	Users []unreliableUser `json:"users"`
+}
+
+// getReliability reports how regularly clients send heartbeats: how long
+// they go between them, and which users' heartbeats have gaps, much longer
+// than usual for them. Gaps within a session are what an SDK that stops
+// sending when it's backgrounded, or a flaky network, look like.
+//
+// Intervals longer than sessionGap (default 30m) are taken to be between
+// sessions, and ignored. A gap is an interval at least factor (default 4)
+// times the user's median interval. Users with fewer than minIntervals
+// (default 10) intervals aren't listed, since their medians mean little.
+// Heartbeats are ordered by their own timestamps, not when they arrived, so
+// ones that were sent on time, and delivered late, aren't gaps.
+//
+// Platform and appVersion are the ones each user sent most heartbeats from.
+//
+// This lives at GET /v1/reliability?from=XXX&to=XXX. from and to are RFC3339
+// timestamps, defaulting to the last day, and at most 7 days apart.
+// Parameters like trait.plan=pro only look at users with those traits.
+func (s *server) getReliability(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := s.Clock.Now()
+	p := params{values: r.URL.Query()}
+	req := reliabilityRequest{
+		To:           p.time("to", now),
+		Traits:       p.traits(),
+		SessionGap:   p.duration("sessionGap", 30*time.Minute, 24*time.Hour),
+		MinIntervals: p.int("minIntervals", 10, 1, 10000),
+		Limit:        p.int("limit", 50, 1, 1000),
+	}
+
+	req.From = p.time("from", req.To.Add(-24*time.Hour))
+	req.Factor = float64(p.int("factor", 4, 2, 1000))
+	p.timeRange("from", req.From, "to", req.To)
+	if req.To.Sub(req.From) > maxReliabilityRange {
+		p.fail("from", "must be at most %s before to", maxReliabilityRange)
+	}
+
+	if p.failed(w) {
+		return
+	}
+
+	// Each heartbeat's interval is from the one before it, from the same user.
+	var q querybuilder.Query
+	filter := querybuilder.Filter{Type: "Heartbeat", From: req.From, To: req.To, Traits: req.Traits}
+	intervals := fmt.Sprintf(`
+		with beats as (
+			select
+				%s as user_id,
+				coalesce(payload->>'platform', '') as platform,
+				coalesce(payload->>'appVersion', '') as app_version,
+				extract(epoch from %s - lag(%s) over (partition by %s order by %s))::numeric as seconds
+			from
+				events_expanded
+			where
+				%s
+		)
+		select * from beats
+		where seconds is not null and seconds <= %s
+	`, querybuilder.UserID, querybuilder.Timestamp, querybuilder.Timestamp, querybuilder.UserID, querybuilder.Timestamp,
+		q.Where(filter), q.Arg(req.SessionGap.Seconds()))
+
+	report := reliability{From: req.From, To: req.To, Histogram: []intervalBucket{}, Users: []unreliableUser{}}
+	err := s.DB.SelectContext(r.Context(), &report.Histogram, fmt.Sprintf(`
+		select (2 ^ ceil(log(2, greatest(seconds, 1))))::bigint as up_to, count(*) as intervals
+		from (%s) intervals
+		group by 1
+		order by 1
+	`, intervals), q.Args()...)
+
+	if err == nil {
+		factor, minIntervals, limit := q.Arg(req.Factor), q.Arg(req.MinIntervals), q.Arg(req.Limit)
+		err = s.DB.SelectContext(r.Context(), &report.Users, fmt.Sprintf(`
+			with intervals as (%s),
+			users as (
+				select
+					user_id,
+					mode() within group (order by platform) as platform,
+					mode() within group (order by app_version) as app_version,
+					count(*) as intervals,
+					percentile_cont(0.5) within group (order by seconds) as median,
+					percentile_cont(0.95) within group (order by seconds) as p95,
+					max(seconds)::float8 as max
+				from intervals
+				group by user_id
+				having count(*) >= %s
+			)
+			select u.*, count(*) as gaps
+			from users u
+			join intervals i on i.user_id = u.user_id and i.seconds >= greatest(u.median, 1) * %s
+			group by u.user_id, u.platform, u.app_version, u.intervals, u.median, u.p95, u.max
+			order by gaps desc, u.max desc, u.user_id
+			limit %s
+		`, intervals, minIntervals, factor, limit), q.Args()...)
+	}
+
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
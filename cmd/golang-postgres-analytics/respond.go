@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// respondJSON sends v to the client as JSON, with the given status.
+//
+// Headers and the status have to be written before the body, or they're
+// silently dropped: the first write to the body sends a 200. So v is encoded up
+// front, before anything's written, which also means an encoding failure can
+// still be reported as a 500.
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(buf, '\n'))
+}
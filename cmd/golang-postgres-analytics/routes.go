@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// getRoutes reports how many events each route has delivered to each of its
+// sinks, and how many it failed to.
+//
+// This lives at GET /admin/v1/routes.
+func (s *server) getRoutes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondJSON(w, http.StatusOK, s.Routes.Metrics())
+}
+
+// getSinks reports how delivery to each sink besides Postgres is going: how
+// many events are queued for it, delivered, retried, and given up on.
+//
+// This lives at GET /admin/v1/sinks.
+func (s *server) getSinks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	respondJSON(w, http.StatusOK, s.Routes.DeliveryMetrics())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// runtimeStatus is a snapshot of what the server is up to, as reported by GET
+// /admin/v1/runtime.
+type runtimeStatus struct {
+	Goroutines int `json:"goroutines"`
+
+	// Pools are the priority pools requests are handled in. See withPriority.
+	Pools map[string]poolStatus `json:"pools"`
+
+	// Background counts the work going on outside of requests.
+	Background backgroundStatus `json:"background"`
+
+	Database databaseStatus `json:"database"`
+	Caches   cacheStatus    `json:"caches"`
+	Memory   memoryStatus   `json:"memory"`
+
+	// LoadShedding is omitted without -shed-queue or -shed-pool-wait.
+	LoadShedding *loadSheddingStatus `json:"loadShedding,omitempty"`
+}
+
+type poolStatus struct {
+	InUse    int `json:"inUse"`
+	Capacity int `json:"capacity"`
+}
+
+type backgroundStatus struct {
+	// ShadowWrites is how many events are being mirrored to the shadow, and
+	// ShadowCapacity how many may be at once.
+	ShadowWrites   int `json:"shadowWrites"`
+	ShadowCapacity int `json:"shadowCapacity"`
+
+	// LTVDeliveries is how many LTV notifications are being delivered,
+	// including ones waiting to be retried.
+	LTVDeliveries int64 `json:"ltvDeliveries"`
+
+	// FallbackHeld is how many events have been held on disk since the server
+	// started, because the database was unavailable, and FallbackDrained how
+	// many of those, or of ones held before, have been stored since. Both are
+	// omitted without -spool-fallback.
+	FallbackHeld    *int64 `json:"fallbackHeld,omitempty"`
+	FallbackDrained *int64 `json:"fallbackDrained,omitempty"`
+
+	// DeadLettersRecorded is how many rejected events have been recorded since
+	// the server started, and DeadLettersUnrecorded how many weren't. Both are
+	// omitted without -dead-letters.
+	DeadLettersRecorded   *int64 `json:"deadLettersRecorded,omitempty"`
+	DeadLettersUnrecorded *int64 `json:"deadLettersUnrecorded,omitempty"`
+}
+
+// databaseStatus is the state of the database connection pool.
+type databaseStatus struct {
+	MaxOpen   int   `json:"maxOpen"`
+	Open      int   `json:"open"`
+	InUse     int   `json:"inUse"`
+	Idle      int   `json:"idle"`
+	WaitCount int64 `json:"waitCount"`
+
+	// WaitSeconds is the total time spent waiting for a connection, and is
+	// worth watching alongside WaitCount: if they're climbing, the pool is too
+	// small.
+	WaitSeconds float64 `json:"waitSeconds"`
+}
+
+type cacheStatus struct {
+	// Signatures is how many request signatures are remembered, to reject
+	// replays.
+	Signatures int `json:"signatures"`
+
+	// HotEvents is how many events the hot cache holds, and HotReconciledAt
+	// when it was last rebuilt from the database. Both are omitted if there's
+	// no hot cache.
+	HotEvents       *int       `json:"hotEvents,omitempty"`
+	HotReconciledAt *time.Time `json:"hotReconciledAt,omitempty"`
+}
+
+type memoryStatus struct {
+	HeapBytes uint64 `json:"heapBytes"`
+	SysBytes  uint64 `json:"sysBytes"`
+	GCCycles  uint32 `json:"gcCycles"`
+}
+
+// getRuntime reports the server's internals -- how busy it is, and where --
+// for a quick look when something's wrong.
+//
+// This lives at GET /admin/v1/runtime.
+func (s *server) getRuntime(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status := runtimeStatus{
+		Goroutines: runtime.NumGoroutine(),
+		Pools:      map[string]poolStatus{},
+	}
+
+	for name, pool := range s.Pools {
+		status.Pools[name] = poolStatus{InUse: len(pool), Capacity: cap(pool)}
+	}
+
+	if s.Shadow != nil {
+		status.Background.ShadowWrites = len(s.Shadow.slots)
+		status.Background.ShadowCapacity = cap(s.Shadow.slots)
+	}
+
+	status.Background.LTVDeliveries = atomic.LoadInt64(&s.ltvDeliveries)
+	if s.Fallback != nil {
+		held, drained := atomic.LoadInt64(&s.Fallback.held), atomic.LoadInt64(&s.Fallback.drained)
+		status.Background.FallbackHeld = &held
+		status.Background.FallbackDrained = &drained
+	}
+
+	if s.DeadLetters != nil {
+		recorded, unrecorded := atomic.LoadInt64(&s.DeadLetters.recorded), atomic.LoadInt64(&s.DeadLetters.unrecorded)
+		status.Background.DeadLettersRecorded = &recorded
+		status.Background.DeadLettersUnrecorded = &unrecorded
+	}
+
+	if s.LoadShedder != nil {
+		status.LoadShedding = &loadSheddingStatus{
+			Reason:   s.overloaded(),
+			Shed:     atomic.LoadInt64(&s.LoadShedder.shed),
+			PoolWait: time.Duration(atomic.LoadInt64(&s.LoadShedder.poolWait)).Round(time.Millisecond).String(),
+		}
+	}
+
+	stats := s.DB.Stats()
+	status.Database = databaseStatus{
+		MaxOpen:     stats.MaxOpenConnections,
+		Open:        stats.OpenConnections,
+		InUse:       stats.InUse,
+		Idle:        stats.Idle,
+		WaitCount:   stats.WaitCount,
+		WaitSeconds: stats.WaitDuration.Seconds(),
+	}
+
+	status.Caches.Signatures = s.Signatures.Len()
+	if s.Hot != nil {
+		events, reconciledAt := s.Hot.Len(), s.Hot.ReconciledAt()
+		status.Caches.HotEvents = &events
+		status.Caches.HotReconciledAt = &reconciledAt
+	}
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	status.Memory = memoryStatus{HeapBytes: memory.HeapAlloc, SysBytes: memory.Sys, GCCycles: memory.NumGC}
+
+	respondJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemacheck"
+)
+
+// schemaCommand is the "schema" subcommand. It has subcommands of its own.
+func schemaCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: schema check [-deployed event.jddf.json] proposed.jddf.json")
+	}
+
+	switch args[0] {
+	case "check":
+		return schemaCheck(args[1:])
+	default:
+		return fmt.Errorf("unknown schema command: %s", args[0])
+	}
+}
+
+// schemaCheck is the "schema check" subcommand. It lints a proposed schema, and
+// then compares it against the deployed schema to catch breaking changes
+// before they're rolled out.
+//
+// Schemas have to be in JSON. If you're editing the YAML version, convert it
+// with yaml2json first, just like the go:generate comments in main.go do.
+func schemaCheck(args []string) error {
+	flags := flag.NewFlagSet("schema check", flag.ContinueOnError)
+	deployedPath := flags.String("deployed", "event.jddf.json", "path to the currently deployed schema")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: schema check [-deployed event.jddf.json] proposed.jddf.json")
+	}
+
+	deployed, err := readJSONFile(*deployedPath)
+	if err != nil {
+		return err
+	}
+
+	proposed, err := readJSONFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// There's no point diffing a schema that isn't valid JDDF; the diff would
+	// mostly be noise.
+	if findings := schemacheck.Lint(proposed); len(findings) != 0 {
+		for _, finding := range findings {
+			fmt.Printf("lint: %s\n", finding)
+		}
+
+		return fmt.Errorf("proposed schema has %d problems", len(findings))
+	}
+
+	findings := schemacheck.Diff(deployed, proposed)
+	for _, finding := range findings {
+		fmt.Printf("breaking: %s\n", finding)
+	}
+
+	if len(findings) != 0 {
+		return fmt.Errorf("proposed schema has %d breaking changes", len(findings))
+	}
+
+	fmt.Println("ok: proposed schema is valid and backwards-compatible")
+	return nil
+}
+
+// readJSONFile parses the JSON in the file at path into generic Golang values.
+func readJSONFile(path string) (interface{}, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/synthetic"
+	"github.com/jddf/jddf-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// seed is the "seed" subcommand. It fills a database with made up users and
+// their events, so that a demo or staging environment has something to show:
+//
+//	golang-postgres-analytics seed -users 1000 -days 30
+//
+// Users sign up over the last -days, and browse, send heartbeats and complete
+// orders as described in the synthetic package. Each user's traits go in the
+// users table, so narrowing by traits works too. Events are stored as if they
+// were received the moment they happened, so lateness and freshness reports
+// aren't thrown off.
+//
+// The same -seed makes the same users and events, relative to now. User IDs
+// start with -prefix, so seeded data can be told apart from real data, and
+// deleted again with delete-events.
+//
+// With -ndjson, events are printed instead of stored, for sending to another
+// instance with ingest-stdin, or over HTTP.
+func seed(args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	database := addDatabaseFlags(flags)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	users := flags.Int("users", 1000, "number of users to make up")
+	days := flags.Int("days", 30, "number of days, ending now, users' events are spread over")
+	randomSeed := flags.Int64("seed", 1, "seed for the random number generator")
+	prefix := flags.String("prefix", "synthetic-", "prefix for the made up users' IDs")
+	batchSize := flags.Int("batch-size", 5000, "number of events to insert per transaction")
+	asNDJSON := flags.Bool("ndjson", false, "print the events to stdout as NDJSON, instead of storing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *users <= 0 || *days <= 0 {
+		return errors.New("-users and -days must be positive")
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	eventLimits, err := loadLimits(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	end := time.Now()
+	start := end.AddDate(0, 0, -*days)
+	r := rand.New(rand.NewSource(*randomSeed))
+	behavior := synthetic.DefaultBehavior
+
+	// The events are checked against the schema like any others, in case it's
+	// been changed in ways the synthetic package doesn't know about.
+	validator := jddf.Validator{}
+	marshal := func(user synthetic.User) ([][]byte, error) {
+		payloads := make([][]byte, len(user.Events))
+		for i, e := range user.Events {
+			buf, err := json.Marshal(e)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := checkEventLine(validator, schema, eventLimits, buf, end); err != nil {
+				return nil, fmt.Errorf("synthetic event doesn't fit the schema: %s: %s", buf, err)
+			}
+
+			payloads[i] = buf
+		}
+
+		return payloads, nil
+	}
+
+	if *asNDJSON {
+		out := bufio.NewWriter(os.Stdout)
+		for n := 0; n < *users; n++ {
+			payloads, err := marshal(behavior.NewUser(r, synthetic.ID(*prefix, n), start, end))
+			if err != nil {
+				return err
+			}
+
+			for _, payload := range payloads {
+				out.Write(payload)
+				out.WriteByte('\n')
+			}
+		}
+
+		return out.Flush()
+	}
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	ctx := context.Background()
+	var batch seedBatch
+	var inserted int64
+	for n := 0; n < *users; n++ {
+		user := behavior.NewUser(r, synthetic.ID(*prefix, n), start, end)
+		payloads, err := marshal(user)
+		if err != nil {
+			return err
+		}
+
+		batch.users = append(batch.users, user)
+		batch.payloads = append(batch.payloads, payloads...)
+		for _, e := range user.Events {
+			batch.receivedAt = append(batch.receivedAt, synthetic.Timestamp(e))
+		}
+
+		if len(batch.payloads) >= *batchSize || n == *users-1 {
+			if err := batch.store(ctx, db); err != nil {
+				return fmt.Errorf("%s (%d events inserted before this batch)", err, inserted)
+			}
+
+			inserted += int64(len(batch.payloads))
+			batch = seedBatch{}
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "seeded %d users, with %d events\n", *users, inserted)
+	return nil
+}
+
+// seedBatch is some made up users, and their events, to store together.
+type seedBatch struct {
+	users      []synthetic.User
+	payloads   [][]byte
+	receivedAt []time.Time
+}
+
+// store inserts the batch's events, each received when it happened, and
+// upserts its users' traits, in one transaction.
+func (b seedBatch) store(ctx context.Context, db *sqlx.DB) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("events", "payload", "received_at"))
+	if err != nil {
+		return err
+	}
+
+	for i, payload := range b.payloads {
+		if _, err := stmt.ExecContext(ctx, string(payload), b.receivedAt[i]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	for _, user := range b.users {
+		traits, err := json.Marshal(user.Traits)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into users (user_id, traits, updated_at) values ($1, $2, now())
+			on conflict (user_id) do update set traits = excluded.traits, updated_at = excluded.updated_at
+		`, user.ID, string(traits))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/dbtrace"
+	"github.com/jddf/jddf-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+)
+
+// shadowTimeout is how long a mirrored event may take to write to the shadow.
+const shadowTimeout = 10 * time.Second
+
+// shadowConcurrency is how many mirrored events may be in flight at once.
+// Beyond that, events aren't mirrored, so that a slow shadow can't back up into
+// the real traffic.
+const shadowConcurrency = 16
+
+// shadow mirrors a fraction of the events the server stores to a secondary
+// database, a proposed new version of the schema, or both, and counts where
+// they disagree with what really happened.
+//
+// It's for trying out migrations with production traffic, before cutting over
+// to them: a new database, or the same one with a new Postgres schema, or a
+// schema change that might reject events the current one accepts.
+type shadow struct {
+	// The counters come first, so that they're 64-bit aligned for sync/atomic.
+	mirrored    int64
+	dropped     int64
+	writeErrors int64
+	rejected    int64
+	mismatched  int64
+
+	// DB, if not nil, is where mirrored events are written.
+	DB *sqlx.DB
+
+	// Schema, if not nil, is what mirrored events are validated against.
+	Schema *jddf.Schema
+
+	// Fraction is the proportion of events that are mirrored, from 0 to 1.
+	Fraction float64
+
+	slots chan struct{}
+}
+
+// shadowMetrics are the counts reported by GET /admin/v1/shadow.
+type shadowMetrics struct {
+	Fraction float64 `json:"fraction"`
+
+	// Mirrored is how many events were sent to the shadow, and Dropped how many
+	// would have been but for too many already being in flight.
+	Mirrored int64 `json:"mirrored"`
+	Dropped  int64 `json:"dropped"`
+
+	// WriteErrors is how many events the shadow database failed to store.
+	WriteErrors int64 `json:"writeErrors"`
+
+	// Rejected is how many events the shadow schema rejected.
+	Rejected int64 `json:"rejected"`
+
+	// Mismatched is how many events the shadow database stored differently than
+	// they were sent.
+	Mismatched int64 `json:"mismatched"`
+}
+
+// openShadow sets up a shadow that writes to the database at databaseURL and
+// validates against the schema at schemaPath. Either may be empty.
+func openShadow(databaseURL, schemaPath string, fraction float64, tracer dbtrace.Tracer) (*shadow, error) {
+	sh := &shadow{Fraction: fraction, slots: make(chan struct{}, shadowConcurrency)}
+
+	if databaseURL != "" {
+		db, err := openDB(databaseURL, tracer)
+		if err != nil {
+			return nil, err
+		}
+
+		sh.DB = db
+	}
+
+	if schemaPath != "" {
+		schema, err := loadSchema(schemaPath)
+		if err != nil {
+			return nil, err
+		}
+
+		sh.Schema = &schema
+	}
+
+	return sh, nil
+}
+
+// mirror sends an event the server has just stored to the shadow, if it's
+// sampled. It doesn't wait for the shadow to finish.
+func (sh *shadow) mirror(buf []byte, event interface{}) {
+	if rand.Float64() >= sh.Fraction {
+		return
+	}
+
+	select {
+	case sh.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&sh.dropped, 1)
+		return
+	}
+
+	atomic.AddInt64(&sh.mirrored, 1)
+	go func() {
+		defer func() { <-sh.slots }()
+		sh.write(buf, event)
+	}()
+}
+
+func (sh *shadow) write(buf []byte, event interface{}) {
+	if sh.Schema != nil {
+		validator := jddf.Validator{}
+		result, _ := validator.Validate(*sh.Schema, event)
+		if len(result.Errors) != 0 {
+			atomic.AddInt64(&sh.rejected, 1)
+			return
+		}
+	}
+
+	if sh.DB == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+
+	// Read back what was stored, to catch a backend that mangles events -- by
+	// rounding numbers, say, or dropping fields.
+	var stored []byte
+	err := sh.DB.GetContext(ctx, &stored, `
+		insert into events (payload) values ($1) returning payload
+	`, buf)
+
+	if err != nil {
+		atomic.AddInt64(&sh.writeErrors, 1)
+		return
+	}
+
+	var roundTripped interface{}
+	if err := json.Unmarshal(stored, &roundTripped); err != nil || !reflect.DeepEqual(roundTripped, event) {
+		atomic.AddInt64(&sh.mismatched, 1)
+	}
+}
+
+func (sh *shadow) metrics() shadowMetrics {
+	return shadowMetrics{
+		Fraction:    sh.Fraction,
+		Mirrored:    atomic.LoadInt64(&sh.mirrored),
+		Dropped:     atomic.LoadInt64(&sh.dropped),
+		WriteErrors: atomic.LoadInt64(&sh.writeErrors),
+		Rejected:    atomic.LoadInt64(&sh.rejected),
+		Mismatched:  atomic.LoadInt64(&sh.mismatched),
+	}
+}
+
+// getShadow reports how the shadow has been getting on.
+//
+// This lives at GET /admin/v1/shadow.
+func (s *server) getShadow(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.Shadow == nil {
+		writeAPIError(w, http.StatusNotFound, "shadow_disabled", "the server is not mirroring events; see -shadow-fraction")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.Shadow.metrics())
+}
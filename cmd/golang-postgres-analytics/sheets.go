@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/sheets"
+	"github.com/julienschmidt/httprouter"
+)
+
+// sheetReportTimeout is how long running a report and writing it to its sheet
+// may take.
+const sheetReportTimeout = 5 * time.Minute
+
+// sheetsConfig is the contents of sheets.json.
+type sheetsConfig struct {
+	// Credentials is the path to the JSON key of the service account the
+	// sheets are written as.
+	Credentials string `json:"credentials"`
+
+	Reports []*sheetReport `json:"reports"`
+}
+
+// sheetReport is a saved report, written to a sheet on a schedule.
+type sheetReport struct {
+	// Name identifies the report in logs and GET /admin/v1/sheets.
+	Name string `json:"name"`
+
+	// Report is what to report: "revenue", revenue over time, or "topPages",
+	// the most viewed pages.
+	Report string `json:"report"`
+
+	// SpreadsheetID is the ID in the spreadsheet's URL, and Sheet the name of
+	// the tab to write to. Whatever's on the tab is replaced.
+	SpreadsheetID string `json:"spreadsheetId"`
+	Sheet         string `json:"sheet"`
+
+	// Every is how often the report is written, and Period how far back it
+	// looks, like "1h" and "720h". Period defaults to 30 days.
+	Every  duration `json:"every"`
+	Period duration `json:"period"`
+
+	// Interval is, for "revenue", what to sum revenue over: hour, day, week,
+	// or month. It defaults to day.
+	Interval string `json:"interval"`
+
+	// Limit is, for "topPages", how many pages to list. It defaults to 50.
+	Limit int `json:"limit"`
+
+	mu     sync.Mutex
+	status sheetReportStatus
+}
+
+// sheetReportStatus is how writing a report to its sheet last went, as
+// reported by GET /admin/v1/sheets.
+type sheetReportStatus struct {
+	Name                string     `json:"name"`
+	LastWritten         *time.Time `json:"lastWritten,omitempty"`
+	Rows                int        `json:"rows"`
+	LastFailed          *time.Time `json:"lastFailed,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	NextRun             time.Time  `json:"nextRun"`
+}
+
+// duration is a time.Duration written in JSON like "1h30m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	*d = duration(parsed)
+	return err
+}
+
+// sheetExports writes saved reports to Google Sheets.
+type sheetExports struct {
+	client  *sheets.Client
+	reports []*sheetReport
+}
+
+// loadSheetExports reads the reports configured in the sheets.json at path.
+// If there isn't one, it returns nil: nothing's written to sheets.
+func loadSheetExports(path string) (*sheetExports, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var config sheetsConfig
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	credentials, err := sheets.LoadCredentials(config.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, report := range config.Reports {
+		if report.Name == "" {
+			report.Name = fmt.Sprintf("%s #%d", report.Report, i+1)
+		}
+
+		if report.Period == 0 {
+			report.Period = duration(30 * 24 * time.Hour)
+		}
+
+		if report.Interval == "" {
+			report.Interval = "day"
+		}
+
+		if report.Limit == 0 {
+			report.Limit = 50
+		}
+
+		switch {
+		case report.Report != "revenue" && report.Report != "topPages":
+			return nil, fmt.Errorf("%s: %s: report must be revenue or topPages", path, report.Name)
+		case report.SpreadsheetID == "" || report.Sheet == "":
+			return nil, fmt.Errorf("%s: %s: spreadsheetId and sheet are required", path, report.Name)
+		case time.Duration(report.Every) < time.Minute:
+			return nil, fmt.Errorf("%s: %s: every must be at least a minute", path, report.Name)
+		case archiveIntervals[report.Interval] == nil:
+			return nil, fmt.Errorf("%s: %s: interval must be hour, day, week, or month", path, report.Name)
+		}
+
+		report.status.Name = report.Name
+	}
+
+	return &sheetExports{client: &sheets.Client{Credentials: credentials}, reports: config.Reports}, nil
+}
+
+// exportSheets writes each saved report to its sheet every so often, until ctx
+// is done. Reports are written once at startup, so that a misconfigured one is
+// found out straight away.
+func (s *server) exportSheets(ctx context.Context) {
+	s.SheetExports.client.Clock = s.Clock
+	for _, report := range s.SheetExports.reports {
+		go func(report *sheetReport) {
+			for {
+				s.exportSheet(ctx, report)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(report.Every)):
+				}
+			}
+		}(report)
+	}
+}
+
+// exportSheet runs a report, and writes it to its sheet.
+func (s *server) exportSheet(ctx context.Context, report *sheetReport) {
+	ctx, cancel := context.WithTimeout(ctx, sheetReportTimeout)
+	defer cancel()
+
+	rows, err := s.sheetRows(ctx, report)
+	if err == nil {
+		err = s.SheetExports.client.Replace(ctx, report.SpreadsheetID, report.Sheet, rows)
+	}
+
+	now := s.Clock.Now()
+
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	report.status.NextRun = now.Add(time.Duration(report.Every))
+	if err != nil {
+		report.status.LastFailed = &now
+		report.status.LastError = err.Error()
+		report.status.ConsecutiveFailures++
+		fmt.Fprintf(os.Stderr, "writing %s to Google Sheets: %s\n", report.Name, err)
+		return
+	}
+
+	report.status.LastWritten = &now
+	report.status.Rows = len(rows) - 1
+	report.status.ConsecutiveFailures = 0
+}
+
+// sheetRows runs a report, and returns its rows, headings first.
+func (s *server) sheetRows(ctx context.Context, report *sheetReport) ([][]interface{}, error) {
+	now := s.Clock.Now()
+	var q querybuilder.Query
+	filter := querybuilder.Filter{From: now.Add(-time.Duration(report.Period)), To: now}
+
+	switch report.Report {
+	case "revenue":
+		filter.Type = "Order Completed"
+		var results []struct {
+			Start   time.Time `db:"start"`
+			Orders  int64     `db:"orders"`
+			Revenue money.Sum `db:"revenue"`
+		}
+
+		// Intervals are in UTC, like "query-archive -report revenue".
+		err := s.DB.SelectContext(ctx, &results, fmt.Sprintf(`
+			select
+				date_trunc(%s, %s at time zone 'UTC') as start,
+				count(*) as orders,
+				coalesce(sum((payload->>'revenue')::numeric), 0) as revenue
+			from events_expanded
+			where %s
+			group by 1
+			order by 1
+		`, q.Arg(report.Interval), querybuilder.Timestamp, q.Where(filter)), q.Args()...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rows := [][]interface{}{{"Start", "Orders", "Revenue"}}
+		for i := range results {
+			rows = append(rows, []interface{}{results[i].Start.Format("2006-01-02 15:04"), results[i].Orders, &results[i].Revenue})
+		}
+
+		return rows, nil
+	default:
+		filter.Type = "Page Viewed"
+		var results []struct {
+			URL   string `db:"url"`
+			Views int64  `db:"views"`
+			Users int64  `db:"users"`
+		}
+
+		err := s.DB.SelectContext(ctx, &results, fmt.Sprintf(`
+			select
+				payload->>'url' as url,
+				count(*) as views,
+				count(distinct %s) as users
+			from events_expanded
+			where %s
+			group by 1
+			order by 2 desc, 1
+			limit %s
+		`, querybuilder.UserID, q.Where(filter), q.Arg(report.Limit)), q.Args()...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rows := [][]interface{}{{"Page", "Views", "Users"}}
+		for _, r := range results {
+			rows = append(rows, []interface{}{r.URL, r.Views, r.Users})
+		}
+
+		return rows, nil
+	}
+}
+
+// getSheets reports how writing each saved report to Google Sheets last went.
+//
+// This lives at GET /admin/v1/sheets.
+func (s *server) getSheets(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	statuses := []sheetReportStatus{}
+	if s.SheetExports != nil {
+		for _, report := range s.SheetExports.reports {
+			report.mu.Lock()
+			statuses = append(statuses, report.status)
+			report.mu.Unlock()
+		}
+	}
+
+	respondJSON(w, http.StatusOK, statuses)
+}
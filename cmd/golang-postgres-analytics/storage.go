@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// tableStorage is how much space a table takes up on disk.
+type tableStorage struct {
+	Name        string `db:"name" json:"name"`
+	RowEstimate int64  `db:"row_estimate" json:"rowEstimate"`
+	TotalBytes  int64  `db:"total_bytes" json:"totalBytes"`
+	TableBytes  int64  `db:"table_bytes" json:"tableBytes"`
+	IndexBytes  int64  `db:"index_bytes" json:"indexBytes"`
+}
+
+// eventTypeStorage is how many events of a type are stored, and how many of
+// those arrived recently.
+type eventTypeStorage struct {
+	Type     string `db:"type" json:"type"`
+	Count    int64  `db:"count" json:"count"`
+	LastDay  int64  `db:"last_day" json:"lastDay"`
+	LastWeek int64  `db:"last_week" json:"lastWeek"`
+}
+
+// storageReport is the response of getStorage.
+type storageReport struct {
+	Tables     []tableStorage     `json:"tables"`
+	EventTypes []eventTypeStorage `json:"eventTypes"`
+
+	// EventsPerDay and BytesPerDay are how fast the events table is growing,
+	// averaged over the last week.
+	EventsPerDay float64 `json:"eventsPerDay"`
+	BytesPerDay  float64 `json:"bytesPerDay"`
+}
+
+// getStorage reports how much storage the service is using, and how fast that's
+// growing, so that operators can plan retention and capacity without needing
+// psql access. It's bound to GET /admin/v1/storage.
+//
+// Counting events by type scans the whole events table, so this endpoint isn't
+// something to poll frequently.
+func (s *server) getStorage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	report := storageReport{}
+
+	// Table sizes come straight out of Postgres's catalog. reltuples is only an
+	// estimate, updated by vacuum and analyze, but it's free to get.
+	err := s.DB.SelectContext(r.Context(), &report.Tables, `
+		select
+			c.relname as name,
+			greatest(c.reltuples, 0)::bigint as row_estimate,
+			pg_total_relation_size(c.oid) as total_bytes,
+			pg_relation_size(c.oid) as table_bytes,
+			pg_indexes_size(c.oid) as index_bytes
+		from
+			pg_class c
+			join pg_namespace n on n.oid = c.relnamespace
+		where
+			c.relkind in ('r', 'p') and
+			n.nspname = current_schema()
+		order by
+			total_bytes desc
+	`)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	err = s.DB.SelectContext(r.Context(), &report.EventTypes, `
+		select
+			payload->>'type' as type,
+			count(*) as count,
+			count(*) filter (where received_at >= now() - interval '1 day') as last_day,
+			count(*) filter (where received_at >= now() - interval '7 days') as last_week
+		from
+			events
+		group by
+			1
+		order by
+			1
+	`)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	// Estimate growth in bytes by assuming new events are about as big as the
+	// ones already stored.
+	var total, lastWeek int64
+	for _, t := range report.EventTypes {
+		total += t.Count
+		lastWeek += t.LastWeek
+	}
+
+	report.EventsPerDay = float64(lastWeek) / 7
+	for _, t := range report.Tables {
+		if t.Name == "events" && total != 0 {
+			report.BytesPerDay = report.EventsPerDay * float64(t.TotalBytes) / float64(total)
+		}
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadCheck is how often the certificate files are checked for changes.
+const certReloadCheck = 10 * time.Second
+
+// clientAuthModes are the values of -tls-client-auth.
+var clientAuthModes = map[string]tls.ClientAuthType{
+	// require turns away connections without a certificate the CA bundle
+	// vouches for, as mutual TLS policies usually demand.
+	"require": tls.RequireAndVerifyClientCert,
+
+	// optional verifies certificates that are sent, but lets clients without
+	// one connect, to authenticate some other way.
+	"optional": tls.VerifyClientCertIfGiven,
+}
+
+// serverTLSConfig is the TLS configuration of the HTTP listener. If clientCA
+// is a path to a PEM bundle of CA certificates, clients' certificates are
+// verified against it, and required or not depending on clientAuth. Verified
+// certificates are then what the client-cert auth provider identifies
+// clients by.
+func serverTLSConfig(clientCA, clientAuth string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA == "" {
+		return config, nil
+	}
+
+	mode, ok := clientAuthModes[clientAuth]
+	if !ok {
+		return nil, fmt.Errorf("-tls-client-auth must be require or optional, not %q", clientAuth)
+	}
+
+	buf, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("%s has no PEM-encoded certificates", clientCA)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = mode
+	return config, nil
+}
+
+// certReloader serves the certificate in certFile and keyFile, reloading them
+// when they change. So certificates renewed by an ACME client like certbot,
+// which replaces the files, are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.modified()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// modified returns when the certificate or key file last changed, whichever
+// was later.
+func (c *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (c *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate is for tls.Config. If the files have changed but can't be
+// loaded, like when only one of them has been replaced so far, the certificate
+// from before is served until they can.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < certReloadCheck {
+		return c.cert, nil
+	}
+
+	c.checked = time.Now()
+	modTime, err := c.modified()
+	if err == nil && modTime.After(c.modTime) {
+		err = c.load(modTime)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reloading TLS certificate: %s\n", err)
+	}
+
+	return c.cert, nil
+}
+
+// httpsRedirect redirects plain HTTP requests to the same URL over HTTPS, on
+// the port of httpsAddr. If webroot isn't empty, ACME HTTP-01 challenges are
+// served from the files under it instead, for certbot --webroot, so
+// certificates can be renewed while the server holds port 80.
+func httpsRedirect(httpsAddr, webroot string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	challenges := http.NotFoundHandler()
+	if webroot != "" {
+		challenges = http.FileServer(http.Dir(webroot))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			challenges.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
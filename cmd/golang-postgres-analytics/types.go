@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/typescan"
+	"github.com/jddf/jddf-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// typeCounts counts the events sent to POST /v1/events by type, as found by
+// typescan before they're parsed.
+type typeCounts struct {
+	// unknown and undetected come first, so that they're 64-bit aligned for
+	// sync/atomic.
+	unknown    int64
+	undetected int64
+
+	// tag is the schema's discriminator, and known has a counter for each of
+	// its types. The map is never written to after newTypeCounts, so it's safe
+	// to read concurrently.
+	tag   string
+	known map[string]*int64
+}
+
+// newTypeCounts returns counters for the types of events schema accepts. If
+// the schema isn't a discriminator, there are no types, and every event is
+// undetected.
+func newTypeCounts(schema jddf.Schema) *typeCounts {
+	c := &typeCounts{known: map[string]*int64{}}
+	if schema.Discriminator.Mapping != nil {
+		c.tag = schema.Discriminator.Tag
+		for eventType := range schema.Discriminator.Mapping {
+			c.known[eventType] = new(int64)
+		}
+	}
+
+	return c
+}
+
+// typeReport is the response of GET /admin/v1/types.
+type typeReport struct {
+	// Received is how many events of each type this instance has been sent,
+	// valid or not.
+	Received map[string]int64 `json:"received"`
+
+	// Unknown is how many events had a type the schema doesn't have, and were
+	// rejected without being parsed.
+	Unknown int64 `json:"unknown"`
+
+	// Undetected is how many events' types couldn't be found without parsing
+	// them, because the type was missing, escaped or not a string, or the
+	// event wasn't an object.
+	Undetected int64 `json:"undetected"`
+}
+
+// rejectUnknownType counts an event by type and, if it's of a type the schema
+// doesn't have, rejects it, without parsing it. It returns whether it did.
+//
+// The rejection is exactly what full validation would have responded with,
+// so clients can't tell the difference, except in how quickly it comes.
+func (s *server) rejectUnknownType(w http.ResponseWriter, buf []byte) bool {
+	counts := s.TypeCounts
+	if counts.tag == "" {
+		return false
+	}
+
+	eventType, ok := typescan.Find(buf, counts.tag)
+	if !ok {
+		atomic.AddInt64(&counts.undetected, 1)
+		return false
+	}
+
+	if counter := counts.known[string(eventType)]; counter != nil {
+		atomic.AddInt64(counter, 1)
+		return false
+	}
+
+	atomic.AddInt64(&counts.unknown, 1)
+	respondJSON(w, http.StatusBadRequest, []jddf.ValidationError{{
+		InstancePath: []string{counts.tag},
+		SchemaPath:   []string{"discriminator", "mapping"},
+	}})
+
+	return true
+}
+
+// getTypes reports how many events of each type this instance has been sent,
+// and how many were rejected early for being of an unknown type.
+//
+// This lives at GET /admin/v1/types.
+func (s *server) getTypes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	report := typeReport{
+		Received:   map[string]int64{},
+		Unknown:    atomic.LoadInt64(&s.TypeCounts.unknown),
+		Undetected: atomic.LoadInt64(&s.TypeCounts.undetected),
+	}
+
+	for eventType, counter := range s.TypeCounts.known {
+		report.Received[eventType] = atomic.LoadInt64(counter)
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
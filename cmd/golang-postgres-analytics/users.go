@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxUsersLimit is the most users GET /v1/users returns at once.
+const maxUsersLimit = 1000
+
+// usersRollupBatch is the most events rolled up into users_activity at once.
+const usersRollupBatch = 10000
+
+// usersRollupSettle is how old events must be before they're rolled up. Ids
+// are handed out before the transactions that insert events commit, so an
+// event can show up with a lower id than one already rolled up; waiting makes
+// that unlikely, like it does for the "forward" subcommand.
+const usersRollupSettle = 10 * time.Second
+
+// userActivity is a row of users_activity, as GET /v1/users reports it.
+type userActivity struct {
+	UserID      string          `db:"user_id" json:"userId"`
+	FirstSeen   time.Time       `db:"first_seen" json:"firstSeen"`
+	LastSeen    time.Time       `db:"last_seen" json:"lastSeen"`
+	Events      int64           `db:"events" json:"events"`
+	EventCounts json.RawMessage `db:"event_counts" json:"eventCounts"`
+}
+
+// userSorts are the columns GET /v1/users can sort by, by their names in its
+// sort parameter.
+var userSorts = map[string]string{
+	"lastSeen":  "last_seen",
+	"firstSeen": "first_seen",
+	"events":    "events",
+}
+
+// rollUpUsers rolls new events up into users_activity every interval, until
+// ctx is done. Whenever it's behind, it rolls up batch after batch until it's
+// caught up.
+func (s *server) rollUpUsers(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := s.rollUpUsersBatch(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rolling up users_activity: %s\n", err)
+			}
+
+			if err != nil || n < usersRollupBatch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollUpUsersBatch rolls the next batch of events after the checkpoint up into
+// users_activity, and returns how many events there were. The checkpoint is
+// locked while it's done, so instances running it at the same time take turns.
+//
+// Like the other analytics, it works from the events' JSON payloads, reading
+// events stored by a codec through events_expanded.
+func (s *server) rollUpUsersBatch(ctx context.Context) (int, error) {
+	tx, err := s.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		insert into rollup_checkpoints (name, last_id) values ('users_activity', 0)
+		on conflict (name) do nothing
+	`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var lastID int64
+	err = tx.GetContext(ctx, &lastID, `
+		select last_id from rollup_checkpoints where name = 'users_activity' for update
+	`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var batch struct {
+		Events int           `db:"events"`
+		LastID sql.NullInt64 `db:"last_id"`
+	}
+
+	err = tx.GetContext(ctx, &batch, `
+		select count(*) as events, max(id) as last_id from (
+			select id from events
+			where id > $1 and received_at < now() - make_interval(secs => $2)
+			order by id
+			limit $3
+		) batch
+	`, lastID, usersRollupSettle.Seconds(), usersRollupBatch)
+
+	if err != nil || !batch.LastID.Valid {
+		return 0, err
+	}
+
+	// Each user's counts are merged into what's there already, type by type.
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		insert into users_activity (user_id, first_seen, last_seen, events, event_counts)
+		select user_id, min(first_seen), max(last_seen), sum(events), jsonb_object_agg(type, events)
+		from (
+			select
+				%s as user_id,
+				%s as type,
+				min(%s) as first_seen,
+				max(%s) as last_seen,
+				count(*) as events
+			from events_expanded
+			where id > $1 and id <= $2 and payload ? 'userId'
+			group by 1, 2
+		) counts
+		group by user_id
+		on conflict (user_id) do update set
+			first_seen = least(users_activity.first_seen, excluded.first_seen),
+			last_seen = greatest(users_activity.last_seen, excluded.last_seen),
+			events = users_activity.events + excluded.events,
+			event_counts = (
+				select jsonb_object_agg(key, total) from (
+					select key, sum(value::bigint) as total from (
+						select * from jsonb_each_text(users_activity.event_counts)
+						union all
+						select * from jsonb_each_text(excluded.event_counts)
+					) merged
+					group by key
+				) totals
+			),
+			updated_at = now()
+	`, querybuilder.UserID, querybuilder.Type, querybuilder.Timestamp, querybuilder.Timestamp), lastID, batch.LastID.Int64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		update rollup_checkpoints set last_id = $1, updated_at = now() where name = 'users_activity'
+	`, batch.LastID.Int64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return batch.Events, tx.Commit()
+}
+
+// rebuildUsers empties users_activity, and rolls every event up into it again.
+func (s *server) rebuildUsers(ctx context.Context) error {
+	tx, err := s.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		insert into rollup_checkpoints (name, last_id) values ('users_activity', 0)
+		on conflict (name) do update set last_id = 0, updated_at = now()
+	`)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `delete from users_activity`); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for {
+		n, err := s.rollUpUsersBatch(ctx)
+		if err != nil || n < usersRollupBatch {
+			return err
+		}
+	}
+}
+
+// getUsers pages through every user who's sent events, with when they were
+// first and last seen, and how many events of each type they've sent. Users
+// are sorted by lastSeen, firstSeen, or events, in either order; most
+// recently seen first, by default.
+//
+// It's served from users_activity, so events show up in it once they've been
+// rolled up, which is usually within a -users-rollup.
+//
+// Each page's "next" cursor fetches the page after it, sorted the same way.
+//
+// This lives at GET /v1/users?sort=XXX&order=YYY&limit=ZZZ&after=AAA.
+func (s *server) getUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	p := params{values: r.URL.Query()}
+	sort := p.oneOf("sort", "lastSeen", "lastSeen", "firstSeen", "events")
+	order := p.oneOf("order", "desc", "asc", "desc")
+	limit := p.int("limit", 100, 1, maxUsersLimit)
+
+	var after *userCursor
+	if cursor := p.string("after", ""); cursor != "" {
+		var err error
+		if after, err = parseUserCursor(cursor, sort); err != nil {
+			p.fail("after", "must be a cursor from a previous page, sorted the same way")
+		}
+	}
+
+	if p.failed(w) {
+		return
+	}
+
+	var q querybuilder.Query
+	column := userSorts[sort]
+	where := "true"
+	if after != nil {
+		comparison := "<"
+		if order == "asc" {
+			comparison = ">"
+		}
+
+		where = fmt.Sprintf("(%s, user_id) %s (%s, %s)", column, comparison, q.Arg(after.value), q.Arg(after.userID))
+	}
+
+	users := []userActivity{}
+	err := s.DB.SelectContext(r.Context(), &users, fmt.Sprintf(`
+		select user_id, first_seen, last_seen, events, event_counts from users_activity
+		where %s
+		order by %s %s, user_id %s
+		limit %s
+	`, where, column, order, order, q.Arg(limit)), q.Args()...)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	page := struct {
+		Users []userActivity `json:"users"`
+		Next  string         `json:"next,omitempty"`
+	}{Users: users}
+
+	if len(users) == limit {
+		page.Next = formatUserCursor(users[len(users)-1], sort)
+	}
+
+	respondJSON(w, http.StatusOK, page)
+}
+
+// userCursor is where a page of GET /v1/users left off: the last user's sort
+// key, and their ID to break ties.
+type userCursor struct {
+	value  interface{}
+	userID string
+}
+
+// formatUserCursor returns the cursor of the page after user, sorted by sort.
+// It's the sort key and user ID, comma-separated, in base64 so that clients
+// don't come to depend on what's in it.
+func formatUserCursor(user userActivity, sort string) string {
+	var value string
+	switch sort {
+	case "firstSeen":
+		value = user.FirstSeen.Format(time.RFC3339Nano)
+	case "lastSeen":
+		value = user.LastSeen.Format(time.RFC3339Nano)
+	default:
+		value = strconv.FormatInt(user.Events, 10)
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(value + "," + user.UserID))
+}
+
+// parseUserCursor parses a cursor made by formatUserCursor with the same sort.
+func parseUserCursor(cursor, sort string) (*userCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(string(buf), ",", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+
+	c := &userCursor{userID: parts[1]}
+	if sort == "events" {
+		c.value, err = strconv.ParseInt(parts[0], 10, 64)
+	} else {
+		c.value, err = time.Parse(time.RFC3339Nano, parts[0])
+	}
+
+	return c, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/julienschmidt/httprouter"
+)
+
+// versionsRequest is the parameters of GET /v1/versions.
+type versionsRequest struct {
+	From time.Time
+	To   time.Time
+
+	// Traits, if set, only counts users with those traits.
+	Traits map[string]string
+
+	// Interval is the bucket size, which is passed straight through to
+	// Postgres's date_trunc.
+	Interval string
+
+	// TimeZone is where buckets start and end: a "day" is midnight to midnight
+	// there.
+	TimeZone *time.Location
+}
+
+// versionCount is the number of users seen on one version of an app, on one
+// platform, during one time bucket.
+type versionCount struct {
+	Bucket      time.Time `db:"bucket" json:"bucket"`
+	Platform    string    `db:"platform" json:"platform"`
+	AppVersion  string    `db:"app_version" json:"appVersion"`
+	ActiveUsers int64     `db:"active_users" json:"activeUsers"`
+}
+
+// getVersions reports how many distinct users were active on each app version,
+// per platform, over time. That's what tells you when nobody's on an old
+// version anymore, and it's safe to drop compatibility with it.
+//
+// Activity comes from Heartbeat events, which carry optional appVersion and
+// platform fields. Heartbeats without them are counted under an empty version
+// and platform.
+//
+// This lives at GET /v1/versions?from=XXX&to=XXX&interval=day. from and to are
+// RFC3339 timestamps, defaulting to the last 30 days. interval may be "day",
+// "week", or "month". tz is the IANA time zone to bucket in, defaulting to
+// UTC. Parameters like trait.plan=pro only count users with those traits.
+func (s *server) getVersions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	now := s.Clock.Now()
+	p := params{values: r.URL.Query()}
+	req := versionsRequest{
+		From:     p.time("from", now.AddDate(0, 0, -30)),
+		To:       p.time("to", now),
+		Interval: p.oneOf("interval", "day", "day", "week", "month"),
+		Traits:   p.traits(),
+		TimeZone: p.timeZone("tz"),
+	}
+
+	p.timeRange("from", req.From, "to", req.To)
+	if p.failed(w) {
+		return
+	}
+
+	filter := querybuilder.Filter{Type: "Heartbeat", From: req.From, To: req.To, Traits: req.Traits}
+
+	// date_trunc on a timestamptz works in the session's time zone. Converting
+	// to a local timestamp in the caller's zone first, and back after, buckets
+	// by their days instead.
+	var q querybuilder.Query
+	interval, tz := q.Arg(req.Interval), q.Arg(req.TimeZone.String())
+	counts := []versionCount{}
+	err := s.DB.SelectContext(r.Context(), &counts, fmt.Sprintf(`
+		select
+			date_trunc(%s, %s at time zone %s) at time zone %s as bucket,
+			coalesce(payload->>'platform', '') as platform,
+			coalesce(payload->>'appVersion', '') as app_version,
+			count(distinct %s) as active_users
+		from
+			events_expanded
+		where
+			%s
+		group by
+			1, 2, 3
+		order by
+			1, 2, 3
+	`, interval, querybuilder.Timestamp, tz, tz, querybuilder.UserID, q.Where(filter)), q.Args()...)
+
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	for i := range counts {
+		counts[i].Bucket = counts[i].Bucket.In(req.TimeZone)
+	}
+
+	respondJSON(w, http.StatusOK, counts)
+}
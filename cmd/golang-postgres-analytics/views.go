@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/snowflake"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/sqlviews"
+)
+
+// views is the "views" subcommand. It generates one SQL view per event type
+// from the event schema, and optionally applies them to the database.
+//
+// It's run by "go generate" to keep views.sql in sync with event.jddf.json.
+// After changing the schema, run it with -apply to update a live database.
+//
+// With -dialect snowflake, it generates the table a "snowflake" sink inserts
+// into, and views over that, instead. Those are run in Snowflake by hand.
+func views(args []string) error {
+	flags := flag.NewFlagSet("views", flag.ContinueOnError)
+	schemaPath := flags.String("schema", "event.jddf.json", "path to the event schema")
+	out := flags.String("o", "", "write the generated SQL to this file, instead of stdout")
+	apply := flags.Bool("apply", false, "run the generated SQL against the database")
+	dialect := flags.String("dialect", "postgres", "the database to generate SQL for: postgres or snowflake")
+	table := flags.String("table", "EVENTS", "with -dialect snowflake, the table events are inserted into")
+	database := addDatabaseFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	schema, err := loadSchema(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	meta, err := schemameta.Load(*schemaPath)
+	if err != nil {
+		return err
+	}
+
+	var sql string
+	switch *dialect {
+	case "postgres":
+		sql, err = sqlviews.Generate(schema, meta, *database.schema)
+	case "snowflake":
+		if *apply {
+			return errors.New("-apply only works with -dialect postgres")
+		}
+
+		sql, err = snowflake.Generate(schema, meta, *table)
+	default:
+		return fmt.Errorf("unknown -dialect %q", *dialect)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if *out != "" {
+		if err := ioutil.WriteFile(*out, []byte(sql), 0644); err != nil {
+			return err
+		}
+	} else if !*apply {
+		fmt.Print(sql)
+	}
+
+	if !*apply {
+		return nil
+	}
+
+	db, err := database.open()
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	// Apply all the views in one transaction, so that analysts never see a
+	// half-updated set of views.
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(sql); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
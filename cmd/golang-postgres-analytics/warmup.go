@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemacheck"
+)
+
+// warmUpTimeout bounds how long warming up may take, so that an unreachable
+// database can't hang startup forever.
+const warmUpTimeout = 30 * time.Second
+
+// warmUp does everything expensive about serving requests ahead of time, so the
+// first requests after a deploy aren't slow, and so problems show up at startup
+// rather than as 500s. It checks the schema, makes sure the database is
+// reachable, opens conns connections to it, and prepares the statement for
+// inserting events.
+//
+// It returns every problem it found, rather than stopping at the first.
+func (s *server) warmUp(schemaPath string, conns int) []error {
+	var problems []error
+
+	// The schema has already been loaded, but that only checks that it's JSON.
+	schema, err := readJSONFile(schemaPath)
+	if err != nil {
+		problems = append(problems, err)
+	} else {
+		for _, finding := range schemacheck.Lint(schema) {
+			problems = append(problems, fmt.Errorf("%s: %s", schemaPath, finding))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), warmUpTimeout)
+	defer cancel()
+
+	if err := s.DB.PingContext(ctx); err != nil {
+		// Nothing else here can work without a database.
+		return append(problems, fmt.Errorf("connecting to database: %s", err))
+	}
+
+	// Hold conns connections open at once, so the pool has to open them all, and
+	// then return them to it to sit idle until requests come in.
+	s.DB.SetMaxIdleConns(conns)
+	var opened []*sql.Conn
+	for i := 0; i < conns; i++ {
+		conn, err := s.DB.Conn(ctx)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("opening connection: %s", err))
+			break
+		}
+
+		opened = append(opened, conn)
+	}
+
+	for _, conn := range opened {
+		conn.Close()
+	}
+
+	// Preparing the insert also checks that the events table exists, and looks
+	// the way we expect.
+	if s.InsertEvent, err = s.DB.PreparexContext(ctx, s.insertEventQuery("payload")); err != nil {
+		problems = append(problems, fmt.Errorf("preparing insert into events: %s", err))
+	}
+
+	// Until the codecs are registered, events are stored as plain jsonb.
+	if err := s.Codecs.register(ctx); err != nil {
+		problems = append(problems, fmt.Errorf("registering codecs: %s", err))
+	}
+
+	return problems
+}
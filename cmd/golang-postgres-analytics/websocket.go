@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/auth"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/websocket"
+	"github.com/jddf/jddf-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// wsIdleTimeout is how long a WebSocket connection may go without sending an
+// event before it's closed.
+const wsIdleTimeout = 2 * time.Minute
+
+// wsRejection is the message sent back over a WebSocket for an event that
+// wasn't stored.
+type wsRejection struct {
+	// Seq is which of the connection's messages was rejected, counting from 1.
+	Seq     int64  `json:"seq"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// ValidationErrors are where the event doesn't match the schema, if that's
+	// the problem.
+	ValidationErrors []jddf.ValidationError `json:"validationErrors,omitempty"`
+}
+
+// createEventsWebSocket takes events over a WebSocket, one per text message,
+// for clients that send lots of small events, like heartbeats every few
+// seconds, and would otherwise make a request for each.
+//
+// Each event goes through ingestEvent, just as if it had been posted to
+// /v1/events. Nothing is sent back for events that are stored; rejected ones
+// get a wsRejection, and the connection carries on.
+//
+// Credentials are checked once, at the handshake. Connections don't go
+// through a priority pool, since they'd hold a slot for as long as they're
+// open.
+//
+// This lives at GET /v1/events/ws.
+func (s *server) createEventsWebSocket(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	conn.MaxMessageSize = maxEventBody
+
+	// Only the handshake's signed, if anything is, and not the messages after.
+	ctx := r.Context()
+	if principal := auth.FromContext(ctx); principal != nil && principal.Signed {
+		unsigned := *principal
+		unsigned.Signed = false
+		ctx = auth.NewContext(ctx, &unsigned)
+	}
+
+	reject := func(seq int64, code, message string) {
+		buf, _ := json.Marshal(wsRejection{Seq: seq, Code: code, Message: message})
+		conn.WriteMessage(websocket.TextMessage, buf)
+	}
+
+	for seq := int64(1); ; seq++ {
+		conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		messageType, buf, err := conn.ReadMessage()
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			conn.Close(websocket.CloseNormal, "idle for too long")
+			return
+		}
+
+		// Otherwise, the client closed the connection, went away, or broke the
+		// protocol, and the connection's already closed.
+		if err != nil {
+			return
+		}
+
+		// Maintenance mode may have started since the handshake.
+		if s.inMaintenance() {
+			conn.Close(websocket.CloseGoingAway, "the server is in maintenance mode; retry later")
+			return
+		}
+
+		if messageType != websocket.TextMessage {
+			reject(seq, "binary_message", "events must be sent as text messages")
+			continue
+		}
+
+		var eventRaw interface{}
+		if err := json.Unmarshal(buf, &eventRaw); err != nil {
+			reject(seq, "invalid_json", err.Error())
+			continue
+		}
+
+		// Messages aren't signed, so ingestEvent turns away types that must
+		// be sent in signed requests.
+		_, _, err = s.ingestEvent(ctx, buf, eventRaw)
+		if err, ok := err.(*ingestError); ok {
+			buf, _ := json.Marshal(wsRejection{Seq: seq, Code: err.Code, Message: err.Message, ValidationErrors: err.ValidationErrors})
+			conn.WriteMessage(websocket.TextMessage, buf)
+			continue
+		}
+
+		// The event may be fine, but it wasn't stored. The client should send it
+		// again.
+		if err != nil {
+			reject(seq, "internal_error", err.Error())
+		}
+	}
+}
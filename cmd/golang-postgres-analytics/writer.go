@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// errWriteBufferFull is what eventWriter.enqueue fails with when events are
+// arriving faster than they can be written.
+var errWriteBufferFull = errors.New("write buffer is full")
+
+// eventWriter stores events in the background, in batches, with COPY. One
+// insert per event caps ingestion at however many round trips to Postgres fit
+// in a second; batching them up makes that many events per round trip.
+//
+// Events are only in memory until they're written, unless the server has a
+// spool: then they're appended to it before they're queued, and taken out
+// once they're committed, so a crash in between doesn't lose them.
+type eventWriter struct {
+	s             *server
+	queue         chan pendingEvent
+	flushInterval time.Duration
+	flushSize     int
+	onError       func(error)
+
+	// pending are the IDs of events queued but not yet written, for GET
+	// /v1/events/status. flushed is closed, and replaced, whenever some are
+	// written, to wake up anything waiting for them.
+	mu      sync.Mutex
+	pending map[string]bool
+	flushed chan struct{}
+}
+
+// pendingEvent is an event waiting to be written, and the spool segment it's
+// in, if there's a spool.
+type pendingEvent struct {
+	buf      []byte
+	id       string
+	received time.Time
+	segment  uint64
+}
+
+// newEventWriter returns a writer for s that writes whenever flushSize events
+// are waiting, or flushInterval after the first of them arrived, whichever is
+// sooner. At most queueSize events may wait at once.
+func newEventWriter(s *server, flushInterval time.Duration, flushSize, queueSize int, onError func(error)) *eventWriter {
+	return &eventWriter{
+		s:             s,
+		queue:         make(chan pendingEvent, queueSize),
+		flushInterval: flushInterval,
+		flushSize:     flushSize,
+		onError:       onError,
+		pending:       map[string]bool{},
+		flushed:       make(chan struct{}),
+	}
+}
+
+// full is whether there's no room for more events. It's checked before an
+// event is sent anywhere, so that a full buffer turns the event away, rather
+// than failing it after other sinks have it.
+func (w *eventWriter) full() bool {
+	return len(w.queue) == cap(w.queue)
+}
+
+// enqueue queues an event to be written. It doesn't wait.
+func (w *eventWriter) enqueue(buf []byte, id string, received time.Time) error {
+	e := pendingEvent{buf: buf, id: id, received: received}
+	if w.s.Spool != nil {
+		segment, err := w.s.Spool.Append(buf)
+		if err != nil {
+			return err
+		}
+
+		e.segment = segment
+	}
+
+	if id != "" {
+		w.mu.Lock()
+		w.pending[id] = true
+		w.mu.Unlock()
+	}
+
+	select {
+	case w.queue <- e:
+		return nil
+	default:
+		w.done([]pendingEvent{e})
+		return errWriteBufferFull
+	}
+}
+
+// isPending is whether the event with the given ID is queued, but not yet
+// written.
+func (w *eventWriter) isPending(id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.pending[id]
+}
+
+// flushedChan returns a channel that's closed the next time events are
+// written, or given up on.
+func (w *eventWriter) flushedChan() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.flushed
+}
+
+// run writes events from the queue until ctx is done.
+func (w *eventWriter) run(ctx context.Context) {
+	for {
+		var batch []pendingEvent
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-w.queue:
+			batch = append(batch, e)
+		}
+
+		timer := time.NewTimer(w.flushInterval)
+	fill:
+		for len(batch) < w.flushSize {
+			select {
+			case e := <-w.queue:
+				batch = append(batch, e)
+			case <-timer.C:
+				break fill
+			}
+		}
+
+		timer.Stop()
+		w.flush(ctx, batch)
+	}
+}
+
+// flush writes a batch, retrying until it's written. If Postgres rejects
+// something in the batch itself, rather than being unreachable, the events
+// are written one at a time instead, so the one it won't take doesn't hold up
+// the rest.
+func (w *eventWriter) flush(ctx context.Context, batch []pendingEvent) {
+	backoff := 100 * time.Millisecond
+	for {
+		err := w.copy(ctx, batch)
+		if err == nil {
+			w.done(batch)
+			return
+		}
+
+		w.onError(fmt.Errorf("writing %d events: %s", len(batch), err))
+		if isDataError(err) {
+			if batch = w.insertEach(ctx, batch); len(batch) == 0 {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			// Anything spooled is written when the server next starts.
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
+
+// copy writes a batch in one transaction, with COPY.
+func (w *eventWriter) copy(ctx context.Context, batch []pendingEvent) error {
+	tx, err := w.s.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	columns := []string{"payload", "codec_id", "payload_compact", "received_at"}
+	if w.s.EventIDs != nil {
+		columns = append(columns, "event_id")
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("events", columns...))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range batch {
+		// Like insertEvent, types with a codec are stored compacted. lib/pq
+		// would encode a []byte payload as bytea, so it's passed as a string.
+		args := []interface{}{string(e.buf), nil, nil, e.received}
+		if compact, codecID, ok := w.s.Codecs.encode(e.buf); ok {
+			args = []interface{}{nil, codecID, compact, e.received}
+		}
+
+		if w.s.EventIDs != nil {
+			args = append(args, e.id)
+		}
+
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertEach writes a batch one event at a time. Events Postgres rejects are
+// dropped. It returns the events that couldn't be written for any other
+// reason, to try again.
+func (w *eventWriter) insertEach(ctx context.Context, batch []pendingEvent) []pendingEvent {
+	var retry []pendingEvent
+	for _, e := range batch {
+		err := w.s.insertEvent(ctx, e.buf, e.id, e.received)
+		if err != nil && !isDataError(err) {
+			retry = append(retry, e)
+			continue
+		}
+
+		if err != nil {
+			w.onError(fmt.Errorf("dropping event %s: %s", e.buf, err))
+		}
+
+		w.done([]pendingEvent{e})
+	}
+
+	return retry
+}
+
+// done is called with events once they're written, or given up on. It takes
+// them out of the spool.
+func (w *eventWriter) done(batch []pendingEvent) {
+	w.mu.Lock()
+	for _, e := range batch {
+		delete(w.pending, e.id)
+	}
+
+	close(w.flushed)
+	w.flushed = make(chan struct{})
+	w.mu.Unlock()
+
+	if w.s.Spool == nil {
+		return
+	}
+
+	for _, e := range batch {
+		w.s.Spool.Done(e.segment)
+	}
+}
+
+// isDataError is whether err is Postgres objecting to the data it was given,
+// which trying again won't fix: a data exception or a constraint violation.
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	class := pqErr.Code.Class()
+	return class == "22" || class == "23"
+}
@@ -0,0 +1,177 @@
+// Package adapter translates webhooks sent by third parties into analytics
+// events.
+//
+// An adapter only translates. Whatever it produces is validated against the
+// event schema, and stored, exactly the same way as events sent directly to
+// POST /v1/events. So an adapter that's misconfigured can't sneak invalid
+// events into the database.
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// ErrNotAnEvent is returned by adapters for webhooks which are perfectly valid,
+// but simply don't correspond to any event we track. Such webhooks should be
+// acknowledged, and then ignored.
+var ErrNotAnEvent = errors.New("adapter: webhook does not correspond to an event")
+
+// Adapter turns a webhook into an event.
+type Adapter interface {
+	// Adapt converts the webhook in r, whose body has already been read into
+	// body, into an event. The event is returned as generic JSON, so it can be
+	// validated against the event schema.
+	Adapt(r *http.Request, body []byte) (interface{}, error)
+}
+
+// Verifier is implemented by adapters that check each webhook's signature
+// with a secret shared with the third party, like Stripe's. Their webhooks
+// need no other credentials. Webhooks for any other adapter could have come
+// from anyone, so they must come with an API key.
+type Verifier interface {
+	Adapter
+
+	// VerifiesSignatures marks the adapter as one that checks signatures in
+	// Adapt, and rejects webhooks whose signature is missing or wrong.
+	VerifiesSignatures()
+}
+
+// Mapping is an Adapter driven entirely by configuration. It builds events out
+// of constant values and fields plucked out of the webhook with JSONPath.
+//
+// For example, this mapping turns a hypothetical shop's order webhook into an
+// "Order Completed" event:
+//
+//	{
+//	  "constants": { "type": "Order Completed" },
+//	  "fields": {
+//	    "userId": { "path": "$.customer.id", "as": "string" },
+//	    "timestamp": { "path": "$.created_at" },
+//	    "revenue": { "path": "$.total_price", "as": "string" }
+//	  }
+//	}
+type Mapping struct {
+	// Constants are event fields that always have the same value.
+	Constants map[string]interface{} `json:"constants"`
+
+	// Fields are event fields whose values come from the webhook.
+	Fields map[string]Field `json:"fields"`
+}
+
+// Field describes where in a webhook an event field comes from.
+type Field struct {
+	// Path is a JSONPath expression, like "$.data.amount", pointing at the value
+	// to use.
+	Path string `json:"path"`
+
+	// As optionally converts the value, because third parties often send, say,
+	// numbers as strings. It may be "string" or "number".
+	As string `json:"as"`
+
+	path jsonPath
+}
+
+// LoadMappings reads a JSON file of mapping adapters, keyed by adapter name. It
+// returns no adapters, and no error, if the file doesn't exist.
+func LoadMappings(path string) (map[string]Adapter, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]Adapter{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var mappings map[string]*Mapping
+	if err := json.NewDecoder(file).Decode(&mappings); err != nil {
+		return nil, fmt.Errorf("adapter: %s: %s", path, err)
+	}
+
+	adapters := map[string]Adapter{}
+	for name, mapping := range mappings {
+		if err := mapping.compile(); err != nil {
+			return nil, fmt.Errorf("adapter: %s: %s: %s", path, name, err)
+		}
+
+		adapters[name] = mapping
+	}
+
+	return adapters, nil
+}
+
+// compile parses the JSONPath expressions in m, so that errors in them are
+// found at startup rather than when a webhook arrives.
+func (m *Mapping) compile() error {
+	for name, field := range m.Fields {
+		path, err := parseJSONPath(field.Path)
+		if err != nil {
+			return err
+		}
+
+		if field.As != "" && field.As != "string" && field.As != "number" {
+			return fmt.Errorf("field %s: unknown conversion %q", name, field.As)
+		}
+
+		field.path = path
+		m.Fields[name] = field
+	}
+
+	return nil
+}
+
+// Adapt implements Adapter.
+//
+// Fields whose path doesn't exist in the webhook are left out of the event. If
+// the schema requires them, the event will fail validation as usual.
+func (m *Mapping) Adapt(r *http.Request, body []byte) (interface{}, error) {
+	var webhook interface{}
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, err
+	}
+
+	event := map[string]interface{}{}
+	for name, value := range m.Constants {
+		event[name] = value
+	}
+
+	for name, field := range m.Fields {
+		value, ok := field.path.get(webhook)
+		if !ok {
+			continue
+		}
+
+		event[name] = convert(value, field.As)
+	}
+
+	return event, nil
+}
+
+// convert applies a Field's "as" conversion to a value. Values that can't be
+// converted are left alone, and left for schema validation to reject.
+func convert(value interface{}, as string) interface{} {
+	switch as {
+	case "string":
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			return strconv.FormatBool(v)
+		}
+	case "number":
+		if s, ok := value.(string); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f
+			}
+		}
+	}
+
+	return value
+}
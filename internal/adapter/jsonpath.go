@@ -0,0 +1,92 @@
+package adapter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a parsed JSONPath expression. Only the subset of JSONPath that
+// picks out a single value is supported: "$", ".name", "['name']", and "[0]".
+type jsonPath []interface{}
+
+// parseJSONPath parses a JSONPath expression like "$.data.object['amount'][0]".
+// Each element of the result is either a string (an object key) or an int (an
+// array index).
+func parseJSONPath(s string) (jsonPath, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("adapter: JSONPath %q must start with $", s)
+	}
+
+	path := jsonPath{}
+	rest := s[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+
+			if end == 0 {
+				return nil, fmt.Errorf("adapter: JSONPath %q has an empty name", s)
+			}
+
+			path = append(path, rest[1:end+1])
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			quote := rest[1]
+			end := strings.IndexByte(rest[2:], quote)
+			if end == -1 || !strings.HasPrefix(rest[2+end+1:], "]") {
+				return nil, fmt.Errorf("adapter: JSONPath %q has an unterminated name", s)
+			}
+
+			path = append(path, rest[2:2+end])
+			rest = rest[2+end+2:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("adapter: JSONPath %q has an unterminated index", s)
+			}
+
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("adapter: JSONPath %q has an invalid index", s)
+			}
+
+			path = append(path, index)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("adapter: JSONPath %q is invalid at %q", s, rest)
+		}
+	}
+
+	return path, nil
+}
+
+// get evaluates the path against a generic JSON value. The second return value
+// is false if the path doesn't exist in v.
+func (p jsonPath) get(v interface{}) (interface{}, bool) {
+	for _, segment := range p {
+		switch segment := segment.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+
+			if v, ok = obj[segment]; !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || segment >= len(arr) {
+				return nil, false
+			}
+
+			v = arr[segment]
+		}
+	}
+
+	return v, true
+}
@@ -0,0 +1,166 @@
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/event"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+)
+
+// SegmentTrack is an Adapter for Segment's track calls, in the shape
+// analytics.js and Segment's other libraries send to their /v1/track endpoint.
+// It lets existing Segment instrumentation send events here unchanged.
+//
+// A call's "event" name is taken as the event's type, so only calls named
+// after one of our types -- "Heartbeat", "Order Completed" or "Page Viewed" --
+// become events. The rest are acknowledged, and ignored. Each type's fields
+// are looked for where Segment's specs put them:
+//
+//   - revenue in properties.revenue, or else properties.total;
+//   - url in properties.url, or else context.page.url;
+//   - appVersion in context.app.version, and platform in context.os.name.
+//
+// The user is userId, or anonymousId for users who haven't logged in. The
+// call's messageId isn't kept: the schema has nowhere to put it.
+type SegmentTrack struct {
+	// Clock is the server's clock, which calls' timestamps are corrected by.
+	// If nil, it's the system clock.
+	Clock clock.Clock
+}
+
+// segmentTrack is the part of a track call we care about.
+type segmentTrack struct {
+	Type        string                 `json:"type"`
+	Event       string                 `json:"event"`
+	UserID      string                 `json:"userId"`
+	AnonymousID string                 `json:"anonymousId"`
+	Timestamp   string                 `json:"timestamp"`
+	SentAt      string                 `json:"sentAt"`
+	Properties  map[string]interface{} `json:"properties"`
+	Context     struct {
+		App struct {
+			Version string `json:"version"`
+		} `json:"app"`
+		OS struct {
+			Name string `json:"name"`
+		} `json:"os"`
+		Page struct {
+			URL string `json:"url"`
+		} `json:"page"`
+	} `json:"context"`
+}
+
+// Adapt implements Adapter.
+func (s SegmentTrack) Adapt(r *http.Request, body []byte) (interface{}, error) {
+	var call segmentTrack
+	if err := json.Unmarshal(body, &call); err != nil {
+		return nil, err
+	}
+
+	if call.Type != "" && call.Type != "track" {
+		return nil, fmt.Errorf("adapter: expected a track call, not %q", call.Type)
+	}
+
+	userID := call.UserID
+	if userID == "" {
+		userID = call.AnonymousID
+	}
+
+	if userID == "" {
+		return nil, errors.New("adapter: track call has neither a userId nor an anonymousId")
+	}
+
+	timestamp, err := call.timestamp(clock.Or(s.Clock).Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var e event.Event
+	switch call.Event {
+	case "Heartbeat":
+		e = event.Event{Type: event.EventTypeHeartbeat, EventHeartbeat: event.EventHeartbeat{Timestamp: timestamp, UserId: userID}}
+		if v := call.Context.App.Version; v != "" {
+			e.EventHeartbeat.AppVersion = &v
+		}
+
+		if p := call.Context.OS.Name; p != "" {
+			e.EventHeartbeat.Platform = &p
+		}
+	case "Order Completed":
+		// Revenue is stored as a decimal string, so numbers are written out
+		// as one.
+		revenue, _ := convert(call.Properties["revenue"], "string").(string)
+		if !money.Valid(revenue) {
+			revenue, _ = convert(call.Properties["total"], "string").(string)
+		}
+
+		if !money.Valid(revenue) {
+			return nil, errors.New("adapter: Order Completed needs a numeric properties.revenue or properties.total")
+		}
+
+		e = event.Event{Type: event.EventTypeOrderCompleted, EventOrderCompleted: event.EventOrderCompleted{Timestamp: timestamp, UserId: userID, Revenue: revenue}}
+	case "Page Viewed":
+		url, _ := call.Properties["url"].(string)
+		if url == "" {
+			url = call.Context.Page.URL
+		}
+
+		if url == "" {
+			return nil, errors.New("adapter: Page Viewed needs properties.url or context.page.url")
+		}
+
+		e = event.Event{Type: event.EventTypePageViewed, EventPageViewed: event.EventPageViewed{Timestamp: timestamp, UserId: userID, Url: url}}
+	default:
+		return nil, ErrNotAnEvent
+	}
+
+	// The event still goes through validation as generic JSON, like any other.
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	var eventRaw interface{}
+	err = json.Unmarshal(buf, &eventRaw)
+	return eventRaw, err
+}
+
+// timestamp works out when the call happened. Clients' clocks are often wrong,
+// so like Segment, if the call says both when it happened and when it was
+// sent, it's taken to have happened that long before it was received.
+func (call segmentTrack) timestamp(received time.Time) (time.Time, error) {
+	parse := func(name, value string) (time.Time, error) {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("adapter: %s isn't an ISO 8601 timestamp: %q", name, value)
+		}
+
+		return t, nil
+	}
+
+	switch {
+	case call.Timestamp != "" && call.SentAt != "":
+		timestamp, err := parse("timestamp", call.Timestamp)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		sentAt, err := parse("sentAt", call.SentAt)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return received.Add(-sentAt.Sub(timestamp)).UTC(), nil
+	case call.Timestamp != "":
+		return parse("timestamp", call.Timestamp)
+	case call.SentAt != "":
+		return parse("sentAt", call.SentAt)
+	default:
+		return received.UTC(), nil
+	}
+}
@@ -0,0 +1,112 @@
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/signature"
+)
+
+// ErrBadSignature is returned when a webhook's signature doesn't check out, so
+// it can't be trusted to really have come from the third party.
+var ErrBadSignature = errors.New("adapter: webhook signature is invalid")
+
+// stripeTolerance is how old a Stripe webhook's signature may be. This is the
+// same default Stripe's own libraries use, and it limits how long an attacker
+// could replay a captured webhook.
+const stripeTolerance = 5 * time.Minute
+
+// zeroDecimalCurrencies are the currencies Stripe doesn't express in cents (or
+// the equivalent). See: https://stripe.com/docs/currencies#zero-decimal
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true,
+	"kmf": true, "krw": true, "mga": true, "pyg": true, "rwf": true,
+	"ugx": true, "vnd": true, "vuv": true, "xaf": true, "xof": true,
+	"xpf": true,
+}
+
+// Stripe is an Adapter for Stripe webhooks. It turns completed checkouts and
+// paid invoices into "Order Completed" events, so revenue gets tracked without
+// any client-side instrumentation.
+//
+// The user ID comes from the "userId" key of the checkout session's or
+// invoice's metadata, which you set when creating them with the Stripe API.
+// Purchases without one are acknowledged, but otherwise ignored.
+type Stripe struct {
+	// Secret is the webhook endpoint's signing secret, which starts with
+	// "whsec_".
+	Secret string
+
+	// Clock is the server's clock, which signatures' timestamps are checked
+	// against. If nil, it's the system clock.
+	Clock clock.Clock
+}
+
+// stripeEvent is the part of a Stripe webhook we care about.
+type stripeEvent struct {
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object struct {
+			AmountTotal int64             `json:"amount_total"`
+			AmountPaid  int64             `json:"amount_paid"`
+			Currency    string            `json:"currency"`
+			Metadata    map[string]string `json:"metadata"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+// VerifiesSignatures implements Verifier.
+func (s *Stripe) VerifiesSignatures() {}
+
+// Adapt implements Adapter.
+func (s *Stripe) Adapt(r *http.Request, body []byte) (interface{}, error) {
+	// Stripe signs its webhooks with the same scheme package signature
+	// implements.
+	if err := signature.Verify(r.Header.Get("Stripe-Signature"), s.Secret, body, clock.Or(s.Clock).Now(), stripeTolerance); err != nil {
+		return nil, ErrBadSignature
+	}
+
+	var webhook stripeEvent
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, err
+	}
+
+	object := webhook.Data.Object
+
+	var amount int64
+	switch webhook.Type {
+	case "checkout.session.completed":
+		amount = object.AmountTotal
+	case "invoice.paid":
+		amount = object.AmountPaid
+	default:
+		return nil, ErrNotAnEvent
+	}
+
+	// A purchase without a user ID can't be attributed to anyone's LTV.
+	userID, ok := object.Metadata["userId"]
+	if !ok {
+		return nil, ErrNotAnEvent
+	}
+
+	// Amounts are in the currency's smallest unit, so they're written out as
+	// decimals exactly, without going through a float64.
+	revenue := strconv.FormatInt(amount, 10)
+	if !zeroDecimalCurrencies[strings.ToLower(object.Currency)] {
+		revenue = big.NewRat(amount, 100).FloatString(2)
+	}
+
+	return map[string]interface{}{
+		"type":      "Order Completed",
+		"userId":    userID,
+		"timestamp": time.Unix(webhook.Created, 0).UTC().Format(time.RFC3339),
+		"revenue":   revenue,
+	}, nil
+}
@@ -0,0 +1,72 @@
+// Package anomaly detects abnormal values in time series, like a sudden drop
+// in how many events are being ingested.
+//
+// Traffic has strong daily cycles, so comparing this hour to the hour before
+// it is misleading: 3am is always quieter than 3pm. Instead, values are
+// compared to the same point in previous seasons -- for hourly data with a
+// period of 24, the same hour on previous days.
+package anomaly
+
+import "math"
+
+// Result is the outcome of checking the latest value in a series.
+type Result struct {
+	// Current is the value being checked.
+	Current float64
+
+	// Mean and StdDev describe the baseline Current is compared to.
+	Mean   float64
+	StdDev float64
+
+	// Z is how many standard deviations Current is from Mean.
+	Z float64
+
+	// Anomalous is whether Z exceeded the threshold, in either direction.
+	Anomalous bool
+}
+
+// Seasonal checks the last value of series, which must be sampled at regular
+// intervals and ordered oldest first, against a baseline made of the values
+// exactly period, 2*period, ... seasons*period samples before it.
+//
+// Samples missing from the start of a short series are left out of the
+// baseline. With no baseline at all, nothing is considered anomalous.
+func Seasonal(series []float64, period, seasons int, threshold float64) Result {
+	last := len(series) - 1
+	if last < 0 {
+		return Result{}
+	}
+
+	var baseline []float64
+	for k := 1; k <= seasons; k++ {
+		if i := last - k*period; i >= 0 {
+			baseline = append(baseline, series[i])
+		}
+	}
+
+	result := Result{Current: series[last]}
+	if len(baseline) == 0 {
+		return result
+	}
+
+	for _, v := range baseline {
+		result.Mean += v
+	}
+
+	result.Mean /= float64(len(baseline))
+
+	for _, v := range baseline {
+		result.StdDev += (v - result.Mean) * (v - result.Mean)
+	}
+
+	result.StdDev = math.Sqrt(result.StdDev / float64(len(baseline)))
+
+	// A perfectly steady baseline would make any change at all infinitely
+	// anomalous. Counts are naturally noisy, with a standard deviation of about
+	// the square root of their mean, so never assume less noise than that.
+	noise := math.Max(result.StdDev, math.Max(math.Sqrt(result.Mean), 1))
+
+	result.Z = (result.Current - result.Mean) / noise
+	result.Anomalous = math.Abs(result.Z) > threshold
+	return result
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/signature"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// APIKeys authenticates requests by the key in their X-API-Key header, or
+// their "Authorization: Bearer" header, looked up in the api_keys table. Bearer
+// tokens that look like JWTs are left to the JWT provider.
+//
+// Keys can be limited to sending only some types of events. That way, if a key
+// leaks -- and keys embedded in web pages or mobile apps always leak -- the
+// damage is limited. The web frontend's key, for example, might only be
+// allowed to send Page Viewed events, so a leaked copy can't be used to forge
+// revenue.
+//
+// If a key has a secret, requests using it must also carry a valid X-Signature
+// header, and that signature must not have been used before. Because the
+// signature covers a timestamp, and each one is only accepted once, a captured
+// request can't be tampered with or replayed.
+type APIKeys struct {
+	DB *sqlx.DB
+
+	// Signatures remembers the signatures already seen. Its TTL should be at
+	// least twice Tolerance.
+	Signatures *signature.Cache
+
+	// Tolerance is how far a signed request's timestamp may be from the
+	// server's clock.
+	Tolerance time.Duration
+
+	// Clock is the server's clock. If nil, it's the system clock.
+	Clock clock.Clock
+}
+
+// DefaultMaxSignedBody is the most a signed request's body may be, unless its
+// route allows more with WithMaxSignedBody. The whole body is read into memory
+// to verify its signature, before the endpoint sees any of it.
+const DefaultMaxSignedBody = 1 << 20
+
+type maxSignedBodyKey struct{}
+
+// WithMaxSignedBody returns a copy of ctx in which signed request bodies may be
+// up to n bytes, for routes that take bigger bodies than most.
+func WithMaxSignedBody(ctx context.Context, n int64) context.Context {
+	return context.WithValue(ctx, maxSignedBodyKey{}, n)
+}
+
+// maxSignedBody returns the most ctx's signed request body may be.
+func maxSignedBody(ctx context.Context) int64 {
+	if n, ok := ctx.Value(maxSignedBodyKey{}).(int64); ok {
+		return n
+	}
+
+	return DefaultMaxSignedBody
+}
+
+// apiKey is a row of the api_keys table.
+type apiKey struct {
+	Key          string         `db:"key"`
+	Name         string         `db:"name"`
+	AllowedTypes pq.StringArray `db:"allowed_types"`
+	DeniedTypes  pq.StringArray `db:"denied_types"`
+	Secret       sql.NullString `db:"secret"`
+	Scopes       pq.StringArray `db:"scopes"`
+}
+
+// Authenticate implements Provider.
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("X-API-Key")
+	if header == "" {
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if bearer == r.Header.Get("Authorization") || strings.Count(bearer, ".") == 2 {
+			return nil, ErrNoCredentials
+		}
+
+		header = bearer
+	}
+
+	var key apiKey
+	err := a.DB.GetContext(r.Context(), &key, `
+		select key, name, allowed_types, denied_types, secret, scopes from api_keys where key = $1
+	`, header)
+
+	if err == sql.ErrNoRows {
+		return nil, &Error{Status: http.StatusUnauthorized, Code: "api_key_invalid", Message: "the API key sent is not valid"}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if key.Secret.Valid {
+		// Verifying the signature needs the whole body. Read it now, and then put
+		// it back for the endpoint to read again.
+		limit := maxSignedBody(r.Context())
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if int64(len(body)) > limit {
+			return nil, &Error{Status: http.StatusRequestEntityTooLarge, Code: "body_too_large", Message: fmt.Sprintf("a signed request's body may be at most %d bytes", limit)}
+		}
+
+		now := clock.Or(a.Clock).Now()
+		header := r.Header.Get("X-Signature")
+		if err := signature.Verify(header, key.Secret.String, body, now, a.Tolerance); err != nil {
+			return nil, &Error{Status: http.StatusUnauthorized, Code: "signature_invalid", Message: "the X-Signature header is missing, expired, or incorrect"}
+		}
+
+		// The header itself can be padded without breaking the signature, so
+		// it's remembered by what was signed.
+		if a.Signatures.Seen(signature.Key(header, key.Secret.String, body), now) {
+			return nil, &Error{Status: http.StatusUnauthorized, Code: "signature_replayed", Message: "this request has already been received"}
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return &Principal{
+		Provider:     "api-key",
+		Subject:      key.Name,
+		AllowedTypes: key.AllowedTypes,
+		DeniedTypes:  key.DeniedTypes,
+		Scopes:       key.Scopes,
+		Signed:       key.Secret.Valid,
+	}, nil
+}
@@ -0,0 +1,137 @@
+// Package auth works out who sent a request.
+//
+// Each way of proving who you are -- an API key, a JWT from an identity
+// provider, a TLS client certificate -- is a Provider. Deployments pick which
+// providers to accept, and in what order, with a Chain. Handlers only ever see
+// the resulting Principal, so adding a new scheme never means touching them.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrNoCredentials is returned by a Provider when the request doesn't carry
+// the kind of credentials it understands. It's not an authentication failure:
+// the request may still be authenticated by another provider, or be allowed
+// through anonymously.
+var ErrNoCredentials = errors.New("auth: no credentials")
+
+// Provider authenticates requests using one kind of credentials.
+type Provider interface {
+	// Authenticate returns who sent the request. If the request doesn't carry
+	// credentials for this provider, it returns ErrNoCredentials. If it does
+	// but they're wrong, it returns an *Error.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Principal is whoever a request was authenticated as.
+type Principal struct {
+	// Provider is the name of the kind of credentials used, like "api-key".
+	Provider string
+
+	// Subject identifies the principal within its provider: an API key's name,
+	// a JWT's "sub" claim, or a certificate's identity.
+	Subject string
+
+	// AllowedTypes, if not nil, are the only event types the principal may
+	// send.
+	AllowedTypes []string
+
+	// DeniedTypes are event types the principal may never send.
+	DeniedTypes []string
+
+	// Tenant is the organization the principal belongs to, for providers that
+	// know it, like a JWT's tenant claim. It's empty otherwise.
+	Tenant string
+
+	// Signed is whether the request's body was signed with a secret only the
+	// principal has, so that it can't have been forged or tampered with.
+	Signed bool
+
+	// Scopes are the extra privileges the principal has, like "forward".
+	Scopes []string
+
+	// Claims holds any other attributes the provider knows about the
+	// principal, like the claims of a JWT.
+	Claims map[string]interface{}
+}
+
+// Allows returns whether the principal may send events of the given type.
+func (p *Principal) Allows(eventType string) bool {
+	for _, t := range p.DeniedTypes {
+		if t == eventType {
+			return false
+		}
+	}
+
+	if p.AllowedTypes == nil {
+		return true
+	}
+
+	for _, t := range p.AllowedTypes {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasScope returns whether the principal has the given scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Error is an authentication failure, to be reported to the client as-is.
+type Error struct {
+	// Status is the HTTP status code to respond with.
+	Status int
+
+	// Code is a machine-readable description of the failure.
+	Code string
+
+	// Message is a human-readable description of the failure.
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "auth: " + e.Message
+}
+
+// Chain is a Provider which tries each of its providers in turn. The first one
+// to find credentials it understands decides the outcome.
+type Chain []Provider
+
+// Authenticate implements Provider.
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, p := range c {
+		principal, err := p.Authenticate(r)
+		if err != ErrNoCredentials {
+			return principal, err
+		}
+	}
+
+	return nil, ErrNoCredentials
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal stored in ctx by NewContext, or nil if the
+// request wasn't authenticated.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
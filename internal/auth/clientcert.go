@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ClientCert authenticates requests by the TLS client certificate they were
+// sent with. It only applies when the server is listening with TLS, and is
+// configured to verify client certificates; the verification itself is done by
+// crypto/tls, against the server's CA bundle.
+//
+// The principal's subject is the certificate's first URI SAN if it has one --
+// which is where SPIFFE IDs live -- and its common name otherwise.
+//
+// Since a certificate the CA signed is proof enough of who sent the request,
+// any identity it vouches for is accepted. Identities may still be given
+// scopes, or limited to some types of events, in the client_certs table.
+type ClientCert struct {
+	// DB is where the client_certs table is. If nil, no identity has scopes or
+	// limits.
+	DB *sqlx.DB
+}
+
+// clientCert is a row of the client_certs table.
+type clientCert struct {
+	AllowedTypes pq.StringArray `db:"allowed_types"`
+	DeniedTypes  pq.StringArray `db:"denied_types"`
+	Scopes       pq.StringArray `db:"scopes"`
+}
+
+// Authenticate implements Provider.
+func (c *ClientCert) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	subject := cert.Subject.CommonName
+	if len(cert.URIs) != 0 {
+		subject = cert.URIs[0].String()
+	}
+
+	uris := make([]interface{}, len(cert.URIs))
+	for i, uri := range cert.URIs {
+		uris[i] = uri.String()
+	}
+
+	principal := &Principal{
+		Provider: "client-cert",
+		Subject:  subject,
+		Claims: map[string]interface{}{
+			"commonName":   cert.Subject.CommonName,
+			"uris":         uris,
+			"issuer":       cert.Issuer.String(),
+			"serialNumber": cert.SerialNumber.String(),
+		},
+	}
+
+	if c.DB == nil {
+		return principal, nil
+	}
+
+	var row clientCert
+	err := c.DB.GetContext(r.Context(), &row, `
+		select allowed_types, denied_types, scopes from client_certs where subject = $1
+	`, subject)
+
+	if err == sql.ErrNoRows {
+		return principal, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	principal.AllowedTypes = row.AllowedTypes
+	principal.DeniedTypes = row.DeniedTypes
+	principal.Scopes = row.Scopes
+	return principal, nil
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+)
+
+// defaultKeySetRefresh is how often a KeySet is refetched if Refresh is zero.
+const defaultKeySetRefresh = time.Hour
+
+// minKeySetRefetch is the least time between fetches of a KeySet, however
+// many tokens it fails to verify, so that bad tokens can't be used to hammer
+// the identity provider.
+const minKeySetRefetch = time.Minute
+
+// keySetFetchTimeout is how long fetching a KeySet may take.
+const keySetFetchTimeout = 10 * time.Second
+
+// jwks is a JSON Web Key Set, as published by identity providers.
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// FetchJWKS downloads a JSON Web Key Set, and returns the RSA signing keys in
+// it. Keys of other types, or for encryption, are skipped.
+func FetchJWKS(ctx context.Context, url string) ([]*rsa.PublicKey, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: fetching %s: %s", url, res.Status)
+	}
+
+	var set jwks
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	var keys []*rsa.PublicKey
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		})
+	}
+
+	return keys, nil
+}
+
+// KeySet is a JSON Web Key Set published at URL, like an identity provider's
+// jwks_uri. It's fetched when first needed, and again every Refresh, so that
+// keys the identity provider rotates in are picked up without a restart. It's
+// safe for concurrent use.
+type KeySet struct {
+	URL string
+
+	// Refresh is how often the keys are fetched again. If zero, it's an hour.
+	Refresh time.Duration
+
+	// Clock decides when the keys are due to be fetched again. If nil, it's
+	// the system clock.
+	Clock clock.Clock
+
+	mu      sync.Mutex
+	keys    []*rsa.PublicKey
+	fetched time.Time
+	tried   time.Time
+	err     error
+}
+
+// Keys returns the keys in the set, fetching them if they're due.
+func (k *KeySet) Keys() ([]*rsa.PublicKey, error) {
+	return k.get(false)
+}
+
+// get returns the keys in the set. If stale, the keys held are suspected to be
+// out of date, and are fetched again unless they were fetched very recently.
+//
+// If fetching fails, the keys fetched before are kept, so that tokens are
+// still verified while the identity provider is down.
+func (k *KeySet) get(stale bool) ([]*rsa.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	refresh := k.Refresh
+	if refresh == 0 {
+		refresh = defaultKeySetRefresh
+	}
+
+	now := clock.Or(k.Clock).Now()
+	due := k.keys == nil || stale || now.Sub(k.fetched) >= refresh
+	if !due || now.Sub(k.tried) < minKeySetRefetch {
+		if k.keys == nil {
+			return nil, k.err
+		}
+
+		return k.keys, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), keySetFetchTimeout)
+	defer cancel()
+
+	k.tried = now
+	keys, err := FetchJWKS(ctx, k.URL)
+	if err != nil {
+		k.err = err
+		if k.keys == nil {
+			return nil, err
+		}
+
+		return k.keys, nil
+	}
+
+	k.keys, k.fetched, k.err = keys, now, nil
+	return keys, nil
+}
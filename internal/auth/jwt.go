@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+)
+
+// JWT authenticates requests by a JSON Web Token in their "Authorization:
+// Bearer" header, signed by an identity provider.
+//
+// Tokens may be signed with HS256, using Secret, or RS256, using one of
+// PublicKeys or the keys in KeySet. Other algorithms, and in particular
+// "none", are rejected.
+type JWT struct {
+	// Secret is the shared secret for HS256 tokens. If empty, HS256 tokens are
+	// rejected.
+	Secret []byte
+
+	// PublicKeys are the keys RS256 tokens may be signed with.
+	PublicKeys []*rsa.PublicKey
+
+	// KeySet, if not nil, is where the identity provider publishes the other
+	// keys RS256 tokens may be signed with.
+	KeySet *KeySet
+
+	// Issuer, if not empty, is the only "iss" claim accepted.
+	Issuer string
+
+	// Audience, if not empty, must be one of the token's "aud" claims.
+	Audience string
+
+	// TenantClaim, if not empty, is the claim naming the tenant the principal
+	// belongs to, like "tenant" or "org_id".
+	TenantClaim string
+
+	// Clock decides whether a token has expired. If nil, it's the system clock.
+	Clock clock.Clock
+}
+
+// jwtHeader is the part of a JWT's header that matters to us.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// Authenticate implements Provider.
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := j.Verify(token)
+	if err != nil {
+		return nil, &Error{Status: http.StatusUnauthorized, Code: "token_invalid", Message: err.Error()}
+	}
+
+	// Scopes are granted by the standard OAuth "scope" claim, which lists them
+	// separated by spaces.
+	subject, _ := claims["sub"].(string)
+	scope, _ := claims["scope"].(string)
+	principal := &Principal{Provider: "jwt", Subject: subject, Scopes: strings.Fields(scope), Claims: claims}
+	if j.TenantClaim != "" {
+		principal.Tenant, _ = claims[j.TenantClaim].(string)
+	}
+
+	return principal, nil
+}
+
+// Verify checks the signature and registered claims of a JWT, and returns its
+// claims.
+func (j *JWT) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is malformed")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("token signature is malformed")
+	}
+
+	switch header.Alg {
+	case "HS256":
+		if len(j.Secret) == 0 {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+
+		mac := hmac.New(sha256.New, j.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errors.New("token signature is incorrect")
+		}
+	case "RS256":
+		if err := j.verifyRS256(signed, signature); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("token algorithm is not accepted")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	// Numeric claims are in seconds since the epoch. JSON decodes them as
+	// float64.
+	now := float64(clock.Or(j.Clock).Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, errors.New("token has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return nil, errors.New("token issuer is not accepted")
+	}
+
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return nil, errors.New("token audience is not accepted")
+	}
+
+	return claims, nil
+}
+
+// verifyRS256 checks an RS256 signature against PublicKeys, and then KeySet.
+func (j *JWT) verifyRS256(signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	verifies := func(keys []*rsa.PublicKey) bool {
+		for _, key := range keys {
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if verifies(j.PublicKeys) {
+		return nil
+	}
+
+	if j.KeySet == nil {
+		return errors.New("token signature is incorrect")
+	}
+
+	keys, err := j.KeySet.get(false)
+	if err == nil && verifies(keys) {
+		return nil
+	}
+
+	// The token may be signed with a key the identity provider has rotated in
+	// since the set was last fetched.
+	if keys, err = j.KeySet.get(true); err != nil {
+		return errors.New("token signing keys are unavailable")
+	}
+
+	if !verifies(keys) {
+		return errors.New("token signature is incorrect")
+	}
+
+	return nil
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a JWT.
+func decodeSegment(segment string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("token is malformed")
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return errors.New("token is malformed")
+	}
+
+	return nil
+}
+
+// hasAudience returns whether an "aud" claim, which may be a string or an
+// array of strings, includes audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ParseRSAPublicKey parses a PEM-encoded RSA public key, like the ones
+// identity providers publish for verifying their tokens.
+func ParseRSAPublicKey(buf []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("auth: no PEM data found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("auth: public key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
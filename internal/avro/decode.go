@@ -0,0 +1,293 @@
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// maxDepth is how deeply values may nest. Only recursive schemas can nest
+// deeper than the schema itself, and no event needs to.
+const maxDepth = 64
+
+// errTruncated is what decoding data that ends too soon fails with.
+var errTruncated = errors.New("avro: data ends too soon")
+
+// singleObjectMagic starts data in Avro's single object encoding, followed by
+// the little-endian fingerprint of the schema it was written with.
+var singleObjectMagic = []byte{0xc3, 0x01}
+
+// SplitSingleObject splits data in Avro's single object encoding into the
+// fingerprint of its schema and the datum itself. ok is false if data isn't
+// in that encoding.
+func SplitSingleObject(data []byte) (fingerprint uint64, datum []byte, ok bool) {
+	if len(data) < 10 || data[0] != singleObjectMagic[0] || data[1] != singleObjectMagic[1] {
+		return 0, nil, false
+	}
+
+	return binary.LittleEndian.Uint64(data[2:10]), data[10:], true
+}
+
+// Decode decodes the single datum in data, written with schema s, into the
+// values encoding/json would decode its JSON into: nil, bool, float64,
+// string, []interface{} and map[string]interface{}.
+//
+// Unions become the value of their branch, enums their symbol, and bytes and
+// fixed a string of their hex. Longs with a timestamp-millis or
+// timestamp-micros logical type become RFC 3339 strings, and ints with a date
+// logical type become dates, like JSON has them.
+//
+// Record fields that are null are left out, rather than set to nil. That's
+// how JSON leaves out optional properties, which Avro has to write as a union
+// with null.
+func Decode(s *Schema, data []byte) (interface{}, error) {
+	d := decoder{buf: data}
+	v, err := d.decode(s, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.pos != len(d.buf) {
+		return nil, fmt.Errorf("avro: %d bytes left over after the datum", len(d.buf)-d.pos)
+	}
+
+	return v, nil
+}
+
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *decoder) decode(s *Schema, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("avro: data nests too deeply")
+	}
+
+	switch s.Type {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		if b > 1 {
+			return nil, fmt.Errorf("avro: %d isn't a boolean", b)
+		}
+
+		return b == 1, nil
+	case "int", "long":
+		n, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+
+		if s.Type == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+			return nil, fmt.Errorf("avro: %d is out of range for an int", n)
+		}
+
+		switch s.LogicalType {
+		case "timestamp-millis":
+			return time.Unix(n/1e3, n%1e3*1e6).UTC().Format(time.RFC3339Nano), nil
+		case "timestamp-micros":
+			return time.Unix(n/1e6, n%1e6*1e3).UTC().Format(time.RFC3339Nano), nil
+		case "date":
+			return time.Unix(0, 0).UTC().AddDate(0, 0, int(n)).Format("2006-01-02"), nil
+		}
+
+		return float64(n), nil
+	case "float":
+		b, err := d.bytes(4)
+		if err != nil {
+			return nil, err
+		}
+
+		return finite(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+	case "double":
+		b, err := d.bytes(8)
+		if err != nil {
+			return nil, err
+		}
+
+		return finite(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case "bytes", "string":
+		n, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, fmt.Errorf("avro: negative length %d", n)
+		}
+
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.Type == "bytes" {
+			return hex.EncodeToString(b), nil
+		}
+
+		if !utf8.Valid(b) {
+			return nil, errors.New("avro: string isn't valid UTF-8")
+		}
+
+		return string(b), nil
+	case "fixed":
+		b, err := d.bytes(int64(s.Size))
+		if err != nil {
+			return nil, err
+		}
+
+		return hex.EncodeToString(b), nil
+	case "enum":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+
+		if i < 0 || i >= int64(len(s.Symbols)) {
+			return nil, fmt.Errorf("avro: %s has no symbol %d", s.Name, i)
+		}
+
+		return s.Symbols[i], nil
+	case "union":
+		i, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+
+		if i < 0 || i >= int64(len(s.Branches)) {
+			return nil, fmt.Errorf("avro: union has no branch %d", i)
+		}
+
+		return d.decode(s.Branches[i], depth+1)
+	case "record":
+		v := make(map[string]interface{}, len(s.Fields))
+		for _, f := range s.Fields {
+			fv, err := d.decode(f.Type, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			if fv != nil {
+				v[f.Name] = fv
+			}
+		}
+
+		return v, nil
+	case "array":
+		v := []interface{}{}
+		err := d.blocks(func() error {
+			item, err := d.decode(s.Items, depth+1)
+			v = append(v, item)
+			return err
+		})
+
+		return v, err
+	case "map":
+		v := map[string]interface{}{}
+		err := d.blocks(func() error {
+			key, err := d.decode(&Schema{Type: "string"}, depth+1)
+			if err != nil {
+				return err
+			}
+
+			value, err := d.decode(s.Values, depth+1)
+			v[key.(string)] = value
+			return err
+		})
+
+		return v, err
+	default:
+		return nil, fmt.Errorf("avro: can't decode %s", s.Type)
+	}
+}
+
+// blocks reads the blocks of an array or map, calling item for each item.
+func (d *decoder) blocks(item func() error) error {
+	for {
+		count, err := d.long()
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			return nil
+		}
+
+		// A negative count is followed by the block's size in bytes, so that
+		// readers can skip it. We don't need to.
+		if count < 0 {
+			count = -count
+			if _, err := d.long(); err != nil {
+				return err
+			}
+		}
+
+		// Every item takes at least a byte, except nulls, which no one sends
+		// arrays of. This stops a bogus count from spinning forever.
+		if count > int64(len(d.buf)-d.pos) {
+			return errTruncated
+		}
+
+		for i := int64(0); i < count; i++ {
+			if err := item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// long reads a zig-zag varint.
+func (d *decoder) long() (int64, error) {
+	var u uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := d.byte()
+		if err != nil {
+			return 0, err
+		}
+
+		u |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return int64(u>>1) ^ -int64(u&1), nil
+		}
+	}
+
+	return 0, errors.New("avro: varint is too long")
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.pos >= len(d.buf) {
+		return 0, errTruncated
+	}
+
+	d.pos++
+	return d.buf[d.pos-1], nil
+}
+
+func (d *decoder) bytes(n int64) ([]byte, error) {
+	if n > int64(len(d.buf)-d.pos) {
+		return nil, errTruncated
+	}
+
+	b := d.buf[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// finite rejects NaN and infinities, which JSON can't represent.
+func finite(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("avro: %v can't be represented in JSON", f)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,394 @@
+// Package avro decodes Avro binary data into the same generic values that
+// encoding/json produces, so that events sent as Avro can be validated and
+// stored exactly like events sent as JSON.
+//
+// Only what ingestion needs is here: parsing schemas, fingerprinting them, and
+// decoding a single datum. Writers and object container files aren't.
+//
+// A datum doesn't say what schema it was written with, so the reader has to be
+// told. Schemas are identified by their fingerprint: the CRC-64-AVRO hash of
+// their Parsing Canonical Form, as in the Avro spec. Two schemas that differ
+// only in docs, defaults or formatting have the same fingerprint.
+package avro
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Schema is a parsed Avro schema.
+type Schema struct {
+	// Type is one of the primitive types, or "record", "enum", "array",
+	// "map", "union" or "fixed".
+	Type string
+
+	// Name is the full name of a record, enum or fixed.
+	Name string
+
+	Fields   []Field   // of a record
+	Symbols  []string  // of an enum
+	Items    *Schema   // of an array
+	Values   *Schema   // of a map
+	Branches []*Schema // of a union
+	Size     int       // of a fixed
+
+	// LogicalType annotates the type, like "timestamp-millis" on a long.
+	LogicalType string
+}
+
+// Field is a field of a record.
+type Field struct {
+	Name string
+	Type *Schema
+}
+
+var primitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// ParseSchema parses an Avro schema from its JSON.
+func ParseSchema(buf []byte) (*Schema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, err
+	}
+
+	p := parser{names: map[string]*Schema{}}
+	return p.parse(raw, "")
+}
+
+// parser remembers the named types seen so far, so later parts of the schema
+// can refer to them by name.
+type parser struct {
+	names map[string]*Schema
+}
+
+func (p *parser) parse(raw interface{}, namespace string) (*Schema, error) {
+	switch raw := raw.(type) {
+	case string:
+		if primitives[raw] {
+			return &Schema{Type: raw}, nil
+		}
+
+		if s, ok := p.names[fullName(raw, namespace)]; ok {
+			return s, nil
+		}
+
+		if s, ok := p.names[raw]; ok {
+			return s, nil
+		}
+
+		return nil, fmt.Errorf("avro: unknown type %q", raw)
+	case []interface{}:
+		s := &Schema{Type: "union"}
+		for _, branch := range raw {
+			b, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			s.Branches = append(s.Branches, b)
+		}
+
+		return s, nil
+	case map[string]interface{}:
+		return p.parseObject(raw, namespace)
+	default:
+		return nil, fmt.Errorf("avro: a schema must be a string, array or object, not %v", raw)
+	}
+}
+
+func (p *parser) parseObject(raw map[string]interface{}, namespace string) (*Schema, error) {
+	typ, _ := raw["type"].(string)
+	logicalType, _ := raw["logicalType"].(string)
+
+	switch typ {
+	case "record", "error", "enum", "fixed":
+		name, _ := raw["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("avro: a %s needs a name", typ)
+		}
+
+		if ns, ok := raw["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+
+		s := &Schema{Type: typ, Name: fullName(name, namespace), LogicalType: logicalType}
+		if s.Type == "error" {
+			s.Type = "record"
+		}
+
+		if _, ok := p.names[s.Name]; ok {
+			return nil, fmt.Errorf("avro: %s is defined twice", s.Name)
+		}
+
+		// Names are relative to the namespace of the type they're in.
+		if i := strings.LastIndex(s.Name, "."); i >= 0 {
+			namespace = s.Name[:i]
+		} else {
+			namespace = ""
+		}
+
+		// A record is named before its fields are parsed, so that they can
+		// refer to it.
+		p.names[s.Name] = s
+		return s, p.parseNamed(s, raw, namespace)
+	case "array":
+		items, err := p.parse(raw["items"], namespace)
+		return &Schema{Type: typ, Items: items, LogicalType: logicalType}, err
+	case "map":
+		values, err := p.parse(raw["values"], namespace)
+		return &Schema{Type: typ, Values: values, LogicalType: logicalType}, err
+	default:
+		if primitives[typ] {
+			return &Schema{Type: typ, LogicalType: logicalType}, nil
+		}
+
+		// {"type": "SomeRecord"} refers to a named type, as does {"type":
+		// {...}} define one.
+		s, err := p.parse(raw["type"], namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		if logicalType != "" && s.Name == "" {
+			s.LogicalType = logicalType
+		}
+
+		return s, nil
+	}
+}
+
+func (p *parser) parseNamed(s *Schema, raw map[string]interface{}, namespace string) error {
+	switch s.Type {
+	case "record":
+		fields, ok := raw["fields"].([]interface{})
+		if !ok {
+			return fmt.Errorf("avro: %s needs fields", s.Name)
+		}
+
+		for _, f := range fields {
+			f, ok := f.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("avro: %s has a field that isn't an object", s.Name)
+			}
+
+			name, _ := f["name"].(string)
+			if name == "" {
+				return fmt.Errorf("avro: %s has a field without a name", s.Name)
+			}
+
+			typ, err := p.parse(f["type"], namespace)
+			if err != nil {
+				return fmt.Errorf("avro: %s.%s: %s", s.Name, name, strings.TrimPrefix(err.Error(), "avro: "))
+			}
+
+			s.Fields = append(s.Fields, Field{Name: name, Type: typ})
+		}
+	case "enum":
+		symbols, ok := raw["symbols"].([]interface{})
+		if !ok || len(symbols) == 0 {
+			return fmt.Errorf("avro: %s needs symbols", s.Name)
+		}
+
+		for _, symbol := range symbols {
+			symbol, ok := symbol.(string)
+			if !ok {
+				return fmt.Errorf("avro: %s has a symbol that isn't a string", s.Name)
+			}
+
+			s.Symbols = append(s.Symbols, symbol)
+		}
+	case "fixed":
+		size, ok := raw["size"].(float64)
+		if !ok || size < 0 || size != float64(int(size)) {
+			return fmt.Errorf("avro: %s needs a size", s.Name)
+		}
+
+		s.Size = int(size)
+	}
+
+	return nil
+}
+
+// fullName qualifies name with namespace, unless it's already qualified.
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+
+	return namespace + "." + name
+}
+
+// Canonical returns the schema's Parsing Canonical Form: the schema with
+// everything that doesn't affect how data is read stripped away.
+func (s *Schema) Canonical() string {
+	var b strings.Builder
+	s.canonical(&b, map[*Schema]bool{})
+	return b.String()
+}
+
+func (s *Schema) canonical(b *strings.Builder, seen map[*Schema]bool) {
+	quote := func(v string) {
+		q, _ := json.Marshal(v)
+		b.Write(q)
+	}
+
+	switch s.Type {
+	case "record", "enum", "fixed":
+		// After its first appearance, a named type is only referred to.
+		if seen[s] {
+			quote(s.Name)
+			return
+		}
+
+		seen[s] = true
+		b.WriteString(`{"name":`)
+		quote(s.Name)
+		b.WriteString(`,"type":`)
+		quote(s.Type)
+
+		switch s.Type {
+		case "record":
+			b.WriteString(`,"fields":[`)
+			for i, f := range s.Fields {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+
+				b.WriteString(`{"name":`)
+				quote(f.Name)
+				b.WriteString(`,"type":`)
+				f.Type.canonical(b, seen)
+				b.WriteByte('}')
+			}
+
+			b.WriteByte(']')
+		case "enum":
+			b.WriteString(`,"symbols":[`)
+			for i, symbol := range s.Symbols {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+
+				quote(symbol)
+			}
+
+			b.WriteByte(']')
+		case "fixed":
+			b.WriteString(`,"size":`)
+			b.WriteString(strconv.Itoa(s.Size))
+		}
+
+		b.WriteByte('}')
+	case "array":
+		b.WriteString(`{"type":"array","items":`)
+		s.Items.canonical(b, seen)
+		b.WriteByte('}')
+	case "map":
+		b.WriteString(`{"type":"map","values":`)
+		s.Values.canonical(b, seen)
+		b.WriteByte('}')
+	case "union":
+		b.WriteByte('[')
+		for i, branch := range s.Branches {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+
+			branch.canonical(b, seen)
+		}
+
+		b.WriteByte(']')
+	default:
+		quote(s.Type)
+	}
+}
+
+// Fingerprint returns the schema's CRC-64-AVRO fingerprint.
+func (s *Schema) Fingerprint() uint64 {
+	return fingerprint([]byte(s.Canonical()))
+}
+
+// emptyFingerprint is both the fingerprint of nothing, and the polynomial
+// CRC-64-AVRO is built from.
+const emptyFingerprint uint64 = 0xc15d213aa4d7a795
+
+var fingerprintTable = func() (table [256]uint64) {
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (emptyFingerprint & -(fp & 1))
+		}
+
+		table[i] = fp
+	}
+
+	return table
+}()
+
+func fingerprint(buf []byte) uint64 {
+	fp := emptyFingerprint
+	for _, b := range buf {
+		fp = (fp >> 8) ^ fingerprintTable[byte(fp)^b]
+	}
+
+	return fp
+}
+
+// Registry is a set of schemas, looked up by fingerprint.
+type Registry struct {
+	schemas map[uint64]*Schema
+}
+
+// LoadRegistry reads the schemas in the JSON file at path. The file holds an
+// array of schemas, each a complete schema of its own. If there's no such
+// file, the registry is empty.
+func LoadRegistry(path string) (*Registry, error) {
+	r := &Registry{schemas: map[uint64]*Schema{}}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var raws []json.RawMessage
+	if err := json.Unmarshal(buf, &raws); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	for i, raw := range raws {
+		s, err := ParseSchema(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: schema %d: %s", path, i, err)
+		}
+
+		r.schemas[s.Fingerprint()] = s
+	}
+
+	return r, nil
+}
+
+// Lookup returns the schema with the given fingerprint, or nil if there isn't
+// one.
+func (r *Registry) Lookup(fingerprint uint64) *Schema {
+	return r.schemas[fingerprint]
+}
+
+// Fingerprints returns the fingerprints of the registry's schemas.
+func (r *Registry) Fingerprints() []uint64 {
+	fps := make([]uint64, 0, len(r.schemas))
+	for fp := range r.schemas {
+		fps = append(fps, fp)
+	}
+
+	return fps
+}
@@ -0,0 +1,108 @@
+// Package codec stores events more compactly than jsonb does.
+//
+// jsonb stores every key of every event, and every value as text. But the
+// schema already says which properties each type of event has, and what kind
+// of value each one is. A codec uses that to store just the values, in binary,
+// and to turn them back into the same event when it's read.
+//
+// Which types are stored with a codec is up to the schema: a variant of the
+// discriminator with "codec" in its metadata names the codec to use for it.
+// jddf-go doesn't keep metadata, so it's read with package schemameta.
+// A codec's state -- for the dictionary codec, the list of fields it stores --
+// is saved alongside the events, so that they can still be read after the
+// schema changes.
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+	"github.com/jddf/jddf-go"
+)
+
+// Codec turns events of one type into bytes, and back again.
+type Codec interface {
+	// Name is the name of the kind of codec, like "dictionary".
+	Name() string
+
+	// Encode returns the compact form of an event, which must be valid against
+	// the schema the codec was made from.
+	Encode(event map[string]interface{}) ([]byte, error)
+
+	// Decode returns the event a compact form was encoded from.
+	Decode(buf []byte) (map[string]interface{}, error)
+}
+
+// kind is a kind of codec: how to make one from a schema, and how to load one
+// from its saved state.
+type kind struct {
+	new  func(schema jddf.Schema, eventType string) (Codec, error)
+	load func(state []byte) (Codec, error)
+}
+
+var kinds = map[string]kind{
+	"dictionary": {
+		new: func(schema jddf.Schema, eventType string) (Codec, error) {
+			return NewDictionary(schema, eventType)
+		},
+		load: func(state []byte) (Codec, error) {
+			var d Dictionary
+			if err := json.Unmarshal(state, &d); err != nil {
+				return nil, err
+			}
+
+			return &d, nil
+		},
+	},
+}
+
+// FromSchema returns a codec for each type of event whose variant of schema
+// has "codec" in its metadata, meta, keyed by event type.
+func FromSchema(schema jddf.Schema, meta schemameta.Schema) (map[string]Codec, error) {
+	codecs := map[string]Codec{}
+
+	eventTypes := make([]string, 0, len(schema.Discriminator.Mapping))
+	for eventType := range schema.Discriminator.Mapping {
+		eventTypes = append(eventTypes, eventType)
+	}
+
+	sort.Strings(eventTypes)
+	for _, eventType := range eventTypes {
+		name, ok := meta.Discriminator.Mapping[eventType].Metadata["codec"]
+		if !ok {
+			continue
+		}
+
+		k, ok := kinds[fmt.Sprint(name)]
+		if !ok {
+			return nil, fmt.Errorf("codec: %s: unknown codec %q", eventType, name)
+		}
+
+		c, err := k.new(schema, eventType)
+		if err != nil {
+			return nil, fmt.Errorf("codec: %s: %s", eventType, err)
+		}
+
+		codecs[eventType] = c
+	}
+
+	return codecs, nil
+}
+
+// Load returns a codec of the named kind from its saved state, as returned by
+// State.
+func Load(name string, state []byte) (Codec, error) {
+	k, ok := kinds[name]
+	if !ok {
+		return nil, fmt.Errorf("codec: unknown codec %q", name)
+	}
+
+	return k.load(state)
+}
+
+// State returns what Load needs to recreate c.
+func State(c Codec) ([]byte, error) {
+	return json.Marshal(c)
+}
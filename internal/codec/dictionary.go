@@ -0,0 +1,397 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jddf/jddf-go"
+)
+
+// dictionaryVersion is the first byte of every event the dictionary codec
+// encodes, so that the format can change.
+const dictionaryVersion = 1
+
+// Field kinds the dictionary codec stores specially. Values of any other kind
+// of schema are stored as JSON.
+const (
+	kindString    = "string"
+	kindTimestamp = "timestamp"
+	kindNumber    = "number"
+	kindInteger   = "integer"
+	kindBoolean   = "boolean"
+	kindEnum      = "enum"
+	kindJSON      = "json"
+)
+
+// Dictionary is a codec that stores an event's properties in a fixed order,
+// without their names, as compact binary values: varints for integers and
+// string lengths, eight bytes for other numbers, and a number of seconds for
+// timestamps.
+//
+// A bitmap at the start records which optional properties are present.
+type Dictionary struct {
+	// Tag and Type are the discriminator's tag and value for the events this
+	// codec is for, which are the same for every event, so aren't stored.
+	Tag  string `json:"tag"`
+	Type string `json:"type"`
+
+	// Fields are the properties stored, in order.
+	Fields []Field `json:"fields"`
+}
+
+// Field is one property of an event, as stored by the dictionary codec.
+type Field struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Optional bool     `json:"optional,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+// NewDictionary returns a dictionary codec for the given type of event.
+func NewDictionary(schema jddf.Schema, eventType string) (*Dictionary, error) {
+	variant, ok := schema.Discriminator.Mapping[eventType]
+	if !ok {
+		return nil, fmt.Errorf("no such event type")
+	}
+
+	d := &Dictionary{Tag: schema.Discriminator.Tag, Type: eventType}
+	for _, optional := range []bool{false, true} {
+		properties := variant.RequiredProperties
+		if optional {
+			properties = variant.OptionalProperties
+		}
+
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		for _, name := range names {
+			d.Fields = append(d.Fields, newField(name, properties[name], optional))
+		}
+	}
+
+	return d, nil
+}
+
+func newField(name string, schema jddf.Schema, optional bool) Field {
+	field := Field{Name: name, Kind: kindJSON, Optional: optional}
+	switch {
+	case len(schema.Enum) != 0:
+		field.Kind, field.Values = kindEnum, schema.Enum
+	case schema.Type == jddf.TypeString:
+		field.Kind = kindString
+	case schema.Type == jddf.TypeTimestamp:
+		field.Kind = kindTimestamp
+	case schema.Type == jddf.TypeBoolean:
+		field.Kind = kindBoolean
+	case schema.Type == jddf.TypeFloat32 || schema.Type == jddf.TypeFloat64:
+		field.Kind = kindNumber
+	case schema.Type != "":
+		field.Kind = kindInteger
+	}
+
+	return field
+}
+
+// Name implements Codec.
+func (d *Dictionary) Name() string {
+	return "dictionary"
+}
+
+// Encode implements Codec.
+func (d *Dictionary) Encode(event map[string]interface{}) ([]byte, error) {
+	optional := 0
+	for _, field := range d.Fields {
+		if field.Optional {
+			optional++
+		}
+	}
+
+	buf := make([]byte, 1+(optional+7)/8, 64)
+	buf[0] = dictionaryVersion
+	bitmap := buf[1:]
+
+	i := 0
+	for _, field := range d.Fields {
+		value, ok := event[field.Name]
+		if field.Optional {
+			if ok {
+				bitmap[i/8] |= 1 << uint(i%8)
+			}
+
+			i++
+		}
+
+		if !ok {
+			if !field.Optional {
+				return nil, fmt.Errorf("codec: event has no %q", field.Name)
+			}
+
+			continue
+		}
+
+		var err error
+		if buf, err = field.encode(buf, value); err != nil {
+			return nil, fmt.Errorf("codec: %s: %s", field.Name, err)
+		}
+	}
+
+	return buf, nil
+}
+
+func (f Field) encode(buf []byte, value interface{}) ([]byte, error) {
+	switch f.Kind {
+	case kindString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+
+		return appendString(buf, s), nil
+	case kindTimestamp:
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+
+		// Timestamps are stored as seconds, nanoseconds, and a UTC offset, if
+		// that's enough to write them back exactly as they were. Otherwise -- as
+		// for "+00:00" rather than "Z", say -- they're stored as strings.
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil || t.Format(time.RFC3339Nano) != s {
+			return appendString(append(buf, 0), s), nil
+		}
+
+		_, offset := t.Zone()
+		buf = append(buf, 1)
+		buf = appendVarint(buf, t.Unix())
+		buf = appendUvarint(buf, uint64(t.Nanosecond()))
+		return appendVarint(buf, int64(offset/60)), nil
+	case kindNumber:
+		n, ok := value.(float64)
+		if !ok {
+			return nil, errors.New("not a number")
+		}
+
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(n))
+		return append(buf, b[:]...), nil
+	case kindInteger:
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return nil, errors.New("not an integer")
+		}
+
+		return appendVarint(buf, int64(n)), nil
+	case kindBoolean:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, errors.New("not a boolean")
+		}
+
+		if b {
+			return append(buf, 1), nil
+		}
+
+		return append(buf, 0), nil
+	case kindEnum:
+		for i, v := range f.Values {
+			if v == value {
+				return appendUvarint(buf, uint64(i)), nil
+			}
+		}
+
+		return nil, errors.New("not one of the enum's values")
+	default:
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return appendString(buf, string(raw)), nil
+	}
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], n)]...)
+}
+
+func appendVarint(buf []byte, n int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], n)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUvarint(buf, uint64(len(s))), s...)
+}
+
+// errTruncated is returned when decoding runs out of bytes.
+var errTruncated = errors.New("codec: truncated event")
+
+// Decode implements Codec.
+func (d *Dictionary) Decode(buf []byte) (map[string]interface{}, error) {
+	optional := 0
+	for _, field := range d.Fields {
+		if field.Optional {
+			optional++
+		}
+	}
+
+	if len(buf) < 1+(optional+7)/8 || buf[0] != dictionaryVersion {
+		return nil, errors.New("codec: not a dictionary-encoded event")
+	}
+
+	bitmap := buf[1 : 1+(optional+7)/8]
+	r := reader{buf: buf[1+len(bitmap):]}
+
+	event := map[string]interface{}{d.Tag: d.Type}
+	i := 0
+	for _, field := range d.Fields {
+		if field.Optional {
+			present := bitmap[i/8]&(1<<uint(i%8)) != 0
+			i++
+			if !present {
+				continue
+			}
+		}
+
+		value, err := field.decode(&r)
+		if err != nil {
+			return nil, err
+		}
+
+		event[field.Name] = value
+	}
+
+	return event, nil
+}
+
+func (f Field) decode(r *reader) (interface{}, error) {
+	switch f.Kind {
+	case kindString:
+		return r.string()
+	case kindTimestamp:
+		form, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		if form == 0 {
+			return r.string()
+		}
+
+		sec, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+
+		nsec, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		offset, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+
+		zone := time.UTC
+		if offset != 0 {
+			zone = time.FixedZone("", int(offset)*60)
+		}
+
+		return time.Unix(sec, int64(nsec)).In(zone).Format(time.RFC3339Nano), nil
+	case kindNumber:
+		if len(r.buf) < 8 {
+			return nil, errTruncated
+		}
+
+		n := math.Float64frombits(binary.BigEndian.Uint64(r.buf))
+		r.buf = r.buf[8:]
+		return n, nil
+	case kindInteger:
+		n, err := r.varint()
+		return float64(n), err
+	case kindBoolean:
+		b, err := r.byte()
+		return b == 1, err
+	case kindEnum:
+		i, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		if i >= uint64(len(f.Values)) {
+			return nil, errors.New("codec: enum value out of range")
+		}
+
+		return f.Values[i], nil
+	default:
+		s, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		err = json.Unmarshal([]byte(s), &value)
+		return value, err
+	}
+}
+
+// reader reads the values of an encoded event, in order.
+type reader struct {
+	buf []byte
+}
+
+func (r *reader) byte() (byte, error) {
+	if len(r.buf) < 1 {
+		return 0, errTruncated
+	}
+
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b, nil
+}
+
+func (r *reader) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(r.buf)
+	if size <= 0 {
+		return 0, errTruncated
+	}
+
+	r.buf = r.buf[size:]
+	return n, nil
+}
+
+func (r *reader) varint() (int64, error) {
+	n, size := binary.Varint(r.buf)
+	if size <= 0 {
+		return 0, errTruncated
+	}
+
+	r.buf = r.buf[size:]
+	return n, nil
+}
+
+func (r *reader) string() (string, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+
+	if uint64(len(r.buf)) < n {
+		return "", errTruncated
+	}
+
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s, nil
+}
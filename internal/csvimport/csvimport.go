@@ -0,0 +1,162 @@
+// Package csvimport turns rows of a CSV file into analytics events.
+//
+// Every value in a CSV is a string, but events have numbers and booleans in
+// them too. Rather than making users spell out the type of each column, the
+// JDDF schema already tells us what type each field of each event type is, so
+// values are converted according to it.
+package csvimport
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/jddf/jddf-go"
+)
+
+// Mapping maps CSV column headers to the event fields they hold. Columns that
+// aren't in the mapping are ignored.
+type Mapping map[string]string
+
+// Reader reads events out of a CSV file, one row at a time. The first row of
+// the file must be a header.
+type Reader struct {
+	csv         *csv.Reader
+	schema      jddf.Schema
+	defaultType string
+	fields      []string
+	row         int
+}
+
+// NewReader returns a Reader reading CSV from r, which maps columns to fields
+// using mapping. If no column maps to the schema's discriminator tag (that is,
+// "type"), every event gets defaultType as its type.
+func NewReader(r io.Reader, schema jddf.Schema, mapping Mapping, defaultType string) (*Reader, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("csvimport: CSV is empty, and has no header")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, len(header))
+	hasType := false
+	for i, column := range header {
+		fields[i] = mapping[column]
+		if fields[i] == schema.Discriminator.Tag {
+			hasType = true
+		}
+	}
+
+	if !hasType && defaultType == "" {
+		return nil, fmt.Errorf("csvimport: no column maps to %q, and no default type was given", schema.Discriminator.Tag)
+	}
+
+	return &Reader{
+		csv:         reader,
+		schema:      schema,
+		defaultType: defaultType,
+		fields:      fields,
+	}, nil
+}
+
+// Read returns the next row of the CSV as an event, in the form of generic
+// JSON. The event hasn't been validated yet. At the end of the file, Read
+// returns io.EOF.
+//
+// If just one row is malformed, the error is a *RowError, and the caller may
+// keep calling Read to carry on with the following rows.
+func (r *Reader) Read() (map[string]interface{}, error) {
+	record, err := r.csv.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+
+	r.row++
+	if err, ok := err.(*csv.ParseError); ok {
+		return nil, &RowError{Row: r.row, Err: err.Err}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	event := map[string]interface{}{}
+	if r.defaultType != "" {
+		event[r.schema.Discriminator.Tag] = r.defaultType
+	}
+
+	for i, field := range r.fields {
+		if field != "" && record[i] != "" {
+			event[field] = record[i]
+		}
+	}
+
+	// Now that we know what type of event this is, convert its values according
+	// to that event type's schema.
+	tag, _ := event[r.schema.Discriminator.Tag].(string)
+	variant := r.schema.Discriminator.Mapping[tag]
+	for field, value := range event {
+		if field == r.schema.Discriminator.Tag {
+			continue
+		}
+
+		converted, err := convert(value.(string), fieldType(variant, field))
+		if err != nil {
+			return nil, &RowError{Row: r.row, Err: fmt.Errorf("%s: %s", field, err)}
+		}
+
+		event[field] = converted
+	}
+
+	return event, nil
+}
+
+// RowError is an error with a single row of a CSV file.
+type RowError struct {
+	// Row is the number of the row with the error. The first row after the
+	// header is row 1.
+	Row int
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("csvimport: row %d: %s", e.Row, e.Err)
+}
+
+// Row returns the number of the row Read last returned, counting from 1 after
+// the header.
+func (r *Reader) Row() int {
+	return r.row
+}
+
+// fieldType returns the JDDF type of a field in a discriminator variant. For
+// fields that aren't in the schema, or aren't of the type form, it returns the
+// empty string.
+func fieldType(variant jddf.Schema, field string) jddf.Type {
+	if schema, ok := variant.RequiredProperties[field]; ok {
+		return schema.Type
+	}
+
+	return variant.OptionalProperties[field].Type
+}
+
+// convert turns a CSV value into the JSON value a field of type typ should
+// have. Values of any non-numeric, non-boolean type are kept as strings.
+func convert(value string, typ jddf.Type) (interface{}, error) {
+	switch typ {
+	case "boolean":
+		return strconv.ParseBool(value)
+	case "float32", "float64", "int8", "uint8", "int16", "uint16", "int32", "uint32":
+		return strconv.ParseFloat(value, 64)
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,240 @@
+// Package dbtimeout makes Postgres give up on queries when their context's
+// deadline passes, rather than leaving the client to give up alone.
+//
+// A query abandoned client-side can keep running server-side, holding a
+// connection's worth of CPU and I/O for nobody. So before a query with a
+// deadline, the connection's statement_timeout is set to the time it has left.
+// Postgres then cancels the query itself, and reports it as a query_canceled
+// error, which IsTimeout recognizes.
+//
+// Queries without a deadline run with the connection's default timeout.
+package dbtimeout
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// queryCanceled is the SQLSTATE of statements cancelled by statement_timeout,
+// or by the client.
+const queryCanceled = "57014"
+
+// IsTimeout returns whether err is a query being cancelled for running out of
+// time, either by Postgres or by its context.
+func IsTimeout(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == queryCanceled
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// Connector wraps c, so that queries on its connections with a deadline time
+// out server-side. Use it with sql.OpenDB.
+func Connector(c driver.Connector) driver.Connector {
+	return &connector{connector: c}
+}
+
+type connector struct {
+	connector driver.Connector
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	inner, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: inner}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// conn is a connection whose statement_timeout follows its queries' deadlines.
+type conn struct {
+	driver.Conn
+
+	// changed is whether statement_timeout has been set, and so needs resetting
+	// before a query without a deadline.
+	changed bool
+}
+
+// setTimeout sets statement_timeout for a query with the given context.
+func (c *conn) setTimeout(ctx context.Context) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline && !c.changed {
+		return nil
+	}
+
+	exec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil
+	}
+
+	if !hasDeadline {
+		if _, err := exec.ExecContext(ctx, "reset statement_timeout", nil); err != nil {
+			return err
+		}
+
+		c.changed = false
+		return nil
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return context.DeadlineExceeded
+	}
+
+	// statement_timeout is in whole milliseconds, and 0 means none at all.
+	ms := int64((remaining + time.Millisecond - 1) / time.Millisecond)
+	if _, err := exec.ExecContext(ctx, fmt.Sprintf("set statement_timeout = %d", ms), nil); err != nil {
+		return err
+	}
+
+	c.changed = true
+	return nil
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var inner driver.Tx
+	var err error
+	if begin, ok := c.Conn.(driver.ConnBeginTx); ok {
+		inner, err = begin.BeginTx(ctx, opts)
+	} else {
+		inner, err = c.Conn.Begin()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx{Tx: inner, conn: c}, nil
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	// Preparing COPY starts it, and nothing else can be sent on the connection
+	// until it's done. So it runs with whatever timeout it already had.
+	isCopy := strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "COPY")
+	if !isCopy {
+		if err := c.setTimeout(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var inner driver.Stmt
+	var err error
+	if prepare, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		inner, err = prepare.PrepareContext(ctx, query)
+	} else {
+		inner, err = c.Conn.Prepare(query)
+	}
+
+	if err != nil || isCopy {
+		return inner, err
+	}
+
+	return &stmt{Stmt: inner, conn: c}, nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if inner, ok := c.Conn.(driver.Pinger); ok {
+		return inner.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if inner, ok := c.Conn.(driver.SessionResetter); ok {
+		return inner.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	inner, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	if err := c.setTimeout(ctx); err != nil {
+		return nil, err
+	}
+
+	return inner.QueryContext(ctx, query, args)
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	inner, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	if err := c.setTimeout(ctx); err != nil {
+		return nil, err
+	}
+
+	return inner.ExecContext(ctx, query, args)
+}
+
+// tx forgets what statement_timeout was set to if it's rolled back, since that
+// undoes any SET or RESET inside it. Resetting it again afterwards is harmless.
+type tx struct {
+	driver.Tx
+	conn *conn
+}
+
+func (t *tx) Rollback() error {
+	t.conn.changed = true
+	return t.Tx.Rollback()
+}
+
+// stmt is a prepared statement whose executions follow their deadlines too.
+type stmt struct {
+	driver.Stmt
+	conn *conn
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.conn.setTimeout(ctx); err != nil {
+		return nil, err
+	}
+
+	if inner, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return inner.ExecContext(ctx, args)
+	}
+
+	return s.Stmt.Exec(values(args))
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.conn.setTimeout(ctx); err != nil {
+		return nil, err
+	}
+
+	if inner, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return inner.QueryContext(ctx, args)
+	}
+
+	return s.Stmt.Query(values(args))
+}
+
+// values converts arguments for drivers that don't support named ones.
+func values(args []driver.NamedValue) []driver.Value {
+	vs := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vs[i] = arg.Value
+	}
+
+	return vs
+}
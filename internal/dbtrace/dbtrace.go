@@ -0,0 +1,114 @@
+// Package dbtrace instruments a database/sql driver, so that every query shows
+// up as a span: what statement ran, how long it took, how many rows it touched,
+// and which endpoint it ran on behalf of.
+//
+// It works by wrapping the driver's connections, so nothing that talks to the
+// database needs to change. COPY isn't traced, since every row would be a span
+// of its own.
+package dbtrace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Span is a trace of one query.
+type Span struct {
+	// Label is the label of the context the query ran in, like the endpoint it
+	// ran on behalf of. See WithLabel.
+	Label string
+
+	// Name summarizes the statement, like "select events". See StatementName.
+	Name string
+
+	Query    string
+	Start    time.Time
+	Duration time.Duration
+
+	// Rows is how many rows the query returned, or, for statements that don't
+	// return rows, how many it affected.
+	Rows int64
+
+	Err error
+}
+
+// Tracer receives spans as queries finish.
+type Tracer interface {
+	Finish(ctx context.Context, span Span)
+}
+
+// LogTracer is a Tracer which writes spans to Out, one line each.
+type LogTracer struct {
+	Out io.Writer
+
+	// Slow, if not zero, is how long a query must take to be logged.
+	Slow time.Duration
+}
+
+// Finish implements Tracer.
+func (t *LogTracer) Finish(ctx context.Context, span Span) {
+	if span.Duration < t.Slow {
+		return
+	}
+
+	fmt.Fprintf(t.Out, "query label=%q name=%q duration=%s rows=%d", span.Label, span.Name, span.Duration, span.Rows)
+	if span.Err != nil {
+		fmt.Fprintf(t.Out, " err=%q", span.Err)
+	}
+
+	fmt.Fprintln(t.Out)
+}
+
+type labelKey struct{}
+
+// WithLabel returns a copy of ctx, such that queries run with it are labeled
+// with label.
+func WithLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, labelKey{}, label)
+}
+
+// Handler labels the queries run by each request h serves with the request's
+// method and path, so that slow endpoints can be tied to the SQL responsible.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(WithLabel(r.Context(), r.Method+" "+r.URL.Path)))
+	})
+}
+
+// StatementName summarizes a SQL statement for use as a span name.
+//
+// A statement may name itself with a leading "-- name: XXX" comment. Otherwise,
+// its name is its verb and the table it's mainly about, like "select events"
+// or "insert into import_checkpoints".
+func StatementName(query string) string {
+	query = strings.TrimSpace(query)
+	if strings.HasPrefix(query, "-- name:") {
+		name := strings.TrimPrefix(query, "-- name:")
+		if i := strings.IndexByte(name, '\n'); i >= 0 {
+			name = name[:i]
+		}
+
+		return strings.TrimSpace(name)
+	}
+
+	words := strings.Fields(query)
+	if len(words) == 0 {
+		return ""
+	}
+
+	verb := strings.ToLower(words[0])
+	for i, word := range words[:len(words)-1] {
+		switch strings.ToLower(word) {
+		case "from", "update":
+			return verb + " " + words[i+1]
+		case "into":
+			return verb + " into " + words[i+1]
+		}
+	}
+
+	return verb
+}
@@ -0,0 +1,217 @@
+package dbtrace
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"time"
+)
+
+// Connector wraps c, so that queries on its connections are reported to
+// tracer. Use it with sql.OpenDB.
+func Connector(c driver.Connector, tracer Tracer) driver.Connector {
+	return &connector{connector: c, tracer: tracer}
+}
+
+type connector struct {
+	connector driver.Connector
+	tracer    Tracer
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	inner, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: inner, tracer: c.tracer}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// conn is a traced connection. Anything that isn't a query is passed straight
+// through to the wrapped connection.
+type conn struct {
+	driver.Conn
+	tracer Tracer
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if inner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return inner.BeginTx(ctx, opts)
+	}
+
+	return c.Conn.Begin()
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var inner driver.Stmt
+	var err error
+	if prepare, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		inner, err = prepare.PrepareContext(ctx, query)
+	} else {
+		inner, err = c.Conn.Prepare(query)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// COPY executes its statement once per row, which would be far too many
+	// spans to be useful.
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "COPY") {
+		return inner, nil
+	}
+
+	return &stmt{Stmt: inner, conn: c, query: query}, nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if inner, ok := c.Conn.(driver.Pinger); ok {
+		return inner.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if inner, ok := c.Conn.(driver.SessionResetter); ok {
+		return inner.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	inner, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	span := c.start(ctx, query)
+	result, err := inner.QueryContext(ctx, query, args)
+	if err != nil {
+		c.finish(ctx, span, err)
+		return nil, err
+	}
+
+	// The query isn't over until its rows have all been read.
+	return &rows{Rows: result, conn: c, ctx: ctx, span: span}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	inner, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	span := c.start(ctx, query)
+	result, err := inner.ExecContext(ctx, query, args)
+	if err == nil {
+		span.Rows, _ = result.RowsAffected()
+	}
+
+	c.finish(ctx, span, err)
+	return result, err
+}
+
+func (c *conn) start(ctx context.Context, query string) Span {
+	label, _ := ctx.Value(labelKey{}).(string)
+	return Span{Label: label, Name: StatementName(query), Query: query, Start: time.Now()}
+}
+
+func (c *conn) finish(ctx context.Context, span Span, err error) {
+	// database/sql retries ErrSkip some other way; it's not a real query.
+	if err == driver.ErrSkip {
+		return
+	}
+
+	span.Duration = time.Since(span.Start)
+	span.Err = err
+	c.tracer.Finish(ctx, span)
+}
+
+// rows counts the rows of a query as they're read, and finishes its span when
+// they're closed.
+type rows struct {
+	driver.Rows
+	conn *conn
+	ctx  context.Context
+	span Span
+	err  error
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.span.Rows++
+	} else if err != io.EOF {
+		r.err = err
+	}
+
+	return err
+}
+
+func (r *rows) Close() error {
+	err := r.Rows.Close()
+	r.conn.finish(r.ctx, r.span, r.err)
+	return err
+}
+
+// stmt is a traced prepared statement.
+type stmt struct {
+	driver.Stmt
+	conn  *conn
+	query string
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	span := s.conn.start(ctx, s.query)
+
+	var result driver.Result
+	var err error
+	if inner, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = inner.ExecContext(ctx, args)
+	} else {
+		result, err = s.Stmt.Exec(values(args))
+	}
+
+	if err == nil {
+		span.Rows, _ = result.RowsAffected()
+	}
+
+	s.conn.finish(ctx, span, err)
+	return result, err
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	span := s.conn.start(ctx, s.query)
+
+	var result driver.Rows
+	var err error
+	if inner, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		result, err = inner.QueryContext(ctx, args)
+	} else {
+		result, err = s.Stmt.Query(values(args))
+	}
+
+	if err != nil {
+		s.conn.finish(ctx, span, err)
+		return nil, err
+	}
+
+	return &rows{Rows: result, conn: s.conn, ctx: ctx, span: span}, nil
+}
+
+// values converts arguments for drivers that don't support named ones.
+func values(args []driver.NamedValue) []driver.Value {
+	vs := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vs[i] = arg.Value
+	}
+
+	return vs
+}
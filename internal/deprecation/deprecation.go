@@ -0,0 +1,121 @@
+// Package deprecation warns producers that send what's on its way out of the
+// schema.
+//
+// Removing an event type or field from the schema breaks whoever still sends
+// it. Marking it deprecated first, in a deprecations file next to the schema,
+// keeps accepting it, but tells its producers -- and whoever's watching which
+// producers still send it -- that it's time to move on:
+//
+//	{
+//	  "types": { "Heartbeat": "send Session Pinged events instead" },
+//	  "fields": { "Page Viewed": { "referrer": "use referrerUrl", "context.locale": "" } }
+//	}
+//
+// Fields are named by their path from the root of the event, with dots
+// between the names of nested properties. The message, which may be empty,
+// says what to do instead.
+package deprecation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Set is the deprecated event types and fields.
+type Set struct {
+	// Types maps deprecated event types to what to do instead.
+	Types map[string]string `json:"types"`
+
+	// Fields maps event types to their deprecated fields, and each field to
+	// what to do instead.
+	Fields map[string]map[string]string `json:"fields"`
+}
+
+// Warning is a deprecated thing an event had.
+type Warning struct {
+	// Type is the event's type. Field is the deprecated field, or empty if
+	// it's the type that's deprecated.
+	Type  string `json:"type"`
+	Field string `json:"field,omitempty"`
+
+	// Message is what to do instead, if the deprecations file says.
+	Message string `json:"message,omitempty"`
+}
+
+// String describes the warning, like a Warning header's text.
+func (w Warning) String() string {
+	what := fmt.Sprintf("%q events are deprecated", w.Type)
+	if w.Field != "" {
+		what = fmt.Sprintf("%s in %q events is deprecated", w.Field, w.Type)
+	}
+
+	if w.Message == "" {
+		return what
+	}
+
+	return what + ": " + w.Message
+}
+
+// Load reads a deprecations file. If there isn't one at path, nothing is
+// deprecated.
+func Load(path string) (*Set, error) {
+	set := &Set{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return set, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(set); err != nil {
+		return nil, fmt.Errorf("deprecation: %s: %s", path, err)
+	}
+
+	return set, nil
+}
+
+// Check returns what's deprecated in an event of type eventType: the type
+// first, then its fields, by name. A nil Set deprecates nothing.
+func (s *Set) Check(eventType string, event map[string]interface{}) []Warning {
+	if s == nil {
+		return nil
+	}
+
+	var warnings []Warning
+	if message, ok := s.Types[eventType]; ok {
+		warnings = append(warnings, Warning{Type: eventType, Message: message})
+	}
+
+	fields := make([]string, 0, len(s.Fields[eventType]))
+	for field := range s.Fields[eventType] {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+	for _, field := range fields {
+		if has(event, strings.Split(field, ".")) {
+			warnings = append(warnings, Warning{Type: eventType, Field: field, Message: s.Fields[eventType][field]})
+		}
+	}
+
+	return warnings
+}
+
+// has returns whether the property at path is in v. A property that's there
+// but null counts as there: the producer still sent it.
+func has(v map[string]interface{}, path []string) bool {
+	value, ok := v[path[0]]
+	if !ok || len(path) == 1 {
+		return ok
+	}
+
+	next, ok := value.(map[string]interface{})
+	return ok && has(next, path[1:])
+}
@@ -0,0 +1,179 @@
+// Package envelope implements the framed binary format analytics instances use
+// to forward events to one another.
+//
+// Events forwarded between instances have already been validated by the
+// instance that first received them. The envelope carries what the receiving
+// instance needs to know about an event -- its type, tenant, and when it was
+// received -- in a fixed header, next to the event's original JSON. So the
+// receiver can authorize and store events without parsing, re-validating, or
+// re-encoding them.
+//
+// A stream of envelopes is a sequence of frames, each laid out as (all integers
+// big-endian):
+//
+//	uint32  length of the rest of the frame
+//	uint8   version, currently 1
+//	uint16  length of the type, then the type
+//	uint16  length of the tenant, then the tenant
+//	int64   when the event was received, in Unix nanoseconds
+//	...     the event's JSON, taking up the rest of the frame
+package envelope
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ContentType is the media type of a stream of envelopes.
+const ContentType = "application/vnd.analytics-envelope"
+
+// Version is the version of the format written by Writer.
+const Version = 1
+
+// MaxFrameSize is the largest frame Reader accepts, so that a corrupt length
+// can't make it allocate without bound.
+const MaxFrameSize = 16 << 20
+
+// headerSize is the size of a frame's fixed-size fields, after its length.
+const headerSize = 1 + 2 + 2 + 8
+
+// Envelope is one forwarded event.
+type Envelope struct {
+	Type       string
+	Tenant     string
+	ReceivedAt time.Time
+
+	// Body is the event's JSON.
+	Body []byte
+}
+
+// Writer writes a stream of envelopes.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a Writer writing to w. Call Flush when done.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Write writes one envelope.
+func (w *Writer) Write(e Envelope) error {
+	if len(e.Type) > 0xffff || len(e.Tenant) > 0xffff {
+		return errors.New("envelope: type or tenant is too long")
+	}
+
+	size := headerSize + len(e.Type) + len(e.Tenant) + len(e.Body)
+	if size > MaxFrameSize {
+		return fmt.Errorf("envelope: frame of %d bytes is too large", size)
+	}
+
+	header := make([]byte, 0, 4+headerSize+len(e.Type)+len(e.Tenant))
+	header = appendUint32(header, uint32(size))
+	header = append(header, Version)
+	header = appendUint16(header, uint16(len(e.Type)))
+	header = append(header, e.Type...)
+	header = appendUint16(header, uint16(len(e.Tenant)))
+	header = append(header, e.Tenant...)
+	header = appendUint64(header, uint64(e.ReceivedAt.UnixNano()))
+
+	// bufio.Writer remembers the first error, so checking the last write is
+	// enough.
+	w.w.Write(header)
+	_, err := w.w.Write(e.Body)
+	return err
+}
+
+// Flush writes out any buffered envelopes.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Reader reads a stream of envelopes.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next envelope. At the end of the stream, it returns io.EOF.
+func (r *Reader) Read() (Envelope, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r.r, length[:]); err != nil {
+		return Envelope{}, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size < headerSize || size > MaxFrameSize {
+		return Envelope{}, fmt.Errorf("envelope: invalid frame length %d", size)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return Envelope{}, err
+	}
+
+	if frame[0] != Version {
+		return Envelope{}, fmt.Errorf("envelope: unsupported version %d", frame[0])
+	}
+
+	rest := frame[1:]
+	typ, rest, err := readString(rest)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	tenant, rest, err := readString(rest)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	if len(rest) < 8 {
+		return Envelope{}, errors.New("envelope: frame is truncated")
+	}
+
+	return Envelope{
+		Type:       typ,
+		Tenant:     tenant,
+		ReceivedAt: time.Unix(0, int64(binary.BigEndian.Uint64(rest))),
+		Body:       rest[8:],
+	}, nil
+}
+
+// readString reads a length-prefixed string from the start of buf, and returns
+// it along with the rest of buf.
+func readString(buf []byte) (string, []byte, error) {
+	if len(buf) < 2 {
+		return "", nil, errors.New("envelope: frame is truncated")
+	}
+
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return "", nil, errors.New("envelope: frame is truncated")
+	}
+
+	return string(buf[2 : 2+n]), buf[2+n:], nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v>>32)), uint32(v))
+}
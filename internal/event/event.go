@@ -53,10 +53,12 @@ type EventPageViewed struct {
 type EventOrderCompleted struct {
 	Timestamp time.Time `json:"timestamp"`
 	UserId string `json:"userId"`
-	Revenue float64 `json:"revenue"`
+	Revenue string `json:"revenue"`
 }
 type EventHeartbeat struct {
 	Timestamp time.Time `json:"timestamp"`
 	UserId string `json:"userId"`
+	AppVersion *string `json:"appVersion,omitempty"`
+	Platform *string `json:"platform,omitempty"`
 }
 
@@ -0,0 +1,215 @@
+// Package eventid generates the IDs the server gives to events.
+//
+// Every strategy makes IDs that sort, as strings, in the order they were made.
+// That makes them good keys for paging through events: "everything after this
+// ID" is an index range scan, and it doesn't skip or repeat events that arrive
+// while someone's paging.
+package eventid
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Generator makes event IDs. It's safe to use from many goroutines.
+type Generator interface {
+	New() string
+}
+
+// New returns the generator for the named strategy: "uuidv7", "ulid", or
+// "snowflake". node distinguishes server instances using the snowflake
+// strategy, and must be unique to each; it's ignored by the others, which are
+// random enough not to need it.
+func New(strategy string, node int) (Generator, error) {
+	switch strategy {
+	case "uuidv7":
+		return &UUIDv7{}, nil
+	case "ulid":
+		return &ULID{}, nil
+	case "snowflake":
+		if node < 0 || node >= 1<<snowflakeNodeBits {
+			return nil, fmt.Errorf("eventid: snowflake node must be from 0 to %d", 1<<snowflakeNodeBits-1)
+		}
+
+		return &Snowflake{Node: int64(node)}, nil
+	default:
+		return nil, fmt.Errorf("eventid: unknown strategy %q", strategy)
+	}
+}
+
+// UUIDv7 makes version 7 UUIDs: a millisecond timestamp, then random bits.
+//
+// Within a millisecond, the 12 bits after the timestamp count up, so that IDs
+// made by one generator always sort in the order they were made.
+type UUIDv7 struct {
+	mu  sync.Mutex
+	ms  int64
+	seq uint16
+}
+
+// New implements Generator.
+func (g *UUIDv7) New() string {
+	g.mu.Lock()
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms > g.ms {
+		g.ms, g.seq = ms, 0
+	} else {
+		// Clocks can go backwards. Stick with the latest time seen, so IDs don't.
+		g.seq++
+		if g.seq == 1<<12 {
+			g.ms, g.seq = g.ms+1, 0
+		}
+	}
+
+	ms, seq := g.ms, g.seq
+	g.mu.Unlock()
+
+	var id [16]byte
+	randomBytes(id[8:])
+	binary.BigEndian.PutUint64(id[:8], uint64(ms)<<16|0x7000|uint64(seq))
+	id[8] = id[8]&0x3f | 0x80 // the RFC 4122 variant
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], id[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], id[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], id[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], id[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], id[10:])
+	return string(buf)
+}
+
+// crockford is the alphabet ULIDs are written in. It leaves out letters that
+// look like digits.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID makes ULIDs: a millisecond timestamp, then 80 random bits, written as
+// 26 characters.
+//
+// Within a millisecond, the random bits are incremented rather than drawn
+// again, so that IDs made by one generator always sort in the order they were
+// made.
+type ULID struct {
+	mu      sync.Mutex
+	ms      int64
+	entropy [10]byte
+}
+
+// New implements Generator.
+func (g *ULID) New() string {
+	g.mu.Lock()
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	if ms > g.ms {
+		g.ms = ms
+		randomBytes(g.entropy[:])
+	} else {
+		// Add one to the entropy, as a big-endian number. If it overflows, move
+		// on to the next millisecond.
+		i := len(g.entropy) - 1
+		for ; i >= 0; i-- {
+			g.entropy[i]++
+			if g.entropy[i] != 0 {
+				break
+			}
+		}
+
+		if i < 0 {
+			g.ms++
+		}
+	}
+
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(g.ms)<<16)
+	copy(id[6:], g.entropy[:])
+	g.mu.Unlock()
+
+	// 128 bits is 26 characters of 5 bits each, with the first character only
+	// using 3 of them.
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	buf := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(buf)
+}
+
+// snowflakeEpoch is when snowflake timestamps count from: 2020-01-01.
+const snowflakeEpoch = 1577836800000
+
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+)
+
+// Snowflake makes Twitter-style snowflake IDs: a 41-bit millisecond timestamp,
+// a 10-bit node number, and a 12-bit sequence number, packed into a 64-bit
+// integer. They're written in decimal, zero-padded to 19 digits so that they
+// sort as strings.
+//
+// Unlike the other strategies, snowflakes have no randomness, so each server
+// instance making them must have its own Node.
+type Snowflake struct {
+	Node int64
+
+	mu  sync.Mutex
+	ms  int64
+	seq int64
+}
+
+// New implements Generator.
+func (g *Snowflake) New() string {
+	g.mu.Lock()
+	ms := time.Now().UnixNano()/int64(time.Millisecond) - snowflakeEpoch
+	if ms > g.ms {
+		g.ms, g.seq = ms, 0
+	} else {
+		g.seq++
+		if g.seq == 1<<snowflakeSeqBits {
+			g.ms, g.seq = g.ms+1, 0
+		}
+	}
+
+	id := g.ms<<(snowflakeNodeBits+snowflakeSeqBits) | g.Node<<snowflakeSeqBits | g.seq
+	g.mu.Unlock()
+
+	return fmt.Sprintf("%019d", id)
+}
+
+func randomBytes(buf []byte) {
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+}
+
+// ErrBadCursor is returned by ParseCursor for cursors it didn't make.
+var ErrBadCursor = errors.New("eventid: malformed cursor")
+
+// Cursor returns an opaque token for paging through events after the one with
+// the given ID. Clients shouldn't depend on what's in it, so that it can
+// change.
+func Cursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// ParseCursor returns the ID a cursor made by Cursor is for.
+func ParseCursor(cursor string) (string, error) {
+	id, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(id) == 0 {
+		return "", ErrBadCursor
+	}
+
+	return string(id), nil
+}
@@ -0,0 +1,179 @@
+// Package eventpb is events as protobuf messages, for consumers that would
+// rather not parse JSON, like those reading events off Kafka.
+//
+// The messages, in event.proto and event.go, are generated from
+// event.jddf.json by the "proto" subcommand; see internal/protogen. This file
+// is the hand-written protobuf wire format they're encoded with. Only what the
+// generated messages need is here.
+package eventpb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// Protobuf's wire format is a sequence of fields, each a varint key -- the
+// field number and a wire type -- followed by the value.
+const (
+	wireVarint  = 0
+	wire64Bit   = 1
+	wireBytes   = 2
+	wire32Bit   = 5
+	maxFieldNum = 1<<29 - 1
+)
+
+var errMalformed = errors.New("eventpb: malformed protobuf message")
+
+// errWireType is the error for a field of a known number, but the wrong wire
+// type.
+func errWireType(message string, num int) error {
+	return fmt.Errorf("eventpb: %s field %d has the wrong wire type", message, num)
+}
+
+// eachField calls f with each field in buf. Varints and fixed-size values are
+// passed as v; length-delimited values as b. Fields f doesn't know can simply
+// be ignored, as protobuf requires.
+func eachField(buf []byte, f func(num, wire int, v uint64, b []byte) error) error {
+	for len(buf) != 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 || key>>3 == 0 || key>>3 > maxFieldNum {
+			return errMalformed
+		}
+
+		buf = buf[n:]
+
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case wireVarint:
+			if v, n = binary.Uvarint(buf); n <= 0 {
+				return errMalformed
+			}
+
+			buf = buf[n:]
+		case wire64Bit:
+			if len(buf) < 8 {
+				return errMalformed
+			}
+
+			v, buf = binary.LittleEndian.Uint64(buf), buf[8:]
+		case wire32Bit:
+			if len(buf) < 4 {
+				return errMalformed
+			}
+
+			v, buf = uint64(binary.LittleEndian.Uint32(buf)), buf[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || size > uint64(len(buf)-n) {
+				return errMalformed
+			}
+
+			b, buf = buf[n:n+int(size)], buf[n+int(size):]
+		default:
+			return errMalformed
+		}
+
+		if err := f(int(key>>3), int(key&7), v, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendKey(buf []byte, num, wire int) []byte {
+	return appendVarint(buf, uint64(num)<<3|uint64(wire))
+}
+
+func appendVarintField(buf []byte, num int, v uint64) []byte {
+	return appendVarint(appendKey(buf, num, wireVarint), v)
+}
+
+func appendBoolField(buf []byte, num int, v bool) []byte {
+	if v {
+		return appendVarintField(buf, num, 1)
+	}
+
+	return appendVarintField(buf, num, 0)
+}
+
+func appendFixed32Field(buf []byte, num int, v float32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(v))
+	return append(appendKey(buf, num, wire32Bit), tmp[:]...)
+}
+
+func appendFixed64Field(buf []byte, num int, v float64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	return append(appendKey(buf, num, wire64Bit), tmp[:]...)
+}
+
+func appendBytesField(buf []byte, num int, v []byte) []byte {
+	buf = appendVarint(appendKey(buf, num, wireBytes), uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// unmarshalString checks that a string field is UTF-8, as proto3 requires.
+func unmarshalString(b []byte) (string, error) {
+	if !utf8.Valid(b) {
+		return "", errors.New("eventpb: string field isn't valid UTF-8")
+	}
+
+	return string(b), nil
+}
+
+// marshalTimestamp encodes t as a google.protobuf.Timestamp: seconds (1) and
+// nanoseconds (2) since the Unix epoch, the nanoseconds never negative.
+func marshalTimestamp(t time.Time) []byte {
+	var buf []byte
+	if s := t.Unix(); s != 0 {
+		buf = appendVarintField(buf, 1, uint64(s))
+	}
+
+	if ns := t.Nanosecond(); ns != 0 {
+		buf = appendVarintField(buf, 2, uint64(ns))
+	}
+
+	return buf
+}
+
+// unmarshalTimestamp decodes a google.protobuf.Timestamp, into UTC.
+func unmarshalTimestamp(b []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := eachField(b, func(num, wire int, v uint64, _ []byte) error {
+		if (num == 1 || num == 2) && wire != wireVarint {
+			return errWireType("Timestamp", num)
+		}
+
+		switch num {
+		case 1:
+			seconds = int64(v)
+		case 2:
+			nanos = int64(int32(v))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if nanos < 0 || nanos >= 1e9 {
+		return time.Time{}, errors.New("eventpb: timestamp nanos out of range")
+	}
+
+	return time.Unix(seconds, nanos).UTC(), nil
+}
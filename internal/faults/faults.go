@@ -0,0 +1,226 @@
+// Package faults makes the database and sinks misbehave on purpose: slow
+// queries, dropped connections, and sinks that are down some or all of the
+// time. It's for integration tests and staging, to see retries, backpressure,
+// and load shedding do their jobs against failures that look like the real
+// thing.
+//
+// Faults are injected by wrapping the database's connector and the router's
+// sinks with an Injector, and changed while the server runs with Set. An
+// Injector with zero Settings injects nothing.
+package faults
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/routing"
+)
+
+// ErrConnect is what connecting to the database fails with when a connection
+// failure is injected.
+var ErrConnect = errors.New("faults: injected connection failure")
+
+// Settings are which faults to inject.
+type Settings struct {
+	// DBLatency is added before every query, and every new connection.
+	DBLatency time.Duration
+
+	// DBFailureRate is the fraction, from 0 to 1, of new connections and
+	// queries that fail as if the connection to the database was lost. Failed
+	// queries report driver.ErrBadConn, so database/sql retries them on
+	// another connection, like it would after a real one.
+	DBFailureRate float64
+
+	// SinkFailureRates are the fractions, from 0 to 1, of deliveries that fail
+	// for each sink, by name. "*" applies to sinks not named. A rate of 1 is
+	// an outage; anything less is a flaky sink.
+	SinkFailureRates map[string]float64
+}
+
+// Injector injects faults. It's safe for concurrent use.
+type Injector struct {
+	mu       sync.RWMutex
+	settings Settings
+}
+
+// Set replaces the faults being injected.
+func (i *Injector) Set(settings Settings) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.settings = settings
+}
+
+// Settings returns the faults being injected.
+func (i *Injector) Settings() Settings {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.settings
+}
+
+// dbFault waits out the database's latency, and returns whether the
+// connection should fail.
+func (i *Injector) dbFault(ctx context.Context) (bool, error) {
+	settings := i.Settings()
+	if settings.DBLatency > 0 {
+		timer := time.NewTimer(settings.DBLatency)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	return rand.Float64() < settings.DBFailureRate, nil
+}
+
+// Sink wraps a sink, so that deliveries to it fail as often as its failure
+// rate says. Its signature suits routing.Router.WrapSinks.
+func (i *Injector) Sink(name string, sink routing.Sink) routing.Sink {
+	return routing.SinkFunc(func(ctx context.Context, events []routing.Event) error {
+		settings := i.Settings()
+		rate, ok := settings.SinkFailureRates[name]
+		if !ok {
+			rate = settings.SinkFailureRates["*"]
+		}
+
+		if rand.Float64() < rate {
+			return fmt.Errorf("faults: injected outage of sink %q", name)
+		}
+
+		return sink.Deliver(ctx, events)
+	})
+}
+
+// Connector wraps c, so that its connections are slow and fail as the
+// injector says. Use it with sql.OpenDB.
+func (i *Injector) Connector(c driver.Connector) driver.Connector {
+	return &connector{connector: c, injector: i}
+}
+
+type connector struct {
+	connector driver.Connector
+	injector  *Injector
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	fail, err := c.injector.dbFault(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if fail {
+		return nil, ErrConnect
+	}
+
+	inner, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: inner, injector: c.injector}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+// conn is a connection that's slow and fails as its injector says. Faults are
+// injected before anything's sent to the database, so a failed query never
+// ran, and is safe for database/sql to retry.
+type conn struct {
+	driver.Conn
+	injector *Injector
+}
+
+// fault injects the connection's faults before a query.
+func (c *conn) fault(ctx context.Context) error {
+	fail, err := c.injector.dbFault(ctx)
+	if err != nil {
+		return err
+	}
+
+	if fail {
+		return driver.ErrBadConn
+	}
+
+	return nil
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.fault(ctx); err != nil {
+		return nil, err
+	}
+
+	if inner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return inner.BeginTx(ctx, opts)
+	}
+
+	return c.Conn.Begin()
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.fault(ctx); err != nil {
+		return nil, err
+	}
+
+	if prepare, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return prepare.PrepareContext(ctx, query)
+	}
+
+	return c.Conn.Prepare(query)
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if err := c.fault(ctx); err != nil {
+		return err
+	}
+
+	if inner, ok := c.Conn.(driver.Pinger); ok {
+		return inner.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if inner, ok := c.Conn.(driver.SessionResetter); ok {
+		return inner.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	inner, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	if err := c.fault(ctx); err != nil {
+		return nil, err
+	}
+
+	return inner.QueryContext(ctx, query, args)
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	inner, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	if err := c.fault(ctx); err != nil {
+		return nil, err
+	}
+
+	return inner.ExecContext(ctx, query, args)
+}
@@ -0,0 +1,165 @@
+// Package features turns features of the server on and off, so risky ones can
+// be rolled out gradually, and switched off again without a deploy.
+//
+// A flag's state comes from, in increasing order of precedence:
+//
+//	its default, as given to New
+//	a JSON file of flag names to booleans, like {"csv-import": false}
+//	an environment variable, like FEATURE_CSV_IMPORT=false
+//	the feature_flags table, if the server is watching it
+//
+// The file and environment make it easy to configure each environment
+// differently. The table is for flipping flags at runtime.
+package features
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Flags is a set of feature flags. It's safe for concurrent use.
+type Flags struct {
+	mu       sync.RWMutex
+	defaults map[string]bool
+	file     map[string]bool
+	table    map[string]bool
+}
+
+// New returns a set of flags with the given defaults. Flags without a default
+// are off unless something turns them on.
+func New(defaults map[string]bool) *Flags {
+	return &Flags{defaults: defaults, file: map[string]bool{}, table: map[string]bool{}}
+}
+
+// LoadFile reads flags from a JSON file. If the file doesn't exist, there
+// aren't any flags in it.
+func (f *Flags) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	var flags map[string]bool
+	if err := json.NewDecoder(file).Decode(&flags); err != nil {
+		return fmt.Errorf("features: %s: %s", path, err)
+	}
+
+	f.mu.Lock()
+	f.file = flags
+	f.mu.Unlock()
+	return nil
+}
+
+// Enabled returns whether a flag is on.
+func (f *Flags) Enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if enabled, ok := f.table[name]; ok {
+		return enabled
+	}
+
+	if enabled, ok := fromEnv(name); ok {
+		return enabled
+	}
+
+	if enabled, ok := f.file[name]; ok {
+		return enabled
+	}
+
+	return f.defaults[name]
+}
+
+// All returns the state of every flag that has a default, or is set anywhere.
+func (f *Flags) All() map[string]bool {
+	f.mu.RLock()
+	names := map[string]bool{}
+	for _, m := range []map[string]bool{f.defaults, f.file, f.table} {
+		for name := range m {
+			names[name] = true
+		}
+	}
+	f.mu.RUnlock()
+
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, "FEATURE_") {
+			name := env[len("FEATURE_"):strings.IndexByte(env, '=')]
+			names[strings.Replace(strings.ToLower(name), "_", "-", -1)] = true
+		}
+	}
+
+	all := map[string]bool{}
+	for name := range names {
+		all[name] = f.Enabled(name)
+	}
+
+	return all
+}
+
+// fromEnv returns the state of a flag set in the environment. The variable for
+// a flag like "csv-import" is FEATURE_CSV_IMPORT.
+func fromEnv(name string) (bool, bool) {
+	value, ok := os.LookupEnv("FEATURE_" + strings.Replace(strings.ToUpper(name), "-", "_", -1))
+	if !ok {
+		return false, false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	return enabled, err == nil
+}
+
+// Refresh re-reads the flags in the feature_flags table.
+func (f *Flags) Refresh(ctx context.Context, db *sqlx.DB) error {
+	var rows []struct {
+		Name    string `db:"name"`
+		Enabled bool   `db:"enabled"`
+	}
+
+	if err := db.SelectContext(ctx, &rows, `select name, enabled from feature_flags`); err != nil {
+		return err
+	}
+
+	table := map[string]bool{}
+	for _, row := range rows {
+		table[row.Name] = row.Enabled
+	}
+
+	f.mu.Lock()
+	f.table = table
+	f.mu.Unlock()
+	return nil
+}
+
+// Watch refreshes the flags from the feature_flags table every interval, until
+// ctx is done. If a refresh fails, the flags are left as they were, and the
+// error is passed to onError.
+func (f *Flags) Watch(ctx context.Context, db *sqlx.DB, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.Refresh(ctx, db); err != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
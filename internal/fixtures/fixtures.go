@@ -0,0 +1,210 @@
+// Package fixtures gives tests realistic events to work with, instead of JSON
+// strings written by hand in every test.
+//
+// The events come from a corpus in testdata/events: valid holds events that
+// event.jddf.json accepts, at least one of every type, and invalid holds
+// events it rejects, each named for what's wrong with it. Tests can range over
+// the whole corpus with Valid and Invalid, build an event of a given type with
+// MustEvent, or fill a database with SeedStore.
+//
+// The helpers take a testing.TB, and fail the test rather than returning
+// errors, so they're only meant to be called from tests.
+package fixtures
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jddf/jddf-go"
+)
+
+// dir returns the directory this file is in. The corpus and the schema are
+// found relative to it, so the helpers work from any package's tests.
+func dir() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}
+
+// SchemaPath is the path of the event schema the corpus is valid against.
+func SchemaPath() string {
+	return filepath.Join(dir(), "..", "..", "event.jddf.json")
+}
+
+// Schema returns the event schema the corpus is valid against.
+func Schema(t testing.TB) jddf.Schema {
+	t.Helper()
+
+	buf, err := ioutil.ReadFile(SchemaPath())
+	if err != nil {
+		t.Fatalf("fixtures: %s", err)
+	}
+
+	var schema jddf.Schema
+	if err := json.Unmarshal(buf, &schema); err != nil {
+		t.Fatalf("fixtures: %s: %s", SchemaPath(), err)
+	}
+
+	return schema
+}
+
+// Valid returns every valid event in the corpus, keyed by name.
+func Valid(t testing.TB) map[string][]byte {
+	t.Helper()
+	return corpus(t, "valid")
+}
+
+// Invalid returns every invalid event in the corpus, keyed by name. The name
+// says what's wrong with the event, like "order-completed-number-revenue".
+func Invalid(t testing.TB) map[string][]byte {
+	t.Helper()
+	return corpus(t, "invalid")
+}
+
+// Names returns the keys of a corpus, sorted, for tests that want to go
+// through it in a stable order.
+func Names(events map[string][]byte) []string {
+	names := make([]string, 0, len(events))
+	for name := range events {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func corpus(t testing.TB, kind string) map[string][]byte {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir(), "testdata", "events", kind, "*.json"))
+	if err != nil {
+		t.Fatalf("fixtures: %s", err)
+	}
+
+	events := map[string][]byte{}
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("fixtures: %s", err)
+		}
+
+		events[strings.TrimSuffix(filepath.Base(file), ".json")] = buf
+	}
+
+	return events
+}
+
+// MustEvent returns the JSON of a valid event of the given type, like
+// "Order Completed", with any overrides applied on top. An override of nil
+// removes the property.
+//
+// The event is the type's basic example from the corpus, so tests only need to
+// spell out the properties they care about:
+//
+//	fixtures.MustEvent(t, "Order Completed", map[string]interface{}{"revenue": "100"})
+//
+// It fails the test if the type has no example, or if the overrides make the
+// event invalid. Tests that want invalid events should use Invalid.
+func MustEvent(t testing.TB, eventType string, overrides ...map[string]interface{}) []byte {
+	t.Helper()
+
+	name := strings.ToLower(strings.Replace(eventType, " ", "-", -1))
+	buf, ok := Valid(t)[name]
+	if !ok {
+		t.Fatalf("fixtures: no example of %q events in the corpus", eventType)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(buf, &event); err != nil {
+		t.Fatalf("fixtures: %s: %s", name, err)
+	}
+
+	for _, o := range overrides {
+		for k, v := range o {
+			if v == nil {
+				delete(event, k)
+			} else {
+				event[k] = v
+			}
+		}
+	}
+
+	buf, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("fixtures: %s", err)
+	}
+
+	// Round-trip through JSON, so the validator sees float64s and strings, just
+	// like it does for events from clients.
+	var instance interface{}
+	if err := json.Unmarshal(buf, &instance); err != nil {
+		t.Fatalf("fixtures: %s", err)
+	}
+
+	var validator jddf.Validator
+	result, err := validator.Validate(Schema(t), instance)
+	if err != nil {
+		t.Fatalf("fixtures: %s", err)
+	}
+
+	if len(result.Errors) != 0 {
+		t.Fatalf("fixtures: %s event is invalid: %v", eventType, result.Errors)
+	}
+
+	return buf
+}
+
+// Store is somewhere SeedStore can insert events: a *sql.DB, *sqlx.DB, or a
+// transaction of either.
+type Store interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// SeedStore inserts n valid events into the events table of store, and returns
+// them in the order they were inserted.
+//
+// The events cycle through the corpus, but each gets its own user, one of ten,
+// and timestamp, a minute apart ending now. That way, queries that group by
+// user or bucket by time have something to group.
+func SeedStore(t testing.TB, store Store, n int) [][]byte {
+	t.Helper()
+
+	valid := Valid(t)
+	names := Names(valid)
+	if len(names) == 0 {
+		t.Fatalf("fixtures: the corpus has no valid events")
+	}
+
+	start := time.Now().UTC().Add(-time.Duration(n) * time.Minute)
+	events := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		var event map[string]interface{}
+		if err := json.Unmarshal(valid[names[i%len(names)]], &event); err != nil {
+			t.Fatalf("fixtures: %s: %s", names[i%len(names)], err)
+		}
+
+		event["userId"] = fmt.Sprintf("user-%d", i%10)
+		event["timestamp"] = start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339Nano)
+
+		buf, err := json.Marshal(event)
+		if err != nil {
+			t.Fatalf("fixtures: %s", err)
+		}
+
+		if _, err := store.ExecContext(context.Background(), `insert into events (payload) values ($1)`, buf); err != nil {
+			t.Fatalf("fixtures: seeding events: %s", err)
+		}
+
+		events = append(events, buf)
+	}
+
+	return events
+}
@@ -0,0 +1,167 @@
+package fixtures
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jddf/jddf-go"
+)
+
+func validate(t *testing.T, buf []byte) []jddf.ValidationError {
+	t.Helper()
+
+	var instance interface{}
+	if err := json.Unmarshal(buf, &instance); err != nil {
+		t.Fatal(err)
+	}
+
+	var validator jddf.Validator
+	result, err := validator.Validate(Schema(t), instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result.Errors
+}
+
+func TestValid(t *testing.T) {
+	valid := Valid(t)
+	if len(valid) == 0 {
+		t.Fatal("the corpus has no valid events")
+	}
+
+	types := map[string]bool{}
+	for _, name := range Names(valid) {
+		if errs := validate(t, valid[name]); len(errs) != 0 {
+			t.Errorf("%s: %v", name, errs)
+		}
+
+		var event struct {
+			Type string `json:"type"`
+		}
+
+		if err := json.Unmarshal(valid[name], &event); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		types[event.Type] = true
+	}
+
+	for eventType := range Schema(t).Discriminator.Mapping {
+		if !types[eventType] {
+			t.Errorf("the corpus has no valid %q event", eventType)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	invalid := Invalid(t)
+	if len(invalid) == 0 {
+		t.Fatal("the corpus has no invalid events")
+	}
+
+	for _, name := range Names(invalid) {
+		if errs := validate(t, invalid[name]); len(errs) == 0 {
+			t.Errorf("%s: is valid", name)
+		}
+	}
+}
+
+func TestMustEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		overrides map[string]interface{}
+		want      map[string]interface{}
+		missing   string
+	}{
+		{
+			name:      "no overrides",
+			eventType: "Page Viewed",
+			want:      map[string]interface{}{"type": "Page Viewed"},
+		},
+		{
+			name:      "override",
+			eventType: "Order Completed",
+			overrides: map[string]interface{}{"userId": "alice"},
+			want:      map[string]interface{}{"type": "Order Completed", "userId": "alice"},
+		},
+		{
+			name:      "remove an optional property",
+			eventType: "Heartbeat",
+			overrides: map[string]interface{}{"appVersion": nil},
+			missing:   "appVersion",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := MustEvent(t, tt.eventType, tt.overrides)
+
+			var event map[string]interface{}
+			if err := json.Unmarshal(buf, &event); err != nil {
+				t.Fatal(err)
+			}
+
+			for k, v := range tt.want {
+				if event[k] != v {
+					t.Errorf("%s = %v, want %v", k, event[k], v)
+				}
+			}
+
+			if _, ok := event[tt.missing]; tt.missing != "" && ok {
+				t.Errorf("%s wasn't removed", tt.missing)
+			}
+		})
+	}
+}
+
+// recordingStore is a Store that remembers what it was asked to insert.
+type recordingStore struct {
+	payloads [][]byte
+}
+
+func (s *recordingStore) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	s.payloads = append(s.payloads, args[0].([]byte))
+	return nil, nil
+}
+
+func TestSeedStore(t *testing.T) {
+	var store recordingStore
+	events := SeedStore(t, &store, 25)
+
+	if len(events) != 25 || len(store.payloads) != 25 {
+		t.Fatalf("seeded %d events, inserting %d; want 25", len(events), len(store.payloads))
+	}
+
+	users := map[string]bool{}
+	var last time.Time
+	for i, buf := range store.payloads {
+		if errs := validate(t, buf); len(errs) != 0 {
+			t.Errorf("event %d: %v", i, errs)
+		}
+
+		var event struct {
+			UserID    string    `json:"userId"`
+			Timestamp time.Time `json:"timestamp"`
+		}
+
+		if err := json.Unmarshal(buf, &event); err != nil {
+			t.Fatal(err)
+		}
+
+		if !event.Timestamp.After(last) {
+			t.Errorf("event %d's timestamp %s isn't after %s", i, event.Timestamp, last)
+		}
+
+		users[event.UserID] = true
+		last = event.Timestamp
+	}
+
+	if len(users) != 10 {
+		t.Errorf("events are from %d users, want 10", len(users))
+	}
+}
@@ -0,0 +1,101 @@
+package fixtures
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/event"
+)
+
+// RandomEvent returns a random, valid event of a random type, for property
+// tests: any event it returns should validate against the schema, and survive
+// being marshaled, unmarshaled and marshaled again unchanged.
+//
+// Values are chosen to reach the edges of what the schema allows, rather than
+// to look realistic: strings with quotes, escapes and non-ASCII characters,
+// timestamps in odd time zones and with nanoseconds, and revenues that are
+// zero, negative or huge. Pass a rand.Rand with a fixed seed to reproduce a
+// failure.
+func RandomEvent(r *rand.Rand) event.Event {
+	switch r.Intn(3) {
+	case 0:
+		e := event.EventHeartbeat{Timestamp: randomTime(r), UserId: randomString(r)}
+		if r.Intn(2) == 0 {
+			appVersion := randomString(r)
+			e.AppVersion = &appVersion
+		}
+
+		if r.Intn(2) == 0 {
+			platform := randomString(r)
+			e.Platform = &platform
+		}
+
+		return event.Event{Type: event.EventTypeHeartbeat, EventHeartbeat: e}
+	case 1:
+		return event.Event{Type: event.EventTypeOrderCompleted, EventOrderCompleted: event.EventOrderCompleted{
+			Timestamp: randomTime(r),
+			UserId:    randomString(r),
+			Revenue:   randomDecimal(r),
+		}}
+	default:
+		return event.Event{Type: event.EventTypePageViewed, EventPageViewed: event.EventPageViewed{
+			Timestamp: randomTime(r),
+			UserId:    randomString(r),
+			Url:       randomString(r),
+		}}
+	}
+}
+
+// randomRunes are what random strings are made of: some ordinary characters,
+// and some that JSON has to escape or that take several bytes in UTF-8. NUL
+// isn't one of them, because jsonb can't hold it and package limits rejects it.
+var randomRunes = []rune("abcXYZ019 -_/?&=\"\\\n\t\u0001\u007fé用户 😀")
+
+func randomString(r *rand.Rand) string {
+	runes := make([]rune, r.Intn(20))
+	for i := range runes {
+		runes[i] = randomRunes[r.Intn(len(randomRunes))]
+	}
+
+	return string(runes)
+}
+
+// randomTime returns a time between the years 1 and 9999, which is the range
+// RFC 3339 can represent, in a random fixed time zone.
+func randomTime(r *rand.Rand) time.Time {
+	min := time.Date(1, 1, 2, 0, 0, 0, 0, time.UTC).Unix()
+	max := time.Date(9999, 12, 30, 0, 0, 0, 0, time.UTC).Unix()
+
+	t := time.Unix(min+r.Int63n(max-min), 0)
+	if r.Intn(2) == 0 {
+		t = t.Add(time.Duration(r.Intn(int(time.Second))))
+	}
+
+	switch r.Intn(3) {
+	case 0:
+		return t.UTC()
+	case 1:
+		// Offsets are whole minutes, from -23:59 to +23:59.
+		offset := (r.Intn(2*24*60-1) - (24*60 - 1)) * 60
+		return t.In(time.FixedZone("", offset))
+	default:
+		return t.In(time.FixedZone("", 0))
+	}
+}
+
+// randomDecimal returns a random decimal amount of revenue: zero, negative,
+// with leading zeros, many digits after the point, or more digits than a
+// float64 could hold.
+func randomDecimal(r *rand.Rand) string {
+	switch r.Intn(4) {
+	case 0:
+		return "0"
+	case 1:
+		return fmt.Sprintf("%d.%02d", r.Intn(100000), r.Intn(100))
+	case 2:
+		return fmt.Sprintf("-%03d.%d", r.Intn(1000), r.Int63())
+	default:
+		return fmt.Sprintf("%d%d.%d", r.Int63(), r.Int63(), r.Int63())
+	}
+}
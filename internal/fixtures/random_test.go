@@ -0,0 +1,114 @@
+package fixtures
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/event"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+	"github.com/jddf/jddf-go"
+)
+
+func TestRandomEventRoundTrip(t *testing.T) {
+	schema := Schema(t)
+
+	roundTrips := func(seed int64) bool {
+		e := RandomEvent(rand.New(rand.NewSource(seed)))
+
+		first, err := json.Marshal(e)
+		if err != nil {
+			t.Logf("seed %d: %s", seed, err)
+			return false
+		}
+
+		var decoded event.Event
+		if err := json.Unmarshal(first, &decoded); err != nil {
+			t.Logf("seed %d: %s: %s", seed, first, err)
+			return false
+		}
+
+		second, err := json.Marshal(decoded)
+		if err != nil {
+			t.Logf("seed %d: %s", seed, err)
+			return false
+		}
+
+		if !bytes.Equal(first, second) {
+			t.Logf("seed %d: %s became %s", seed, first, second)
+			return false
+		}
+
+		var instance interface{}
+		json.Unmarshal(first, &instance)
+
+		var validator jddf.Validator
+		if result, err := validator.Validate(schema, instance); err != nil || len(result.Errors) != 0 {
+			t.Logf("seed %d: %s is invalid: %v %v", seed, first, err, result.Errors)
+			return false
+		}
+
+		if e.Type == event.EventTypeOrderCompleted && !money.Valid(e.EventOrderCompleted.Revenue) {
+			t.Logf("seed %d: revenue %q isn't a decimal", seed, e.EventOrderCompleted.Revenue)
+			return false
+		}
+
+		return true
+	}
+
+	if err := quick.Check(roundTrips, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// benchmarkEvents returns the same 1000 random events every time, so every run
+// of a benchmark measures the same work: as events, as JSON, and as what the
+// JSON unmarshals into.
+func benchmarkEvents() ([]event.Event, [][]byte, []interface{}) {
+	r := rand.New(rand.NewSource(1))
+	events := make([]event.Event, 1000)
+	payloads := make([][]byte, len(events))
+	instances := make([]interface{}, len(events))
+	for i := range events {
+		events[i] = RandomEvent(r)
+		payloads[i], _ = json.Marshal(events[i])
+		json.Unmarshal(payloads[i], &instances[i])
+	}
+
+	return events, payloads, instances
+}
+
+func BenchmarkValidate(b *testing.B) {
+	schema := Schema(b)
+	_, _, instances := benchmarkEvents()
+	validator := jddf.Validator{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		validator.Validate(schema, instances[i%len(instances)])
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	events, _, _ := benchmarkEvents()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(events[i%len(events)])
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	_, payloads, _ := benchmarkEvents()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var e event.Event
+		json.Unmarshal(payloads[i%len(payloads)], &e)
+	}
+}
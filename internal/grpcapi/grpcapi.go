@@ -0,0 +1,212 @@
+// Package grpcapi serves the analytics.v1.Events gRPC service, described in
+// events.proto, so that services that speak gRPC can send events without going
+// through JSON-over-HTTP.
+//
+// gRPC is HTTP/2 with a thin framing of protobuf messages, and net/http already
+// speaks HTTP/2 over TLS. So rather than pull in grpc-go and generated code,
+// Server is an http.Handler that does the framing itself, and encodes the
+// service's handful of small messages by hand. Any gRPC client works with it.
+//
+// Events themselves are still JSON, inside the messages, since that's what
+// the schema validates.
+package grpcapi
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ServiceName is the full name of the service, as it appears in RPC paths.
+const ServiceName = "analytics.v1.Events"
+
+// MaxMessageSize is the largest request message accepted. It's the same as
+// grpc-go's default.
+const MaxMessageSize = 4 << 20
+
+// Code is a gRPC status code.
+type Code int
+
+// The status codes the service uses.
+const (
+	OK                Code = 0
+	InvalidArgument   Code = 3
+	PermissionDenied  Code = 7
+	ResourceExhausted Code = 8
+	Unimplemented     Code = 12
+	Internal          Code = 13
+	Unavailable       Code = 14
+)
+
+// Error is an error with a gRPC status code. Errors of other types are
+// reported as Internal.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Backend stores events for a Server.
+type Backend interface {
+	// CreateEvent validates and stores an event, given as JSON, and returns the
+	// ID it was given, or "" if events don't get IDs. It returns an *Error
+	// with code InvalidArgument or PermissionDenied if the event is rejected.
+	CreateEvent(ctx context.Context, event []byte) (string, error)
+}
+
+// Server serves the Events service, passing events on to Backend.
+type Server struct {
+	Backend Backend
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "grpcapi: not a gRPC request")
+		return
+	}
+
+	// The status comes in trailers, after the response message, and net/http
+	// only sends trailers it's been told about up front.
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Add("Trailer", "Grpc-Status")
+	w.Header().Add("Trailer", "Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	res, err := s.call(r)
+	if err == nil {
+		err = writeMessage(w, res)
+	}
+
+	code, message := OK, ""
+	if err, ok := err.(*Error); ok {
+		code, message = err.Code, err.Message
+	} else if err != nil {
+		code, message = Internal, err.Error()
+	}
+
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	w.Header().Set("Grpc-Message", encodeGrpcMessage(message))
+}
+
+// call runs the RPC r is for, and returns its encoded response.
+func (s *Server) call(r *http.Request) ([]byte, error) {
+	buf, err := readMessage(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.URL.Path {
+	case "/" + ServiceName + "/CreateEvent":
+		var req CreateEventRequest
+		if err := req.unmarshal(buf); err != nil {
+			return nil, err
+		}
+
+		id, err := s.Backend.CreateEvent(r.Context(), req.Event)
+		if err != nil {
+			return nil, err
+		}
+
+		return CreateEventResponse{EventID: id}.marshal(), nil
+	case "/" + ServiceName + "/CreateEventBatch":
+		var req CreateEventBatchRequest
+		if err := req.unmarshal(buf); err != nil {
+			return nil, err
+		}
+
+		res, err := s.createEventBatch(r.Context(), req)
+		if err != nil {
+			return nil, err
+		}
+
+		return res.marshal(), nil
+	default:
+		return nil, &Error{Code: Unimplemented, Message: fmt.Sprintf("unknown method %s", r.URL.Path)}
+	}
+}
+
+// createEventBatch stores each event of a batch in turn. Events the backend
+// rejects are reported, and the rest are still stored. Any other error stops
+// the batch, but the events before it have been stored, and stay that way.
+func (s *Server) createEventBatch(ctx context.Context, req CreateEventBatchRequest) (CreateEventBatchResponse, error) {
+	var res CreateEventBatchResponse
+	for i, event := range req.Events {
+		id, err := s.Backend.CreateEvent(ctx, event)
+		if err, ok := err.(*Error); ok && (err.Code == InvalidArgument || err.Code == PermissionDenied) {
+			res.Rejected = append(res.Rejected, Rejection{Index: int64(i), Code: err.Code, Message: err.Message})
+			continue
+		}
+
+		if err != nil {
+			return CreateEventBatchResponse{}, fmt.Errorf("event %d: %s (the %d events before it were stored)", i, err, res.Stored)
+		}
+
+		res.Stored++
+		res.EventIDs = append(res.EventIDs, id)
+	}
+
+	return res, nil
+}
+
+// readMessage reads the one message of a unary request. Each message is
+// prefixed with a byte saying whether it's compressed, and four giving its
+// length.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &Error{Code: InvalidArgument, Message: fmt.Sprintf("reading request: %s", err)}
+	}
+
+	if prefix[0] != 0 {
+		return nil, &Error{Code: Unimplemented, Message: "compressed messages aren't supported"}
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > MaxMessageSize {
+		return nil, &Error{Code: ResourceExhausted, Message: fmt.Sprintf("messages may be at most %d bytes", MaxMessageSize)}
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, &Error{Code: InvalidArgument, Message: fmt.Sprintf("reading request: %s", err)}
+	}
+
+	return buf, nil
+}
+
+// writeMessage writes a response message, uncompressed.
+func writeMessage(w io.Writer, buf []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(buf)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// encodeGrpcMessage percent-encodes a status message, as gRPC requires of
+// anything outside printable ASCII.
+func encodeGrpcMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,156 @@
+package grpcapi
+
+import "encoding/binary"
+
+// The messages of events.proto. Field numbers must match it.
+
+// CreateEventRequest is the request of CreateEvent.
+type CreateEventRequest struct {
+	Event []byte // 1: the event, as JSON
+}
+
+// CreateEventResponse is the response of CreateEvent.
+type CreateEventResponse struct {
+	EventID string // 1
+}
+
+// CreateEventBatchRequest is the request of CreateEventBatch.
+type CreateEventBatchRequest struct {
+	Events [][]byte // 1: each event, as JSON
+}
+
+// CreateEventBatchResponse is the response of CreateEventBatch.
+type CreateEventBatchResponse struct {
+	Stored   int64       // 1
+	Rejected []Rejection // 2
+	EventIDs []string    // 3: of the stored events, in order
+}
+
+// Rejection is why an event of a batch wasn't stored.
+type Rejection struct {
+	Index   int64  // 1: the event's index in the batch
+	Code    Code   // 2
+	Message string // 3
+}
+
+func (m *CreateEventRequest) unmarshal(buf []byte) error {
+	return eachField(buf, func(num int, value []byte) {
+		if num == 1 {
+			m.Event = value
+		}
+	})
+}
+
+func (m CreateEventResponse) marshal() []byte {
+	return appendBytesField(nil, 1, []byte(m.EventID))
+}
+
+func (m *CreateEventBatchRequest) unmarshal(buf []byte) error {
+	return eachField(buf, func(num int, value []byte) {
+		if num == 1 {
+			m.Events = append(m.Events, value)
+		}
+	})
+}
+
+func (m CreateEventBatchResponse) marshal() []byte {
+	buf := appendVarintField(nil, 1, uint64(m.Stored))
+	for _, r := range m.Rejected {
+		buf = appendBytesField(buf, 2, r.marshal())
+	}
+
+	for _, id := range m.EventIDs {
+		buf = appendBytesField(buf, 3, []byte(id))
+	}
+
+	return buf
+}
+
+func (m Rejection) marshal() []byte {
+	buf := appendVarintField(nil, 1, uint64(m.Index))
+	buf = appendVarintField(buf, 2, uint64(m.Code))
+	return appendBytesField(buf, 3, []byte(m.Message))
+}
+
+// Protobuf's wire format is a sequence of fields, each a varint key -- the
+// field number and a wire type -- followed by the value. Only the wire types
+// these messages use are written, but any may be skipped when read.
+const (
+	wireVarint  = 0
+	wire64Bit   = 1
+	wireBytes   = 2
+	wire32Bit   = 5
+	maxFieldNum = 1<<29 - 1
+)
+
+var errMalformed = &Error{Code: InvalidArgument, Message: "malformed protobuf message"}
+
+// eachField calls f with the number and value of each length-delimited field
+// in buf. Fields of other wire types are skipped. proto3 strings, bytes and
+// embedded messages are all length-delimited.
+func eachField(buf []byte, f func(num int, value []byte)) error {
+	for len(buf) != 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 || key>>3 == 0 || key>>3 > maxFieldNum {
+			return errMalformed
+		}
+
+		buf = buf[n:]
+		switch key & 7 {
+		case wireVarint:
+			if _, n = binary.Uvarint(buf); n <= 0 {
+				return errMalformed
+			}
+
+			buf = buf[n:]
+		case wire64Bit, wire32Bit:
+			size := 8
+			if key&7 == wire32Bit {
+				size = 4
+			}
+
+			if len(buf) < size {
+				return errMalformed
+			}
+
+			buf = buf[size:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || size > uint64(len(buf)-n) {
+				return errMalformed
+			}
+
+			f(int(key>>3), buf[n:n+int(size)])
+			buf = buf[n+int(size):]
+		default:
+			return errMalformed
+		}
+	}
+
+	return nil
+}
+
+// appendVarintField appends a varint field, unless it's zero, which proto3
+// leaves out.
+func appendVarintField(buf []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return buf
+	}
+
+	buf = appendVarint(buf, uint64(num)<<3|wireVarint)
+	return appendVarint(buf, v)
+}
+
+// appendBytesField appends a length-delimited field. Unlike varints, empty
+// ones are kept, so that repeated fields keep their place.
+func appendBytesField(buf []byte, num int, v []byte) []byte {
+	buf = appendVarint(buf, uint64(num)<<3|wireBytes)
+	buf = appendVarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
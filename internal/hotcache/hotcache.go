@@ -0,0 +1,263 @@
+// Package hotcache keeps the last few hours of events in memory, so that
+// realtime aggregates can be served without querying Postgres.
+//
+// Events are stored column by column -- a slice of timestamps, a slice of
+// types, and so on -- with types and user IDs dictionary-encoded, so that each
+// event costs a couple dozen bytes, and an aggregate is a tight loop over a few
+// slices.
+//
+// The server adds each event it stores as it stores it. That misses events
+// stored some other way, like by another instance or a bulk import, so the
+// cache is also periodically rebuilt from Postgres.
+package hotcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+	"github.com/jmoiron/sqlx"
+)
+
+// Cache is an in-memory, columnar store of recent events.
+type Cache struct {
+	// Window is how far back the cache goes.
+	Window time.Duration
+
+	// Clock decides what "now" is when reconciling. If nil, it's the system
+	// clock.
+	Clock clock.Clock
+
+	mu           sync.RWMutex
+	cols         columns
+	reconciledAt time.Time
+}
+
+// columns are the cached events, one slice per attribute. The slices are all
+// the same length, and the i-th element of each is about the same event.
+type columns struct {
+	times   []int64 // Unix nanoseconds
+	types   []uint16
+	users   []uint32
+	revenue []string // decimals, like "49.99"
+
+	typeNames []string
+	typeIDs   map[string]uint16
+	userNames []string
+	userIDs   map[string]uint32
+}
+
+func newColumns() columns {
+	return columns{typeIDs: map[string]uint16{}, userIDs: map[string]uint32{}}
+}
+
+func (c *columns) add(t time.Time, eventType, userID string, revenue string) {
+	typeID, ok := c.typeIDs[eventType]
+	if !ok {
+		typeID = uint16(len(c.typeNames))
+		c.typeIDs[eventType] = typeID
+		c.typeNames = append(c.typeNames, eventType)
+	}
+
+	userID32, ok := c.userIDs[userID]
+	if !ok {
+		userID32 = uint32(len(c.userNames))
+		c.userIDs[userID] = userID32
+		c.userNames = append(c.userNames, userID)
+	}
+
+	c.times = append(c.times, t.UnixNano())
+	c.types = append(c.types, typeID)
+	c.users = append(c.users, userID32)
+	c.revenue = append(c.revenue, revenue)
+}
+
+// New returns an empty cache of the given window.
+func New(window time.Duration) *Cache {
+	return &Cache{Window: window, cols: newColumns()}
+}
+
+// Add records an event, received at t. revenue is the event's revenue, as a
+// decimal, or "" if it has none.
+func (c *Cache) Add(t time.Time, eventType, userID string, revenue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cols.add(t, eventType, userID, revenue)
+}
+
+// Summary is an aggregate of the events received since a point in time.
+type Summary struct {
+	Since   time.Time `json:"since"`
+	Events  int       `json:"events"`
+	Users   int       `json:"users"`
+	Revenue money.Sum `json:"revenue"`
+
+	// Types breaks the totals down by event type.
+	Types map[string]*TypeSummary `json:"types"`
+}
+
+// TypeSummary is an aggregate of the events of one type.
+type TypeSummary struct {
+	Events  int       `json:"events"`
+	Users   int       `json:"users"`
+	Revenue money.Sum `json:"revenue"`
+}
+
+// Summarize aggregates the cached events received since the given time. since
+// should be within the cache's window.
+func (c *Cache) Summarize(since time.Time) Summary {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cols.summarize(since)
+}
+
+func (c *columns) summarize(since time.Time) Summary {
+	summary := Summary{Since: since, Types: map[string]*TypeSummary{}}
+	cutoff := since.UnixNano()
+
+	users := map[uint32]struct{}{}
+	typeUsers := make([]map[uint32]struct{}, len(c.typeNames))
+	typeSummaries := make([]TypeSummary, len(c.typeNames))
+
+	// Events are added in roughly, but not exactly, the order they're received,
+	// so every one has to be checked.
+	for i, t := range c.times {
+		if t < cutoff {
+			continue
+		}
+
+		typeID, user := c.types[i], c.users[i]
+		summary.Events++
+		summary.Revenue.Add(c.revenue[i])
+		users[user] = struct{}{}
+
+		typeSummaries[typeID].Events++
+		typeSummaries[typeID].Revenue.Add(c.revenue[i])
+		if typeUsers[typeID] == nil {
+			typeUsers[typeID] = map[uint32]struct{}{}
+		}
+
+		typeUsers[typeID][user] = struct{}{}
+	}
+
+	summary.Users = len(users)
+	for typeID, name := range c.typeNames {
+		if typeSummaries[typeID].Events != 0 {
+			typeSummaries[typeID].Users = len(typeUsers[typeID])
+			summary.Types[name] = &typeSummaries[typeID]
+		}
+	}
+
+	return summary
+}
+
+// Reconcile rebuilds the cache from the events table, dropping anything that's
+// fallen out of the window, and picking up anything that was stored without
+// going through Add.
+//
+// Events added while the rebuild is running are kept.
+func (c *Cache) Reconcile(ctx context.Context, db *sqlx.DB) error {
+	start := clock.Or(c.Clock).Now()
+	cols, err := load(ctx, db, start.Add(-c.Window), start)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := start.UnixNano()
+	for i, t := range c.cols.times {
+		if t >= cutoff {
+			cols.add(time.Unix(0, t), c.cols.typeNames[c.cols.types[i]], c.cols.userNames[c.cols.users[i]], c.cols.revenue[i])
+		}
+	}
+
+	c.cols = cols
+	c.reconciledAt = start
+	return nil
+}
+
+// Len returns how many events are cached.
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.cols.times)
+}
+
+// ReconciledAt returns when the cache was last rebuilt from the events table,
+// or the zero time if it never has been.
+func (c *Cache) ReconciledAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.reconciledAt
+}
+
+// Watch reconciles the cache every interval, until ctx is done. Errors are
+// passed to onError, and the cache carries on as it was.
+func (c *Cache) Watch(ctx context.Context, db *sqlx.DB, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Reconcile(ctx, db); err != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Query aggregates the events received in [since, until) straight from the
+// events table, for when there's no cache.
+func Query(ctx context.Context, db *sqlx.DB, since, until time.Time) (Summary, error) {
+	cols, err := load(ctx, db, since, until)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	return cols.summarize(since), nil
+}
+
+// load reads the events received in [from, to) into columns.
+func load(ctx context.Context, db *sqlx.DB, from, to time.Time) (columns, error) {
+	rows, err := db.QueryxContext(ctx, `
+		select
+			received_at,
+			payload->>'type',
+			coalesce(payload->>'userId', ''),
+			coalesce((payload->>'revenue')::numeric, 0)
+		from events_expanded
+		where received_at >= $1 and received_at < $2
+		order by received_at
+	`, from, to)
+
+	if err != nil {
+		return columns{}, err
+	}
+
+	defer rows.Close()
+
+	cols := newColumns()
+	for rows.Next() {
+		var receivedAt time.Time
+		var eventType, userID, revenue string
+		if err := rows.Scan(&receivedAt, &eventType, &userID, &revenue); err != nil {
+			return columns{}, err
+		}
+
+		cols.add(receivedAt, eventType, userID, revenue)
+	}
+
+	return cols, rows.Err()
+}
@@ -0,0 +1,162 @@
+// Package kafkarest consumes from Kafka through a Kafka REST Proxy, using its v2
+// API, so that the server needn't speak Kafka's own protocol. The routing
+// package's KafkaREST sink produces through the same proxy.
+//
+// A Consumer is one member of a consumer group. The proxy holds the actual
+// Kafka consumer, and the Consumer polls it for records. The group's offsets
+// are left to the caller to keep, so they can be stored along with whatever
+// the records were turned into.
+package kafkarest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The v2 API's content types. Records are requested with their values as JSON,
+// which is what events are.
+const (
+	contentType       = "application/vnd.kafka.v2+json"
+	jsonRecordsAccept = "application/vnd.kafka.json.v2+json"
+)
+
+// Consumer is a member of a consumer group, consuming through the proxy at URL.
+// It isn't safe for concurrent use.
+type Consumer struct {
+	URL   string
+	Group string
+
+	// Headers are sent with every request, for proxies that need auth.
+	Headers map[string]string
+
+	// baseURI is where the proxy put the consumer instance, once it's open.
+	baseURI string
+}
+
+// Record is a record consumed from a topic.
+type Record struct {
+	Topic     string          `json:"topic"`
+	Partition int32           `json:"partition"`
+	Offset    int64           `json:"offset"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// Open creates the consumer instance in the proxy, and subscribes it to topic.
+// Offsets are never committed to Kafka, so partitions assigned to the consumer
+// start from the beginning of the topic, unless it Seeks them elsewhere.
+func (c *Consumer) Open(ctx context.Context, topic string) error {
+	var instance struct {
+		BaseURI string `json:"base_uri"`
+	}
+
+	err := c.do(ctx, "POST", strings.TrimSuffix(c.URL, "/")+"/consumers/"+c.Group, "", map[string]string{
+		"format":             "json",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}, &instance)
+
+	if err != nil {
+		return err
+	}
+
+	c.baseURI = instance.BaseURI
+	return c.do(ctx, "POST", c.baseURI+"/subscription", "", map[string][]string{"topics": {topic}}, nil)
+}
+
+// Poll returns the next records, waiting up to timeout for some to arrive, and
+// fetching at most maxBytes of them. It returns no records, and no error, if
+// none arrived in time.
+func (c *Consumer) Poll(ctx context.Context, timeout time.Duration, maxBytes int) ([]Record, error) {
+	var records []Record
+	url := fmt.Sprintf("%s/records?timeout=%d&max_bytes=%d", c.baseURI, timeout/time.Millisecond, maxBytes)
+	if err := c.do(ctx, "GET", url, jsonRecordsAccept, nil, &records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Offset is where in a partition of a topic to consume from next.
+type Offset struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// Seek makes the consumer carry on from offsets in their partitions, which
+// must be assigned to it. Records already fetched from them are dropped.
+func (c *Consumer) Seek(ctx context.Context, offsets []Offset) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	return c.do(ctx, "POST", c.baseURI+"/positions", "", map[string][]Offset{"offsets": offsets}, nil)
+}
+
+// Close deletes the consumer instance, so that its partitions go to the rest
+// of the group straight away, rather than once the proxy times it out.
+func (c *Consumer) Close(ctx context.Context) error {
+	if c.baseURI == "" {
+		return nil
+	}
+
+	return c.do(ctx, "DELETE", c.baseURI, "", nil, nil)
+}
+
+// do makes a request of the proxy, with in as its JSON body if it isn't nil,
+// and decodes the response into out if it isn't nil.
+func (c *Consumer) do(ctx context.Context, method, url, accept string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if accept == "" {
+		accept = contentType
+	}
+
+	req.Header.Set("Accept", accept)
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("kafkarest: %s %s: %s: %s", method, req.URL.Path, res.Status, bytes.TrimSpace(message))
+	}
+
+	if out == nil {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,277 @@
+// Package lateness measures how long after their own timestamp events arrive.
+//
+// Hourly aggregates, like the anomaly checks' "last complete hour", treat an
+// hour as final some time after it ends. An event that arrives after that, say
+// from a phone that was offline, changes a number that's already been
+// reported. How often that happens decides how long to wait before finalizing:
+// too short, and reports keep changing; too long, and they're stale.
+//
+// A Tracker keeps a histogram of lateness for events as they're stored, and
+// periodically reconciles against the events table, for a view over every
+// instance and a longer period.
+package lateness
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/querybuilder"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Buckets are the upper bounds of the lateness histogram. Events later than
+// the last bound are counted in a final, unbounded bucket.
+var Buckets = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// Tracker keeps track of how late events are. It's safe for concurrent use.
+type Tracker struct {
+	// These are updated atomically. They come first to keep them 64-bit
+	// aligned, as sync/atomic requires.
+	count    int64
+	late     int64
+	sumNanos int64
+
+	// counts has one entry per bucket, plus one for events later than every
+	// bucket. Each is updated atomically.
+	counts []int64
+
+	// FinalizeAfter is how long after an hour ends that its aggregates are
+	// treated as final.
+	FinalizeAfter time.Duration
+
+	// Clock decides how far back Watch looks. If nil, it's the system clock.
+	Clock clock.Clock
+
+	mu     sync.Mutex
+	report *Report
+}
+
+// New returns a Tracker for hours that are final finalizeAfter after they end.
+func New(finalizeAfter time.Duration) *Tracker {
+	return &Tracker{FinalizeAfter: finalizeAfter, counts: make([]int64, len(Buckets)+1)}
+}
+
+// Observe records an event with the given timestamp, received at the given
+// time. Events with timestamps in the future count as on time.
+func (t *Tracker) Observe(timestamp, received time.Time) {
+	lateness := received.Sub(timestamp)
+	if lateness < 0 {
+		lateness = 0
+	}
+
+	i := 0
+	for i < len(Buckets) && lateness > Buckets[i] {
+		i++
+	}
+
+	atomic.AddInt64(&t.counts[i], 1)
+	atomic.AddInt64(&t.count, 1)
+	atomic.AddInt64(&t.sumNanos, int64(lateness))
+
+	if !received.Before(finalizedAt(timestamp, t.FinalizeAfter)) {
+		atomic.AddInt64(&t.late, 1)
+	}
+}
+
+// finalizedAt returns when the hour containing timestamp is final.
+func finalizedAt(timestamp time.Time, finalizeAfter time.Duration) time.Time {
+	return timestamp.Truncate(time.Hour).Add(time.Hour + finalizeAfter)
+}
+
+// Histogram is a snapshot of how late events have been. Like a Prometheus
+// histogram, its buckets are cumulative: each counts the events at most that
+// late.
+type Histogram struct {
+	Buckets    []Bucket `json:"buckets"`
+	Count      int64    `json:"count"`
+	SumSeconds float64  `json:"sumSeconds"`
+
+	// Late is how many events arrived after their hour was final.
+	Late int64 `json:"late"`
+}
+
+// Bucket is one bucket of a Histogram. LE is its upper bound in seconds, or
+// "+Inf".
+type Bucket struct {
+	LE    string `json:"le"`
+	Count int64  `json:"count"`
+}
+
+// Histogram returns how late the events observed so far have been.
+func (t *Tracker) Histogram() Histogram {
+	h := Histogram{
+		Count:      atomic.LoadInt64(&t.count),
+		SumSeconds: time.Duration(atomic.LoadInt64(&t.sumNanos)).Seconds(),
+		Late:       atomic.LoadInt64(&t.late),
+	}
+
+	var cumulative int64
+	for i := range t.counts {
+		cumulative += atomic.LoadInt64(&t.counts[i])
+
+		le := "+Inf"
+		if i < len(Buckets) {
+			le = fmt.Sprintf("%g", Buckets[i].Seconds())
+		}
+
+		h.Buckets = append(h.Buckets, Bucket{LE: le, Count: cumulative})
+	}
+
+	return h
+}
+
+// Report is the result of reconciling against the events table.
+type Report struct {
+	ReconciledAt time.Time `json:"reconciledAt"`
+	Since        time.Time `json:"since"`
+	Until        time.Time `json:"until"`
+
+	// Events is how many events have timestamps in [Since, Until), and Late is
+	// how many of those arrived after their hour was final.
+	Events int64 `json:"events"`
+	Late   int64 `json:"late"`
+
+	// Quantiles of lateness, in seconds.
+	P50Seconds float64 `json:"p50Seconds"`
+	P90Seconds float64 `json:"p90Seconds"`
+	P99Seconds float64 `json:"p99Seconds"`
+	MaxSeconds float64 `json:"maxSeconds"`
+
+	// Hours are the hours that changed after they were final, and by how many
+	// events.
+	Hours []Hour `json:"hours"`
+}
+
+// Hour is an hour that late events changed after it was final.
+type Hour struct {
+	Hour   time.Time `json:"hour"`
+	Events int64     `json:"events"`
+	Late   int64     `json:"late"`
+}
+
+// Reconcile works out, from the events table, how late events with timestamps
+// in [since, until) arrived, and which hours they changed after those hours
+// were final. now is when the report says it was made.
+func Reconcile(ctx context.Context, db *sqlx.DB, since, until, now time.Time, finalizeAfter time.Duration) (Report, error) {
+	report := Report{ReconciledAt: now, Since: since, Until: until, Hours: []Hour{}}
+
+	var totals struct {
+		Events    int64           `db:"events"`
+		Late      int64           `db:"late"`
+		Quantiles pq.Float64Array `db:"quantiles"`
+		Max       float64         `db:"max"`
+	}
+
+	// Both queries share their arguments. The filter bounds received_at too,
+	// so only recent rows are looked at.
+	var q querybuilder.Query
+	secs := q.Arg(finalizeAfter.Seconds())
+	where := q.Where(querybuilder.Filter{From: since, To: until})
+
+	err := db.GetContext(ctx, &totals, `
+		with lateness as (
+			select
+				`+querybuilder.Timestamp+` as ts,
+				received_at,
+				greatest(extract(epoch from received_at - `+querybuilder.Timestamp+`), 0)::float8 as seconds
+			from
+				events_expanded
+			where
+				`+where+`
+		)
+		select
+			count(*) as events,
+			count(*) filter (where received_at >= date_trunc('hour', ts) + interval '1 hour' + make_interval(secs => `+secs+`)) as late,
+			coalesce(percentile_cont(array[0.5, 0.9, 0.99]) within group (order by seconds), array[0, 0, 0]::float8[]) as quantiles,
+			coalesce(max(seconds), 0) as max
+		from
+			lateness
+	`, q.Args()...)
+
+	if err != nil {
+		return Report{}, err
+	}
+
+	report.Events, report.Late, report.MaxSeconds = totals.Events, totals.Late, totals.Max
+	if len(totals.Quantiles) == 3 {
+		report.P50Seconds, report.P90Seconds, report.P99Seconds = totals.Quantiles[0], totals.Quantiles[1], totals.Quantiles[2]
+	}
+
+	err = db.SelectContext(ctx, &report.Hours, `
+		select
+			date_trunc('hour', `+querybuilder.Timestamp+`) as hour,
+			count(*) as events,
+			count(*) filter (where received_at >= date_trunc('hour', `+querybuilder.Timestamp+`) + interval '1 hour' + make_interval(secs => `+secs+`)) as late
+		from
+			events_expanded
+		where
+			`+where+`
+		group by
+			1
+		having
+			count(*) filter (where received_at >= date_trunc('hour', `+querybuilder.Timestamp+`) + interval '1 hour' + make_interval(secs => `+secs+`)) > 0
+		order by
+			1
+	`, q.Args()...)
+
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+// Watch reconciles the events from the last lookback against the events table
+// every interval, until ctx is done, keeping the latest report for Report.
+func (t *Tracker) Watch(ctx context.Context, db *sqlx.DB, lookback, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := clock.Or(t.Clock).Now()
+		if err := t.Reconcile(ctx, db, now.Add(-lookback), now); err != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile reconciles the events with timestamps in [since, until) against
+// the events table, and keeps the result for Report.
+func (t *Tracker) Reconcile(ctx context.Context, db *sqlx.DB, since, until time.Time) error {
+	report, err := Reconcile(ctx, db, since, until, clock.Or(t.Clock).Now(), t.FinalizeAfter)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.report = &report
+	t.mu.Unlock()
+	return nil
+}
+
+// Report returns the latest reconciliation, or nil if there hasn't been one.
+func (t *Tracker) Report() *Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.report
+}
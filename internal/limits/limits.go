@@ -0,0 +1,200 @@
+// Package limits bounds the size of events.
+//
+// An event can be perfectly valid against the schema and still be a problem:
+// a multi-megabyte string, or an array with a million entries, makes for
+// bloated jsonb rows and indexes. Limits are configured in the schema's
+// metadata, under "limits", either at the root of the schema (as a default for
+// every event type) or on an event type's own schema (overriding the default):
+//
+//	{
+//	  "metadata": { "limits": { "maxBytes": 4096, "maxStringLength": 1024, "maxEntries": 100 } },
+//	  "discriminator": { ... }
+//	}
+//
+// A limit of zero, or one that's left out, means no limit. jddf-go doesn't keep
+// metadata, so limits are read with package schemameta.
+//
+// JDDF has no decimal type, so amounts of money are strings. A string
+// property whose metadata has "format": "decimal" must also be a decimal, like
+// "49.99", which is checked along with the limits: anything else would break
+// every query that sums it as numeric.
+//
+// Events' timestamps also mustn't be more than MaxFuture after they're
+// received, so that queries over a range of timestamps can bound received_at
+// too.
+package limits
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+)
+
+// MaxFuture is how far after it's received an event's timestamp may be. Client
+// clocks drift, but not by a day; an event from further in the future is a
+// bug, and it would be missed by queries that derive received_at bounds from
+// their range of timestamps (see package querybuilder).
+const MaxFuture = 24 * time.Hour
+
+// Limits are the bounds on one type of event.
+type Limits struct {
+	// MaxBytes is the most bytes the event's JSON may take up.
+	MaxBytes int `json:"maxBytes"`
+
+	// MaxStringLength is the most characters any string in the event may have.
+	MaxStringLength int `json:"maxStringLength"`
+
+	// MaxEntries is the most entries any object or array in the event may have.
+	MaxEntries int `json:"maxEntries"`
+}
+
+// Set holds the limits of each type of event in a schema.
+type Set struct {
+	defaults Limits
+	types    map[string]Limits
+
+	// decimals are the properties of each type of event that must be
+	// decimals.
+	decimals map[string][]string
+}
+
+// FromSchema reads the limits configured in a schema's metadata.
+func FromSchema(schema schemameta.Schema) (*Set, error) {
+	set := &Set{types: map[string]Limits{}, decimals: map[string][]string{}}
+	if err := fromMetadata(schema.Metadata, &set.defaults); err != nil {
+		return nil, err
+	}
+
+	for eventType, variant := range schema.Discriminator.Mapping {
+		limits := set.defaults
+		if err := fromMetadata(variant.Metadata, &limits); err != nil {
+			return nil, fmt.Errorf("limits: %s: %s", eventType, err)
+		}
+
+		set.types[eventType] = limits
+
+		for _, properties := range []map[string]schemameta.Schema{variant.RequiredProperties, variant.OptionalProperties} {
+			for name, property := range properties {
+				if property.Decimal() {
+					set.decimals[eventType] = append(set.decimals[eventType], name)
+				}
+			}
+		}
+	}
+
+	return set, nil
+}
+
+// fromMetadata overwrites limits with those set in a schema's metadata. Limits
+// the metadata doesn't mention are left as they were.
+func fromMetadata(metadata map[string]interface{}, limits *Limits) error {
+	raw, ok := metadata["limits"]
+	if !ok {
+		return nil
+	}
+
+	// Unmarshaling only sets the fields that are present, which is what lets
+	// an event type inherit the limits it doesn't override.
+	buf, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, limits)
+}
+
+// Violation is an event exceeding one of its limits.
+type Violation struct {
+	// Code is a machine-readable description of the violation, for API
+	// errors: "invalid_decimal" for a decimal property that isn't one, and
+	// "event_limit_exceeded" for anything else.
+	Code    string
+	Message string
+}
+
+func (v *Violation) Error() string {
+	return "limits: " + v.Message
+}
+
+// Check returns a *Violation if an event of the given type, whose JSON is buf
+// and whose parsed form is event, exceeds its limits, has a decimal property
+// that isn't one, has a timestamp more than MaxFuture after received, or has a
+// string with a NUL character in it, which jsonb can't hold. A nil Set has no
+// limits.
+func (s *Set) Check(eventType string, buf []byte, event interface{}, received time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	limits, ok := s.types[eventType]
+	if !ok {
+		limits = s.defaults
+	}
+
+	if limits.MaxBytes != 0 && len(buf) > limits.MaxBytes {
+		return &Violation{Code: "event_limit_exceeded", Message: fmt.Sprintf("event is %d bytes, more than the limit of %d", len(buf), limits.MaxBytes)}
+	}
+
+	if fields, ok := event.(map[string]interface{}); ok {
+		for _, name := range s.decimals[eventType] {
+			if value, ok := fields[name].(string); ok && !money.Valid(value) {
+				return &Violation{Code: "invalid_decimal", Message: fmt.Sprintf("event.%s is %q, which isn't a decimal like \"49.99\"", name, value)}
+			}
+		}
+
+		// The schema has already checked the timestamp is RFC3339.
+		if value, ok := fields["timestamp"].(string); ok {
+			if timestamp, err := time.Parse(time.RFC3339, value); err == nil && timestamp.Sub(received) > MaxFuture {
+				return &Violation{Code: "event_limit_exceeded", Message: fmt.Sprintf("event.timestamp is %s, more than %s after the event was received", value, MaxFuture)}
+			}
+		}
+	}
+
+	return limits.checkValue("event", event)
+}
+
+// checkValue checks the string length and entry limits, recursively, on a
+// value in an event. path describes where the value is, for error messages.
+func (l Limits) checkValue(path string, value interface{}) error {
+	switch value := value.(type) {
+	case string:
+		if n := utf8.RuneCountInString(value); l.MaxStringLength != 0 && n > l.MaxStringLength {
+			return &Violation{Code: "event_limit_exceeded", Message: fmt.Sprintf("%s is %d characters long, more than the limit of %d", path, n, l.MaxStringLength)}
+		}
+
+		if strings.ContainsRune(value, 0) {
+			return &Violation{Code: "event_limit_exceeded", Message: fmt.Sprintf("%s contains a NUL character, which Postgres can't store", path)}
+		}
+	case []interface{}:
+		if l.MaxEntries != 0 && len(value) > l.MaxEntries {
+			return &Violation{Code: "event_limit_exceeded", Message: fmt.Sprintf("%s has %d entries, more than the limit of %d", path, len(value), l.MaxEntries)}
+		}
+
+		for i, v := range value {
+			if err := l.checkValue(fmt.Sprintf("%s[%d]", path, i), v); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if l.MaxEntries != 0 && len(value) > l.MaxEntries {
+			return &Violation{Code: "event_limit_exceeded", Message: fmt.Sprintf("%s has %d entries, more than the limit of %d", path, len(value), l.MaxEntries)}
+		}
+
+		for k, v := range value {
+			if strings.ContainsRune(k, 0) {
+				return &Violation{Code: "event_limit_exceeded", Message: fmt.Sprintf("%s has a key containing a NUL character, which Postgres can't store", path)}
+			}
+
+			if err := l.checkValue(fmt.Sprintf("%s.%s", path, k), v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package limits
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+)
+
+func TestCheck(t *testing.T) {
+	meta, err := schemameta.Parse([]byte(`{
+		"metadata": { "limits": { "maxStringLength": 20 } },
+		"discriminator": {
+			"tag": "type",
+			"mapping": {
+				"Order Completed": {
+					"properties": {
+						"revenue": { "metadata": { "format": "decimal" }, "type": "string" }
+					}
+				}
+			}
+		}
+	}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := FromSchema(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		event string
+
+		// code is the Violation's code, or "" if the event is within its
+		// limits.
+		code string
+	}{
+		{name: "ok", event: `{"type":"Order Completed","timestamp":"2020-01-01T12:00:00Z","revenue":"49.99"}`},
+		{name: "long string", event: `{"type":"Order Completed","revenue":"49.99","note":"much, much, much too long"}`, code: "event_limit_exceeded"},
+		{name: "NUL", event: `{"type":"Order Completed","note":"a\u0000b"}`, code: "event_limit_exceeded"},
+		{name: "NUL key", event: `{"type":"Order Completed","a\u0000b":"note"}`, code: "event_limit_exceeded"},
+		{name: "not a decimal", event: `{"type":"Order Completed","revenue":"1e3"}`, code: "invalid_decimal"},
+		{name: "late", event: `{"type":"Order Completed","timestamp":"2019-01-01T12:00:00Z"}`},
+		{name: "early", event: `{"type":"Order Completed","timestamp":"2020-01-02T11:00:00Z"}`},
+		{name: "too early", event: `{"type":"Order Completed","timestamp":"2020-01-02T13:00:00Z"}`, code: "event_limit_exceeded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var event interface{}
+			if err := json.Unmarshal([]byte(tt.event), &event); err != nil {
+				t.Fatal(err)
+			}
+
+			err := set.Check("Order Completed", []byte(tt.event), event, received)
+			if tt.code == "" && err != nil {
+				t.Errorf("Check(%s) = %v", tt.event, err)
+			}
+
+			if v, ok := err.(*Violation); tt.code != "" && (!ok || v.Code != tt.code) {
+				t.Errorf("Check(%s) = %#v, want code %q", tt.event, err, tt.code)
+			}
+		})
+	}
+}
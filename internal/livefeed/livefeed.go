@@ -0,0 +1,154 @@
+// Package livefeed follows the events table as events are stored, and fans
+// them out to subscribers, like clients tailing events live.
+//
+// The feed is woken up to look for new events whenever it's told there are
+// some -- by Postgres's NOTIFY, say -- and also every so often regardless, so
+// it works, if less promptly, without being told at all. Either way, it reads
+// what's new with one query, however many subscribers there are.
+//
+// Events are followed by the events table's serial id. Ids are handed out as
+// events are inserted, not as they're committed, so an event committed after
+// a later one can be missed. The feed is for watching, not for anything that
+// needs every event; that's what the events table is for.
+package livefeed
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// batchSize is the most events fetched at once.
+const batchSize = 1000
+
+// Event is an event as the feed reports it.
+type Event struct {
+	// Seq is the event's serial id in the events table, which the feed follows.
+	Seq int64 `json:"-"`
+
+	// ID is the event's ID, if the server gave it one.
+	ID         string          `json:"id,omitempty"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Fetch returns up to limit events with a Seq greater than after, in order of
+// Seq.
+type Fetch func(ctx context.Context, after int64, limit int) ([]Event, error)
+
+// Feed is a live feed of events. It's safe to use from many goroutines.
+type Feed struct {
+	// OnEvent, if not nil, is called with every event before subscribers get
+	// it. It's for consumers that mustn't fall behind, or be dropped, like
+	// in-memory aggregates. It must not block.
+	OnEvent func(Event)
+
+	fetch Fetch
+	last  int64
+
+	mu   sync.Mutex
+	subs map[*Subscription]bool
+}
+
+// Subscription is a subscriber's events. C is closed when the subscriber has
+// fallen so far behind that its buffer filled up, or when it unsubscribes.
+type Subscription struct {
+	C <-chan Event
+	c chan Event
+}
+
+// New returns a feed of the events after last, as fetched by fetch.
+func New(fetch Fetch, last int64) *Feed {
+	return &Feed{fetch: fetch, last: last, subs: map[*Subscription]bool{}}
+}
+
+// Subscribe returns a subscription to events stored from now on, which can
+// fall buffer events behind before it's dropped.
+func (f *Feed) Subscribe(buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, c: c}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.subs[sub] = true
+	return sub
+}
+
+// Unsubscribe ends a subscription. It's fine to call after it's been dropped.
+func (f *Feed) Unsubscribe(sub *Subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subs[sub] {
+		delete(f.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Subscribers returns how many subscriptions there are.
+func (f *Feed) Subscribers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.subs)
+}
+
+// Run follows the events table until ctx is done. It looks for new events
+// whenever wake sends, which may be nil, and at least every poll. Errors
+// fetching events are passed to onError, and tried again next time.
+func (f *Feed) Run(ctx context.Context, wake <-chan struct{}, poll time.Duration, onError func(error)) {
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		if err := f.catchUp(ctx); err != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// catchUp fetches and fans out every event since the last one.
+func (f *Feed) catchUp(ctx context.Context) error {
+	for {
+		events, err := f.fetch(ctx, f.last, batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			f.publish(e)
+			f.last = e.Seq
+		}
+
+		if len(events) < batchSize {
+			return nil
+		}
+	}
+}
+
+func (f *Feed) publish(e Event) {
+	if f.OnEvent != nil {
+		f.OnEvent(e)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for sub := range f.subs {
+		select {
+		case sub.c <- e:
+		default:
+			delete(f.subs, sub)
+			close(sub.c)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package money adds up revenue without losing cents.
+//
+// Revenue arrives as a decimal string, like "49.99", so that no client ever
+// has it as a float64, which can only hold the nearest binary fraction, and
+// whose sums drift: 0.1 + 0.2 is 0.30000000000000004. Postgres sums it exactly
+// as numeric, and a Sum adds amounts up as exact fractions.
+package money
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+)
+
+// decimalPattern is what a valid amount looks like. It's stricter than
+// Postgres' numeric, which also takes "NaN", "1e3", and surrounding spaces.
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// maxScale is the most digits after the decimal point a Sum can format. Every
+// float64's shortest decimal form fits in far fewer.
+const maxScale = 1100
+
+// Sum is an exact total of amounts of money. The zero value is zero, ready to
+// use. A Sum must not be copied once it's been added to.
+type Sum struct {
+	r big.Rat
+}
+
+// Valid returns whether amount is a decimal, like "49.99" or "-5": digits,
+// optionally signed, and optionally with a fractional part.
+func Valid(amount string) bool {
+	return decimalPattern.MatchString(amount)
+}
+
+// parse returns the value of an amount, or zero if it isn't Valid.
+func parse(amount string) *big.Rat {
+	r := new(big.Rat)
+	if Valid(amount) {
+		r.SetString(amount)
+	}
+
+	return r
+}
+
+// decimal returns the decimal f was most likely parsed from: the shortest one
+// that parses back to f.
+func decimal(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return r
+}
+
+// Add adds an amount, a decimal like "49.99", to the sum. Amounts that
+// aren't Valid count as zero.
+func (s *Sum) Add(amount string) {
+	s.r.Add(&s.r, parse(amount))
+}
+
+// Sub subtracts an amount from the sum, like Add.
+func (s *Sum) Sub(amount string) {
+	s.r.Sub(&s.r, parse(amount))
+}
+
+// AddSum adds another sum to this one.
+func (s *Sum) AddSum(o *Sum) {
+	s.r.Add(&s.r, &o.r)
+}
+
+// Cmp compares the sum to an amount, returning -1, 0, or +1 if the sum is less
+// than, equal to, or greater than it.
+func (s *Sum) Cmp(amount string) int {
+	return s.r.Cmp(parse(amount))
+}
+
+// CmpSum compares the sum to another, like Cmp.
+func (s *Sum) CmpSum(o *Sum) int {
+	return s.r.Cmp(&o.r)
+}
+
+// String returns the sum as a decimal, with as many digits after the point as
+// it needs and no more, like "130" or "0.3".
+func (s Sum) String() string {
+	// Sums of decimals are decimals, so some power of ten is a multiple of the
+	// denominator, and that many digits are exact.
+	denom := s.r.Denom()
+	ten, pow, rem := big.NewInt(10), big.NewInt(1), new(big.Int)
+	for scale := 0; scale <= maxScale; scale++ {
+		if rem.Mod(pow, denom).Sign() == 0 {
+			return s.r.FloatString(scale)
+		}
+
+		pow.Mul(pow, ten)
+	}
+
+	return s.r.FloatString(maxScale)
+}
+
+// MarshalJSON encodes the sum as a JSON number, with every digit exact.
+func (s Sum) MarshalJSON() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Scan reads a sum from a Postgres numeric, like sum((payload->>'revenue')::numeric).
+func (s *Sum) Scan(src interface{}) error {
+	var text string
+	switch v := src.(type) {
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	case int64:
+		s.r.SetInt64(v)
+		return nil
+	case float64:
+		s.r.Set(decimal(v))
+		return nil
+	case nil:
+		s.r.SetInt64(0)
+		return nil
+	default:
+		return fmt.Errorf("money: can't scan a %T", src)
+	}
+
+	if _, ok := s.r.SetString(text); !ok {
+		return fmt.Errorf("money: invalid amount: %q", text)
+	}
+
+	return nil
+}
@@ -0,0 +1,420 @@
+// Package msgpack converts between MessagePack and the generic values that
+// encoding/json works with, so that MessagePack can stand in for JSON on the
+// wire without the rest of the server knowing.
+//
+// Decode produces what json.Unmarshal into an interface{} would: nil, bool,
+// float64, string, []interface{} and map[string]interface{}. Encode takes the
+// same, plus json.Number, so that JSON decoded with UseNumber keeps its
+// integers exact.
+//
+// Only what JSON can represent is supported. Map keys must be strings, and of
+// the extension types, only timestamps, which decode to RFC 3339 strings.
+package msgpack
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// maxDepth is how deeply arrays and maps may nest.
+const maxDepth = 64
+
+// timestampExt is the extension type of MessagePack timestamps.
+const timestampExt = -1
+
+var errTruncated = errors.New("msgpack: data ends too soon")
+
+// Decode decodes the single value in data.
+func Decode(data []byte) (interface{}, error) {
+	d := decoder{buf: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.pos != len(d.buf) {
+		return nil, fmt.Errorf("msgpack: %d bytes left over after the value", len(d.buf)-d.pos)
+	}
+
+	return v, nil
+}
+
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *decoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("msgpack: data nests too deeply")
+	}
+
+	b, err := d.bytes(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return float64(c), nil
+	case c >= 0xe0:
+		return float64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return d.object(int(c&0x0f), depth)
+	}
+
+	switch c := b[0]; c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		return float64(n), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sign-extend from the value's size.
+		shift := uint(64 - 8*size)
+		return float64(int64(n<<shift) >> shift), nil
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+
+		return finite(float64(math.Float32frombits(uint32(n))))
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+
+		return finite(math.Float64frombits(n))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		// Some older encoders write strings as binaries, so those are taken as
+		// strings too, if they're valid UTF-8.
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.object(int(n), depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.ext(int(n))
+	default:
+		return nil, fmt.Errorf("msgpack: 0x%02x isn't a valid type", c)
+	}
+}
+
+func (d *decoder) str(n int) (interface{}, error) {
+	b, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if !utf8.Valid(b) {
+		return nil, errors.New("msgpack: string isn't valid UTF-8")
+	}
+
+	return string(b), nil
+}
+
+func (d *decoder) array(n int, depth int) (interface{}, error) {
+	// Every element takes at least a byte, so a count bigger than what's left
+	// is a lie, and shouldn't be allocated for.
+	if n > len(d.buf)-d.pos {
+		return nil, errTruncated
+	}
+
+	v := make([]interface{}, n)
+	for i := range v {
+		item, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		v[i] = item
+	}
+
+	return v, nil
+}
+
+func (d *decoder) object(n int, depth int) (interface{}, error) {
+	if 2*n > len(d.buf)-d.pos {
+		return nil, errTruncated
+	}
+
+	v := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		k, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key %v isn't a string", key)
+		}
+
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		v[k] = value
+	}
+
+	return v, nil
+}
+
+// ext decodes an extension value of n bytes. Only timestamps are supported.
+func (d *decoder) ext(n int) (interface{}, error) {
+	typ, err := d.bytes(1)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(typ[0]) != timestampExt {
+		return nil, fmt.Errorf("msgpack: extension type %d isn't supported", int8(typ[0]))
+	}
+
+	var t time.Time
+	switch n {
+	case 4:
+		t = time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		t = time.Unix(int64(v&(1<<34-1)), int64(v>>34))
+	case 12:
+		t = time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data)))
+	default:
+		return nil, fmt.Errorf("msgpack: a timestamp can't be %d bytes", n)
+	}
+
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.bytes(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+
+	return n, nil
+}
+
+func (d *decoder) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(d.buf)-d.pos {
+		return nil, errTruncated
+	}
+
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// finite rejects NaN and infinities, which JSON can't represent.
+func finite(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("msgpack: %v can't be represented in JSON", f)
+	}
+
+	return f, nil
+}
+
+// Encode encodes v, which must be made of the values Decode returns, or
+// json.Numbers. Numbers that are whole and fit in 64 bits are encoded as
+// integers; the rest as doubles. Map keys are sorted, so the same v always
+// encodes the same way.
+func Encode(v interface{}) ([]byte, error) {
+	var e encoder
+	if err := e.encode(v); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) encode(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if v {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			e.int(n)
+		} else if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			e.buf = append(e.buf, 0xcf)
+			e.buf = appendUint(e.buf, n, 8)
+		} else if f, err := v.Float64(); err == nil {
+			e.float(f)
+		} else {
+			return err
+		}
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			e.int(int64(v))
+		} else {
+			e.float(v)
+		}
+	case string:
+		e.header(len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		e.buf = append(e.buf, v...)
+	case []interface{}:
+		e.header(len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := e.encode(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		e.header(len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			if err := e.encode(k); err != nil {
+				return err
+			}
+
+			if err := e.encode(v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: can't encode %T", v)
+	}
+
+	return nil
+}
+
+// header writes the header of a string, array or map of length n: fix|n if n
+// fits in fixMax, or else the 8-, 16- or 32-bit form. Arrays and maps have no
+// 8-bit form, and pass 0 for it.
+func (e *encoder) header(n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint8 && code8 != 0:
+		e.buf = append(e.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, code16)
+		e.buf = appendUint(e.buf, uint64(n), 2)
+	default:
+		e.buf = append(e.buf, code32)
+		e.buf = appendUint(e.buf, uint64(n), 4)
+	}
+}
+
+// int writes n in the smallest form that holds it.
+func (e *encoder) int(n int64) {
+	switch {
+	case n >= 0 && n <= 0x7f, n < 0 && n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = appendUint(e.buf, uint64(n), 2)
+	case n >= 0 && n <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = appendUint(e.buf, uint64(n), 4)
+	case n >= 0:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = appendUint(e.buf, uint64(n), 8)
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = appendUint(e.buf, uint64(n), 2)
+	case n >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = appendUint(e.buf, uint64(n), 4)
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = appendUint(e.buf, uint64(n), 8)
+	}
+}
+
+func (e *encoder) float(f float64) {
+	e.buf = append(e.buf, 0xcb)
+	e.buf = appendUint(e.buf, math.Float64bits(f), 8)
+}
+
+// appendUint appends the low size bytes of n, big-endian.
+func appendUint(buf []byte, n uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		buf = append(buf, byte(n>>(8*uint(i))))
+	}
+
+	return buf
+}
@@ -0,0 +1,105 @@
+// Package objstore reads objects out of cloud object storage, like S3 or GCS,
+// or out of a local directory that's laid out the same way.
+//
+// Only listing and downloading objects is supported, because that's all
+// importing events needs. Both S3 and GCS are accessed through the S3 XML API,
+// which GCS also supports via its "interoperability" HMAC keys. That keeps us
+// from pulling in two large SDKs for two API calls.
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Bucket is a collection of objects, identified by key.
+type Bucket interface {
+	// List returns the keys of all objects whose key starts with prefix, in
+	// lexicographic order.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Open returns the contents of the object with the given key.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// Open returns the bucket, and key prefix, that a URL refers to. Supported
+// URLs are:
+//
+//	s3://bucket/prefix    (credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, and AWS_REGION)
+//	gs://bucket/prefix    (credentials from GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET)
+//	file:///path/to/dir   (a local directory, mostly useful for testing)
+func Open(rawURL string) (Bucket, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+
+	switch u.Scheme {
+	case "s3":
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+
+		return &s3Bucket{
+			endpoint:     fmt.Sprintf("https://s3.%s.amazonaws.com", region),
+			bucket:       u.Host,
+			region:       region,
+			accessKeyID:  os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, prefix, nil
+	case "gs":
+		return &s3Bucket{
+			endpoint:    "https://storage.googleapis.com",
+			bucket:      u.Host,
+			region:      "auto",
+			accessKeyID: os.Getenv("GCS_HMAC_ACCESS_ID"),
+			secretKey:   os.Getenv("GCS_HMAC_SECRET"),
+		}, prefix, nil
+	case "file":
+		return dirBucket(u.Path), "", nil
+	default:
+		return nil, "", fmt.Errorf("objstore: unsupported URL scheme: %q", u.Scheme)
+	}
+}
+
+// dirBucket is a Bucket backed by a local directory. Keys are paths relative to
+// the directory, with forward slashes.
+type dirBucket string
+
+func (d dirBucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(string(d), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		key, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+
+		key = filepath.ToSlash(key)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (d dirBucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(key)))
+}
@@ -0,0 +1,60 @@
+package oidc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrBadCookie is returned by OpenCookie when a cookie wasn't produced by
+// SealCookie with the same secret and name.
+var ErrBadCookie = errors.New("oidc: cookie is malformed or has been tampered with")
+
+// SealCookie encodes v as the value of the cookie called name, signed with
+// secret so that it can't be forged or modified by the browser. The name is
+// signed too, so a value sealed for one cookie won't open as another, even
+// though they share a secret. The value isn't encrypted, so it mustn't hold
+// anything the person it's about shouldn't see.
+func SealCookie(secret []byte, name string, v interface{}) (string, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(buf)
+	return payload + "." + cookieMAC(secret, name, payload), nil
+}
+
+// OpenCookie checks the signature of a value produced by SealCookie for the
+// cookie called name, and decodes it into v.
+func OpenCookie(secret []byte, name, value string, v interface{}) error {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return ErrBadCookie
+	}
+
+	payload, mac := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(cookieMAC(secret, name, payload))) {
+		return ErrBadCookie
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ErrBadCookie
+	}
+
+	return json.Unmarshal(buf, v)
+}
+
+func cookieMAC(secret []byte, name, payload string) string {
+	// Cookie names can't contain a NUL, so it separates the name from the
+	// payload unambiguously.
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
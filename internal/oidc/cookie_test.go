@@ -0,0 +1,43 @@
+package oidc
+
+import "testing"
+
+func TestOpenCookie(t *testing.T) {
+	type value struct {
+		Subject string `json:"sub"`
+	}
+
+	secret := []byte("secret")
+	sealed, err := SealCookie(secret, "admin_login", value{Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		secret []byte
+		cookie string
+		value  string
+		ok     bool
+	}{
+		{name: "same name", secret: secret, cookie: "admin_login", value: sealed, ok: true},
+		{name: "other name", secret: secret, cookie: "admin_session", value: sealed},
+		{name: "other secret", secret: []byte("other"), cookie: "admin_login", value: sealed},
+		{name: "tampered", secret: secret, cookie: "admin_login", value: "e30" + sealed[len("eyJzdWIiOiJhbGljZSJ9"):]},
+		{name: "unsigned", secret: secret, cookie: "admin_login", value: "eyJzdWIiOiJhbGljZSJ9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v value
+			err := OpenCookie(tt.secret, tt.cookie, tt.value, &v)
+			if tt.ok {
+				if err != nil || v.Subject != "alice" {
+					t.Errorf("OpenCookie() = %v, %+v", err, v)
+				}
+			} else if err != ErrBadCookie {
+				t.Errorf("OpenCookie() = %v, want ErrBadCookie", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Package pipeline runs jobs on a fixed number of worker goroutines, fed by a
+// bounded queue.
+//
+// It decouples taking work from doing it: an HTTP handler can submit a job and
+// respond straight away, while the workers keep how many jobs run at once --
+// and so how many database connections they hold -- to a number the database
+// can take. When work arrives faster than the workers get through it, the
+// queue absorbs the burst, and once it's full, Submit says so, instead of
+// requests piling up waiting.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrFull is what Submit fails with when the queue is full. The job isn't
+// taken.
+var ErrFull = errors.New("pipeline: queue is full")
+
+// Job is a unit of work. Its error, if any, is passed to the pipeline's
+// onError.
+type Job func(ctx context.Context) error
+
+// Pipeline is a queue of jobs and the workers that run them. It's safe to use
+// from many goroutines.
+type Pipeline struct {
+	// The counters come first, so that they're 64-bit aligned for sync/atomic.
+	succeeded int64
+	failed    int64
+
+	workers int
+	queue   chan task
+	onError func(error)
+
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+// task is a job and the key it was submitted with.
+type task struct {
+	key string
+	job Job
+}
+
+// Stats are how a pipeline has been doing.
+type Stats struct {
+	Workers int `json:"workers"`
+
+	// Queued is how many jobs are waiting for a worker now, and Capacity how
+	// many may.
+	Queued   int `json:"queued"`
+	Capacity int `json:"capacity"`
+
+	// Succeeded and Failed are how many jobs have run, by outcome.
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+}
+
+// New returns a pipeline with the given number of workers, and room for
+// queueSize jobs waiting for them. Errors from jobs are passed to onError. No
+// jobs run until Start.
+func New(workers, queueSize int, onError func(error)) *Pipeline {
+	return &Pipeline{
+		workers: workers,
+		queue:   make(chan task, queueSize),
+		onError: onError,
+		pending: map[string]int{},
+	}
+}
+
+// Start starts the workers. They run jobs until ctx is done, and pass ctx to
+// each. Jobs still queued then are never run.
+func (p *Pipeline) Start(ctx context.Context) {
+	for i := 0; i < p.workers; i++ {
+		go p.work(ctx)
+	}
+}
+
+// Submit queues a job. It doesn't wait, and fails with ErrFull if there's no
+// room. key names the job for Pending, and may be empty.
+func (p *Pipeline) Submit(key string, job Job) error {
+	p.track(key, 1)
+	select {
+	case p.queue <- task{key: key, job: job}:
+		return nil
+	default:
+		p.track(key, -1)
+		return ErrFull
+	}
+}
+
+// Pending is whether a job submitted with key is queued or running.
+func (p *Pipeline) Pending(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pending[key] != 0
+}
+
+// Stats returns how the pipeline has been doing.
+func (p *Pipeline) Stats() Stats {
+	return Stats{
+		Workers:   p.workers,
+		Queued:    len(p.queue),
+		Capacity:  cap(p.queue),
+		Succeeded: atomic.LoadInt64(&p.succeeded),
+		Failed:    atomic.LoadInt64(&p.failed),
+	}
+}
+
+func (p *Pipeline) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-p.queue:
+			if err := t.job(ctx); err != nil {
+				atomic.AddInt64(&p.failed, 1)
+				p.onError(err)
+			} else {
+				atomic.AddInt64(&p.succeeded, 1)
+			}
+
+			p.track(t.key, -1)
+		}
+	}
+}
+
+// track counts a job with key in or out of pending.
+func (p *Pipeline) track(key string, delta int) {
+	if key == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pending[key] += delta; p.pending[key] == 0 {
+		delete(p.pending, key)
+	}
+}
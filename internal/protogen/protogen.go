@@ -0,0 +1,479 @@
+// Package protogen generates a Protocol Buffers definition of events, and Go
+// types for it, from a JDDF schema.
+//
+// The JDDF schema stays the source of truth; the .proto is generated from it,
+// so that Kafka consumers and the like can decode events as protobuf without
+// anyone keeping a second schema in step by hand.
+//
+// Protobuf identifies fields by number, not name, so numbers must never change
+// once messages are out there. They can't be worked out from the schema's
+// shape without shifting when a property is added, so the schema gives them,
+// in each variant's and each property's metadata:
+//
+//	"Order Completed": {
+//	  "metadata": { "protobufField": 2 },
+//	  "properties": {
+//	    "revenue": { "metadata": { "protobufField": 3 }, "type": "float64" },
+//	    ...
+//
+// jddf-go doesn't keep metadata, so it's passed in separately, as read by
+// package schemameta. The variants become a oneof in an Event message. Only properties with a
+// JDDF type can be generated, which is all events have.
+package protogen
+
+import (
+	"errors"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+	"github.com/jddf/jddf-go"
+)
+
+// scalar is how a JDDF type is represented in protobuf and in Go.
+type scalar struct {
+	proto string // the .proto type
+	goTyp string // the Go type, as the event package has it
+
+	// wire is the wire type: "varint", "fixed32", "fixed64", "bytes" or
+	// "timestamp", a google.protobuf.Timestamp embedded as bytes.
+	wire string
+}
+
+var scalars = map[jddf.Type]scalar{
+	"boolean":   {"bool", "bool", "varint"},
+	"float32":   {"float", "float32", "fixed32"},
+	"float64":   {"double", "float64", "fixed64"},
+	"int8":      {"int32", "int8", "varint"},
+	"uint8":     {"uint32", "uint8", "varint"},
+	"int16":     {"int32", "int16", "varint"},
+	"uint16":    {"uint32", "uint16", "varint"},
+	"int32":     {"int32", "int32", "varint"},
+	"uint32":    {"uint32", "uint32", "varint"},
+	"string":    {"string", "string", "bytes"},
+	"timestamp": {"google.protobuf.Timestamp", "time.Time", "timestamp"},
+}
+
+// message is a generated message: a variant of the schema, or the Event
+// message that holds one of them.
+type message struct {
+	name   string // like "OrderCompleted"
+	tag    string // the discriminator value, like "Order Completed"
+	num    int    // its field number in Event
+	fields []field
+}
+
+type field struct {
+	jsonName string // like "userId"
+	name     string // like "UserId", as the event package has it
+	num      int
+	optional bool
+	scalar   scalar
+}
+
+// parse reads the messages to generate out of a schema and its metadata, in
+// field number order.
+func parse(schema jddf.Schema, meta schemameta.Schema) ([]message, error) {
+	if schema.Discriminator.Tag == "" {
+		return nil, errors.New("protogen: schema is not of the discriminator form")
+	}
+
+	var messages []message
+	nums := map[int]string{}
+	for tag, variant := range schema.Discriminator.Mapping {
+		variantMeta := meta.Discriminator.Mapping[tag]
+		num, err := fieldNumber(variantMeta.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("protogen: %s: %s", tag, err)
+		}
+
+		if other, ok := nums[num]; ok {
+			return nil, fmt.Errorf("protogen: %s and %s both have protobufField %d", other, tag, num)
+		}
+
+		nums[num] = tag
+		m := message{name: goName(tag), tag: tag, num: num}
+		if m.fields, err = fields(variant, variantMeta); err != nil {
+			return nil, fmt.Errorf("protogen: %s.%s", tag, err)
+		}
+
+		messages = append(messages, m)
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].num < messages[j].num })
+	return messages, nil
+}
+
+// fields reads the fields of a variant, in field number order.
+func fields(variant jddf.Schema, meta schemameta.Schema) ([]field, error) {
+	var out []field
+	nums := map[int]string{}
+	add := func(props map[string]jddf.Schema, optional bool) error {
+		for name, prop := range props {
+			num, err := fieldNumber(meta.Property(name).Metadata)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+
+			if other, ok := nums[num]; ok {
+				return fmt.Errorf("%s: %s has protobufField %d too", name, other, num)
+			}
+
+			nums[num] = name
+
+			s, ok := scalars[prop.Type]
+			if !ok {
+				return fmt.Errorf("%s: only properties with a type can be generated", name)
+			}
+
+			out = append(out, field{jsonName: name, name: goName(name), num: num, optional: optional, scalar: s})
+		}
+
+		return nil
+	}
+
+	if err := add(variant.RequiredProperties, false); err != nil {
+		return nil, err
+	}
+
+	if err := add(variant.OptionalProperties, true); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].num < out[j].num })
+	return out, nil
+}
+
+// fieldNumber reads a protobuf field number from a schema's metadata.
+func fieldNumber(metadata map[string]interface{}) (int, error) {
+	raw, ok := metadata["protobufField"]
+	if !ok {
+		return 0, errors.New("metadata needs a protobufField")
+	}
+
+	n, ok := raw.(float64)
+	if !ok || n != float64(int(n)) || n < 1 || n > 1<<29-1 {
+		return 0, fmt.Errorf("protobufField must be a whole number from 1 to %d", 1<<29-1)
+	}
+
+	// Protobuf reserves these for itself.
+	if n >= 19000 && n <= 19999 {
+		return 0, errors.New("protobufField can't be from 19000 to 19999")
+	}
+
+	return int(n), nil
+}
+
+// Proto returns the .proto definition of the schema's events, in the given
+// protobuf package.
+func Proto(schema jddf.Schema, meta schemameta.Schema, pkg string) (string, error) {
+	messages, err := parse(schema, meta)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	out.WriteString("// Code generated from event.jddf.json by \"golang-postgres-analytics proto\". DO NOT EDIT.\n\n")
+	out.WriteString("syntax = \"proto3\";\n\n")
+	fmt.Fprintf(&out, "package %s;\n\n", pkg)
+	for _, imp := range imports(messages) {
+		if imp == "time" {
+			out.WriteString("import \"google/protobuf/timestamp.proto\";\n\n")
+		}
+	}
+
+	fmt.Fprintf(&out, "// Event is one event, of whichever type its %q says.\n", schema.Discriminator.Tag)
+	out.WriteString("message Event {\n  oneof event {\n")
+	for _, m := range messages {
+		fmt.Fprintf(&out, "    %s %s = %d; // %q\n", m.name, snakeCase(m.name), m.num, m.tag)
+	}
+
+	out.WriteString("  }\n}\n")
+
+	for _, m := range messages {
+		fmt.Fprintf(&out, "\nmessage %s {\n", m.name)
+		for _, f := range m.fields {
+			optional := ""
+			if f.optional {
+				optional = "optional "
+			}
+
+			fmt.Fprintf(&out, "  %s%s %s = %d;\n", optional, f.scalar.proto, snakeCase(f.jsonName), f.num)
+		}
+
+		out.WriteString("}\n")
+	}
+
+	return out.String(), nil
+}
+
+// Go returns Go types for the messages of the .proto that Proto generates, in
+// the package named pkg. They marshal themselves with helpers the package
+// must already have; see internal/eventpb. eventImport is the import path of
+// the event package that jddf-codegen generates, which they convert to and
+// from.
+func Go(schema jddf.Schema, meta schemameta.Schema, pkg, eventImport string) (string, error) {
+	messages, err := parse(schema, meta)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	w := func(format string, args ...interface{}) {
+		fmt.Fprintf(&out, format, args...)
+	}
+
+	w("// Code generated from event.jddf.json by \"golang-postgres-analytics proto\". DO NOT EDIT.\n\n")
+	w("package %s\n\n", pkg)
+	w("import (\n")
+	for _, imp := range imports(messages) {
+		w("%q\n", imp)
+	}
+
+	w("\n%q\n)\n\n", eventImport)
+
+	// The Event message, and its oneof.
+	w("// Event is the Event message. Exactly one of its fields is set.\n")
+	w("type Event struct {\n")
+	for _, m := range messages {
+		w("%s *%s // %d\n", m.name, m.name, m.num)
+	}
+
+	w("}\n\n")
+
+	w("// Marshal encodes the message.\n")
+	w("func (m *Event) Marshal() []byte {\nvar buf []byte\n")
+	for _, m := range messages {
+		w("if m.%s != nil {\nbuf = appendBytesField(buf, %d, m.%s.Marshal())\n}\n\n", m.name, m.num, m.name)
+	}
+
+	w("return buf\n}\n\n")
+
+	w("// Unmarshal decodes the message. If more than one of the oneof's fields\n")
+	w("// is set, the last one wins, as in protobuf.\n")
+	w("func (m *Event) Unmarshal(buf []byte) error {\n*m = Event{}\n")
+	w("return eachField(buf, func(num, wire int, v uint64, b []byte) error {\nswitch num {\n")
+	for _, m := range messages {
+		w("case %d:\nif wire != wireBytes {\nreturn errWireType(\"Event\", num)\n}\n\n", m.num)
+		w("*m = Event{%s: &%s{}}\nreturn m.%s.Unmarshal(b)\n", m.name, m.name, m.name)
+	}
+
+	w("}\n\nreturn nil\n})\n}\n\n")
+
+	// Converting to and from the event package.
+	w("// FromEvent converts an event.Event to an Event message.\n")
+	w("func FromEvent(e event.Event) (*Event, error) {\nswitch e.Type {\n")
+	for _, m := range messages {
+		w("case event.EventType%s:\nreturn &Event{%s: &%s{\n", m.name, m.name, m.name)
+		for _, f := range m.fields {
+			w("%s: e.Event%s.%s,\n", f.name, m.name, f.name)
+		}
+
+		w("}}, nil\n")
+	}
+
+	w("}\n\nreturn nil, event.ErrUnknownVariant\n}\n\n")
+
+	w("// ToEvent converts the message to an event.Event. It fails if none of\n")
+	w("// the oneof's fields is set.\n")
+	w("func (m *Event) ToEvent() (event.Event, error) {\nswitch {\n")
+	for _, m := range messages {
+		w("case m.%s != nil:\nreturn event.Event{Type: event.EventType%s, Event%s: event.Event%s{\n", m.name, m.name, m.name, m.name)
+		for _, f := range m.fields {
+			w("%s: m.%s.%s,\n", f.name, m.name, f.name)
+		}
+
+		w("}}, nil\n")
+	}
+
+	w("}\n\nreturn event.Event{}, event.ErrUnknownVariant\n}\n")
+
+	// The variants' messages.
+	for _, m := range messages {
+		w("\n// %s is the %s message, for %q events.\n", m.name, m.name, m.tag)
+		w("type %s struct {\n", m.name)
+		for _, f := range m.fields {
+			ptr := ""
+			if f.optional {
+				ptr = "*"
+			}
+
+			w("%s %s%s // %d\n", f.name, ptr, f.scalar.goTyp, f.num)
+		}
+
+		w("}\n\n")
+
+		w("// Marshal encodes the message.\n")
+		w("func (m *%s) Marshal() []byte {\nvar buf []byte\n", m.name)
+		for _, f := range m.fields {
+			value := "m." + f.name
+			if f.optional {
+				w("if %s != nil {\n", value)
+				value = "*" + value
+			} else if f.scalar.wire != "timestamp" {
+				w("if %s != %s {\n", value, zero(f.scalar))
+			} else {
+				// Messages, like timestamps, are always written.
+				w("buf = %s\n\n", appendField(f, value))
+				continue
+			}
+
+			w("buf = %s\n}\n\n", appendField(f, value))
+		}
+
+		w("return buf\n}\n\n")
+
+		w("// Unmarshal decodes the message.\n")
+		w("func (m *%s) Unmarshal(buf []byte) error {\n*m = %s{}\n", m.name, m.name)
+		w("return eachField(buf, func(num, wire int, v uint64, b []byte) error {\nswitch num {\n")
+		for _, f := range m.fields {
+			w("case %d:\n%s\n", f.num, decodeField(m, f))
+		}
+
+		w("}\n\nreturn nil\n})\n}\n")
+	}
+
+	src, err := format.Source([]byte(out.String()))
+	if err != nil {
+		return "", fmt.Errorf("protogen: generated Go doesn't parse: %s", err)
+	}
+
+	return string(src), nil
+}
+
+// imports returns the standard packages the generated Go needs for the given
+// messages' fields.
+func imports(messages []message) []string {
+	var floats, timestamps bool
+	for _, m := range messages {
+		for _, f := range m.fields {
+			floats = floats || f.scalar.wire == "fixed32" || f.scalar.wire == "fixed64"
+			timestamps = timestamps || f.scalar.wire == "timestamp"
+		}
+	}
+
+	var out []string
+	if floats {
+		out = append(out, "math")
+	}
+
+	if timestamps {
+		out = append(out, "time")
+	}
+
+	return out
+}
+
+// zero returns the Go zero value of a scalar, which proto3 leaves out.
+func zero(s scalar) string {
+	switch s.goTyp {
+	case "bool":
+		return "false"
+	case "string":
+		return `""`
+	default:
+		return "0"
+	}
+}
+
+// appendField returns the expression appending a field with the given value.
+func appendField(f field, value string) string {
+	switch f.scalar.wire {
+	case "varint":
+		if f.scalar.goTyp == "bool" {
+			return fmt.Sprintf("appendBoolField(buf, %d, %s)", f.num, value)
+		}
+
+		// Negative numbers are sign-extended to 64 bits, as protobuf's int32 is.
+		return fmt.Sprintf("appendVarintField(buf, %d, uint64(int64(%s)))", f.num, value)
+	case "fixed32":
+		return fmt.Sprintf("appendFixed32Field(buf, %d, %s)", f.num, value)
+	case "fixed64":
+		return fmt.Sprintf("appendFixed64Field(buf, %d, %s)", f.num, value)
+	case "timestamp":
+		return fmt.Sprintf("appendBytesField(buf, %d, marshalTimestamp(%s))", f.num, value)
+	default:
+		return fmt.Sprintf("appendBytesField(buf, %d, []byte(%s))", f.num, value)
+	}
+}
+
+// decodeField returns the statements decoding a field into the message, from
+// the wire type, varint and bytes eachField passes.
+func decodeField(m message, f field) string {
+	var wire, value, check string
+	switch f.scalar.wire {
+	case "varint":
+		wire = "wireVarint"
+		value = fmt.Sprintf("%s(v)", f.scalar.goTyp)
+		if f.scalar.goTyp == "bool" {
+			value = "v != 0"
+		}
+	case "fixed32":
+		wire, value = "wire32Bit", "math.Float32frombits(uint32(v))"
+	case "fixed64":
+		wire, value = "wire64Bit", "math.Float64frombits(v)"
+	case "timestamp":
+		wire = "wireBytes"
+		check = "t, err := unmarshalTimestamp(b)\nif err != nil {\nreturn err\n}\n\n"
+		value = "t"
+	default:
+		wire = "wireBytes"
+		check = "s, err := unmarshalString(b)\nif err != nil {\nreturn err\n}\n\n"
+		value = "s"
+	}
+
+	out := fmt.Sprintf("if wire != %s {\nreturn errWireType(%q, num)\n}\n\n%s", wire, m.name, check)
+	if f.optional && check != "" {
+		return out + fmt.Sprintf("m.%s = &%s", f.name, value)
+	}
+
+	if f.optional {
+		return out + fmt.Sprintf("x := %s\nm.%s = &x", value, f.name)
+	}
+
+	return out + fmt.Sprintf("m.%s = %s", f.name, value)
+}
+
+// goName converts names like "userId" or "Order Completed" into "UserId" or
+// "OrderCompleted", the way jddf-codegen names them in Go.
+func goName(s string) string {
+	var out strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+
+		if upper {
+			r = unicode.ToUpper(r)
+		}
+
+		out.WriteRune(r)
+		upper = false
+	}
+
+	return out.String()
+}
+
+// snakeCase converts names like "userId" or "OrderCompleted" into "user_id" or
+// "order_completed", as protobuf field names are written.
+func snakeCase(s string) string {
+	var out strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				out.WriteRune('_')
+			}
+
+			r = unicode.ToLower(r)
+		}
+
+		out.WriteRune(r)
+	}
+
+	return out.String()
+}
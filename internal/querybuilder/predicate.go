@@ -0,0 +1,304 @@
+package querybuilder
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/money"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+	"github.com/jddf/jddf-go"
+)
+
+// Predicate is a condition on a field of events, like "revenue is at least
+// 10". Predicates are made by ParsePredicate, which checks them against the
+// event schema, so that the SQL they compile to is safe to run on any event.
+type Predicate struct {
+	// Path is the field's path within events, like ["url"], or ["context",
+	// "os"] for a field of an object.
+	Path []string
+
+	// Op is how the field is compared to Value: eq, ne, gt, gte, lt, lte, or
+	// prefix.
+	Op string
+
+	// Value is what the field is compared to: a string, float64, bool, or
+	// time.Time, according to the field's type. Decimals are compared to a
+	// string, so they're compared exactly.
+	Value interface{}
+
+	// tag is the schema's discriminator tag, and types the event types that
+	// have the field. Fields are only compared on events of those types, where
+	// the schema guarantees they have the expected type.
+	tag   string
+	types []string
+	kind  kind
+}
+
+// kind is a field's type, as far as comparing it goes.
+type kind int
+
+const (
+	kindString kind = iota
+	kindEnum
+	kindBoolean
+	kindNumber
+	kindInteger
+	kindTimestamp
+	kindDecimal
+)
+
+// ops are the comparisons each kind of field supports.
+var ops = map[kind][]string{
+	kindString:    {"eq", "ne", "prefix"},
+	kindEnum:      {"eq", "ne"},
+	kindBoolean:   {"eq", "ne"},
+	kindNumber:    {"eq", "ne", "gt", "gte", "lt", "lte"},
+	kindInteger:   {"eq", "ne", "gt", "gte", "lt", "lte"},
+	kindTimestamp: {"eq", "ne", "gt", "gte", "lt", "lte"},
+	kindDecimal:   {"eq", "ne", "gt", "gte", "lt", "lte"},
+}
+
+// comparisons are the SQL operators for each op besides prefix.
+var comparisons = map[string]string{
+	"eq":  "=",
+	"ne":  "<>",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+// ParsePredicate parses a predicate like "revenue:gte:10" -- a field, an op,
+// and a value, separated by colons -- checking it against schema, which must
+// have a discriminator. Fields of objects are separated by dots, like
+// "context.os:eq:ios". meta is the schema's metadata, which says which strings
+// are decimals, and so compared as numbers.
+//
+// If eventType isn't empty, the field must be one that events of that type
+// have. Otherwise, it must be one that events of some type have, with the same
+// type wherever it appears. Either way, the op must suit the field's type, and
+// the value must be one the field could have.
+func ParsePredicate(schema jddf.Schema, meta schemameta.Schema, eventType, expr string) (Predicate, error) {
+	parts := strings.SplitN(expr, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return Predicate{}, fmt.Errorf("%q must look like field:op:value", expr)
+	}
+
+	field, op, value := parts[0], parts[1], parts[2]
+	p := Predicate{Path: strings.Split(field, "."), Op: op, tag: schema.Discriminator.Tag}
+
+	var fieldSchema *jddf.Schema
+	var decimal bool
+	var found []string
+	for name, variant := range schema.Discriminator.Mapping {
+		if eventType != "" && name != eventType {
+			continue
+		}
+
+		s := lookup(schema, variant, p.Path)
+		if s == nil {
+			continue
+		}
+
+		d := lookupMeta(meta.Discriminator.Mapping[name], p.Path).Decimal()
+		if fieldSchema != nil && (!sameType(*fieldSchema, *s) || d != decimal) {
+			return Predicate{}, fmt.Errorf("field %q has different types in different events; filter on a type too", field)
+		}
+
+		fieldSchema = s
+		decimal = d
+		found = append(found, name)
+	}
+
+	if eventType != "" && len(found) == 0 {
+		if _, ok := schema.Discriminator.Mapping[eventType]; !ok {
+			return Predicate{}, fmt.Errorf("unknown event type %q", eventType)
+		}
+
+		return Predicate{}, fmt.Errorf("%q events have no field %q", eventType, field)
+	}
+
+	if fieldSchema == nil {
+		return Predicate{}, fmt.Errorf("unknown field %q", field)
+	}
+
+	sort.Strings(found)
+	p.types = found
+
+	var ok bool
+	if p.kind, ok = kindOf(*fieldSchema); !ok {
+		return Predicate{}, fmt.Errorf("field %q can't be filtered on", field)
+	}
+
+	if decimal && p.kind == kindString {
+		p.kind = kindDecimal
+	}
+
+	if !contains(ops[p.kind], op) {
+		return Predicate{}, fmt.Errorf("field %q can't be compared with %q; use one of %s", field, op, strings.Join(ops[p.kind], ", "))
+	}
+
+	var err error
+	switch p.kind {
+	case kindString:
+		p.Value = value
+	case kindEnum:
+		if !contains(fieldSchema.Enum, value) {
+			return Predicate{}, fmt.Errorf("field %q must be one of %s", field, strings.Join(fieldSchema.Enum, ", "))
+		}
+
+		p.Value = value
+	case kindBoolean:
+		p.Value, err = strconv.ParseBool(value)
+	case kindNumber:
+		p.Value, err = strconv.ParseFloat(value, 64)
+	case kindInteger:
+		var n int64
+		n, err = strconv.ParseInt(value, 10, 64)
+		p.Value = float64(n)
+	case kindTimestamp:
+		p.Value, err = time.Parse(time.RFC3339, value)
+	case kindDecimal:
+		if !money.Valid(value) {
+			err = fmt.Errorf("%q is not a decimal", value)
+		}
+
+		p.Value = value
+	}
+
+	if err != nil {
+		return Predicate{}, fmt.Errorf("field %q can't be compared with %q", field, value)
+	}
+
+	return p, nil
+}
+
+// lookup returns the schema of the field at path within an event of variant,
+// or nil if there's no such field.
+func lookup(root, variant jddf.Schema, path []string) *jddf.Schema {
+	s := variant
+	for _, name := range path {
+		for s.Ref != nil {
+			s = root.Definitions[*s.Ref]
+		}
+
+		next, ok := s.RequiredProperties[name]
+		if !ok {
+			if next, ok = s.OptionalProperties[name]; !ok {
+				return nil
+			}
+		}
+
+		s = next
+	}
+
+	for s.Ref != nil {
+		s = root.Definitions[*s.Ref]
+	}
+
+	return &s
+}
+
+// lookupMeta returns the metadata of the field at path within an event whose
+// metadata is variant. Fields without any have an empty Schema.
+func lookupMeta(variant schemameta.Schema, path []string) schemameta.Schema {
+	s := variant
+	for _, name := range path {
+		s = s.Property(name)
+	}
+
+	return s
+}
+
+func kindOf(s jddf.Schema) (kind, bool) {
+	if s.Enum != nil {
+		return kindEnum, true
+	}
+
+	switch s.Type {
+	case jddf.TypeString:
+		return kindString, true
+	case jddf.TypeBoolean:
+		return kindBoolean, true
+	case jddf.TypeFloat32, jddf.TypeFloat64:
+		return kindNumber, true
+	case jddf.TypeInt8, jddf.TypeUint8, jddf.TypeInt16, jddf.TypeUint16, jddf.TypeInt32, jddf.TypeUint32:
+		return kindInteger, true
+	case jddf.TypeTimestamp:
+		return kindTimestamp, true
+	}
+
+	return 0, false
+}
+
+func sameType(a, b jddf.Schema) bool {
+	ka, okA := kindOf(a)
+	kb, okB := kindOf(b)
+	return okA && okB && ka == kb
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// predicate adds p's arguments to q, and returns a SQL boolean expression
+// matching the events p describes.
+//
+// Equality on anything but a timestamp or decimal is containment, which a GIN
+// index on payload can answer. ("10" and "10.00" are equal decimals, but not
+// equal strings.) Other comparisons cast the field from text, which is only
+// done for events of the types the schema says have the field with that type,
+// so that the cast can't fail.
+func (q *Query) predicate(p Predicate) string {
+	if p.Op == "eq" && p.kind != kindTimestamp && p.kind != kindDecimal {
+		var doc interface{} = p.Value
+		for i := len(p.Path) - 1; i >= 0; i-- {
+			doc = map[string]interface{}{p.Path[i]: doc}
+		}
+
+		buf, _ := json.Marshal(doc)
+		return fmt.Sprintf("payload @> %s::jsonb", q.Arg(string(buf)))
+	}
+
+	field := "payload"
+	for i, name := range p.Path {
+		if i == len(p.Path)-1 {
+			field = fmt.Sprintf("%s->>%s", field, q.Arg(name))
+		} else {
+			field = fmt.Sprintf("%s->%s", field, q.Arg(name))
+		}
+	}
+
+	if p.Op == "prefix" {
+		// Escape the prefix's own wildcards, so that they're matched literally.
+		pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(p.Value.(string)) + "%"
+		return fmt.Sprintf("%s like %s", field, q.Arg(pattern))
+	}
+
+	switch p.kind {
+	case kindNumber, kindInteger, kindDecimal:
+		field = fmt.Sprintf("(%s)::numeric", field)
+	case kindTimestamp:
+		field = fmt.Sprintf("(%s)::timestamptz", field)
+	case kindBoolean:
+		field = fmt.Sprintf("(%s)::boolean", field)
+	}
+
+	types := make([]string, len(p.types))
+	for i, t := range p.types {
+		types[i] = q.Arg(t)
+	}
+
+	guarded := fmt.Sprintf("case when payload->>%s in (%s) then %s end", q.Arg(p.tag), strings.Join(types, ", "), field)
+	return fmt.Sprintf("%s %s %s", guarded, comparisons[p.Op], q.Arg(p.Value))
+}
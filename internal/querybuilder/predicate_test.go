@@ -0,0 +1,177 @@
+package querybuilder
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+	"github.com/jddf/jddf-go"
+)
+
+const testSchema = `{
+	"discriminator": {
+		"tag": "type",
+		"mapping": {
+			"Order Completed": {
+				"properties": {
+					"userId": { "type": "string" },
+					"revenue": { "metadata": { "format": "decimal" }, "type": "string" },
+					"items": { "type": "uint32" }
+				}
+			},
+			"Page Viewed": {
+				"properties": {
+					"userId": { "type": "string" },
+					"url": { "type": "string" },
+					"items": { "type": "float64" }
+				},
+				"optionalProperties": {
+					"context": {
+						"properties": {
+							"os": { "enum": ["android", "ios"] },
+							"beta": { "type": "boolean" }
+						}
+					}
+				}
+			},
+			"Heartbeat": {
+				"properties": {
+					"userId": { "type": "string" },
+					"url": { "type": "float64" }
+				}
+			}
+		}
+	}
+}`
+
+func parseTestSchema(t *testing.T) (jddf.Schema, schemameta.Schema) {
+	t.Helper()
+
+	var schema jddf.Schema
+	if err := json.Unmarshal([]byte(testSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := schemameta.Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return schema, meta
+}
+
+func TestParsePredicate(t *testing.T) {
+	schema, meta := parseTestSchema(t)
+
+	tests := []struct {
+		eventType string
+		expr      string
+		value     interface{}
+		types     []string
+		err       bool
+	}{
+		{expr: "userId:eq:alice", value: "alice", types: []string{"Heartbeat", "Order Completed", "Page Viewed"}},
+		{expr: "userId:prefix:a", value: "a", types: []string{"Heartbeat", "Order Completed", "Page Viewed"}},
+		{expr: "revenue:gte:10", value: "10", types: []string{"Order Completed"}},
+		{expr: "revenue:lt:9.99", value: "9.99", types: []string{"Order Completed"}},
+		{expr: "context.os:eq:ios", value: "ios", types: []string{"Page Viewed"}},
+		{expr: "context.beta:ne:true", value: true, types: []string{"Page Viewed"}},
+		{eventType: "Order Completed", expr: "items:gt:2", value: float64(2), types: []string{"Order Completed"}},
+		{eventType: "Page Viewed", expr: "items:gt:2.5", value: 2.5, types: []string{"Page Viewed"}},
+		{eventType: "Heartbeat", expr: "url:lte:1", value: float64(1), types: []string{"Heartbeat"}},
+
+		{expr: "userId", err: true},
+		{expr: ":eq:alice", err: true},
+		{expr: "nope:eq:1", err: true},
+		{expr: "url:eq:/", err: true},
+		{expr: "userId:gt:a", err: true},
+		{expr: "revenue:prefix:1", err: true},
+		{expr: "revenue:gte:1e3", err: true},
+		{expr: "revenue:gte:ten", err: true},
+		{expr: "context.os:eq:windows", err: true},
+		{expr: "context:eq:ios", err: true},
+		{eventType: "Order Completed", expr: "items:gt:2.5", err: true},
+		{eventType: "Order Completed", expr: "url:eq:/", err: true},
+		{eventType: "Signed Up", expr: "userId:eq:alice", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.eventType+" "+tt.expr, func(t *testing.T) {
+			p, err := ParsePredicate(schema, meta, tt.eventType, tt.expr)
+			if tt.err {
+				if err == nil {
+					t.Errorf("ParsePredicate() = %+v, want an error", p)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p.Value != tt.value {
+				t.Errorf("Value = %#v, want %#v", p.Value, tt.value)
+			}
+
+			if !reflect.DeepEqual(p.types, tt.types) {
+				t.Errorf("types = %v, want %v", p.types, tt.types)
+			}
+		})
+	}
+}
+
+func TestPredicateSQL(t *testing.T) {
+	schema, meta := parseTestSchema(t)
+
+	tests := []struct {
+		expr string
+		sql  string
+		args []interface{}
+	}{
+		{
+			expr: "userId:eq:alice",
+			sql:  "payload @> $1::jsonb",
+			args: []interface{}{`{"userId":"alice"}`},
+		},
+		{
+			expr: "context.os:eq:ios",
+			sql:  "payload @> $1::jsonb",
+			args: []interface{}{`{"context":{"os":"ios"}}`},
+		},
+		{
+			expr: "userId:prefix:50%_off",
+			sql:  "payload->>$1 like $2",
+			args: []interface{}{"userId", `50\%\_off%`},
+		},
+		{
+			expr: "revenue:eq:10",
+			sql:  "case when payload->>$3 in ($2) then (payload->>$1)::numeric end = $4",
+			args: []interface{}{"revenue", "Order Completed", "type", "10"},
+		},
+		{
+			expr: "context.beta:ne:false",
+			sql:  "case when payload->>$4 in ($3) then (payload->$1->>$2)::boolean end <> $5",
+			args: []interface{}{"context", "beta", "Page Viewed", "type", false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			p, err := ParsePredicate(schema, meta, "", tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var q Query
+			if sql := q.predicate(p); sql != tt.sql {
+				t.Errorf("predicate() = %q, want %q", sql, tt.sql)
+			}
+
+			if !reflect.DeepEqual(q.Args(), tt.args) {
+				t.Errorf("Args() = %#v, want %#v", q.Args(), tt.args)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Package querybuilder builds parameterized SQL over the events table.
+//
+// Events are stored as jsonb, so even simple filters turn into expressions
+// like (payload->>'timestamp')::timestamptz. Rather than copy-pasting those into
+// every endpoint, endpoints describe what they want with a Filter, and splice
+// the SQL it produces into their queries.
+package querybuilder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/limits"
+)
+
+// Expressions for the fields every event has. They're safe to use anywhere in
+// a query over the events table.
+//
+// Because every event was validated against event.jddf.json before being
+// inserted, we know "timestamp" is always an RFC3339 string. That's what makes
+// it safe to cast it to a timestamptz.
+const (
+	Type      = "payload->>'type'"
+	UserID    = "payload->>'userId'"
+	Timestamp = "(payload->>'timestamp')::timestamptz"
+)
+
+// Filter describes a subset of the events table. Zero-valued fields don't
+// filter anything.
+type Filter struct {
+	// Type, if set, matches only events of that type.
+	Type string
+
+	// UserID, if set, matches only events from that user.
+	UserID string
+
+	// UserPrefix, if set, matches only events from users whose ID starts with
+	// it.
+	UserPrefix string
+
+	// From and To, if set, match only events whose timestamp is at or after
+	// From, and before To.
+	//
+	// From also bounds received_at, since no event is stored more than
+	// limits.MaxFuture before its timestamp. That lets Postgres skip older
+	// rows by the events_received_at index, or older partitions, if events are
+	// partitioned by received_at. There's no such bound from To: events can
+	// arrive any time after their timestamp.
+	From time.Time
+	To   time.Time
+
+	// ReceivedFrom and ReceivedTo are like From and To, but apply to when the
+	// server received the event, rather than the event's own timestamp.
+	ReceivedFrom time.Time
+	ReceivedTo   time.Time
+
+	// Properties matches only events whose properties have the given values,
+	// compared as text.
+	Properties map[string]string
+
+	// Traits matches only events from users whose traits, in the users table,
+	// have the given values, compared as text. Events from users who aren't in
+	// the table don't match.
+	Traits map[string]string
+
+	// Predicates matches only events that satisfy every one of them.
+	Predicates []Predicate
+}
+
+// Empty is true if the filter would match every event.
+func (f Filter) Empty() bool {
+	return f.Type == "" && f.UserID == "" && f.UserPrefix == "" &&
+		f.From.IsZero() && f.To.IsZero() &&
+		f.ReceivedFrom.IsZero() && f.ReceivedTo.IsZero() &&
+		len(f.Properties) == 0 && len(f.Traits) == 0 && len(f.Predicates) == 0
+}
+
+// Query accumulates the arguments of a parameterized SQL statement. The zero
+// value is an empty query, ready to use.
+type Query struct {
+	args []interface{}
+}
+
+// Arg adds an argument to the query, and returns the placeholder (like "$3")
+// to refer to it with.
+func (q *Query) Arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// Args returns the query's arguments, to pass along with its SQL.
+func (q *Query) Args() []interface{} {
+	return q.args
+}
+
+// Where adds f's arguments to the query, and returns a SQL boolean expression
+// matching the events f describes.
+func (q *Query) Where(f Filter) string {
+	conds := []string{"true"}
+
+	if f.Type != "" {
+		conds = append(conds, fmt.Sprintf("%s = %s", Type, q.Arg(f.Type)))
+	}
+
+	if f.UserID != "" {
+		conds = append(conds, fmt.Sprintf("%s = %s", UserID, q.Arg(f.UserID)))
+	}
+
+	if f.UserPrefix != "" {
+		// We use left() instead of "like" so that a "%" or "_" in the prefix is
+		// matched literally.
+		prefix := q.Arg(f.UserPrefix)
+		conds = append(conds, fmt.Sprintf("left(%s, length(%s)) = %s", UserID, prefix, prefix))
+	}
+
+	if !f.From.IsZero() {
+		conds = append(conds, fmt.Sprintf("%s >= %s", Timestamp, q.Arg(f.From)))
+		conds = append(conds, fmt.Sprintf("received_at >= %s", q.Arg(f.From.Add(-limits.MaxFuture))))
+	}
+
+	if !f.To.IsZero() {
+		conds = append(conds, fmt.Sprintf("%s < %s", Timestamp, q.Arg(f.To)))
+	}
+
+	if !f.ReceivedFrom.IsZero() {
+		conds = append(conds, fmt.Sprintf("received_at >= %s", q.Arg(f.ReceivedFrom)))
+	}
+
+	if !f.ReceivedTo.IsZero() {
+		conds = append(conds, fmt.Sprintf("received_at < %s", q.Arg(f.ReceivedTo)))
+	}
+
+	// Sort the properties, so the same filter always produces the same SQL.
+	names := make([]string, 0, len(f.Properties))
+	for name := range f.Properties {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		conds = append(conds, fmt.Sprintf("payload->>%s = %s", q.Arg(name), q.Arg(f.Properties[name])))
+	}
+
+	// Traits are a semi-join against users, so an event matches at most once
+	// however many traits there are.
+	if len(f.Traits) != 0 {
+		names := make([]string, 0, len(f.Traits))
+		for name := range f.Traits {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		traitConds := make([]string, len(names))
+		for i, name := range names {
+			traitConds[i] = fmt.Sprintf("traits->>%s = %s", q.Arg(name), q.Arg(f.Traits[name]))
+		}
+
+		conds = append(conds, fmt.Sprintf("%s in (select user_id from users where %s)", UserID, strings.Join(traitConds, " and ")))
+	}
+
+	for _, p := range f.Predicates {
+		conds = append(conds, q.predicate(p))
+	}
+
+	return strings.Join(conds, " and ")
+}
@@ -0,0 +1,153 @@
+package querybuilder
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/limits"
+)
+
+func TestWhereReceivedAtBounds(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		bounds []string
+		args   []time.Time
+	}{
+		{name: "none", filter: Filter{Type: "Heartbeat"}},
+		{name: "to only", filter: Filter{To: to}},
+		{
+			name:   "from",
+			filter: Filter{From: from},
+			bounds: []string{"received_at >= $2"},
+			args:   []time.Time{from.Add(-limits.MaxFuture)},
+		},
+		{
+			name:   "from and to",
+			filter: Filter{Type: "Heartbeat", From: from, To: to},
+			bounds: []string{"received_at >= $3"},
+			args:   []time.Time{from.Add(-limits.MaxFuture)},
+		},
+		{
+			name:   "received",
+			filter: Filter{ReceivedFrom: from, ReceivedTo: to},
+			bounds: []string{"received_at >= $1", "received_at < $2"},
+			args:   []time.Time{from, to},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q Query
+			sql := q.Where(tt.filter)
+
+			if n := strings.Count(sql, "received_at"); n != len(tt.bounds) {
+				t.Errorf("%q has %d received_at bounds, want %d", sql, n, len(tt.bounds))
+			}
+
+			for i, bound := range tt.bounds {
+				if !strings.Contains(sql, bound) {
+					t.Errorf("%q doesn't contain %q", sql, bound)
+					continue
+				}
+
+				n, _ := strconv.Atoi(bound[strings.Index(bound, "$")+1:])
+				if arg := q.Args()[n-1]; arg != tt.args[i] {
+					t.Errorf("%s is %v, want %v", bound, arg, tt.args[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWhere(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		sql    string
+		args   []interface{}
+	}{
+		{
+			name: "empty",
+			sql:  "true",
+		},
+		{
+			name:   "type and user",
+			filter: Filter{Type: "Heartbeat", UserID: "alice"},
+			sql:    "true and payload->>'type' = $1 and payload->>'userId' = $2",
+			args:   []interface{}{"Heartbeat", "alice"},
+		},
+		{
+			name:   "user prefix",
+			filter: Filter{UserPrefix: "test_%"},
+			sql:    "true and left(payload->>'userId', length($1)) = $1",
+			args:   []interface{}{"test_%"},
+		},
+		{
+			name:   "time range",
+			filter: Filter{From: from, To: from.Add(time.Hour)},
+			sql:    "true and (payload->>'timestamp')::timestamptz >= $1 and received_at >= $2 and (payload->>'timestamp')::timestamptz < $3",
+			args:   []interface{}{from, from.Add(-limits.MaxFuture), from.Add(time.Hour)},
+		},
+		{
+			name:   "properties sorted",
+			filter: Filter{Properties: map[string]string{"url": "/", "platform": "ios"}},
+			sql:    "true and payload->>$1 = $2 and payload->>$3 = $4",
+			args:   []interface{}{"platform", "ios", "url", "/"},
+		},
+		{
+			name:   "traits",
+			filter: Filter{Traits: map[string]string{"plan": "pro", "country": "NZ"}},
+			sql:    "true and payload->>'userId' in (select user_id from users where traits->>$1 = $2 and traits->>$3 = $4)",
+			args:   []interface{}{"country", "NZ", "plan", "pro"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q Query
+			if sql := q.Where(tt.filter); sql != tt.sql {
+				t.Errorf("Where() = %q, want %q", sql, tt.sql)
+			}
+
+			if !reflect.DeepEqual(q.Args(), tt.args) {
+				t.Errorf("Args() = %v, want %v", q.Args(), tt.args)
+			}
+
+			if empty := tt.filter.Empty(); empty != (tt.sql == "true") {
+				t.Errorf("Empty() = %v", empty)
+			}
+		})
+	}
+}
+
+func TestQueryArg(t *testing.T) {
+	var q Query
+	if p := q.Arg("a"); p != "$1" {
+		t.Errorf("first Arg() = %q", p)
+	}
+
+	if p := q.Arg(2); p != "$2" {
+		t.Errorf("second Arg() = %q", p)
+	}
+
+	if args := q.Args(); !reflect.DeepEqual(args, []interface{}{"a", 2}) {
+		t.Errorf("Args() = %v", args)
+	}
+}
+
+func BenchmarkWhere(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var q Query
+		q.Where(Filter{Type: "Order Completed", UserID: "user-1"})
+	}
+}
@@ -0,0 +1,108 @@
+// Package ratelimit limits how often each of many clients may do something,
+// with a token bucket per client.
+//
+// Each client's bucket holds up to Burst tokens, and refills at Rate tokens a
+// second. Every request takes a token, and requests that find the bucket empty
+// are turned away until it refills. That lets a client send a burst now and
+// then, while holding it to Rate over time.
+//
+// Buckets are kept in memory, so each instance limits clients separately: with
+// N instances behind a load balancer, a client gets up to N times the limit.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+)
+
+// sweepInterval is how often buckets that have refilled are forgotten, so that
+// clients that come and go don't pile up.
+const sweepInterval = time.Minute
+
+// Limiter is a token bucket for each client. It's safe for concurrent use.
+type Limiter struct {
+	// Rate is how many requests a second each client may make over time, and
+	// Burst how many it may make at once.
+	Rate  float64
+	Burst int
+
+	// Clock decides how much buckets have refilled. If nil, it's the system
+	// clock.
+	Clock clock.Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucket is a client's tokens, as of updated.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// New returns a limiter allowing each client rate requests a second, and burst
+// at once.
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{Rate: rate, Burst: burst, buckets: map[string]*bucket{}}
+}
+
+// Allow takes a token from key's bucket, and returns true if there was one.
+// Otherwise, it returns false, and how long until there will be.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	now := clock.Or(l.Clock).Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), updated: now}
+		l.buckets[key] = b
+	}
+
+	b.refill(now, l.Rate, l.Burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / l.Rate
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// Clients returns how many clients the limiter is keeping buckets for.
+func (l *Limiter) Clients() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.buckets)
+}
+
+// sweep forgets buckets that are full again, since a client with a full
+// bucket is no different from one that's never been seen.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now, l.Rate, l.Burst)
+		if b.tokens >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst int) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+	}
+
+	b.updated = now
+}
@@ -0,0 +1,272 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/spool"
+)
+
+// ErrQueueFull is what Enqueue fails with when a sink has fallen so far behind
+// that its queue is full. The event isn't taken, so the client should retry.
+var ErrQueueFull = errors.New("routing: sink's queue is full")
+
+// DeliveryOptions tune how a Delivery batches and retries. Zero values get the
+// defaults.
+type DeliveryOptions struct {
+	// QueueSize is how many events may wait to be delivered. Default 10000.
+	QueueSize int
+
+	// BatchSize is the most events handed to the sink at once. Default 100.
+	BatchSize int
+
+	// Linger is how long a batch waits to fill up before it's delivered
+	// anyway. Default 100ms.
+	Linger time.Duration
+
+	// MaxAttempts is how many times a batch is tried before it's given up on,
+	// and dead-lettered. Default 5.
+	MaxAttempts int
+
+	// Backoff is how long to wait before the first retry. It doubles after
+	// every retry, up to a minute. Default 1s.
+	Backoff time.Duration
+}
+
+func (o *DeliveryOptions) setDefaults() {
+	if o.QueueSize <= 0 {
+		o.QueueSize = 10000
+	}
+
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+
+	if o.Linger <= 0 {
+		o.Linger = 100 * time.Millisecond
+	}
+
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+
+	if o.Backoff <= 0 {
+		o.Backoff = time.Second
+	}
+}
+
+// Delivery delivers events to a sink in the background: it queues them,
+// batches them up, retries batches that fail, and hands batches that keep
+// failing to a dead-letter sink. Every sink outside the server goes through
+// one, so they all get the same guarantees without looping on their own.
+//
+// Delivery is at least once. A batch that fails is retried whole, so a sink
+// that stored part of it sees that part again. With a spool, events are on
+// disk from when they're queued until they're delivered or dead-lettered, so
+// they survive a restart too, and are redelivered by Start. Without one, the
+// queue is only in memory.
+type Delivery struct {
+	// The counters come first, so that they're 64-bit aligned for sync/atomic.
+	delivered    int64
+	failed       int64
+	retries      int64
+	deadLettered int64
+	dropped      int64
+
+	name       string
+	sink       Sink
+	deadLetter Sink
+	opts       DeliveryOptions
+	queue      chan queuedEvent
+	spool      *spool.Spool
+	onError    func(error)
+}
+
+// queuedEvent is an event waiting to be delivered, and the spool segment it's
+// in, if there's a spool.
+type queuedEvent struct {
+	event   Event
+	segment uint64
+}
+
+// NewDelivery returns a Delivery to sink, named name in errors and metrics.
+// Batches that are given up on go to deadLetter, which may be nil to drop
+// them. Nothing is delivered until Start.
+func NewDelivery(name string, sink, deadLetter Sink, opts DeliveryOptions) *Delivery {
+	opts.setDefaults()
+	return &Delivery{
+		name:       name,
+		sink:       sink,
+		deadLetter: deadLetter,
+		opts:       opts,
+		queue:      make(chan queuedEvent, opts.QueueSize),
+		onError:    func(error) {},
+	}
+}
+
+// Enqueue queues an event for delivery. It doesn't wait, and fails with
+// ErrQueueFull if there's no room.
+func (d *Delivery) Enqueue(event Event) error {
+	return d.enqueue(event, false)
+}
+
+func (d *Delivery) enqueue(event Event, wait bool) error {
+	q := queuedEvent{event: event}
+	if d.spool != nil {
+		// Check for room first. An event that's spooled and then doesn't fit is
+		// marked done, but its segment may still be replayed after a crash,
+		// delivering an event the client was told wasn't taken.
+		if !wait && len(d.queue) == cap(d.queue) {
+			return ErrQueueFull
+		}
+
+		segment, err := d.spool.Append(event)
+		if err != nil {
+			return err
+		}
+
+		q.segment = segment
+	}
+
+	if wait {
+		d.queue <- q
+		return nil
+	}
+
+	select {
+	case d.queue <- q:
+		return nil
+	default:
+		if d.spool != nil {
+			d.spool.Done(q.segment)
+		}
+
+		return ErrQueueFull
+	}
+}
+
+// Start starts delivering events until ctx is done. If spoolDir isn't empty,
+// events are spooled there, and events left there by a previous process are
+// delivered first. Errors delivering events are passed to onError; they're
+// retried, so they're only worth logging.
+func (d *Delivery) Start(ctx context.Context, spoolDir string, onError func(error)) error {
+	d.onError = onError
+	if spoolDir != "" {
+		var err error
+		if d.spool, err = spool.Open(spoolDir, spool.DefaultSegmentSize); err != nil {
+			return err
+		}
+	}
+
+	go d.run(ctx)
+
+	if d.spool == nil {
+		return nil
+	}
+
+	// Requeueing spools the events again, in new segments, before the old ones
+	// are removed.
+	_, err := d.spool.Replay(func(buf []byte) error {
+		return d.enqueue(Event(buf), true)
+	})
+
+	return err
+}
+
+// run delivers batches from the queue until ctx is done.
+func (d *Delivery) run(ctx context.Context) {
+	for {
+		var batch []queuedEvent
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-d.queue:
+			batch = append(batch, q)
+		}
+
+		linger := time.NewTimer(d.opts.Linger)
+	fill:
+		for len(batch) < d.opts.BatchSize {
+			select {
+			case q := <-d.queue:
+				batch = append(batch, q)
+			case <-linger.C:
+				break fill
+			}
+		}
+
+		linger.Stop()
+		d.deliver(ctx, batch)
+	}
+}
+
+// deliver delivers a batch, retrying it with backoff, and dead-letters it if
+// it still fails.
+func (d *Delivery) deliver(ctx context.Context, batch []queuedEvent) {
+	events := make([]Event, len(batch))
+	for i, q := range batch {
+		events[i] = q.event
+	}
+
+	backoff := d.opts.Backoff
+	var err error
+	for attempt := 1; attempt <= d.opts.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			atomic.AddInt64(&d.retries, 1)
+			select {
+			case <-ctx.Done():
+				// The batch stays in the spool, if there is one, for next time.
+				return
+			case <-time.After(backoff):
+			}
+
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+		}
+
+		if err = d.deliverOnce(ctx, d.sink, events); err == nil {
+			atomic.AddInt64(&d.delivered, int64(len(events)))
+			d.done(batch)
+			return
+		}
+
+		atomic.AddInt64(&d.failed, 1)
+		d.onError(fmt.Errorf("routing: delivering %d events to %s, attempt %d of %d: %s", len(events), d.name, attempt, d.opts.MaxAttempts, err))
+	}
+
+	if d.deadLetter != nil {
+		if err = d.deliverOnce(ctx, d.deadLetter, events); err == nil {
+			atomic.AddInt64(&d.deadLettered, int64(len(events)))
+			d.done(batch)
+			return
+		}
+
+		d.onError(fmt.Errorf("routing: dead-lettering %d events from %s: %s", len(events), d.name, err))
+	}
+
+	atomic.AddInt64(&d.dropped, int64(len(events)))
+	d.onError(fmt.Errorf("routing: gave up on %d events for %s", len(events), d.name))
+	d.done(batch)
+}
+
+func (d *Delivery) deliverOnce(ctx context.Context, sink Sink, events []Event) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	return sink.Deliver(ctx, events)
+}
+
+// done takes a batch out of the spool.
+func (d *Delivery) done(batch []queuedEvent) {
+	if d.spool == nil {
+		return
+	}
+
+	for _, q := range batch {
+		d.spool.Done(q.segment)
+	}
+}
@@ -0,0 +1,500 @@
+// Package routing decides where each type of event is stored.
+//
+// By default, every event goes to the server's own Postgres database. A routes
+// file can instead send some types of events elsewhere, or to several places:
+// orders to Postgres and to a finance topic in Kafka, say, and heartbeats only
+// to ClickHouse, where they're cheaper to keep.
+//
+// Postgres is written to as the event's ingested, so that the client hears
+// whether it was stored. Every other sink is delivered to in the background,
+// through a Delivery, which batches and retries.
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/snowflake"
+)
+
+// Postgres is the name of the server's own database, as a sink. It's always
+// available, and needn't be configured.
+const Postgres = "postgres"
+
+// sendTimeout is how long a sink outside the server may take to accept a
+// batch of events.
+const sendTimeout = 10 * time.Second
+
+// Event is an event on its way to a sink: already validated, in its JSON
+// encoding.
+type Event []byte
+
+// Sink is somewhere events can be stored.
+type Sink interface {
+	// Deliver stores a batch of events. If it fails, the whole batch may be
+	// delivered again, so sinks should cope with seeing an event twice.
+	Deliver(ctx context.Context, events []Event) error
+}
+
+// SinkFunc is a function that's a Sink.
+type SinkFunc func(ctx context.Context, events []Event) error
+
+// Deliver implements Sink.
+func (f SinkFunc) Deliver(ctx context.Context, events []Event) error {
+	return f(ctx, events)
+}
+
+// HTTP is a sink that POSTs each event, as JSON, to a URL. With a URL like
+// http://clickhouse:8123/?query=INSERT+INTO+events+FORMAT+JSONEachRow, it
+// writes to ClickHouse.
+type HTTP struct {
+	URL     string
+	Headers map[string]string
+}
+
+// Deliver implements Sink. Events are posted one at a time, in order, since
+// not every endpoint takes more than one event per request.
+func (h *HTTP) Deliver(ctx context.Context, events []Event) error {
+	for _, event := range events {
+		if err := post(ctx, h.URL, "application/json", h.Headers, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// KafkaREST is a sink that produces each event to a Kafka topic, through a
+// Kafka REST Proxy at URL.
+type KafkaREST struct {
+	URL     string
+	Topic   string
+	Headers map[string]string
+}
+
+// Deliver implements Sink. The batch is produced in one request.
+func (k *KafkaREST) Deliver(ctx context.Context, events []Event) error {
+	records := make([]map[string]json.RawMessage, len(events))
+	for i, event := range events {
+		records[i] = map[string]json.RawMessage{"value": json.RawMessage(event)}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(k.URL, "/") + "/topics/" + k.Topic
+	return post(ctx, url, "application/vnd.kafka.json.v2+json", k.Headers, body)
+}
+
+// Snowflake is a sink that inserts events into a table in Snowflake. Each
+// batch is inserted by one statement.
+type Snowflake struct {
+	Client *snowflake.Client
+	Table  string
+}
+
+// Deliver implements Sink.
+func (s *Snowflake) Deliver(ctx context.Context, events []Event) error {
+	rows := make([][]byte, len(events))
+	for i, event := range events {
+		rows[i] = event
+	}
+
+	return s.Client.Insert(ctx, s.Table, rows)
+}
+
+func post(ctx context.Context, url, contentType string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("routing: %s responded %s", req.URL.Host, res.Status)
+	}
+
+	return nil
+}
+
+// Config is the format of a routes file.
+type Config struct {
+	// Sinks are the places events can be sent, besides Postgres, keyed by name.
+	Sinks map[string]SinkConfig `json:"sinks"`
+
+	// Routes are tried in order. The first whose types include an event's type
+	// decides where it goes. Events no route matches go to Postgres.
+	Routes []RouteConfig `json:"routes"`
+}
+
+// SinkConfig describes a sink.
+type SinkConfig struct {
+	// Kind is "http", "kafka-rest", or "snowflake".
+	Kind    string            `json:"kind"`
+	URL     string            `json:"url"`
+	Topic   string            `json:"topic"`
+	Headers map[string]string `json:"headers"`
+
+	// These configure "snowflake" sinks; see snowflake.Client. PrivateKey is
+	// the path to the user's key, and Table the table to insert into.
+	Account    string `json:"account"`
+	User       string `json:"user"`
+	PrivateKey string `json:"privateKey"`
+	Database   string `json:"database"`
+	Schema     string `json:"schema"`
+	Warehouse  string `json:"warehouse"`
+	Role       string `json:"role"`
+	Table      string `json:"table"`
+
+	// These tune the sink's Delivery; see DeliveryOptions. Linger and Backoff
+	// are durations, like "250ms".
+	QueueSize   int    `json:"queueSize"`
+	BatchSize   int    `json:"batchSize"`
+	Linger      string `json:"linger"`
+	MaxAttempts int    `json:"maxAttempts"`
+	Backoff     string `json:"backoff"`
+
+	// DeadLetter is the name of another sink to send batches to once
+	// MaxAttempts is up. Without one, they're dropped.
+	DeadLetter string `json:"deadLetter"`
+}
+
+// RouteConfig describes a route.
+type RouteConfig struct {
+	Name string `json:"name"`
+
+	// Types are the event types the route is for. "*" matches every type.
+	Types []string `json:"types"`
+
+	// Sinks are the names of the sinks events are sent to, in order.
+	Sinks []string `json:"sinks"`
+}
+
+// Router picks the route for each event.
+type Router struct {
+	routes     []*Route
+	fallback   *Route
+	deliveries map[string]*Delivery
+}
+
+// Route is where one set of event types is sent.
+type Route struct {
+	Name  string
+	types map[string]bool
+	sinks []*routeSink
+}
+
+// routeSink is one of a route's sinks, and how it's been doing.
+type routeSink struct {
+	// The counters come first, so that they're 64-bit aligned for sync/atomic.
+	// For sinks other than Postgres, delivered counts events queued, and
+	// failed those that didn't fit in the queue; the Delivery counts the rest.
+	delivered int64
+	failed    int64
+
+	name     string
+	delivery *Delivery
+}
+
+// Metrics are how one sink of one route has been doing.
+type Metrics struct {
+	Route string `json:"route"`
+	Sink  string `json:"sink"`
+
+	// Delivered and Failed are how many events the route sent to the sink, or
+	// queued for it, and how many it couldn't.
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"`
+}
+
+// DeliveryMetrics are how a sink's Delivery has been doing, across every
+// route that sends to it.
+type DeliveryMetrics struct {
+	Sink string `json:"sink"`
+
+	// Queued is how many events are waiting to be delivered now.
+	Queued int `json:"queued"`
+
+	// Delivered is how many events the sink has taken. FailedAttempts is how
+	// many times a batch failed, and Retries how many times one was tried
+	// again.
+	Delivered      int64 `json:"delivered"`
+	FailedAttempts int64 `json:"failedAttempts"`
+	Retries        int64 `json:"retries"`
+
+	// DeadLettered and Dropped are how many events were given up on, and sent
+	// to the dead-letter sink, or dropped for lack of one.
+	DeadLettered int64 `json:"deadLettered"`
+	Dropped      int64 `json:"dropped"`
+}
+
+// Load reads a routes file. It returns a Router that sends every event to
+// Postgres, and no error, if the file doesn't exist.
+func Load(path string) (*Router, error) {
+	router := &Router{fallback: newRoute("default", nil, []string{Postgres}, nil), deliveries: map[string]*Delivery{}}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return router, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var config Config
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, fmt.Errorf("routing: %s: %s", path, err)
+	}
+
+	sinks := map[string]Sink{}
+	for name, sink := range config.Sinks {
+		if name == Postgres {
+			return nil, fmt.Errorf("routing: %s: the %q sink is built in, and can't be configured", path, name)
+		}
+
+		switch sink.Kind {
+		case "http":
+			sinks[name] = &HTTP{URL: sink.URL, Headers: sink.Headers}
+		case "kafka-rest":
+			if sink.Topic == "" {
+				return nil, fmt.Errorf("routing: %s: sink %q has no topic", path, name)
+			}
+
+			sinks[name] = &KafkaREST{URL: sink.URL, Topic: sink.Topic, Headers: sink.Headers}
+		case "snowflake":
+			if sink.Account == "" || sink.User == "" || sink.PrivateKey == "" {
+				return nil, fmt.Errorf("routing: %s: sink %q needs an account, user, and privateKey", path, name)
+			}
+
+			key, err := snowflake.LoadKey(sink.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("routing: %s: sink %q: %s", path, name, err)
+			}
+
+			table := sink.Table
+			if table == "" {
+				table = "EVENTS"
+			}
+
+			sinks[name] = &Snowflake{Table: table, Client: &snowflake.Client{
+				Account:   sink.Account,
+				User:      sink.User,
+				Key:       key,
+				URL:       sink.URL,
+				Database:  sink.Database,
+				Schema:    sink.Schema,
+				Warehouse: sink.Warehouse,
+				Role:      sink.Role,
+			}}
+		default:
+			return nil, fmt.Errorf("routing: %s: sink %q has unknown kind %q", path, name, sink.Kind)
+		}
+	}
+
+	// Every sink gets a Delivery, once they're all known, so that any of them
+	// can be another's dead-letter sink.
+	for name, sink := range config.Sinks {
+		opts := DeliveryOptions{QueueSize: sink.QueueSize, BatchSize: sink.BatchSize, MaxAttempts: sink.MaxAttempts}
+		for _, d := range []struct {
+			value string
+			dst   *time.Duration
+		}{{sink.Linger, &opts.Linger}, {sink.Backoff, &opts.Backoff}} {
+			if d.value == "" {
+				continue
+			}
+
+			if *d.dst, err = time.ParseDuration(d.value); err != nil {
+				return nil, fmt.Errorf("routing: %s: sink %q: %s", path, name, err)
+			}
+		}
+
+		var deadLetter Sink
+		if sink.DeadLetter != "" {
+			if deadLetter = sinks[sink.DeadLetter]; deadLetter == nil || sink.DeadLetter == name {
+				return nil, fmt.Errorf("routing: %s: sink %q dead-letters to unknown sink %q", path, name, sink.DeadLetter)
+			}
+		}
+
+		router.deliveries[name] = NewDelivery(name, sinks[name], deadLetter, opts)
+	}
+
+	for i, config := range config.Routes {
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("route %d", i)
+		}
+
+		if len(config.Sinks) == 0 {
+			return nil, fmt.Errorf("routing: %s: %s has no sinks", path, config.Name)
+		}
+
+		for _, name := range config.Sinks {
+			if _, ok := sinks[name]; !ok && name != Postgres {
+				return nil, fmt.Errorf("routing: %s: %s sends to unknown sink %q", path, config.Name, name)
+			}
+		}
+
+		router.routes = append(router.routes, newRoute(config.Name, config.Types, config.Sinks, router.deliveries))
+	}
+
+	return router, nil
+}
+
+func newRoute(name string, types, sinkNames []string, deliveries map[string]*Delivery) *Route {
+	route := &Route{Name: name, types: map[string]bool{}}
+	for _, t := range types {
+		route.types[t] = true
+	}
+
+	for _, sinkName := range sinkNames {
+		route.sinks = append(route.sinks, &routeSink{name: sinkName, delivery: deliveries[sinkName]})
+	}
+
+	return route
+}
+
+// Start starts delivering to every sink besides Postgres, until ctx is done.
+// If spoolDir isn't empty, each sink's queue is spooled in a directory of its
+// own under it, and whatever a previous process left there is redelivered.
+func (r *Router) Start(ctx context.Context, spoolDir string, onError func(error)) error {
+	for name, d := range r.deliveries {
+		dir := ""
+		if spoolDir != "" {
+			dir = filepath.Join(spoolDir, name)
+		}
+
+		if err := d.Start(ctx, dir, onError); err != nil {
+			return fmt.Errorf("routing: starting delivery to %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// WrapSinks replaces every sink besides Postgres with what wrap returns for
+// it, given its name. Dead-letter sinks are left as they are. It must be
+// called before Start.
+func (r *Router) WrapSinks(wrap func(name string, sink Sink) Sink) {
+	for name, d := range r.deliveries {
+		d.sink = wrap(name, d.sink)
+	}
+}
+
+// Route returns the route for events of the given type.
+func (r *Router) Route(eventType string) *Route {
+	for _, route := range r.routes {
+		if route.types[eventType] || route.types["*"] {
+			return route
+		}
+	}
+
+	return r.fallback
+}
+
+// Metrics returns how each sink of each route has been doing, with the default
+// route last.
+func (r *Router) Metrics() []Metrics {
+	var metrics []Metrics
+	for _, route := range append(r.routes, r.fallback) {
+		for _, s := range route.sinks {
+			metrics = append(metrics, Metrics{
+				Route:     route.Name,
+				Sink:      s.name,
+				Delivered: atomic.LoadInt64(&s.delivered),
+				Failed:    atomic.LoadInt64(&s.failed),
+			})
+		}
+	}
+
+	return metrics
+}
+
+// DeliveryMetrics returns how each sink's Delivery has been doing, ordered by
+// sink name.
+func (r *Router) DeliveryMetrics() []DeliveryMetrics {
+	var names []string
+	for name := range r.deliveries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	metrics := []DeliveryMetrics{}
+	for _, name := range names {
+		d := r.deliveries[name]
+		metrics = append(metrics, DeliveryMetrics{
+			Sink:           name,
+			Queued:         len(d.queue),
+			Delivered:      atomic.LoadInt64(&d.delivered),
+			FailedAttempts: atomic.LoadInt64(&d.failed),
+			Retries:        atomic.LoadInt64(&d.retries),
+			DeadLettered:   atomic.LoadInt64(&d.deadLettered),
+			Dropped:        atomic.LoadInt64(&d.dropped),
+		})
+	}
+
+	return metrics
+}
+
+// Stores returns whether the route sends events to Postgres.
+func (r *Route) Stores() bool {
+	for _, s := range r.sinks {
+		if s.name == Postgres {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Send sends an event to each of the route's sinks in turn. It's delivered to
+// postgres, for the Postgres sink, right away, and queued for the others. It
+// stops at the first sink that fails, so that listing the most important sink
+// first keeps the others from getting events it doesn't have.
+func (r *Route) Send(ctx context.Context, buf []byte, postgres Sink) error {
+	for _, s := range r.sinks {
+		var err error
+		if s.name == Postgres {
+			err = postgres.Deliver(ctx, []Event{buf})
+		} else {
+			err = s.delivery.Enqueue(buf)
+		}
+
+		if err != nil {
+			atomic.AddInt64(&s.failed, 1)
+			return fmt.Errorf("routing: %s: sending to %s: %s", r.Name, s.name, err)
+		}
+
+		atomic.AddInt64(&s.delivered, 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package schemacheck
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Diff returns the breaking changes made between the deployed and proposed
+// versions of a schema.
+//
+// A change is breaking if it could cause data that was valid under the deployed
+// schema to be invalid under the proposed one, or could cause data already
+// stored in the database to stop being readable with the generated types. For
+// instance, removing a field, changing its type, or removing a discriminator
+// value are all breaking. Adding an optional field is not.
+//
+// Diff assumes both schemas have already passed Lint.
+func Diff(deployed, proposed interface{}) []Finding {
+	d := differ{}
+	d.diff([]string{}, deployed, proposed)
+
+	// Definitions are compared by name, because that's how refs point to them.
+	// A definition that changed in a breaking way is reported here, rather than
+	// at each of the places that refer to it.
+	deployedDefs, _ := get(deployed, "definitions").(map[string]interface{})
+	proposedDefs, _ := get(proposed, "definitions").(map[string]interface{})
+	for _, name := range sortedKeys(deployedDefs) {
+		path := []string{"definitions", name}
+		if _, ok := proposedDefs[name]; !ok {
+			d.report(path, "definition %q was removed", name)
+			continue
+		}
+
+		d.diff(path, deployedDefs[name], proposedDefs[name])
+	}
+
+	return d.findings
+}
+
+type differ struct {
+	findings []Finding
+}
+
+func (d *differ) report(path []string, format string, args ...interface{}) {
+	d.findings = append(d.findings, Finding{
+		Path:    append([]string{}, path...),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (d *differ) diff(path []string, deployed, proposed interface{}) {
+	oldObj, _ := deployed.(map[string]interface{})
+	newObj, _ := proposed.(map[string]interface{})
+
+	oldForms, newForms := formsOf(oldObj), formsOf(newObj)
+
+	// The empty form accepts anything, so switching to it is never breaking.
+	if len(newForms) == 0 {
+		return
+	}
+
+	if strings.Join(oldForms, ",") != strings.Join(newForms, ",") {
+		d.report(path, "schema changed from %s form to %s form", formName(oldForms), formName(newForms))
+		return
+	}
+
+	switch newForms[0] {
+	case "ref":
+		if oldObj["ref"] != newObj["ref"] {
+			d.report(append(path, "ref"), "ref changed from %v to %v", oldObj["ref"], newObj["ref"])
+		}
+	case "type":
+		if oldObj["type"] != newObj["type"] {
+			d.report(append(path, "type"), "type changed from %v to %v", oldObj["type"], newObj["type"])
+		}
+	case "enum":
+		oldEnum, _ := oldObj["enum"].([]interface{})
+		newEnum, _ := newObj["enum"].([]interface{})
+
+		newValues := map[interface{}]bool{}
+		for _, v := range newEnum {
+			newValues[v] = true
+		}
+
+		for _, v := range oldEnum {
+			if !newValues[v] {
+				d.report(append(path, "enum"), "enum value %v was removed", v)
+			}
+		}
+	case "elements":
+		d.diff(append(path, "elements"), oldObj["elements"], newObj["elements"])
+	case "values":
+		d.diff(append(path, "values"), oldObj["values"], newObj["values"])
+	case "properties":
+		d.diffProperties(path, oldObj, newObj)
+	case "discriminator":
+		d.diffDiscriminator(append(path, "discriminator"), oldObj["discriminator"], newObj["discriminator"])
+	}
+}
+
+func (d *differ) diffProperties(path []string, oldObj, newObj map[string]interface{}) {
+	oldRequired, _ := oldObj["properties"].(map[string]interface{})
+	oldOptional, _ := oldObj["optionalProperties"].(map[string]interface{})
+	newRequired, _ := newObj["properties"].(map[string]interface{})
+	newOptional, _ := newObj["optionalProperties"].(map[string]interface{})
+
+	for _, name := range sortedKeys(oldRequired) {
+		if schema, ok := newRequired[name]; ok {
+			d.diff(append(path, "properties", name), oldRequired[name], schema)
+		} else if schema, ok := newOptional[name]; ok {
+			// Making a required property optional doesn't reject any inputs, but
+			// readers relying on it always being present will break.
+			d.report(append(path, "properties", name), "required property %q became optional", name)
+			d.diff(append(path, "optionalProperties", name), oldRequired[name], schema)
+		} else {
+			d.report(append(path, "properties", name), "property %q was removed", name)
+		}
+	}
+
+	for _, name := range sortedKeys(oldOptional) {
+		if schema, ok := newOptional[name]; ok {
+			d.diff(append(path, "optionalProperties", name), oldOptional[name], schema)
+		} else if schema, ok := newRequired[name]; ok {
+			d.report(append(path, "properties", name), "optional property %q became required", name)
+			d.diff(append(path, "properties", name), oldOptional[name], schema)
+		} else {
+			d.report(append(path, "optionalProperties", name), "property %q was removed", name)
+		}
+	}
+
+	for _, name := range sortedKeys(newRequired) {
+		_, wasRequired := oldRequired[name]
+		_, wasOptional := oldOptional[name]
+		if !wasRequired && !wasOptional {
+			d.report(append(path, "properties", name), "new required property %q will reject existing producers", name)
+		}
+	}
+
+	if oldObj["additionalProperties"] == true && newObj["additionalProperties"] != true {
+		d.report(path, "additional properties are no longer allowed")
+	}
+}
+
+func (d *differ) diffDiscriminator(path []string, deployed, proposed interface{}) {
+	oldTag, newTag := get(deployed, "tag"), get(proposed, "tag")
+	if !reflect.DeepEqual(oldTag, newTag) {
+		d.report(append(path, "tag"), "tag changed from %v to %v", oldTag, newTag)
+		return
+	}
+
+	oldMapping, _ := get(deployed, "mapping").(map[string]interface{})
+	newMapping, _ := get(proposed, "mapping").(map[string]interface{})
+	for _, name := range sortedKeys(oldMapping) {
+		variantPath := append(path, "mapping", name)
+		if _, ok := newMapping[name]; !ok {
+			d.report(variantPath, "discriminator value %q was removed", name)
+			continue
+		}
+
+		d.diff(variantPath, oldMapping[name], newMapping[name])
+	}
+}
+
+// get returns obj[key] if obj is a JSON object, or nil otherwise.
+func get(obj interface{}, key string) interface{} {
+	if m, ok := obj.(map[string]interface{}); ok {
+		return m[key]
+	}
+
+	return nil
+}
+
+func formName(forms []string) string {
+	if len(forms) == 0 {
+		return "empty"
+	}
+
+	return strings.Join(forms, "/")
+}
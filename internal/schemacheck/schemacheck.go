@@ -0,0 +1,281 @@
+// Package schemacheck lints JDDF schemas and finds breaking changes between two
+// versions of a schema.
+//
+// It works on schemas decoded as generic JSON (map[string]interface{}), rather
+// than as jddf.Schema. Decoding into jddf.Schema silently drops keywords it
+// doesn't know about, which hides exactly the kinds of typos a linter ought to
+// catch.
+package schemacheck
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Finding is a single problem with a schema.
+type Finding struct {
+	// Path is the location of the problem, as a list of keywords and property
+	// names leading from the root of the schema.
+	Path []string `json:"path"`
+
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("/%s: %s", strings.Join(f.Path, "/"), f.Message)
+}
+
+// types are the values JDDF permits for the "type" keyword.
+var types = map[string]bool{
+	"boolean":   true,
+	"float32":   true,
+	"float64":   true,
+	"int8":      true,
+	"uint8":     true,
+	"int16":     true,
+	"uint16":    true,
+	"int32":     true,
+	"uint32":    true,
+	"string":    true,
+	"timestamp": true,
+}
+
+// keywords are the keywords JDDF permits in a schema. Anything else is most
+// likely a typo.
+var keywords = map[string]bool{
+	"definitions":          true,
+	"metadata":             true,
+	"ref":                  true,
+	"type":                 true,
+	"enum":                 true,
+	"elements":             true,
+	"properties":           true,
+	"optionalProperties":   true,
+	"additionalProperties": true,
+	"values":               true,
+	"discriminator":        true,
+}
+
+// Lint returns everything wrong with schema. A schema with no findings is a
+// correct JDDF schema.
+func Lint(schema interface{}) []Finding {
+	root, ok := schema.(map[string]interface{})
+	if !ok {
+		return []Finding{{Path: []string{}, Message: "schema must be an object"}}
+	}
+
+	l := linter{definitions: map[string]bool{}}
+
+	if defs, ok := root["definitions"]; ok {
+		defsObj, ok := defs.(map[string]interface{})
+		if !ok {
+			l.report([]string{"definitions"}, "definitions must be an object")
+		}
+
+		for name := range defsObj {
+			l.definitions[name] = true
+		}
+
+		for _, name := range sortedKeys(defsObj) {
+			l.lint([]string{"definitions", name}, defsObj[name])
+		}
+	}
+
+	l.lint([]string{}, root)
+	return l.findings
+}
+
+type linter struct {
+	definitions map[string]bool
+	findings    []Finding
+}
+
+func (l *linter) report(path []string, format string, args ...interface{}) {
+	l.findings = append(l.findings, Finding{
+		Path:    append([]string{}, path...),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *linter) lint(path []string, schema interface{}) {
+	obj, ok := schema.(map[string]interface{})
+	if !ok {
+		l.report(path, "schema must be an object")
+		return
+	}
+
+	for _, k := range sortedKeys(obj) {
+		if !keywords[k] {
+			l.report(path, "unknown keyword %q", k)
+		}
+	}
+
+	if _, ok := obj["definitions"]; ok && len(path) != 0 {
+		l.report(path, "definitions may only appear at the root of a schema")
+	}
+
+	if forms := formsOf(obj); len(forms) > 1 {
+		l.report(path, "schema mixes keywords from different forms: %s", strings.Join(forms, ", "))
+	}
+
+	if ref, ok := obj["ref"]; ok {
+		if name, ok := ref.(string); !ok {
+			l.report(append(path, "ref"), "ref must be a string")
+		} else if !l.definitions[name] {
+			l.report(append(path, "ref"), "ref to undefined definition %q", name)
+		}
+	}
+
+	if typ, ok := obj["type"]; ok {
+		if name, ok := typ.(string); !ok || !types[name] {
+			l.report(append(path, "type"), "unknown type %v", typ)
+		}
+	}
+
+	if enum, ok := obj["enum"]; ok {
+		values, ok := enum.([]interface{})
+		if !ok || len(values) == 0 {
+			l.report(append(path, "enum"), "enum must be a non-empty array")
+		}
+
+		seen := map[string]bool{}
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				l.report(append(path, "enum"), "enum values must be strings, got %v", v)
+				continue
+			}
+
+			if seen[s] {
+				l.report(append(path, "enum"), "enum value %q is repeated", s)
+			}
+
+			seen[s] = true
+		}
+	}
+
+	if elements, ok := obj["elements"]; ok {
+		l.lint(append(path, "elements"), elements)
+	}
+
+	if values, ok := obj["values"]; ok {
+		l.lint(append(path, "values"), values)
+	}
+
+	required := l.lintProperties(path, obj, "properties")
+	optional := l.lintProperties(path, obj, "optionalProperties")
+	for name := range required {
+		if optional[name] {
+			l.report(path, "property %q is both required and optional", name)
+		}
+	}
+
+	if disc, ok := obj["discriminator"]; ok {
+		l.lintDiscriminator(append(path, "discriminator"), disc)
+	}
+}
+
+// lintProperties lints the "properties" or "optionalProperties" keyword of obj,
+// and returns the names of the properties it defines.
+func (l *linter) lintProperties(path []string, obj map[string]interface{}, keyword string) map[string]bool {
+	names := map[string]bool{}
+
+	props, ok := obj[keyword]
+	if !ok {
+		return names
+	}
+
+	propsObj, ok := props.(map[string]interface{})
+	if !ok {
+		l.report(append(path, keyword), "%s must be an object", keyword)
+		return names
+	}
+
+	for _, name := range sortedKeys(propsObj) {
+		names[name] = true
+		l.lint(append(path, keyword, name), propsObj[name])
+	}
+
+	return names
+}
+
+func (l *linter) lintDiscriminator(path []string, disc interface{}) {
+	obj, ok := disc.(map[string]interface{})
+	if !ok {
+		l.report(path, "discriminator must be an object")
+		return
+	}
+
+	tag, ok := obj["tag"].(string)
+	if !ok {
+		l.report(append(path, "tag"), "tag must be a string")
+	}
+
+	mapping, ok := obj["mapping"].(map[string]interface{})
+	if !ok {
+		l.report(append(path, "mapping"), "mapping must be an object")
+		return
+	}
+
+	for _, name := range sortedKeys(mapping) {
+		variantPath := append(path, "mapping", name)
+		variant, ok := mapping[name].(map[string]interface{})
+		if !ok {
+			l.report(variantPath, "schema must be an object")
+			continue
+		}
+
+		if forms := formsOf(variant); len(forms) != 1 || forms[0] != "properties" {
+			l.report(variantPath, "discriminator mapping values must be of the properties form")
+		}
+
+		for _, keyword := range []string{"properties", "optionalProperties"} {
+			if props, ok := variant[keyword].(map[string]interface{}); ok {
+				if _, ok := props[tag]; ok {
+					l.report(append(variantPath, keyword, tag), "discriminator tag %q may not be redefined as a property", tag)
+				}
+			}
+		}
+
+		l.lint(variantPath, variant)
+	}
+}
+
+// formsOf returns the JDDF forms that obj's keywords belong to. A well-formed
+// schema belongs to at most one form.
+func formsOf(obj map[string]interface{}) []string {
+	forms := []string{}
+	for _, form := range []struct {
+		name     string
+		keywords []string
+	}{
+		{"ref", []string{"ref"}},
+		{"type", []string{"type"}},
+		{"enum", []string{"enum"}},
+		{"elements", []string{"elements"}},
+		{"properties", []string{"properties", "optionalProperties", "additionalProperties"}},
+		{"values", []string{"values"}},
+		{"discriminator", []string{"discriminator"}},
+	} {
+		for _, k := range form.keywords {
+			if _, ok := obj[k]; ok {
+				forms = append(forms, form.name)
+				break
+			}
+		}
+	}
+
+	return forms
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
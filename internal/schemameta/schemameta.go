@@ -0,0 +1,71 @@
+// Package schemameta reads the metadata in a JDDF schema.
+//
+// JDDF lets any schema carry "metadata", which validation ignores, and which
+// this repo uses to configure limits, codecs, and protobuf field numbers. But
+// jddf-go drops metadata when it decodes a schema. So it's read separately,
+// from the same JSON, into a Schema laid out like the jddf.Schema it goes
+// with.
+package schemameta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Schema is the metadata of a schema, and of the schemas inside it.
+type Schema struct {
+	Metadata map[string]interface{} `json:"metadata"`
+
+	Definitions        map[string]Schema `json:"definitions"`
+	Elements           *Schema           `json:"elements"`
+	RequiredProperties map[string]Schema `json:"properties"`
+	OptionalProperties map[string]Schema `json:"optionalProperties"`
+	Values             *Schema           `json:"values"`
+	Discriminator      Discriminator     `json:"discriminator"`
+}
+
+// Discriminator is the metadata of a discriminator's variants.
+type Discriminator struct {
+	Mapping map[string]Schema `json:"mapping"`
+}
+
+// Parse reads the metadata of the schema whose JSON is buf.
+func Parse(buf []byte) (Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return Schema{}, fmt.Errorf("schemameta: %s", err)
+	}
+
+	return s, nil
+}
+
+// Load reads the metadata of the schema in the JSON file at path.
+func Load(path string) (Schema, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	s, err := Parse(buf)
+	if err != nil {
+		return Schema{}, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return s, nil
+}
+
+// Property returns the metadata of a property of s, required or optional.
+func (s Schema) Property(name string) Schema {
+	if p, ok := s.RequiredProperties[name]; ok {
+		return p
+	}
+
+	return s.OptionalProperties[name]
+}
+
+// Decimal returns whether s is for a decimal, like an amount of money: a
+// string with "format": "decimal" in its metadata.
+func (s Schema) Decimal() bool {
+	return s.Metadata["format"] == "decimal"
+}
@@ -0,0 +1,253 @@
+// Package sheets writes rows to Google Sheets, through the Sheets API, for
+// stakeholders who'd rather read a spreadsheet than a dashboard.
+//
+// Requests are made as a Google Cloud service account, with the JSON key
+// Google gives out for it. The spreadsheet has to be shared with the service
+// account's email address, like it would be with a person.
+package sheets
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+)
+
+// scope is the OAuth scope that allows reading and writing spreadsheets.
+const scope = "https://www.googleapis.com/auth/spreadsheets"
+
+// baseURL is where the Sheets API is.
+const baseURL = "https://sheets.googleapis.com/v4/spreadsheets/"
+
+// Credentials are a service account's JSON key, as downloaded from Google
+// Cloud.
+type Credentials struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// LoadCredentials reads a service account's JSON key.
+func LoadCredentials(path string) (*Credentials, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Credentials
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("sheets: %s: %s", path, err)
+	}
+
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("sheets: %s: private_key is not PEM-encoded", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("sheets: %s: %s", path, err)
+	}
+
+	var ok bool
+	if c.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("sheets: %s: private_key is not an RSA key", path)
+	}
+
+	if c.TokenURI == "" {
+		c.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &c, nil
+}
+
+// Client writes to spreadsheets as a service account. It's safe for
+// concurrent use.
+type Client struct {
+	Credentials *Credentials
+
+	// Clock decides when access tokens expire. If nil, it's the system clock.
+	Clock clock.Clock
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Error is an error the Sheets API, or Google's token endpoint, responded with.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("sheets: %s (status %d)", e.Message, e.Status)
+}
+
+// Replace replaces everything on a sheet, the tab named sheet in the
+// spreadsheet with the given ID, with rows, starting at its top left cell.
+// Values are written as they are, not parsed like typed-in text.
+func (c *Client) Replace(ctx context.Context, spreadsheetID, sheet string, rows [][]interface{}) error {
+	// A1 notation quotes sheet names, doubling any quotes in them.
+	name := "'" + strings.Replace(sheet, "'", "''", -1) + "'"
+	path := url.PathEscape(spreadsheetID) + "/values/" + url.PathEscape(name)
+
+	if err := c.do(ctx, "POST", path+":clear", struct{}{}); err != nil {
+		return err
+	}
+
+	body := struct {
+		Range          string          `json:"range"`
+		MajorDimension string          `json:"majorDimension"`
+		Values         [][]interface{} `json:"values"`
+	}{name, "ROWS", rows}
+
+	return c.do(ctx, "PUT", path+"?valueInputOption=RAW", body)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body interface{}) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, baseURL+path, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return responseError(res)
+	}
+
+	return nil
+}
+
+// accessToken returns an OAuth access token to make requests with, getting a
+// new one when the last is close to expiring. Service accounts get them by
+// signing a JWT asking for one.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	if c.Credentials == nil || c.Credentials.key == nil {
+		return "", errors.New("sheets: no credentials")
+	}
+
+	now := clock.Or(c.Clock).Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && now.Before(c.expires.Add(-5*time.Minute)) {
+		return c.token, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   c.Credentials.ClientEmail,
+		"scope": scope,
+		"aud":   c.Credentials.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.Credentials.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+
+	req, err := http.NewRequest("POST", c.Credentials.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", responseError(res)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("sheets: reading access token: %s", err)
+	}
+
+	c.token = token.AccessToken
+	c.expires = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// responseError reads the error out of a failed response. Google's APIs
+// describe errors in different shapes, so the body's used as the message if
+// it isn't one that's recognized.
+func responseError(res *http.Response) error {
+	buf, _ := ioutil.ReadAll(res.Body)
+
+	// The Sheets API nests a message in "error"; the token endpoint has an
+	// OAuth error code there, and describes it alongside.
+	var body struct {
+		Error            interface{} `json:"error"`
+		ErrorDescription string      `json:"error_description"`
+	}
+
+	message := strings.TrimSpace(string(buf))
+	if json.Unmarshal(buf, &body) == nil {
+		if e, ok := body.Error.(map[string]interface{}); ok && e["message"] != nil {
+			message = fmt.Sprint(e["message"])
+		} else if code, ok := body.Error.(string); ok && body.ErrorDescription != "" {
+			message = code + ": " + body.ErrorDescription
+		}
+	}
+
+	if message == "" {
+		message = res.Status
+	}
+
+	return &Error{Status: res.StatusCode, Message: message}
+}
@@ -0,0 +1,62 @@
+package signature
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache remembers signatures it has seen, by their Key, so that a request
+// can't be replayed even within the tolerance window. A signature only needs
+// to be remembered for as long as Verify would accept it.
+//
+// A Cache is safe for concurrent use. The zero value is not usable; use
+// NewCache.
+type Cache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	inserts int
+}
+
+// NewCache returns a Cache remembering signatures for ttl, which should be
+// twice the tolerance passed to Verify, since timestamps may be in the future
+// by up to that much.
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{ttl: ttl, seen: map[string]time.Time{}}
+}
+
+// Seen records that the signature whose Key is key was used at time now, and
+// returns whether it had already been used.
+func (c *Cache) Seen(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if expires, ok := c.seen[key]; ok && now.Before(expires) {
+		return true
+	}
+
+	c.seen[key] = now.Add(c.ttl)
+
+	// Every so often, forget signatures that have expired, so the cache doesn't
+	// grow forever.
+	c.inserts++
+	if c.inserts%1000 == 0 {
+		for h, expires := range c.seen {
+			if !now.Before(expires) {
+				delete(c.seen, h)
+			}
+		}
+	}
+
+	return false
+}
+
+// Len returns how many signatures the cache is remembering, including any that
+// have expired but haven't been forgotten yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.seen)
+}
@@ -0,0 +1,98 @@
+// Package signature verifies HMAC-signed request bodies.
+//
+// Signatures use the scheme popularized by Stripe. The signature header looks
+// like:
+//
+//	t=1492774577,v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// where t is a Unix timestamp, and v1 is the hex-encoded HMAC-SHA256 of the
+// timestamp, a period, and the body, keyed with a shared secret. There may be
+// more than one v1 signature while a secret is being rolled; any of them
+// matching is enough.
+//
+// Signing the timestamp along with the body means a captured request can only
+// be replayed within a short tolerance window. Cache, remembering each
+// request's Key, closes that window entirely.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is returned when a signature is missing, malformed, too old, or
+// simply wrong.
+var ErrInvalid = errors.New("signature: invalid signature")
+
+// Sign returns a signature header for body, signed with secret at time t.
+func Sign(secret string, body []byte, t time.Time) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac(secret, timestamp, body))
+}
+
+// Verify checks that header is a valid signature of body with secret, made no
+// more than tolerance away from now.
+func Verify(header, secret string, body []byte, now time.Time, tolerance time.Duration) error {
+	timestamp, signatures := parse(header)
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+
+	if age := now.Sub(time.Unix(t, 0)); age > tolerance || age < -tolerance {
+		return ErrInvalid
+	}
+
+	expected := mac(secret, timestamp, body)
+	for _, signature := range signatures {
+		actual, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(actual, expected) {
+			return nil
+		}
+	}
+
+	return ErrInvalid
+}
+
+// Key returns what identifies a request whose signature Verify accepted: the
+// signature it should have, of its timestamp and body. Fields and signatures
+// can be added to a header without Verify minding, so it's the key, not the
+// header, that a Cache should remember.
+func Key(header, secret string, body []byte) string {
+	timestamp, _ := parse(header)
+	return hex.EncodeToString(mac(secret, timestamp, body))
+}
+
+// parse returns the timestamp and signatures in a header.
+func parse(header string) (string, []string) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	return timestamp, signatures
+}
+
+func mac(secret, timestamp string, body []byte) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(timestamp))
+	m.Write([]byte("."))
+	m.Write(body)
+	return m.Sum(nil)
+}
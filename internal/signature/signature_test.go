@@ -0,0 +1,58 @@
+package signature
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	now := time.Unix(1492774577, 0)
+	body := []byte(`{"type":"Order Completed"}`)
+	header := Sign("secret", body, now)
+
+	tests := []struct {
+		name   string
+		header string
+		body   []byte
+		same   bool
+	}{
+		{name: "same header", header: header, body: body, same: true},
+		{name: "extra field", header: header + ",x=1", body: body, same: true},
+		{name: "extra signature", header: header + ",v1=00", body: body, same: true},
+		{name: "reordered", header: "v1=00," + header, body: body, same: true},
+		{name: "another body", header: Sign("secret", []byte(`{}`), now), body: []byte(`{}`)},
+		{name: "another time", header: Sign("secret", body, now.Add(time.Second)), body: body},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.header, "secret", tt.body, now, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			same := Key(tt.header, "secret", tt.body) == Key(header, "secret", body)
+			if same != tt.same {
+				t.Errorf("same key = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestCacheReplayPadded(t *testing.T) {
+	now := time.Unix(1492774577, 0)
+	body := []byte(`{"type":"Order Completed"}`)
+	header := Sign("secret", body, now)
+	cache := NewCache(10 * time.Minute)
+
+	if cache.Seen(Key(header, "secret", body), now) {
+		t.Fatal("first request was seen already")
+	}
+
+	if !cache.Seen(Key(header+",x=1", "secret", body), now.Add(time.Second)) {
+		t.Error("padded replay wasn't seen")
+	}
+
+	if cache.Seen(Key(header, "secret", body), now.Add(11*time.Minute)) {
+		t.Error("signature was remembered past the cache's TTL")
+	}
+}
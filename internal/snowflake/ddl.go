@@ -0,0 +1,125 @@
+package snowflake
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+	"github.com/jddf-examples/golang-postgres-analytics/internal/sqlviews"
+	"github.com/jddf/jddf-go"
+)
+
+// columnTypes maps JDDF types to the Snowflake type the corresponding column
+// gets cast to.
+var columnTypes = map[jddf.Type]string{
+	"boolean":   "BOOLEAN",
+	"float32":   "FLOAT",
+	"float64":   "NUMBER(38, 9)", // exact, so sums don't lose cents
+	"int8":      "NUMBER(3, 0)",
+	"uint8":     "NUMBER(3, 0)",
+	"int16":     "NUMBER(5, 0)",
+	"uint16":    "NUMBER(5, 0)",
+	"int32":     "NUMBER(10, 0)",
+	"uint32":    "NUMBER(10, 0)",
+	"string":    "VARCHAR",
+	"timestamp": "TIMESTAMP_TZ",
+}
+
+// Generate returns SQL that creates the table events are inserted into, if it
+// doesn't exist, and (re-)creates one view over it per discriminator value in
+// schema, like the Postgres views in views.sql. The schema must be of the
+// discriminator form, like event.jddf.json.
+//
+// table is SQL, as for Insert. Views are created alongside it, named like
+// ORDER_COMPLETED_EVENTS. meta is the schema's metadata, which says which
+// strings are decimals, and get NUMBER columns.
+func Generate(schema jddf.Schema, meta schemameta.Schema, table string) (string, error) {
+	tag := schema.Discriminator.Tag
+	if tag == "" {
+		return "", errors.New("snowflake: schema is not of the discriminator form")
+	}
+
+	var names []string
+	for name := range schema.Discriminator.Mapping {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	// Views go in the table's schema, if it's qualified with one.
+	prefix := ""
+	if i := strings.LastIndex(table, "."); i != -1 {
+		prefix = table[:i+1]
+	}
+
+	var sql strings.Builder
+	sql.WriteString("-- Code generated from event.jddf.json by \"golang-postgres-analytics views -dialect snowflake\". DO NOT EDIT.\n")
+
+	fmt.Fprintf(&sql, "\ncreate table if not exists %s (\n", table)
+	sql.WriteString("  PAYLOAD VARIANT not null,\n")
+	sql.WriteString("  LOADED_AT TIMESTAMP_TZ not null default current_timestamp()\n);\n")
+
+	for _, name := range names {
+		view := prefix + quoteIdent(strings.ToUpper(sqlviews.ViewName(name)))
+
+		fmt.Fprintf(&sql, "\ncreate or replace view %s as\n  select\n    LOADED_AT", view)
+		for _, property := range properties(schema.Discriminator.Mapping[name]) {
+			expr := columnExpr(property.name, property.schema, meta.Discriminator.Mapping[name].Property(property.name))
+			fmt.Fprintf(&sql, ",\n    %s as %s", expr, quoteIdent(strings.ToUpper(sqlviews.ColumnName(property.name))))
+		}
+
+		fmt.Fprintf(&sql, "\n  from\n    %s\n  where\n    PAYLOAD[%s]::VARCHAR = %s;\n", table, quoteLiteral(tag), quoteLiteral(name))
+	}
+
+	return sql.String(), nil
+}
+
+type property struct {
+	name   string
+	schema jddf.Schema
+}
+
+// properties returns the properties of a discriminator variant, required and
+// optional alike, sorted by name.
+func properties(variant jddf.Schema) []property {
+	var out []property
+	for name, schema := range variant.RequiredProperties {
+		out = append(out, property{name, schema})
+	}
+
+	for name, schema := range variant.OptionalProperties {
+		out = append(out, property{name, schema})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// columnExpr returns the SQL expression extracting a property out of the
+// PAYLOAD column. Scalars are cast to their Snowflake equivalent, and decimals
+// to NUMBER; everything else is left as VARIANT.
+func columnExpr(name string, schema jddf.Schema, meta schemameta.Schema) string {
+	if len(schema.Enum) != 0 {
+		return fmt.Sprintf("PAYLOAD[%s]::VARCHAR", quoteLiteral(name))
+	}
+
+	if meta.Decimal() {
+		return fmt.Sprintf("PAYLOAD[%s]::%s", quoteLiteral(name), columnTypes["float64"])
+	}
+
+	if sfType, ok := columnTypes[schema.Type]; ok {
+		return fmt.Sprintf("PAYLOAD[%s]::%s", quoteLiteral(name), sfType)
+	}
+
+	return fmt.Sprintf("PAYLOAD[%s]", quoteLiteral(name))
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), "'", "''", -1) + "'"
+}
@@ -0,0 +1,294 @@
+// Package snowflake writes events to Snowflake, through its SQL API, for
+// organizations whose analysts work there rather than in Postgres.
+//
+// Events land in a table with a VARIANT column, PAYLOAD, much like the events
+// table's jsonb column. Generate makes that table, and a typed view for each
+// type of event over it, from the event schema.
+//
+// Requests are authenticated with key-pair authentication: a JWT signed with
+// an RSA key registered on the Snowflake user, as set up by "alter user ... set
+// rsa_public_key = ...". No driver is needed, just HTTPS.
+package snowflake
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/clock"
+)
+
+// tokenLifetime is how long the JWTs requests are signed with last. Snowflake
+// accepts up to an hour.
+const tokenLifetime = 59 * time.Minute
+
+// pollInterval is how often a statement that's still running is checked on.
+const pollInterval = 500 * time.Millisecond
+
+// Client runs statements in a Snowflake account. It's safe for concurrent use.
+type Client struct {
+	// Account is the account identifier, like "myorg-myaccount", or a locator
+	// like "xy12345.us-east-1". User is the user statements run as, and Key the
+	// private key registered for them.
+	Account string
+	User    string
+	Key     *rsa.PrivateKey
+
+	// URL is where the account is, like https://myorg-myaccount.snowflakecomputing.com.
+	// If empty, it's worked out from Account.
+	URL string
+
+	// Database, Schema, Warehouse, and Role are what statements run in, with,
+	// and as. Any left empty are the user's defaults.
+	Database  string
+	Schema    string
+	Warehouse string
+	Role      string
+
+	// Clock decides when tokens expire. If nil, it's the system clock.
+	Clock clock.Clock
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Error is an error Snowflake reported running a statement.
+type Error struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("snowflake: %s (code %s, status %d)", e.Message, e.Code, e.Status)
+}
+
+// statementRequest is a request to the SQL API to run a statement.
+type statementRequest struct {
+	Statement string             `json:"statement"`
+	Bindings  map[string]binding `json:"bindings,omitempty"`
+	Database  string             `json:"database,omitempty"`
+	Schema    string             `json:"schema,omitempty"`
+	Warehouse string             `json:"warehouse,omitempty"`
+	Role      string             `json:"role,omitempty"`
+}
+
+type binding struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// statementResponse is the part of the SQL API's responses that matters here.
+type statementResponse struct {
+	Code            string `json:"code"`
+	Message         string `json:"message"`
+	StatementHandle string `json:"statementHandle"`
+}
+
+// stillRunning is the code of responses about statements that haven't
+// finished yet.
+const stillRunning = "333334"
+
+// LoadKey reads an unencrypted, PEM-encoded RSA private key, in PKCS #8 or
+// PKCS #1 form, like one made by "openssl genrsa".
+func LoadKey(path string) (*rsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("snowflake: %s is not PEM-encoded", path)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("snowflake: %s: %s", path, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("snowflake: %s is not an RSA key", path)
+	}
+
+	return rsaKey, nil
+}
+
+// Insert adds rows, each a JSON document, to the PAYLOAD column of table, in
+// one statement. table is SQL, like EVENTS or ANALYTICS.PUBLIC.EVENTS, and
+// isn't quoted.
+//
+// The rows are bound as one JSON array, and flattened back into rows by
+// Snowflake, so that however many there are, the statement's the same.
+func (c *Client) Insert(ctx context.Context, table string, rows [][]byte) error {
+	array := make([]json.RawMessage, len(rows))
+	for i, row := range rows {
+		array[i] = row
+	}
+
+	buf, err := json.Marshal(array)
+	if err != nil {
+		return err
+	}
+
+	statement := fmt.Sprintf("insert into %s (PAYLOAD) select value from table(flatten(input => parse_json(?)))", table)
+	return c.Exec(ctx, statement, string(buf))
+}
+
+// Exec runs a statement, with args bound to its ?s as text, and waits for it
+// to finish.
+func (c *Client) Exec(ctx context.Context, statement string, args ...string) error {
+	req := statementRequest{
+		Statement: statement,
+		Bindings:  map[string]binding{},
+		Database:  c.Database,
+		Schema:    c.Schema,
+		Warehouse: c.Warehouse,
+		Role:      c.Role,
+	}
+
+	for i, arg := range args {
+		req.Bindings[fmt.Sprint(i+1)] = binding{Type: "TEXT", Value: arg}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(ctx, "POST", "/api/v2/statements", body)
+	if err != nil {
+		return err
+	}
+
+	// Statements that take more than a few seconds carry on running, and are
+	// checked on until they're done.
+	for res.StatementHandle != "" && res.Code == stillRunning {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+
+		if res, err = c.do(ctx, "GET", "/api/v2/statements/"+res.StatementHandle, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*statementResponse, error) {
+	token, err := c.authToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, c.baseURL()+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Snowflake-Authorization-Token-Type", "KEYPAIR_JWT")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	var out statementResponse
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil && res.StatusCode/100 == 2 {
+		return nil, fmt.Errorf("snowflake: reading response: %s", err)
+	}
+
+	if res.StatusCode/100 != 2 {
+		if out.Message == "" {
+			out.Message = res.Status
+		}
+
+		return nil, &Error{Status: res.StatusCode, Code: out.Code, Message: out.Message}
+	}
+
+	return &out, nil
+}
+
+func (c *Client) baseURL() string {
+	if c.URL != "" {
+		return strings.TrimSuffix(c.URL, "/")
+	}
+
+	return "https://" + strings.ToLower(c.Account) + ".snowflakecomputing.com"
+}
+
+// authToken returns a JWT to authenticate requests with, signing a new one
+// when the last is close to expiring.
+func (c *Client) authToken() (string, error) {
+	if c.Key == nil {
+		return "", errors.New("snowflake: no private key")
+	}
+
+	now := clock.Or(c.Clock).Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && now.Before(c.expires.Add(-5*time.Minute)) {
+		return c.token, nil
+	}
+
+	public, err := x509.MarshalPKIXPublicKey(&c.Key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	// The issuer names the key by its fingerprint, so that Snowflake knows
+	// which of the user's keys to check the signature with. Accounts are named
+	// without their region, in upper case.
+	fingerprint := sha256.Sum256(public)
+	subject := strings.ToUpper(strings.SplitN(c.Account, ".", 2)[0] + "." + c.User)
+	expires := now.Add(tokenLifetime)
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": subject + ".SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:]),
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": expires.Unix(),
+	})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	c.token = signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	c.expires = expires
+	return c.token, nil
+}
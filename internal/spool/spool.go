@@ -0,0 +1,300 @@
+// Package spool is a write-ahead log of events on local disk.
+//
+// Events are appended to segment files before they're written to the
+// database, and a segment is deleted once every event in it has been. If the
+// process dies in between, the segments left behind are replayed the next
+// time it starts, so accepted events aren't lost.
+//
+// Replaying can store an event that was already stored, just before the crash.
+// Delivery is at least once.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultSegmentSize is how big a segment may grow before a new one is
+// started.
+const DefaultSegmentSize = 64 << 20
+
+// maxRecordSize is the largest record read back. Anything bigger is taken to
+// be corruption.
+const maxRecordSize = 16 << 20
+
+// segmentSuffix is the extension of segment files.
+const segmentSuffix = ".seg"
+
+// Spool is a directory of segment files. It's safe to use from many
+// goroutines.
+type Spool struct {
+	dir         string
+	segmentSize int64
+
+	mu       sync.Mutex
+	current  *os.File
+	seq      uint64
+	size     int64
+	pending  map[uint64]int
+	leftover []uint64
+}
+
+// Open opens the spool in dir, creating the directory if need be. Segments
+// already in it, left by a previous process, are kept for Replay; new events
+// go in new segments.
+func Open(dir string, segmentSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, segmentSize: segmentSize, pending: map[uint64]int{}}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.leftover = append(s.leftover, seq)
+		if seq > s.seq {
+			s.seq = seq
+		}
+	}
+
+	sort.Slice(s.leftover, func(i, j int) bool { return s.leftover[i] < s.leftover[j] })
+	return s, nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// Append durably writes an event to the spool. It returns the segment the
+// event is in, which must be passed to Done once the event is stored
+// elsewhere.
+func (s *Spool) Append(buf []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil || s.size >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Each record is its length and checksum, then the event. A record torn by
+	// a crash mid-write fails the checksum, and is where replaying stops.
+	record := make([]byte, 8+len(buf))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(buf)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(buf))
+	copy(record[8:], buf)
+
+	if _, err := s.current.Write(record); err != nil {
+		return 0, err
+	}
+
+	if err := s.current.Sync(); err != nil {
+		return 0, err
+	}
+
+	s.size += int64(len(record))
+	s.pending[s.seq]++
+	return s.seq, nil
+}
+
+// rotate closes the current segment, if there is one, and starts the next.
+func (s *Spool) rotate() error {
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+
+		// The old segment may already have been stored in full.
+		if s.pending[s.seq] == 0 {
+			delete(s.pending, s.seq)
+			os.Remove(s.path(s.seq))
+		}
+	}
+
+	file, err := os.OpenFile(s.path(s.seq+1), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	s.seq++
+	s.current, s.size = file, 0
+	return nil
+}
+
+// Done records that an event appended to the given segment has been stored
+// elsewhere, or given up on. Once every event in a segment is done, and no
+// more are being added to it, the segment is deleted.
+func (s *Spool) Done(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending[seq]--
+	if s.pending[seq] == 0 && !(s.current != nil && seq == s.seq) {
+		delete(s.pending, seq)
+		os.Remove(s.path(seq))
+	}
+}
+
+// Replay passes every event in the segments left by a previous process to
+// store, oldest first, deleting each segment once all its events are stored.
+// It stops at the first error from store, keeping the segment it's in for the
+// next replay.
+func (s *Spool) Replay(store func(buf []byte) error) (int, error) {
+	s.mu.Lock()
+	leftover := s.leftover
+	s.mu.Unlock()
+
+	replayed := 0
+	for len(leftover) != 0 {
+		n, err := replaySegment(s.path(leftover[0]), store)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+
+		if err := os.Remove(s.path(leftover[0])); err != nil {
+			return replayed, err
+		}
+
+		leftover = leftover[1:]
+		s.mu.Lock()
+		s.leftover = leftover
+		s.mu.Unlock()
+	}
+
+	return replayed, nil
+}
+
+// Seal closes the current segment, and hands every segment with events that
+// aren't done to the next Replay, as if a previous process had left them.
+//
+// It's for spools used as a backlog, rather than a write-ahead log: events are
+// appended to them and never marked done, and then replayed, and removed, in
+// bulk. New events go in new segments. Seal mustn't be called while Replay is
+// running.
+func (s *Spool) Seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil {
+		if err := s.current.Close(); err != nil {
+			return err
+		}
+
+		s.current = nil
+		if s.pending[s.seq] == 0 {
+			os.Remove(s.path(s.seq))
+		}
+	}
+
+	for seq, n := range s.pending {
+		if n != 0 {
+			s.leftover = append(s.leftover, seq)
+		}
+	}
+
+	s.pending = map[uint64]int{}
+	sort.Slice(s.leftover, func(i, j int) bool { return s.leftover[i] < s.leftover[j] })
+	return nil
+}
+
+// errTorn is the end of a segment whose last record was only partly written.
+var errTorn = errors.New("spool: torn record")
+
+func replaySegment(path string, store func(buf []byte) error) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	in := bufio.NewReader(file)
+	replayed := 0
+	for {
+		buf, err := readRecord(in)
+		if err == io.EOF || err == errTorn {
+			return replayed, nil
+		}
+
+		if err != nil {
+			return replayed, err
+		}
+
+		if err := store(buf); err != nil {
+			return replayed, err
+		}
+
+		replayed++
+	}
+}
+
+func readRecord(in *bufio.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTorn
+		}
+
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, errTorn
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(in, buf); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, errTorn
+		}
+
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(buf) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errTorn
+	}
+
+	return buf, nil
+}
+
+// Close closes the current segment. Events in it that aren't done are replayed
+// by the next process to open the spool.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
@@ -0,0 +1,192 @@
+// Package sqlviews generates Postgres views over the events table, one per
+// event type, from a JDDF schema.
+//
+// The events table stores everything in a single jsonb column, which is great
+// for ingestion but clumsy for analysts. A view like order_completed_events,
+// with typed user_id, timestamp, and revenue columns, lets them query events
+// as if they were an ordinary relation.
+package sqlviews
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/schemameta"
+	"github.com/jddf/jddf-go"
+)
+
+// columnTypes maps JDDF types to the Postgres type the corresponding column
+// gets cast to.
+var columnTypes = map[jddf.Type]string{
+	"boolean":   "boolean",
+	"float32":   "real",
+	"float64":   "numeric", // exact, so sums don't lose cents
+	"int8":      "smallint",
+	"uint8":     "smallint",
+	"int16":     "smallint",
+	"uint16":    "integer",
+	"int32":     "integer",
+	"uint32":    "bigint",
+	"string":    "text",
+	"timestamp": "timestamptz",
+}
+
+// Generate returns SQL that (re-)creates one view per discriminator value in
+// schema. The schema must be of the discriminator form, like event.jddf.json.
+// meta is the schema's metadata, which says which strings are decimals, and
+// get numeric columns.
+//
+// If namespace isn't empty, the views, and the events table they select from,
+// are qualified with it. Otherwise, they're resolved using the search_path.
+//
+// Views are dropped and re-created, rather than using "create or replace",
+// because Postgres won't let "create or replace" remove or retype columns.
+func Generate(schema jddf.Schema, meta schemameta.Schema, namespace string) (string, error) {
+	tag := schema.Discriminator.Tag
+	if tag == "" {
+		return "", errors.New("sqlviews: schema is not of the discriminator form")
+	}
+
+	var names []string
+	for name := range schema.Discriminator.Mapping {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var sql strings.Builder
+	sql.WriteString("-- Code generated from event.jddf.json by \"golang-postgres-analytics views\". DO NOT EDIT.\n")
+
+	qualify := func(name string) string {
+		if namespace == "" {
+			return quoteIdent(name)
+		}
+
+		return quoteIdent(namespace) + "." + quoteIdent(name)
+	}
+
+	table := "events_expanded"
+	if namespace != "" {
+		table = qualify(table)
+	}
+
+	for _, name := range names {
+		variant := schema.Discriminator.Mapping[name]
+		view := qualify(ViewName(name))
+
+		fmt.Fprintf(&sql, "\ndrop view if exists %s;\n", view)
+		fmt.Fprintf(&sql, "create view %s as\n  select\n    id", view)
+
+		for _, column := range columns(variant, meta.Discriminator.Mapping[name]) {
+			fmt.Fprintf(&sql, ",\n    %s as %s", column.expr, quoteIdent(column.name))
+		}
+
+		fmt.Fprintf(&sql, "\n  from\n    %s\n  where\n    payload->>%s = %s;\n", table, quoteLiteral(tag), quoteLiteral(name))
+	}
+
+	return sql.String(), nil
+}
+
+// ViewName returns the name of the view for a discriminator value. For
+// example, "Order Completed" becomes "order_completed_events".
+func ViewName(discriminatorValue string) string {
+	return snakeCase(discriminatorValue) + "_events"
+}
+
+// ColumnName returns the name of the column for a property. For example,
+// "userId" becomes "user_id".
+func ColumnName(property string) string {
+	return snakeCase(property)
+}
+
+type column struct {
+	name string
+	expr string
+}
+
+// columns returns the columns of the view for a discriminator variant, sorted
+// by property name. Required and optional properties are treated alike; a
+// missing optional property is just null.
+func columns(variant jddf.Schema, meta schemameta.Schema) []column {
+	props := map[string]jddf.Schema{}
+	for name, schema := range variant.RequiredProperties {
+		props[name] = schema
+	}
+
+	for name, schema := range variant.OptionalProperties {
+		props[name] = schema
+	}
+
+	var names []string
+	for name := range props {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	out := make([]column, len(names))
+	for i, name := range names {
+		out[i] = column{name: ColumnName(name), expr: columnExpr(name, props[name], meta.Property(name))}
+	}
+
+	return out
+}
+
+// columnExpr returns the SQL expression extracting a property out of the
+// payload column. Scalars are cast to their Postgres equivalent, and decimals
+// to numeric; everything else is left as jsonb.
+func columnExpr(property string, schema jddf.Schema, meta schemameta.Schema) string {
+	if len(schema.Enum) != 0 {
+		return fmt.Sprintf("payload->>%s", quoteLiteral(property))
+	}
+
+	if meta.Decimal() {
+		return fmt.Sprintf("(payload->>%s)::numeric", quoteLiteral(property))
+	}
+
+	if pgType, ok := columnTypes[schema.Type]; ok {
+		return fmt.Sprintf("(payload->>%s)::%s", quoteLiteral(property), pgType)
+	}
+
+	return fmt.Sprintf("payload->%s", quoteLiteral(property))
+}
+
+// snakeCase converts names like "userId" or "Order Completed" into "user_id"
+// or "order_completed".
+func snakeCase(s string) string {
+	var out strings.Builder
+	prevLower := false
+	for _, r := range s {
+		switch {
+		case unicode.IsUpper(r):
+			if prevLower {
+				out.WriteRune('_')
+			}
+
+			out.WriteRune(unicode.ToLower(r))
+			prevLower = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			out.WriteRune(r)
+			prevLower = true
+		default:
+			if prevLower {
+				out.WriteRune('_')
+			}
+
+			prevLower = false
+		}
+	}
+
+	return strings.TrimSuffix(out.String(), "_")
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
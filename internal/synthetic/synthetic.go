@@ -0,0 +1,252 @@
+// Package synthetic makes up users, and what they do, for demos and staging
+// environments that would otherwise have empty dashboards.
+//
+// Unlike fixtures.RandomEvent, which looks for the edges of the schema, the
+// events here are meant to look like a real app's. Each user signs up at some
+// point, and then comes back for sessions every so often, less and less often
+// as time goes on. In a session they browse some pages, with heartbeats while
+// the app is open, and sometimes go on to check out. Revenue is log-normal:
+// most orders are small, and a few are large. Users on the "pro" plan come
+// back more often, and buy more often, than those on "free".
+//
+// Everything is drawn from the rand.Rand passed in, so the same seed makes the
+// same users.
+package synthetic
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/jddf-examples/golang-postgres-analytics/internal/event"
+)
+
+// Platforms are the platforms users are spread across, most common first.
+var Platforms = []string{"ios", "android", "web"}
+
+// AppVersions are released evenly over the period users are made up for, so
+// later sessions run later versions, and GET /v1/versions has something to
+// show.
+var AppVersions = []string{"1.0.0", "1.1.0", "1.2.0", "2.0.0"}
+
+// pages are where sessions browse, with how likely each is to be viewed next.
+// A session that reaches /checkout may complete an order.
+var pages = []struct {
+	path   string
+	weight float64
+}{
+	{"/", 30},
+	{"/search", 15},
+	{"/products/1", 10},
+	{"/products/2", 8},
+	{"/products/3", 6},
+	{"/products/4", 4},
+	{"/cart", 8},
+	{"/checkout", 4},
+	{"/account", 5},
+}
+
+// Behavior is how users behave, on average.
+type Behavior struct {
+	// SessionGap is the mean time between a user's sessions, at first. Gaps
+	// get longer the longer a user's had the app.
+	SessionGap time.Duration
+
+	// SessionLength is the mean length of a session.
+	SessionLength time.Duration
+
+	// HeartbeatInterval is how often the app sends a heartbeat while it's open.
+	HeartbeatInterval time.Duration
+
+	// CheckoutRate is the chance a session that views /checkout completes an
+	// order.
+	CheckoutRate float64
+
+	// MedianRevenue and RevenueSpread shape the log-normal distribution order
+	// revenues are drawn from. Spread is the standard deviation of the
+	// revenue's logarithm.
+	MedianRevenue float64
+	RevenueSpread float64
+
+	// ProRate is the fraction of users on the "pro" plan.
+	ProRate float64
+}
+
+// DefaultBehavior is a shop's app with a modest conversion rate.
+var DefaultBehavior = Behavior{
+	SessionGap:        36 * time.Hour,
+	SessionLength:     8 * time.Minute,
+	HeartbeatInterval: time.Minute,
+	CheckoutRate:      0.4,
+	MedianRevenue:     35,
+	RevenueSpread:     0.8,
+	ProRate:           0.2,
+}
+
+// User is a made up user, with their traits, as stored in the users table, and
+// everything they did, in order.
+type User struct {
+	ID     string
+	Traits map[string]interface{}
+	Events []event.Event
+}
+
+// NewUser makes up a user with the given ID, who signs up between start and
+// end, and whose events all happen before end.
+func (b Behavior) NewUser(r *rand.Rand, id string, start, end time.Time) User {
+	plan := "free"
+	if r.Float64() < b.ProRate {
+		plan = "pro"
+	}
+
+	platform := Platforms[weighted(r, []float64{5, 4, 2})]
+	signup := start.Add(time.Duration(r.Int63n(int64(end.Sub(start)) + 1)))
+
+	user := User{
+		ID:     id,
+		Traits: map[string]interface{}{"plan": plan, "platform": platform, "signedUpAt": signup.UTC()},
+	}
+
+	gap := b.SessionGap
+	checkoutRate := b.CheckoutRate
+	if plan == "pro" {
+		gap /= 2
+		checkoutRate = math.Min(1, checkoutRate*1.5)
+	}
+
+	for t := signup; t.Before(end); {
+		user.Events = append(user.Events, b.session(r, id, platform, appVersion(t, start, end), t, end, checkoutRate)...)
+
+		// Each session makes the next one further off, as the novelty wears
+		// off.
+		t = t.Add(exponential(r, gap))
+		gap = gap * 5 / 4
+	}
+
+	return user
+}
+
+// session makes up one session, starting at t, and cut short at end.
+func (b Behavior) session(r *rand.Rand, userID, platform, version string, t, end time.Time, checkoutRate float64) []event.Event {
+	var events []event.Event
+	sessionEnd := t.Add(exponential(r, b.SessionLength))
+	if sessionEnd.After(end) {
+		sessionEnd = end
+	}
+
+	// Heartbeats run for the whole session, while pages are viewed at random
+	// points in it.
+	for hb := t; hb.Before(sessionEnd); hb = hb.Add(b.HeartbeatInterval) {
+		e := event.EventHeartbeat{Timestamp: hb.UTC(), UserId: userID}
+		e.AppVersion = &version
+		e.Platform = &platform
+		events = append(events, event.Event{Type: event.EventTypeHeartbeat, EventHeartbeat: e})
+	}
+
+	weights := make([]float64, len(pages))
+	for i, page := range pages {
+		weights[i] = page.weight
+	}
+
+	viewedAt := t
+	for viewedAt.Before(sessionEnd) {
+		page := pages[weighted(r, weights)].path
+		events = append(events, event.Event{Type: event.EventTypePageViewed, EventPageViewed: event.EventPageViewed{
+			Timestamp: viewedAt.UTC(),
+			UserId:    userID,
+			Url:       "https://shop.example.com" + page,
+		}})
+
+		if page == "/checkout" && r.Float64() < checkoutRate {
+			orderedAt := viewedAt.Add(time.Duration(10+r.Intn(50)) * time.Second)
+			if orderedAt.After(end) {
+				orderedAt = end
+			}
+
+			events = append(events, event.Event{Type: event.EventTypeOrderCompleted, EventOrderCompleted: event.EventOrderCompleted{
+				Timestamp: orderedAt.UTC(),
+				UserId:    userID,
+				Revenue:   b.revenue(r),
+			}})
+
+			break
+		}
+
+		viewedAt = viewedAt.Add(exponential(r, 30*time.Second))
+	}
+
+	sortEvents(events)
+	return events
+}
+
+// revenue draws an order's revenue, in whole cents, as a decimal.
+func (b Behavior) revenue(r *rand.Rand) string {
+	revenue := b.MedianRevenue * math.Exp(r.NormFloat64()*b.RevenueSpread)
+	return strconv.FormatFloat(revenue, 'f', 2, 64)
+}
+
+// appVersion returns the latest of AppVersions released by t.
+func appVersion(t, start, end time.Time) string {
+	i := int(float64(len(AppVersions)) * float64(t.Sub(start)) / float64(end.Sub(start)+1))
+	if i < 0 {
+		i = 0
+	}
+
+	return AppVersions[i]
+}
+
+// exponential returns an exponentially distributed duration with the given
+// mean.
+func exponential(r *rand.Rand, mean time.Duration) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(mean))
+}
+
+// weighted returns an index into weights, with each index as likely as its
+// share of their total.
+func weighted(r *rand.Rand, weights []float64) int {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	x := r.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return i
+		}
+
+		x -= w
+	}
+
+	return len(weights) - 1
+}
+
+// sortEvents puts events in the order they happened. Sessions are short, so an
+// insertion sort is plenty.
+func sortEvents(events []event.Event) {
+	for i := 1; i < len(events); i++ {
+		for j := i; j > 0 && Timestamp(events[j]).Before(Timestamp(events[j-1])); j-- {
+			events[j], events[j-1] = events[j-1], events[j]
+		}
+	}
+}
+
+// Timestamp returns when e happened.
+func Timestamp(e event.Event) time.Time {
+	switch e.Type {
+	case event.EventTypeHeartbeat:
+		return e.EventHeartbeat.Timestamp
+	case event.EventTypeOrderCompleted:
+		return e.EventOrderCompleted.Timestamp
+	default:
+		return e.EventPageViewed.Timestamp
+	}
+}
+
+// ID formats an ID for the nth user, with a prefix to tell them apart from
+// real users.
+func ID(prefix string, n int) string {
+	return fmt.Sprintf("%s%06d", prefix, n)
+}
@@ -0,0 +1,185 @@
+// Package typescan finds an event's type without parsing the whole event.
+//
+// Parsing JSON into interface{} allocates for every value in it, which is most
+// of the cost of rejecting an event. But to reject an event of an unknown
+// type, or to count events by type, only the discriminator is needed. Find
+// skims over everything else, and allocates nothing.
+//
+// Find is deliberately conservative. Whenever the answer isn't plain -- the
+// property is missing, isn't a string, or is escaped, or the JSON is cut short
+// -- it reports that it doesn't know, and callers parse the event in full, as
+// they would have anyway. It only checks the JSON enough to find its way
+// through, though: an event with, say, mismatched brackets in another
+// property can still have its type found.
+package typescan
+
+// Find returns the value of the top-level string property named key in the
+// JSON object buf. If key appears more than once, the last value is returned,
+// as encoding/json would decode it. The value is a slice of buf, without its
+// quotes. ok is false if Find can't tell.
+func Find(buf []byte, key string) (value []byte, ok bool) {
+	s := scanner{buf: buf}
+	s.space()
+	if !s.consume('{') {
+		return nil, false
+	}
+
+	s.space()
+	if s.consume('}') {
+		return nil, false
+	}
+
+	for {
+		name, escaped, valid := s.string()
+		if !valid {
+			return nil, false
+		}
+
+		s.space()
+		if !s.consume(':') {
+			return nil, false
+		}
+
+		s.space()
+
+		// A key written with escapes might be key in disguise, and then
+		// there'd be no telling which value wins.
+		if escaped {
+			return nil, false
+		}
+
+		if string(name) == key {
+			if s.peek() != '"' {
+				return nil, false
+			}
+
+			v, escaped, valid := s.string()
+			if !valid || escaped {
+				return nil, false
+			}
+
+			value, ok = v, true
+		} else if !s.skipValue() {
+			return nil, false
+		}
+
+		s.space()
+		if s.consume('}') {
+			return value, ok
+		}
+
+		if !s.consume(',') {
+			return nil, false
+		}
+
+		s.space()
+	}
+}
+
+type scanner struct {
+	buf []byte
+	pos int
+}
+
+func (s *scanner) peek() byte {
+	if s.pos >= len(s.buf) {
+		return 0
+	}
+
+	return s.buf[s.pos]
+}
+
+func (s *scanner) consume(b byte) bool {
+	if s.peek() != b {
+		return false
+	}
+
+	s.pos++
+	return true
+}
+
+func (s *scanner) space() {
+	for s.pos < len(s.buf) {
+		switch s.buf[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// string reads a string, returning its contents as they're written, and
+// whether they contain escapes.
+func (s *scanner) string() (contents []byte, escaped, valid bool) {
+	if !s.consume('"') {
+		return nil, false, false
+	}
+
+	start := s.pos
+	for s.pos < len(s.buf) {
+		switch c := s.buf[s.pos]; {
+		case c == '"':
+			s.pos++
+			return s.buf[start : s.pos-1], escaped, true
+		case c == '\\':
+			escaped = true
+			s.pos += 2
+		case c < 0x20:
+			return nil, false, false
+		default:
+			s.pos++
+		}
+	}
+
+	return nil, false, false
+}
+
+// skipValue skips over a value of any kind. Strings are skipped properly, so
+// brackets inside them don't count, but otherwise values are only checked
+// enough to find where they end.
+func (s *scanner) skipValue() bool {
+	switch s.peek() {
+	case '"':
+		_, _, valid := s.string()
+		return valid
+	case '{', '[':
+		depth := 0
+		for s.pos < len(s.buf) {
+			switch s.buf[s.pos] {
+			case '"':
+				if _, _, valid := s.string(); !valid {
+					return false
+				}
+
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+
+			s.pos++
+			if depth == 0 {
+				return true
+			}
+		}
+
+		return false
+	case 0:
+		return false
+	default:
+		// Numbers, true, false and null run until the next delimiter.
+		start := s.pos
+		for s.pos < len(s.buf) {
+			switch s.buf[s.pos] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return s.pos > start
+			}
+
+			s.pos++
+		}
+
+		return false
+	}
+}
@@ -0,0 +1,305 @@
+// Package websocket is the server side of RFC 6455, WebSockets: enough of it for
+// clients to keep one connection open and stream messages over it, rather than
+// making a request per message.
+//
+// It handles the handshake, masking, fragmented messages, and pings and closes
+// from the client. Extensions, like compression, aren't supported, and are
+// never negotiated.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The types of message, as their opcodes.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// The opcodes of control frames.
+const (
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// Close codes, for Close.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseTooBig          = 1009
+)
+
+// acceptGUID is what RFC 6455 has servers append to the client's key, to prove
+// they speak WebSocket.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrClosed is returned by ReadMessage once the client has closed the
+// connection.
+var ErrClosed = errors.New("websocket: closed by the client")
+
+// Conn is a WebSocket connection. Reads must all come from one goroutine, but
+// writes may come from any.
+type Conn struct {
+	// MaxMessageSize is the largest message ReadMessage accepts. Bigger ones
+	// close the connection with CloseTooBig.
+	MaxMessageSize int64
+
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu sync.Mutex // guards w
+	w  *bufio.Writer
+}
+
+// Upgrade turns an HTTP request into a WebSocket connection. If the request
+// isn't a valid WebSocket handshake, it responds with an error, and returns
+// one.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !hasToken(r.Header.Get("Connection"), "upgrade") || !hasToken(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "websocket: not a WebSocket handshake")
+		return nil, errors.New("websocket: not a WebSocket handshake")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, errors.New("websocket: connection can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Any timeouts were for the HTTP request, not for the connection's new
+	// life.
+	conn.SetDeadline(time.Time{})
+
+	accept := sha1.Sum([]byte(key + acceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{MaxMessageSize: 1 << 20, conn: conn, r: rw.Reader, w: rw.Writer}, nil
+}
+
+// hasToken returns whether a comma-separated header value contains token,
+// ignoring case.
+func hasToken(header, token string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetReadDeadline sets when a ReadMessage that hasn't gotten a message yet
+// gives up.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage returns the next message, and whether it's a TextMessage or a
+// BinaryMessage. Pings are answered while waiting for it.
+//
+// When the client closes the connection, ReadMessage returns ErrClosed. If the
+// client breaks the protocol, ReadMessage closes the connection itself, and
+// returns why.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+
+			c.Close(code, "")
+			return 0, nil, ErrClosed
+		case opContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "continuation frame without a message to continue")
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "new message before the last one finished")
+			}
+
+			messageType = opcode
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode))
+		}
+
+		if int64(len(message)+len(payload)) > c.MaxMessageSize {
+			return 0, nil, c.fail(CloseTooBig, fmt.Sprintf("messages may be at most %d bytes", c.MaxMessageSize))
+		}
+
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, "text message isn't valid UTF-8")
+		}
+
+		return messageType, message, nil
+	}
+}
+
+// readFrame reads one frame, and unmasks its payload.
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin, opcode := header[0]&0x80 != 0, int(header[0]&0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "reserved bits set, but no extension was negotiated")
+	}
+
+	// Clients must mask every frame they send.
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "frame isn't masked")
+	}
+
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= opClose && (!fin || size > 125) {
+		return false, 0, nil, c.fail(CloseProtocolError, "control frames must be whole, and at most 125 bytes")
+	}
+
+	// Check the size before allocating for it. ReadMessage checks it again
+	// for the message as a whole.
+	if size > uint64(c.MaxMessageSize) {
+		return false, 0, nil, c.fail(CloseTooBig, fmt.Sprintf("messages may be at most %d bytes", c.MaxMessageSize))
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends a message, in one frame.
+func (c *Conn) WriteMessage(messageType int, p []byte) error {
+	return c.writeFrame(messageType, p)
+}
+
+// writeFrame sends one unmasked, final frame, as servers do.
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | byte(opcode)}
+	switch {
+	case len(payload) <= 125:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	c.w.Write(header)
+	c.w.Write(payload)
+	return c.w.Flush()
+}
+
+// Close sends a close frame, with a code and reason, and closes the
+// connection. Reasons longer than a close frame allows are cut short.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	// The client may already be gone, in which case there's no one to tell.
+	c.writeFrame(opClose, payload)
+	return c.conn.Close()
+}
+
+// fail closes the connection because the client broke the protocol, and
+// returns an error saying how.
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return fmt.Errorf("websocket: %s", reason)
+}
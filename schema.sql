@@ -1,4 +1,397 @@
+-- Table names here are unqualified, so they're created in the first schema on
+-- the search_path. To keep analytics in a schema of its own, run this file
+-- after:
+--
+--   create schema analytics;
+--   set search_path = analytics;
+--
+-- and pass -db-schema analytics to the server and its subcommands.
+
+-- event_codecs records each codec events have been compacted with, along with
+-- everything it needs to expand them again.
+create table event_codecs (
+  id bigserial not null primary key,
+  event_type text not null,
+  codec text not null,
+  state jsonb not null,
+
+  unique (event_type, codec, state)
+);
+
 create table events (
   id bigserial not null primary key,
-  payload jsonb not null
+  payload jsonb,
+  received_at timestamptz not null default now(),
+
+  -- event_id is only set when the server is run with -event-ids. Whichever
+  -- strategy it uses, IDs sort by time as strings, so the "C" collation keeps
+  -- them in that order.
+  event_id text collate "C" unique,
+
+  -- Events of types with a codec are stored compacted, instead of in payload.
+  codec_id bigint references event_codecs (id),
+  payload_compact bytea,
+
+  check ((payload is null) = (codec_id is not null and payload_compact is not null))
+);
+
+-- Events are inserted in roughly received_at order, so a BRIN index on it is
+-- tiny, and lets queries over recent events skip the rest of the table.
+-- Queries by timestamp bound received_at too; see querybuilder.Filter.
+create index events_received_at on events using brin (received_at);
+
+-- Filters on events' fields, like GET /admin/v1/events?filter=url:eq:..., test
+-- for equality by containment, which this index answers.
+create index events_payload on events using gin (payload jsonb_path_ops);
+
+-- expand_uvarint and expand_varint read the varint at pos in buf, as Go's
+-- encoding/binary writes them, and return the position after it and its value.
+create function expand_uvarint(buf bytea, inout pos int, out value numeric) as $$
+declare
+  b int;
+  shift int := 0;
+begin
+  value := 0;
+  loop
+    b := get_byte(buf, pos);
+    pos := pos + 1;
+    value := value + (b & 127) * 2::numeric ^ shift;
+    exit when b < 128;
+    shift := shift + 7;
+  end loop;
+end;
+$$ language plpgsql immutable strict parallel safe;
+
+create function expand_varint(buf bytea, inout pos int, out value numeric) as $$
+begin
+  select * into pos, value from expand_uvarint(buf, pos);
+  if mod(value, 2) = 0 then
+    value := div(value, 2);
+  else
+    value := -div(value + 1, 2);
+  end if;
+end;
+$$ language plpgsql immutable strict parallel safe;
+
+-- expand_string reads the length-prefixed UTF-8 string at pos in buf.
+create function expand_string(buf bytea, inout pos int, out value text) as $$
+declare
+  n numeric;
+begin
+  select * into pos, n from expand_uvarint(buf, pos);
+  if octet_length(buf) < pos + n then
+    raise exception 'expand_string: truncated event';
+  end if;
+
+  value := convert_from(substring(buf from pos + 1 for n::int), 'UTF8');
+  pos := pos + n::int;
+end;
+$$ language plpgsql immutable strict parallel safe;
+
+-- expand_event turns an event compacted by the codec with the given id back into
+-- the same jsonb it would have been stored as, like internal/codec does in Go.
+-- Numbers are written out with as many digits as it takes to read them back
+-- exactly.
+create function expand_event(codec_id bigint, compact bytea) returns jsonb as $$
+declare
+  codec_name text;
+  codec_state jsonb;
+  field jsonb;
+  event jsonb;
+  optional int;
+  optional_index int := 0;
+  pos int;
+  n numeric;
+  value jsonb;
+  string text;
+  seconds numeric;
+  nanos numeric;
+  offset_minutes int;
+  exponent int;
+begin
+  select c.codec, c.state into codec_name, codec_state from event_codecs c where c.id = codec_id;
+  if codec_name is distinct from 'dictionary' then
+    raise exception 'expand_event: codec % is %, not dictionary', codec_id, coalesce(codec_name, 'missing');
+  end if;
+
+  select count(*) into optional
+  from jsonb_array_elements(codec_state->'fields') f
+  where coalesce((f->>'optional')::boolean, false);
+
+  if get_byte(compact, 0) <> 1 then
+    raise exception 'expand_event: not a dictionary-encoded event';
+  end if;
+
+  pos := 1 + (optional + 7) / 8;
+  event := jsonb_build_object(codec_state->>'tag', codec_state->>'type');
+
+  for field in select * from jsonb_array_elements(codec_state->'fields') loop
+    -- Optional properties are only stored if their bit is set.
+    if coalesce((field->>'optional')::boolean, false) then
+      optional_index := optional_index + 1;
+      continue when get_byte(compact, 1 + (optional_index - 1) / 8) & (1 << ((optional_index - 1) % 8)) = 0;
+    end if;
+
+    case field->>'kind'
+    when 'timestamp' then
+      if get_byte(compact, pos) = 0 then
+        -- Timestamps that wouldn't be written back the same are kept as
+        -- strings.
+        select * into pos, string from expand_string(compact, pos + 1);
+        value := to_jsonb(string);
+      else
+        select * into pos, seconds from expand_varint(compact, pos + 1);
+        select * into pos, nanos from expand_uvarint(compact, pos);
+        select * into pos, n from expand_varint(compact, pos);
+        offset_minutes := n::int;
+
+        value := to_jsonb(
+          to_char(to_timestamp((seconds + offset_minutes * 60)::float8) at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS')
+          || case when nanos = 0 then '' else '.' || rtrim(lpad(nanos::text, 9, '0'), '0') end
+          || case
+            when offset_minutes = 0 then 'Z'
+            else case when offset_minutes < 0 then '-' else '+' end
+              || lpad((abs(offset_minutes) / 60)::text, 2, '0') || ':' || lpad((abs(offset_minutes) % 60)::text, 2, '0')
+          end
+        );
+      end if;
+    when 'number' then
+      -- An IEEE 754 double, big-endian.
+      n := 0;
+      for i in 0..7 loop
+        n := n * 256 + get_byte(compact, pos + i);
+      end loop;
+
+      pos := pos + 8;
+      -- Every step is exact, and none is a subnormal power of two, which
+      -- Postgres would call out of range.
+      exponent := div(mod(n, 2::numeric ^ 63), 2::numeric ^ 52)::int;
+      value := to_jsonb(
+        case when n >= 2::numeric ^ 63 then -1 else 1 end
+        * case
+          when exponent = 0 then mod(n, 2::numeric ^ 52)::float8 * 2::float8 ^ -52 * 2::float8 ^ -1022
+          else (1 + mod(n, 2::numeric ^ 52)::float8 * 2::float8 ^ -52) * 2::float8 ^ (exponent - 1023)
+        end
+      );
+    when 'integer' then
+      select * into pos, n from expand_varint(compact, pos);
+      value := to_jsonb(n);
+    when 'boolean' then
+      value := to_jsonb(get_byte(compact, pos) = 1);
+      pos := pos + 1;
+    when 'enum' then
+      select * into pos, n from expand_uvarint(compact, pos);
+      value := field->'values'->n::int;
+    else
+      -- Strings, and anything else, which is stored as its JSON.
+      select * into pos, string from expand_string(compact, pos);
+      if field->>'kind' = 'string' then
+        value := to_jsonb(string);
+      else
+        value := string::jsonb;
+      end if;
+    end case;
+
+    event := event || jsonb_build_object(field->>'name', value);
+  end loop;
+
+  return event;
+end;
+$$ language plpgsql stable strict parallel safe set extra_float_digits = 3;
+
+-- events_expanded is events, with compacted events' payloads expanded, so that
+-- analytics see every event however it was stored. Only compacted events pay
+-- for expanding: conditions on payload still use the indexes above for the
+-- rest.
+create view events_expanded as
+  select id, payload, received_at, event_id, codec_id, payload_compact
+  from events
+  where codec_id is null
+  union all
+  select id, expand_event(codec_id, payload_compact), received_at, event_id, codec_id, payload_compact
+  from events
+  where codec_id is not null;
+
+-- Servers run with -live-feed LISTEN on the "events" channel, and are
+-- notified of each statement that inserts events, with the highest id it
+-- inserted, so they can follow new events without polling for them. This needs
+-- Postgres 10 or later.
+create function notify_events() returns trigger as $$
+begin
+  perform pg_notify('events', (select max(id) from inserted)::text);
+  return null;
+end;
+$$ language plpgsql;
+
+create trigger events_notify
+  after insert on events
+  referencing new table as inserted
+  for each statement
+  execute procedure notify_events();
+
+-- candidate_failures are events the server's -candidate-schema would have
+-- rejected, though the current schema accepted them, with the errors it would
+-- have reported. candidate is the version of the candidate schema, as reported
+-- by GET /admin/v1/candidate.
+create table candidate_failures (
+  id bigserial not null primary key,
+  candidate text not null,
+  event_type text not null,
+  payload jsonb not null,
+  errors jsonb not null,
+  received_at timestamptz not null
+);
+
+create index on candidate_failures (candidate, received_at);
+
+-- events_dead_letter are events the schema rejected, kept by servers run with
+-- -dead-letters, with the validation errors they were rejected for. sender is
+-- whoever sent the event ("api-key:<name>", say, or "" without credentials),
+-- and event_type its type, if it had one. Rows can be deleted at will.
+create table events_dead_letter (
+  id bigserial not null primary key,
+  sender text not null,
+  event_type text,
+  payload jsonb not null,
+  errors jsonb not null,
+  received_at timestamptz not null
+);
+
+create index on events_dead_letter (sender, id);
+create index on events_dead_letter (received_at);
+
+-- idempotency_keys are the Idempotency-Keys events were sent with, scoped to
+-- whoever sent them ("api-key:<name>", say, or "" without credentials), so
+-- that retries are answered from here instead of storing the event twice.
+-- request_sha256 is of the event, to catch a key reused for a different one.
+-- Keys older than the server's -idempotency-window can be deleted at will.
+create table idempotency_keys (
+  scope text not null,
+  key text not null,
+  request_sha256 bytea not null,
+  created_at timestamptz not null,
+  completed boolean not null default false,
+  event_id text,
+  received_at timestamptz,
+  primary key (scope, key)
+);
+
+create index on idempotency_keys (created_at);
+
+-- import_checkpoints records how far the "import" subcommand has gotten through
+-- each object it's importing, so that an interrupted import can resume without
+-- skipping or duplicating events.
+create table import_checkpoints (
+  source text not null,
+  object_key text not null,
+  lines bigint not null default 0,
+  done boolean not null default false,
+  primary key (source, object_key)
+);
+
+-- api_keys are the keys clients send in the X-API-Key header, or as a bearer
+-- token in the Authorization header. A key may be
+-- limited to sending only some types of events: if allowed_types is not null,
+-- it may only send those types, and it may never send any of denied_types.
+--
+-- If secret is not null, requests using the key must be signed with it.
+--
+-- scopes grant privileges. Keys with the "read" scope may query analytics, and
+-- only send events if they also have the "ingest" scope; keys with neither may
+-- only send events. The "forward" scope lets a key send events forwarded from
+-- another instance, which skip validation.
+create table api_keys (
+  key text not null primary key,
+  name text not null,
+  allowed_types text[],
+  denied_types text[] not null default '{}',
+  secret text,
+  scopes text[] not null default '{}'
+);
+
+-- client_certs gives clients identified by a TLS client certificate the same
+-- scopes and limits api_keys gives keys. subject is the certificate's first URI
+-- SAN, like a SPIFFE ID, or else its common name. Certificates the server's CA
+-- bundle vouches for are accepted whether they're here or not; those that
+-- aren't have no scopes or limits.
+create table client_certs (
+  subject text not null primary key,
+  allowed_types text[],
+  denied_types text[] not null default '{}',
+  scopes text[] not null default '{}'
+);
+
+-- feature_flags turns features of the server on and off at runtime. Flags set
+-- here take precedence over features.json and FEATURE_* environment variables.
+-- The server only reads this table if it's started with -feature-refresh.
+create table feature_flags (
+  name text not null primary key,
+  enabled boolean not null,
+  updated_at timestamptz not null default now()
+);
+
+-- forward_checkpoints records, for each instance the "forward" subcommand
+-- replicates events to, the id of the last event it forwarded there.
+create table forward_checkpoints (
+  target text not null primary key,
+  last_id bigint not null,
+  updated_at timestamptz not null default now()
+);
+
+-- ltv_webhooks are notified whenever a user's LTV crosses one of thresholds, or,
+-- if first_purchase is true, when the user completes their first order. If
+-- secret is not null, notifications are signed with it.
+create table ltv_webhooks (
+  id bigserial not null primary key,
+  url text not null,
+  first_purchase boolean not null default true,
+  thresholds numeric[] not null default '{100,1000}',
+  secret text
+);
+
+-- users holds what's known about each user, as traits like {"plan": "pro"}.
+-- Analytics endpoints can be narrowed to users with given traits. Nothing in
+-- the server writes to it: keep it in sync from wherever users are managed.
+create table users (
+  user_id text not null primary key,
+  traits jsonb not null default '{}',
+  updated_at timestamptz not null default now()
+);
+
+-- users_activity summarizes what each user has done: their first and last
+-- events, by the events' own timestamps, and how many events of each type
+-- they've sent, like {"Page Viewed": 12}. The server rolls it up from the
+-- events table in the background (see -users-rollup), so it lags a little
+-- behind. It backs GET /v1/users.
+create table users_activity (
+  user_id text not null primary key,
+  first_seen timestamptz not null,
+  last_seen timestamptz not null,
+  events bigint not null,
+  event_counts jsonb not null default '{}',
+  updated_at timestamptz not null default now()
+);
+
+create index users_activity_first_seen on users_activity (first_seen, user_id);
+create index users_activity_last_seen on users_activity (last_seen, user_id);
+create index users_activity_events on users_activity (events, user_id);
+
+-- rollup_checkpoints records, for each summary rolled up from the events table,
+-- the id of the last event rolled into it.
+create table rollup_checkpoints (
+  name text not null primary key,
+  last_id bigint not null,
+  updated_at timestamptz not null default now()
+);
+
+-- kafka_offsets records, for each partition consume-kafka consumes, the offset
+-- of the next record to store. It's updated in the same transaction as the
+-- events are inserted, so each record is stored exactly once.
+create table kafka_offsets (
+  consumer_group text not null,
+  topic text not null,
+  partition int not null,
+  next_offset bigint not null,
+  updated_at timestamptz not null default now(),
+  primary key (consumer_group, topic, partition)
 );
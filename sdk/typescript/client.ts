@@ -0,0 +1,21 @@
+// This file is written by hand. The types it uses come from index.ts, which is
+// generated from event.jddf.json by jddf-codegen -- so the TypeScript compiler
+// will catch any event that the server would reject for having the wrong shape.
+
+import { Event } from "./index";
+
+export * from "./index";
+
+// sendEvent sends an analytics event to a golang-postgres-analytics server,
+// such as "http://localhost:3000".
+export async function sendEvent(baseUrl: string, event: Event): Promise<void> {
+  const res = await fetch(`${baseUrl}/v1/events`, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(event),
+  });
+
+  if (!res.ok) {
+    throw new Error(`sending event: ${res.status} ${await res.text()}`);
+  }
+}
@@ -0,0 +1,23 @@
+export type Event = EventHeartbeat | EventOrderCompleted | EventPageViewed;
+
+export interface EventHeartbeat {
+  type: "Heartbeat";
+  appVersion?: string;
+  platform?: string;
+  timestamp: string;
+  userId: string;
+}
+
+export interface EventOrderCompleted {
+  type: "Order Completed";
+  revenue: string;
+  timestamp: string;
+  userId: string;
+}
+
+export interface EventPageViewed {
+  type: "Page Viewed";
+  timestamp: string;
+  url: string;
+  userId: string;
+}